@@ -14,6 +14,8 @@ go build ./entity/i-cscf
 go build ./entity/s-cscf
 go build ./entity/p-cscf
 go build ./entity/pgw
+go build ./entity/mme
+go build ./entity/pcrf
 
 
 kill -9 $(ps aux|grep "./hss -d $domain -f ./config.yml"|grep -v grep|awk 'NR==1{ print $2 }')
@@ -21,10 +23,14 @@ kill -9 $(ps aux|grep "./s-cscf -d $domain -f ./config.yml"|grep -v grep|awk 'NR
 kill -9 $(ps aux|grep "./i-cscf -d $domain -f ./config.yml"|grep -v grep|awk 'NR==1{ print $2 }')
 kill -9 $(ps aux|grep "./p-cscf -d $domain -f ./config.yml"|grep -v grep|awk 'NR==1{ print $2 }')
 kill -9 $(ps aux|grep "./pgw -d $domain -f ./config.yml"|grep -v grep|awk 'NR==1{ print $2 }')
+kill -9 $(ps aux|grep "./mme -d $domain -f ./config.yml"|grep -v grep|awk 'NR==1{ print $2 }')
+kill -9 $(ps aux|grep "./pcrf -d $domain -f ./config.yml"|grep -v grep|awk 'NR==1{ print $2 }')
 
 nohup ./hss -d $domain -f ./config.yml &
 nohup ./s-cscf -d $domain -f ./config.yml &
 nohup ./i-cscf -d $domain -f ./config.yml &
 nohup ./p-cscf -d $domain -f ./config.yml &
 nohup ./pgw -d $domain -f ./config.yml &
+nohup ./mme -d $domain -f ./config.yml &
+nohup ./pcrf -d $domain -f ./config.yml &
 
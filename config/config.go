@@ -1,11 +1,16 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/wonderivan/logger"
@@ -16,10 +21,58 @@ type Node struct {
 	ActualAddr  string
 }
 
+// 一个网络域的配置，同一进程中的多个功能实体各自持有所在网络域的配置
+type Network struct {
+	Name      string           // 配置文件中的网络名称，如hebeiyidong
+	DNS       string           // 网络域名，如hebeiyidong.3gpp.net
+	Dhcp      string           // PGW为UE分配地址的网段，可以是IPv4或IPv6
+	Dhcp6     string           // IPv4v6双栈时PGW为UE分配IPv6前缀的网段
+	LeaseTime time.Duration    // PGW分配地址的租约时间，为0时使用默认值
+	EnbID     string           // 基站标识
+	AMF       uint16           // HSS生成鉴权向量使用的鉴权管理域
+	AVNum     int              // S-CSCF每次向HSS请求的鉴权向量个数
+	Cx        string           // CSCF与HSS之间Cx接口的消息格式：legacy、diameter
+	Diameter  string           // HSS的Diameter监听地址，Cx接口使用diameter时有效
+	Elements  map[string]*Node // 本域及对端域的功能实体地址
+}
+
+// Cx接口的消息格式
+const (
+	CxLegacy   = "legacy"   // 自定义的 key=value 格式，经UDP传输
+	CxDiameter = "diameter" // Diameter协议(RFC6733)，经TCP传输
+)
+
+// CSCF之间SIP消息的传输配置
+type SIPTransport struct {
+	TCP       bool   // CSCF在UDP的监听地址上同时监听TCP，超过MTU的请求改用TCP
+	Transport string // CSCF之间默认使用的传输协议：UDP、TCP、TLS
+	Cert      string // TLS证书文件
+	Key       string // TLS私钥文件
+	CA        string // 校验对端证书的CA文件，为空时使用系统的CA
+}
+
+// 单个功能实体进程启动时通过命令行指定的网络名称
 var Domain string
-var Elements map[string]*Node
 
-func init() {
+// SIP地址到实际网络地址的映射，代替DNS解析各个网络域中的功能实体
+var hosts map[string]string
+
+// 各个网络域中PGW的实际地址，发往PGW的消息走下行链路
+var pgws map[string]bool
+
+// 各个网络域中应用服务器的实际地址，应用服务器不属于核心网，SIP消息不加帧头
+var ases map[string]bool
+
+// 各个网络域中CSCF的实际地址，CSCF之间可以使用面向连接的传输
+var cscfs map[string]bool
+
+// CSCF的实际地址到TLS监听地址的映射
+var tlsHosts map[string]string
+
+var sipTransport SIPTransport
+
+// 单个功能实体进程的启动流程：解析命令行参数、初始化日志、加载配置文件，返回所在网络域的配置
+func Setup() *Network {
 	var confile string
 	flag.StringVar(&Domain, "d", "", "网络域")
 	flag.StringVar(&confile, "f", "", "配置文件路径")
@@ -30,58 +83,237 @@ func init() {
 		flag.Usage()
 		os.Exit(0)
 	}
+	args := strings.Split(os.Args[0], "/")
+	SetupLogger(args[len(args)-1])
+	if e := Load(confile); e != nil {
+		log.Panicln("配置文件读取失败", e)
+	}
+	n, err := NewNetwork(Domain)
+	if err != nil {
+		log.Panicln("网络域配置读取失败", err)
+	}
+	return n
+}
 
+// 初始化日志，日志文件以程序名区分
+func SetupLogger(program string) {
 	path, err := os.Getwd()
 	if err != nil {
 		log.Fatal("获取运行目录失败")
 	}
-
-	args := strings.Split(os.Args[0], "/")
-	pgnm := args[len(args)-1]
-	logconf = strings.ReplaceAll(logconf, "#entity", pgnm)
+	conf := strings.ReplaceAll(logconf, "#entity", program)
 	if runtime.GOOS != "windows" {
-		logger.SetLogger(logconf)
-	} else {
-		logconf = strings.Replace(logconf, "/tmp", ".", 1)
+		logger.SetLogger(conf)
 	}
-
 	logger.SetLogPathTrim(path)
-	viper.SetConfigFile(confile)
-	if e := viper.ReadInConfig(); e != nil {
-		log.Panicln("配置文件读取失败", e)
+}
+
+// 读取配置文件，加载全部网络域中功能实体的地址映射
+func Load(file string) error {
+	viper.SetConfigFile(file)
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	loadHosts()
+	loadSIPTransport()
+	return nil
+}
+
+// 配置文件中的全部网络名称
+func Networks() (names []string) {
+	for key := range viper.AllSettings() {
+		if len(viper.GetString(key+".domain")) > 0 {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// 读取网络域的配置，对端域为配置文件中的另一个网络
+func NewNetwork(name string) (*Network, error) {
+	dns := viper.GetString(name + ".domain")
+	if len(dns) == 0 {
+		return nil, errors.New("ErrNetworkNotExist")
+	}
+	n := &Network{
+		Name:      name,
+		DNS:       dns,
+		Dhcp:      viper.GetString(name + ".pgw.dhcp"),
+		Dhcp6:     viper.GetString(name + ".pgw.dhcp6"),
+		LeaseTime: viper.GetDuration(name + ".pgw.lease"),
+		EnbID:     viper.GetString(name + ".enb.id"),
+		Elements:  make(map[string]*Node, 7),
+	}
+	if amf := viper.GetString(name + ".hss.amf"); len(amf) > 0 {
+		v, err := strconv.ParseUint(amf, 16, 16)
+		if err != nil {
+			return nil, errors.New("ErrInvalidAMF")
+		}
+		n.AMF = uint16(v)
+	}
+	n.AVNum = viper.GetInt(name + ".s-cscf.av-num")
+	if n.AVNum <= 0 {
+		n.AVNum = 1
 	}
-	Elements = make(map[string]*Node, 5)
-	hssv := viper.GetString(Domain + ".hss.vip")
-	hssa := viper.GetString(Domain + ".hss.host")
-	Elements["HSS"] = &Node{VirtualAddr: hssv, ActualAddr: hssa}
-	scscfv := viper.GetString(Domain + ".s-cscf.vip")
-	scscfa := viper.GetString(Domain + ".s-cscf.host")
-	Elements["SCSCF"] = &Node{VirtualAddr: scscfv, ActualAddr: scscfa}
-	icscfv := viper.GetString(Domain + ".i-cscf.vip")
-	icscfa := viper.GetString(Domain + ".i-cscf.host")
-	Elements["ICSCF"] = &Node{VirtualAddr: icscfv, ActualAddr: icscfa}
-	pcscfv := viper.GetString(Domain + ".p-cscf.vip")
-	pcscfa := viper.GetString(Domain + ".p-cscf.host")
-	Elements["PCSCF"] = &Node{VirtualAddr: pcscfv, ActualAddr: pcscfa}
-	pgwv := viper.GetString(Domain + ".pgw.vip")
-	pgwa := viper.GetString(Domain + ".pgw.host")
-	Elements["PGW"] = &Node{VirtualAddr: pgwv, ActualAddr: pgwa}
-	if Domain == "hebeiyidong" {
-		icscfv := viper.GetString("chongqingdianxin.i-cscf.vip")
-		icscfa := viper.GetString("chongqingdianxin.i-cscf.host")
-		Elements["OTHER-ICSCF"] = &Node{VirtualAddr: icscfv, ActualAddr: icscfa}
-		scscfv := viper.GetString("chongqingdianxin.s-cscf.vip")
-		scscfa := viper.GetString("chongqingdianxin.s-cscf.host")
-		Elements["OTHER-SCSCF"] = &Node{VirtualAddr: scscfv, ActualAddr: scscfa}
-	} else {
-		icscfv := viper.GetString("hebeiyidong.i-cscf.vip")
-		icscfa := viper.GetString("hebeiyidong.i-cscf.host")
-		Elements["OTHER-ICSCF"] = &Node{VirtualAddr: icscfv, ActualAddr: icscfa}
-		scscfv := viper.GetString("hebeiyidong.s-cscf.vip")
-		scscfa := viper.GetString("hebeiyidong.s-cscf.host")
-		Elements["OTHER-SCSCF"] = &Node{VirtualAddr: scscfv, ActualAddr: scscfa}
+	n.Cx = viper.GetString(name + ".hss.cx")
+	n.Diameter = viper.GetString(name + ".hss.diameter")
+	if n.Cx != CxDiameter || len(n.Diameter) == 0 {
+		n.Cx = CxLegacy
 	}
+	n.Elements["HSS"] = node(name, "hss")
+	n.Elements["SCSCF"] = node(name, "s-cscf")
+	n.Elements["ICSCF"] = node(name, "i-cscf")
+	n.Elements["PCSCF"] = node(name, "p-cscf")
+	n.Elements["PGW"] = node(name, "pgw")
+	n.Elements["MME"] = node(name, "mme")
+	n.Elements["PCRF"] = node(name, "pcrf")
+	for _, other := range Networks() {
+		if other == name {
+			continue
+		}
+		n.Elements["OTHER-ICSCF"] = node(other, "i-cscf")
+		n.Elements["OTHER-SCSCF"] = node(other, "s-cscf")
+		break
+	}
+	return n, nil
+}
 
+// 功能实体在网络域中的SIP域名，如p-cscf.hebeiyidong.3gpp.net
+func (n *Network) Host(entity string) string {
+	return entity + "." + n.DNS
+}
+
+func node(network, entity string) *Node {
+	return &Node{
+		VirtualAddr: viper.GetString(network + "." + entity + ".vip"),
+		ActualAddr:  viper.GetString(network + "." + entity + ".host"),
+	}
+}
+
+// 加载全部网络域中功能实体和应用服务器的地址映射，实体以 名称.域名 的形式访问，域名本身指向该域的入口I-CSCF
+func loadHosts() {
+	hosts = make(map[string]string)
+	pgws = make(map[string]bool)
+	ases = make(map[string]bool)
+	cscfs = make(map[string]bool)
+	tlsHosts = make(map[string]string)
+	for _, key := range Networks() {
+		dns := viper.GetString(key + ".domain")
+		for _, name := range []string{"mme", "pgw", "pcrf", "p-cscf", "i-cscf", "s-cscf", "hss"} {
+			host := viper.GetString(key + "." + name + ".host")
+			if len(host) == 0 {
+				continue
+			}
+			hosts[name+"."+dns] = host
+			hosts[host] = host
+			if vip := viper.GetString(key + "." + name + ".vip"); len(vip) > 0 {
+				hosts[vip] = host
+			}
+			switch name {
+			case "pgw":
+				pgws[host] = true
+			case "p-cscf", "i-cscf", "s-cscf":
+				cscfs[host] = true
+				if tls := viper.GetString(key + "." + name + ".tls"); len(tls) > 0 {
+					tlsHosts[host] = tls
+				}
+			}
+		}
+		// 应用服务器以 名称.域名 的形式访问，iFC中的ServerName使用该地址
+		for name, host := range viper.GetStringMapString(key + ".as") {
+			hosts[name+"."+dns] = host
+			hosts[host] = host
+			ases[host] = true
+		}
+		if icscf, ok := hosts["i-cscf."+dns]; ok {
+			hosts[dns] = icscf
+		}
+	}
+}
+
+// 解析SIP地址对应的实际网络地址，地址可以携带端口
+func Resolve(host string) (string, bool) {
+	if addr, ok := hosts[host]; ok {
+		return addr, true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		if addr, ok := hosts[name]; ok {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// 实际地址是否是PGW
+func IsPGW(addr string) bool {
+	return pgws[addr]
+}
+
+// 实际地址是否是应用服务器
+func IsAS(addr string) bool {
+	return ases[addr]
+}
+
+// 读取SIP传输配置，没有证书时不使用TLS，默认的传输协议无效时使用UDP
+func loadSIPTransport() {
+	sipTransport = SIPTransport{
+		TCP:       viper.GetBool("sip.tcp"),
+		Transport: strings.ToUpper(viper.GetString("sip.transport")),
+		Cert:      viper.GetString("sip.tls.cert"),
+		Key:       viper.GetString("sip.tls.key"),
+		CA:        viper.GetString("sip.tls.ca"),
+	}
+	if len(sipTransport.Cert) == 0 || len(sipTransport.Key) == 0 {
+		tlsHosts = make(map[string]string)
+	}
+	switch sipTransport.Transport {
+	case "TCP":
+		sipTransport.TCP = true
+	case "TLS":
+	default:
+		sipTransport.Transport = "UDP"
+	}
+}
+
+// SIP传输配置
+func SIP() SIPTransport {
+	return sipTransport
+}
+
+// 实际地址是否是CSCF
+func IsCSCF(addr string) bool {
+	return cscfs[addr]
+}
+
+// CSCF的TLS监听地址，没有配置TLS时返回false
+func TLSAddr(addr string) (string, bool) {
+	tls, ok := tlsHosts[addr]
+	return tls, ok
+}
+
+// HSS用户数据存储配置
+type Store struct {
+	Driver string // mysql、sqlite、memory
+	DSN    string // mysql连接串或sqlite数据库文件
+	Seed   string // 初始用户数据文件，支持yaml和json
+}
+
+// 读取HSS用户数据存储配置，未配置时使用mysql
+func HSSStore() Store {
+	s := Store{
+		Driver: viper.GetString("store.driver"),
+		Seed:   viper.GetString("store.seed"),
+	}
+	switch s.Driver {
+	case "sqlite":
+		s.DSN = viper.GetString("store.sqlite")
+	case "memory":
+	default:
+		s.Driver = "mysql"
+		s.DSN = viper.GetString("mysql")
+	}
+	return s
 }
 
 var logconf string = `{"TimeFormat":"2006-01-02 15:04:05","File": {"filename": "/tmp/logs/#entity.app.log","level": "INFO","daily": true,"maxlines": 1000000,"maxsize": 1,"maxdays": -1,"append": true,"permit": "0660"}}`
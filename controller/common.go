@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strconv"
 	"time"
 
+	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/modules"
 	"github.com/VegetableManII/volte/sip"
 	"github.com/patrickmn/go-cache"
@@ -18,8 +20,157 @@ const (
 	AV_XRES = "XRES"
 	AV_IK   = "IK"
 	AV_CK   = "CK"
+	AV_AUTS = "AUTS"
+	AV_NUM  = "Number" // 鉴权向量个数(SIP-Number-Auth-Items)
 )
 
+// MAA和SAA中用户的业务签约数据(SIP-User-Data)，内容为ServiceProfile
+const USER_DATA = "UserData"
+
+// Cx接口消息的字段
+const (
+	CX_RESULT     = "ResultCode"     // 结果码
+	CX_SERVER     = "ServerName"     // S-CSCF地址
+	CX_ASSIGNMENT = "AssignmentType" // SAR的分配类型
+	CX_REASON     = "Reason"         // RTR的注销原因
+	CX_SESSION    = "SessionID"      // 会话标识(Session-Id)，应答原样返回
+)
+
+// EPC消息的字段
+const (
+	EPC_UE_IDENTITY = "UE-IDENTITY"        // UE标识(IMSI)
+	EPC_CELL_ID     = "UTRAN-CELL-ID-3GPP" // 基站标识
+	EPC_DETACH_TYPE = "DETACH-TYPE"        // 去附着类型
+	EPC_USER_NAME   = "UserName"           // IMS用户名，与Cx消息一致
+	EPC_RES         = "RES"                // UE计算的鉴权响应
+	EPC_APN         = "APN"                // 签约的APN
+	EPC_BEARER_ID   = "EPS-BEARER-ID"      // EPS承载标识
+	EPC_QCI         = "QCI"                // 承载的QCI
+	EPC_GBR         = "GBR"                // 专用承载的保证比特率，单位kbps
+	EPC_CALL_ID     = "CALL-ID"            // 专用承载所属IMS会话的Call-ID
+	EPC_CAUSE       = "CAUSE"              // 附着拒绝的EMM原因值，或PGW应答的原因值
+)
+
+// Rx和Gx消息的字段，多个媒体或规则按序号区分
+const (
+	RX_MEDIA        = "Media-Component-Description" // 媒体个数
+	RX_MEDIA_NUMBER = "Media-Component-Number"      // 媒体在SDP中的序号
+	RX_MEDIA_TYPE   = "Media-Type"                  // SDP的媒体类型
+	RX_BANDWIDTH    = "Max-Requested-Bandwidth"     // 媒体的带宽，单位kbps
+	GX_RULE_INSTALL = "Charging-Rule-Install"       // 安装的规则个数
+	GX_RULE_REMOVE  = "Charging-Rule-Remove"        // 删除的规则个数，各项为规则名
+	GX_RULE_NAME    = "Charging-Rule-Name"          // 规则名
+	GX_GBR          = "Guaranteed-Bitrate"          // 单位kbps
+)
+
+// EMM原因值(3GPP TS 24.301 9.9.3.9)
+const (
+	EmmIllegalUE            = "3"  // 鉴权失败
+	EmmEPSNotAllowed        = "7"  // HSS中没有签约数据
+	EmmUEIdentityNotDerived = "9"  // 附着请求没有携带IMSI
+	EmmNetworkFailure       = "17" // 核心网的流程失败
+	EmmESMFailure           = "19" // PGW建立会话失败
+)
+
+// PGW应答的原因值(3GPP TS 29.274 8.4)
+const (
+	GtpRequestAccepted             = "16"
+	GtpContextNotFound             = "64"
+	GtpAllDynamicAddressesOccupied = "84"
+	GtpSystemFailure               = "72"
+)
+
+// 去附着类型(3GPP TS 24.301 9.9.3.7)
+const (
+	DetachEPS                 = "eps"                    // UE发起的去附着
+	DetachSwitchOff           = "switch-off"             // UE关机，网络侧不应答
+	DetachReattachRequired    = "re-attach-required"     // 网络侧发起，UE需要重新附着
+	DetachReattachNotRequired = "re-attach-not-required" // 网络侧发起，UE不需要重新附着
+)
+
+// Cx接口的结果码(3GPP TS 29.229 6.2)
+const (
+	ResultSuccess                = "2001"
+	ResultFirstRegistration      = "2001"
+	ResultSubsequentRegistration = "2002"
+	ResultUnregisteredService    = "2003"
+	ResultErrorUserUnknown       = "5001"
+	ResultUnknownSessionID       = "5002" // Rx或Gx的会话不存在
+	ResultUnableToComply         = "5012"
+)
+
+// SAR的分配类型(3GPP TS 29.229 6.3.15)
+const (
+	AssignmentRegistration             = "REGISTRATION"
+	AssignmentReRegistration           = "RE_REGISTRATION"
+	AssignmentUnregisteredUser         = "UNREGISTERED_USER"
+	AssignmentTimeoutDeregistration    = "TIMEOUT_DEREGISTRATION"
+	AssignmentUserDeregistration       = "USER_DEREGISTRATION"
+	AssignmentAdministrativeDeregister = "ADMINISTRATIVE_DEREGISTRATION"
+)
+
+// RTR的注销原因(3GPP TS 29.229 6.3.17)
+const (
+	ReasonPermanentTermination = "PERMANENT_TERMINATION"
+	ReasonNewServerAssigned    = "NEW_SERVER_ASSIGNED"
+	ReasonServerChange         = "SERVER_CHANGE"
+	ReasonRemoveSCSCF          = "REMOVE_S-CSCF"
+)
+
+// 结果码是否表示成功
+func isCxSuccess(code string) bool {
+	return len(code) == 4 && code[0] == '2'
+}
+
+// HSS单次返回的鉴权向量个数上限
+const MaxAVNum = 16
+
+// 五元鉴权向量，各项为十六进制编码
+type AuthVector struct {
+	RAND string
+	AUTN string
+	XRES string
+	CK   string
+	IK   string
+}
+
+// 鉴权向量在MAA中的字段名，多个向量按序号区分(SIP-Item-Number)，Rx和Gx中的多个媒体和规则同样按序号区分
+func avKey(field string, item int) string {
+	return field + "." + strconv.Itoa(item)
+}
+
+// 将鉴权向量写入MAA
+func marshalAuthVectors(m map[string]string, avs []AuthVector) {
+	m[AV_NUM] = strconv.Itoa(len(avs))
+	for i, av := range avs {
+		m[avKey(AV_RAND, i+1)] = av.RAND
+		m[avKey(AV_AUTN, i+1)] = av.AUTN
+		m[avKey(AV_XRES, i+1)] = av.XRES
+		m[avKey(AV_CK, i+1)] = av.CK
+		m[avKey(AV_IK, i+1)] = av.IK
+	}
+}
+
+// 从MAA中读取鉴权向量
+func unmarshalAuthVectors(m map[string]string) []AuthVector {
+	n, _ := strconv.Atoi(m[AV_NUM])
+	avs := make([]AuthVector, 0, n)
+	for i := 1; i <= n; i++ {
+		av := AuthVector{
+			RAND: m[avKey(AV_RAND, i)],
+			AUTN: m[avKey(AV_AUTN, i)],
+			XRES: m[avKey(AV_XRES, i)],
+			CK:   m[avKey(AV_CK, i)],
+			IK:   m[avKey(AV_IK, i)],
+		}
+		if len(av.RAND) == 0 || len(av.AUTN) == 0 || len(av.XRES) == 0 {
+			continue
+		}
+		avs = append(avs, av)
+	}
+	return avs
+}
+
 // 定义基础路由转发方法
 type BaseSignallingT func(context.Context, *modules.Package, chan *modules.Package, chan *modules.Package) error
 
@@ -36,6 +187,133 @@ func (m *Mux) Regist(r [2]byte, f BaseSignallingT) {
 	m.router[r] = f
 }
 
+// 构造SIP消息的发送回调，事务层通过该回调完成消息的发送和重传
+// 应用服务器不属于核心网，发往应用服务器的SIP消息不加帧头
+// 请求按消息选择传输协议并写入第一个Via，应答使用请求到达时的传输协议
+func sipSender(hop NextHop, out chan *modules.Package) sip.TransportFunc {
+	return func(msg *sip.Message) {
+		pkg := new(modules.Package)
+		transport := hop.Transport
+		if msg.IsRequest {
+			transport = requestTransport(msg, len(msg.String()))
+		}
+		transport, host := streamHost(transport, hop.Host)
+		if msg.IsRequest {
+			msg.Header.Via.SetFirstTransport(transport)
+		}
+		pkg.SetShortConn(host)
+		pkg.SetTransport(transport)
+		pkg.SetStreamConn(hop.Conn)
+		pkg.SetRaw(config.IsAS(host))
+		if msg.IsRequest {
+			pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, msg.String())
+		} else {
+			pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, msg.String())
+		}
+		modules.Send(pkg, out)
+	}
+}
+
+// 消息转发的下一跳
+type NextHop struct {
+	Host      string // 下一跳地址
+	Up        bool   // 是否通过上行链路发送
+	Transport string // 应答的传输协议，请求发送时按消息选择
+	Conn      string // 请求到达的连接，面向连接传输的应答优先从该连接返回(RFC3261-18.2.2)
+}
+
+// 构造发送到下一跳的回调
+func (h NextHop) sender(up, down chan *modules.Package) sip.TransportFunc {
+	if h.Up {
+		return sipSender(h, up)
+	}
+	return sipSender(h, down)
+}
+
+// 解析SIP地址对应的下一跳，无法解析的地址(如UE的地址)使用默认的下一跳，发往PGW的消息走下行链路
+func resolveHop(host string, fallback *NextHop) (NextHop, error) {
+	if addr, ok := config.Resolve(host); ok {
+		return NextHop{Host: addr, Up: !config.IsPGW(addr)}, nil
+	}
+	if fallback != nil {
+		return *fallback, nil
+	}
+	return NextHop{}, errors.New("ErrUnresolvableHost")
+}
+
+// 消息第一个Via对应的下一跳，应答严格按照Via原路返回(RFC3261-16.7)
+func viaHop(msg *sip.Message, fallback *NextHop) (NextHop, error) {
+	if msg.Header.Via.Len() == 0 {
+		return NextHop{}, errors.New("ErrViaNotExist")
+	}
+	via, _ := msg.Header.Via.FirstAddrInfo()
+	hop, err := resolveHop(via, fallback)
+	hop.Transport = msg.Header.Via.FirstTransport()
+	return hop, err
+}
+
+// 服务端事务发送应答的回调，需要在加入本服务器的Via之前构造
+func responseSender(req *sip.Message, fallback *NextHop, up, down chan *modules.Package) (sip.TransportFunc, error) {
+	hop, err := viaHop(req, fallback)
+	if err != nil {
+		return nil, err
+	}
+	if req.Transport() != modules.TransportUDP {
+		hop.Conn = req.RealAddress()
+	}
+	return hop.sender(up, down), nil
+}
+
+// 应答优先通过服务端事务原路返回，没有对应事务时(如2xx的重传)按Via无状态转发
+func forwardResponse(tl *sip.TransactionLayer, resp *sip.Message, fallback *NextHop, up, down chan *modules.Package) error {
+	if stx := tl.MatchServer(resp); stx != nil {
+		stx.Respond(resp)
+		return nil
+	}
+	hop, err := viaHop(resp, fallback)
+	if err != nil {
+		return err
+	}
+	hop.sender(up, down)(resp)
+	return nil
+}
+
+// 非2xx应答的ACK由INVITE服务端事务吸收，2xx应答的ACK不属于任何事务，由上层直接无状态转发
+func absorbAck(tl *sip.TransactionLayer, req *sip.Message) bool {
+	_, isNew := tl.ServerRequest(req, nil)
+	return !isNew
+}
+
+// 建立对话的初始请求需要插入Record-Route，保证对话内的后续请求经过本服务器
+func isDialogCreating(req *sip.Message) bool {
+	if req.RequestLine.Method != sip.MethodInvite && req.RequestLine.Method != sip.MethodSubscribe {
+		return false
+	}
+	_, err := req.Header.To.Arguments.Get("tag")
+	return err != nil
+}
+
+// 处理CANCEL请求(RFC3261-16.10)，先对CANCEL应答200，再取消对应的INVITE事务，最终由INVITE事务应答487
+func cancelRequest(tl *sip.TransactionLayer, req *sip.Message, send sip.TransportFunc) error {
+	stx, isNew := tl.ServerRequest(req, send)
+	if !isNew {
+		return nil
+	}
+	inv := tl.MatchCancel(req)
+	if inv == nil {
+		stx.Respond(sip.NewResponse(sip.StatusCallTransactionDoesNotExist, req))
+		return errors.New("ErrTransactionNotExist")
+	}
+	stx.Respond(sip.NewResponse(sip.StatusOK, req))
+	tl.CancelInvite(inv)
+	return nil
+}
+
+// 100 Trying 只在相邻节点之间有效，代理不再向前转发(RFC3261-16.7)
+func isTrying(resp *sip.Message) bool {
+	return resp.ResponseLine.StatusCode == sip.StatusTrying.Code
+}
+
 // VoLTE网络中各个功能实体的逻辑处理器实体抽象基类对象
 type Base interface {
 	CoreProcessor(context.Context, chan *modules.Package, chan *modules.Package, chan *modules.Package)
@@ -45,7 +323,18 @@ var defExpire time.Duration = 120 * time.Second
 var UARegPrefix = "ua:"
 var MARegPrefix = "ma:"
 var AddrPrefix = "addr:"
-var UeInfoPrefix = "uinfo:"
+var CallPrefix = "call:"
+var ServiceRoutePrefix = "sr:"
+var AuthVectorPrefix = "av:"
+var RegSubscriptionPrefix = "regsub:"
+var ServiceProfilePrefix = "sp:"
+var ODIPrefix = "odi:"
+var ThirdPartyRegPrefix = "3preg:"
+var LIRPrefix = "lir:"
+var UEPrefix = "ue:"
+var EmmPrefix = "emm:"
+var ConfirmedCallPrefix = "confirmed:"
+var RxSessionPrefix = "rx:"
 
 type Cache struct {
 	*cache.Cache
@@ -93,7 +382,6 @@ func (c *Cache) getUserRegistReq(key string) (*sip.Message, bool) {
 func (c *Cache) setUserRegistReq(key string, msg *sip.Message) {
 	rc := new(RegistCombine)
 	rc.Req = msg
-	rc.XRES = "NONE"
 	c.Set(key, rc, defExpire)
 }
 
@@ -115,31 +403,29 @@ func (c *Cache) setUserRegistReq(key string, msg *sip.Message) {
 // 	i.Set(key, rc, defExpire)
 // }
 
-// SCSCF 添加用户注册请求对应鉴权向量
-func (i *Cache) setUserRegistXRES(key string, val string) error {
+// SCSCF 添加用户注册请求对应鉴权向量和摘要算法
+func (i *Cache) setUserRegistAV(key string, av AuthVector, algorithm string) error {
 	// 首先查看是否存在请求
 	m, expire, ok := i.GetWithExpiration(key)
 	if !ok {
 		return errors.New("ErrNotFoundRequest")
 	}
 	rc := m.(*RegistCombine)
-	rc.XRES = val
+	rc.AV = &av
+	rc.Algorithm = algorithm
 	remain := time.Until(expire)
 	i.Set(key, rc, remain)
 	return nil
 }
 
-// SCSCF 查看用户注册请求对应鉴权向量
-func (s *Cache) getUserRegistXRES(key string) string {
+// SCSCF 查看用户注册请求对应鉴权向量和摘要算法
+func (s *Cache) getUserRegistAV(key string) (*AuthVector, string) {
 	m, ok := s.Get(key)
 	if !ok {
-		return ""
+		return nil, ""
 	}
 	rc := m.(*RegistCombine)
-	if rc.XRES == "NONE" {
-		return ""
-	}
-	return rc.XRES
+	return rc.AV, rc.Algorithm
 }
 
 // SCSCF 删除用户注册请求和鉴权向量
@@ -147,17 +433,192 @@ func (s *Cache) delUserRegistReqXRES(key string) {
 	s.Delete(key)
 }
 
-// SCSCF 添加用户信息到系统
-func (s *Cache) updateUserInfo(key string, val *User) {
+// SCSCF 缓存HSS返回的尚未使用的鉴权向量
+func (s *Cache) pushAuthVectors(key string, avs []AuthVector) {
+	if len(avs) == 0 {
+		return
+	}
+	if m, ok := s.Get(key); ok {
+		avs = append(m.([]AuthVector), avs...)
+	}
+	s.Set(key, avs, cache.NoExpiration)
+}
+
+// SCSCF 取出一个缓存的鉴权向量，每个向量只使用一次
+func (s *Cache) popAuthVector(key string) (AuthVector, bool) {
+	m, ok := s.Get(key)
+	if !ok {
+		return AuthVector{}, false
+	}
+	avs := m.([]AuthVector)
+	if len(avs) <= 1 {
+		s.Delete(key)
+	} else {
+		s.Set(key, avs[1:], cache.NoExpiration)
+	}
+	if len(avs) == 0 {
+		return AuthVector{}, false
+	}
+	return avs[0], true
+}
+
+// SCSCF 缓存会话的路由信息，会话建立前默认2分钟后过期
+func (s *Cache) setCall(key string, val *Call, confirmed bool) {
+	if confirmed {
+		s.Set(key, val, cache.NoExpiration)
+		return
+	}
+	s.Set(key, val, defExpire)
+}
+
+// SCSCF 查询会话的路由信息
+func (s *Cache) getCall(key string) *Call {
+	m, ok := s.Get(key)
+	if !ok {
+		return nil
+	}
+	return m.(*Call)
+}
+
+// PCSCF 保存用户注册成功时返回的Service-Route
+func (p *Cache) setServiceRoute(key string, val []sip.User) {
+	p.Set(key, val, cache.NoExpiration)
+}
+
+// PCSCF 查询用户的Service-Route，用户未注册时返回nil
+func (p *Cache) getServiceRoute(key string) []sip.User {
+	m, ok := p.Get(key)
+	if !ok {
+		return nil
+	}
+	return m.([]sip.User)
+}
+
+// PCSCF 记录INVITE应答成功的会话，会话内的请求失败时保留专用承载，会话结束时删除
+func (p *Cache) setConfirmedCall(key string) {
+	p.Set(key, true, cache.NoExpiration)
+}
+
+// PCSCF 会话是否已经建立
+func (p *Cache) isConfirmedCall(key string) bool {
+	_, ok := p.Get(key)
+	return ok
+}
+
+// PCRF 保存IMS会话的Rx会话，会话结束时删除
+func (p *Cache) setRxSession(key string, val *RxSession) {
+	p.Set(key, val, cache.NoExpiration)
+}
+
+// PCRF 查询Rx会话，不存在时返回nil
+func (p *Cache) getRxSession(key string) *RxSession {
+	m, ok := p.Get(key)
+	if !ok {
+		return nil
+	}
+	return m.(*RxSession)
+}
+
+// PGW 保存UE上下文，去附着时删除
+func (p *Cache) setUEContext(key string, val *UEContext) {
+	p.Set(key, val, cache.NoExpiration)
+}
+
+// PGW 查询UE上下文，UE未附着时返回nil
+func (p *Cache) getUEContext(key string) *UEContext {
+	m, ok := p.Get(key)
+	if !ok {
+		return nil
+	}
+	return m.(*UEContext)
+}
+
+// MME 保存UE的移动性管理上下文，附着完成前按默认时间过期
+func (m *Cache) setEmmContext(key string, val *EmmContext, attached bool) {
+	if attached {
+		m.Set(key, val, cache.NoExpiration)
+		return
+	}
+	m.Set(key, val, defExpire)
+}
+
+// MME 查询UE的移动性管理上下文
+func (m *Cache) getEmmContext(key string) *EmmContext {
+	v, ok := m.Get(key)
+	if !ok {
+		return nil
+	}
+	return v.(*EmmContext)
+}
+
+// P-CSCF代替UE订阅的注册状态事件，对话的本端为P-CSCF
+type RegSubscribeInfo struct {
+	CallID    string
+	LocalTag  string // 本端标签(From)
+	RemoteTag string // S-CSCF应答中的标签(To)
+	CSeq      int    // 本端最近一次SUBSCRIBE的CSeq
+}
+
+// PCSCF 保存注册状态事件的订阅，与订阅的有效时间一致
+func (p *Cache) setRegSubscription(key string, val *RegSubscribeInfo, expires time.Duration) {
+	p.Set(key, val, expires)
+}
+
+// PCSCF 查询注册状态事件的订阅
+func (p *Cache) getRegSubscription(key string) *RegSubscribeInfo {
+	m, ok := p.Get(key)
+	if !ok {
+		return nil
+	}
+	return m.(*RegSubscribeInfo)
+}
+
+// SCSCF 保存HSS下发的用户业务签约数据
+func (s *Cache) setServiceProfile(key string, val *ServiceProfile) {
 	s.Set(key, val, cache.NoExpiration)
 }
 
-// ICSCF/SCSCF 查询用户信息
-func (i *Cache) getUserInfo(key string) *User {
-	m, ok := i.Get(key)
+// SCSCF 查询用户业务签约数据，未下发时返回nil
+func (s *Cache) getServiceProfile(key string) *ServiceProfile {
+	m, ok := s.Get(key)
 	if !ok {
 		return nil
 	}
-	ue := m.(*User)
-	return ue
+	return m.(*ServiceProfile)
+}
+
+// SCSCF 保存经AS转发的请求的iFC评估进度，默认2分钟后过期
+func (s *Cache) setIfcState(key string, val IfcState) {
+	s.Set(key, &val, defExpire)
+}
+
+// SCSCF 查询iFC评估进度，返回副本，同一个ODI可以被AS多次使用
+func (s *Cache) getIfcState(key string) *IfcState {
+	m, ok := s.Get(key)
+	if !ok {
+		return nil
+	}
+	st := *m.(*IfcState)
+	return &st
+}
+
+// S-CSCF发给AS的第三方注册，应答失败时按默认处理决定是否注销用户
+type ThirdPartyRegister struct {
+	User            string
+	DefaultHandling int
+}
+
+// SCSCF 保存第三方注册，等待AS应答
+func (s *Cache) setThirdPartyRegister(key string, val *ThirdPartyRegister) {
+	s.Set(key, val, defExpire)
+}
+
+// SCSCF 取出第三方注册
+func (s *Cache) popThirdPartyRegister(key string) *ThirdPartyRegister {
+	m, ok := s.Get(key)
+	if !ok {
+		return nil
+	}
+	s.Delete(key)
+	return m.(*ThirdPartyRegister)
 }
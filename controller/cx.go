@@ -0,0 +1,312 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VegetableManII/volte/diameter"
+	"github.com/VegetableManII/volte/modules"
+)
+
+var ErrUnsupportedCxCommand = errors.New("ErrUnsupportedCxCommand")
+
+// IMS AKA鉴权的鉴权方案(3GPP TS 29.229 6.3.9)
+const sipAuthSchemeAKA = "Digest-AKAv1-MD5"
+
+// Cx消息与Diameter命令的对应关系
+type cxCommand struct {
+	code    uint32
+	request bool
+}
+
+var cxCommands = map[byte]cxCommand{
+	modules.UserAuthorizationRequest:        {diameter.CodeUserAuthorization, true},
+	modules.UserAuthorizationAnswer:         {diameter.CodeUserAuthorization, false},
+	modules.MultiMediaAuthenticationRequest: {diameter.CodeMultimediaAuth, true},
+	modules.MultiMediaAuthenticationAnswer:  {diameter.CodeMultimediaAuth, false},
+	modules.ServerAssignmentRequest:         {diameter.CodeServerAssignment, true},
+	modules.ServerAssignmentAnswer:          {diameter.CodeServerAssignment, false},
+	modules.LocationInfoRequest:             {diameter.CodeLocationInfo, true},
+	modules.LocationInfoAnswer:              {diameter.CodeLocationInfo, false},
+	modules.RegistrationTerminationRequest:  {diameter.CodeRegistrationTermination, true},
+	modules.RegistrationTerminationAnswer:   {diameter.CodeRegistrationTermination, false},
+}
+
+// Diameter命令对应的Cx消息类型
+func cxMethod(code uint32, request bool) (byte, bool) {
+	for method, cmd := range cxCommands {
+		if cmd.code == code && cmd.request == request {
+			return method, true
+		}
+	}
+	return 0, false
+}
+
+// Server-Assignment-Type的枚举值(3GPP TS 29.229 6.3.15)
+var cxAssignmentTypes = map[string]uint32{
+	AssignmentRegistration:             1,
+	AssignmentReRegistration:           2,
+	AssignmentUnregisteredUser:         3,
+	AssignmentTimeoutDeregistration:    4,
+	AssignmentUserDeregistration:       5,
+	AssignmentAdministrativeDeregister: 8,
+}
+
+// Reason-Code的枚举值(3GPP TS 29.229 6.3.17)
+var cxReasonCodes = map[string]uint32{
+	ReasonPermanentTermination: 0,
+	ReasonNewServerAssigned:    1,
+	ReasonServerChange:         2,
+	ReasonRemoveSCSCF:          3,
+}
+
+func enumName(enums map[string]uint32, v uint32) string {
+	for name, value := range enums {
+		if value == v {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+// 会话标识的序号
+var cxSessionSeq uint32
+
+// 生成Session-Id：<DiameterIdentity>;<高32位>;<低32位>(RFC6733-8.8)
+func newCxSessionID(host string) string {
+	return host + ";" + strconv.FormatInt(time.Now().Unix(), 10) + ";" + strconv.FormatUint(uint64(atomic.AddUint32(&cxSessionSeq, 1)), 10)
+}
+
+// 将Cx消息编码为Diameter消息，请求没有会话标识时生成新的会话标识
+func encodeCx(local diameter.Identity, method byte, m map[string]string) (*diameter.Message, error) {
+	cmd, ok := cxCommands[method]
+	if !ok {
+		return nil, ErrUnsupportedCxCommand
+	}
+	session := m[CX_SESSION]
+	if len(session) == 0 {
+		session = newCxSessionID(local.Host)
+	}
+	msg := &diameter.Message{Code: cmd.code, AppID: diameter.AppCx, Flags: diameter.FlagProxiable}
+	msg.Add(diameter.UTF8String(diameter.AVPSessionID, 0, session))
+	if cmd.request {
+		msg.Flags |= diameter.FlagRequest
+		msg.Add(diameter.Grouped(diameter.AVPVendorSpecificApplicationID, 0,
+			diameter.Unsigned32(diameter.AVPVendorID, 0, diameter.Vendor3GPP),
+			diameter.Unsigned32(diameter.AVPAuthApplicationID, 0, diameter.AppCx)))
+	} else if avp, err := cxResult(method, m[CX_RESULT]); err != nil {
+		return nil, err
+	} else {
+		msg.Add(avp)
+	}
+	msg.Add(diameter.Unsigned32(diameter.AVPAuthSessionState, 0, diameter.NoStateMaintained))
+	msg.Add(local.Origin()...)
+	if cmd.request {
+		msg.Add(diameter.UTF8String(diameter.AVPDestinationRealm, 0, local.Realm))
+	}
+	if user, ok := m["UserName"]; ok {
+		msg.Add(diameter.UTF8String(diameter.AVPUserName, 0, user))
+		if cmd.request && len(user) > 0 {
+			msg.Add(diameter.UTF8String(diameter.AVPPublicIdentity, diameter.Vendor3GPP, "sip:"+user+"@"+local.Realm))
+		}
+	}
+	if server, ok := m[CX_SERVER]; ok {
+		msg.Add(diameter.UTF8String(diameter.AVPServerName, diameter.Vendor3GPP, "sip:"+server))
+	}
+	if assignment, ok := m[CX_ASSIGNMENT]; ok {
+		v, ok := cxAssignmentTypes[assignment]
+		if !ok {
+			return nil, errors.New("ErrInvalidAssignmentType")
+		}
+		msg.Add(diameter.Unsigned32(diameter.AVPServerAssignmentType, diameter.Vendor3GPP, v))
+	}
+	if reason, ok := m[CX_REASON]; ok {
+		v, ok := cxReasonCodes[reason]
+		if !ok {
+			return nil, errors.New("ErrInvalidReasonCode")
+		}
+		msg.Add(diameter.Grouped(diameter.AVPDeregistrationReason, diameter.Vendor3GPP,
+			diameter.Unsigned32(diameter.AVPReasonCode, diameter.Vendor3GPP, v),
+			diameter.UTF8String(diameter.AVPReasonInfo, diameter.Vendor3GPP, reason)))
+	}
+	// 业务签约数据在Diameter中直接携带XML
+	if data, ok := m[USER_DATA]; ok {
+		xml, err := base64.RawStdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Add(diameter.OctetString(diameter.AVPUserData, diameter.Vendor3GPP, xml))
+	}
+	if err := encodeCxAuth(msg, method, m); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 应答的结果码，3GPP定义的结果码使用Experimental-Result(3GPP TS 29.229 6.2)
+func cxResult(method byte, result string) (diameter.AVP, error) {
+	code, err := strconv.ParseUint(result, 10, 32)
+	if err != nil {
+		return diameter.AVP{}, errors.New("ErrInvalidResultCode")
+	}
+	experimental := false
+	switch result {
+	case ResultSubsequentRegistration, ResultUnregisteredService, ResultErrorUserUnknown:
+		experimental = true
+	case ResultFirstRegistration:
+		experimental = method == modules.UserAuthorizationAnswer
+	}
+	if !experimental {
+		return diameter.Unsigned32(diameter.AVPResultCode, 0, uint32(code)), nil
+	}
+	return diameter.Grouped(diameter.AVPExperimentalResult, 0,
+		diameter.Unsigned32(diameter.AVPVendorID, 0, diameter.Vendor3GPP),
+		diameter.Unsigned32(diameter.AVPExperimentalResultCode, 0, uint32(code))), nil
+}
+
+// MAR请求的鉴权向量个数和重新同步参数，MAA下发的鉴权向量(3GPP TS 29.229 6.3.13)
+// SIP-Authenticate为RAND||AUTN，SIP-Authorization在MAR中为RAND||AUTS，在MAA中为XRES
+func encodeCxAuth(msg *diameter.Message, method byte, m map[string]string) error {
+	switch method {
+	case modules.MultiMediaAuthenticationRequest:
+		n, _ := strconv.Atoi(m[AV_NUM])
+		msg.Add(diameter.Unsigned32(diameter.AVPSIPNumberAuthItems, diameter.Vendor3GPP, uint32(n)))
+		item := []diameter.AVP{diameter.UTF8String(diameter.AVPSIPAuthenticationScheme, diameter.Vendor3GPP, sipAuthSchemeAKA)}
+		if len(m[AV_AUTS]) > 0 {
+			auth, err := hex.DecodeString(m[AV_RAND] + m[AV_AUTS])
+			if err != nil {
+				return err
+			}
+			item = append(item, diameter.OctetString(diameter.AVPSIPAuthorization, diameter.Vendor3GPP, auth))
+		}
+		msg.Add(diameter.Grouped(diameter.AVPSIPAuthDataItem, diameter.Vendor3GPP, item...))
+	case modules.MultiMediaAuthenticationAnswer:
+		avs := unmarshalAuthVectors(m)
+		msg.Add(diameter.Unsigned32(diameter.AVPSIPNumberAuthItems, diameter.Vendor3GPP, uint32(len(avs))))
+		for i, av := range avs {
+			authenticate, err := hex.DecodeString(av.RAND + av.AUTN)
+			if err != nil {
+				return err
+			}
+			fields := make([][]byte, 3)
+			for j, f := range []string{av.XRES, av.CK, av.IK} {
+				if fields[j], err = hex.DecodeString(f); err != nil {
+					return err
+				}
+			}
+			msg.Add(diameter.Grouped(diameter.AVPSIPAuthDataItem, diameter.Vendor3GPP,
+				diameter.Unsigned32(diameter.AVPSIPItemNumber, diameter.Vendor3GPP, uint32(i+1)),
+				diameter.UTF8String(diameter.AVPSIPAuthenticationScheme, diameter.Vendor3GPP, sipAuthSchemeAKA),
+				diameter.OctetString(diameter.AVPSIPAuthenticate, diameter.Vendor3GPP, authenticate),
+				diameter.OctetString(diameter.AVPSIPAuthorization, diameter.Vendor3GPP, fields[0]),
+				diameter.OctetString(diameter.AVPConfidentialityKey, diameter.Vendor3GPP, fields[1]),
+				diameter.OctetString(diameter.AVPIntegrityKey, diameter.Vendor3GPP, fields[2])))
+		}
+	}
+	return nil
+}
+
+// 将Diameter消息解码为Cx消息
+func decodeCx(msg *diameter.Message) (byte, map[string]string, error) {
+	method, ok := cxMethod(msg.Code, msg.IsRequest())
+	if !ok || msg.AppID != diameter.AppCx {
+		return 0, nil, ErrUnsupportedCxCommand
+	}
+	m := map[string]string{
+		CX_SESSION: msg.SessionID(),
+	}
+	if a, ok := msg.Find(diameter.AVPUserName, 0); ok {
+		m["UserName"] = a.String()
+	} else if a, ok := msg.Find(diameter.AVPPublicIdentity, diameter.Vendor3GPP); ok {
+		uri := strings.TrimPrefix(a.String(), "sip:")
+		m["UserName"] = strings.SplitN(uri, "@", 2)[0]
+	}
+	if !msg.IsRequest() {
+		code, ok := msg.ResultCode()
+		if !ok {
+			return 0, nil, errors.New("ErrInvalidResultCode")
+		}
+		m[CX_RESULT] = strconv.FormatUint(uint64(code), 10)
+	}
+	if a, ok := msg.Find(diameter.AVPServerName, diameter.Vendor3GPP); ok {
+		m[CX_SERVER] = strings.TrimPrefix(a.String(), "sip:")
+	}
+	if a, ok := msg.Find(diameter.AVPServerAssignmentType, diameter.Vendor3GPP); ok {
+		v, err := a.Uint32()
+		if err != nil {
+			return 0, nil, err
+		}
+		m[CX_ASSIGNMENT] = enumName(cxAssignmentTypes, v)
+	}
+	if a, ok := msg.Find(diameter.AVPDeregistrationReason, diameter.Vendor3GPP); ok {
+		group, err := a.Group()
+		if err != nil {
+			return 0, nil, err
+		}
+		if code, ok := diameter.Find(group, diameter.AVPReasonCode, diameter.Vendor3GPP); ok {
+			v, err := code.Uint32()
+			if err != nil {
+				return 0, nil, err
+			}
+			m[CX_REASON] = enumName(cxReasonCodes, v)
+		}
+	}
+	if a, ok := msg.Find(diameter.AVPUserData, diameter.Vendor3GPP); ok {
+		m[USER_DATA] = base64.RawStdEncoding.EncodeToString(a.Data)
+	}
+	if err := decodeCxAuth(msg, method, m); err != nil {
+		return 0, nil, err
+	}
+	return method, m, nil
+}
+
+func decodeCxAuth(msg *diameter.Message, method byte, m map[string]string) error {
+	if method != modules.MultiMediaAuthenticationRequest && method != modules.MultiMediaAuthenticationAnswer {
+		return nil
+	}
+	if a, ok := msg.Find(diameter.AVPSIPNumberAuthItems, diameter.Vendor3GPP); ok {
+		n, err := a.Uint32()
+		if err != nil {
+			return err
+		}
+		m[AV_NUM] = strconv.FormatUint(uint64(n), 10)
+	}
+	var avs []AuthVector
+	for _, a := range msg.FindAll(diameter.AVPSIPAuthDataItem, diameter.Vendor3GPP) {
+		group, err := a.Group()
+		if err != nil {
+			return err
+		}
+		authorization, _ := diameter.Find(group, diameter.AVPSIPAuthorization, diameter.Vendor3GPP)
+		if method == modules.MultiMediaAuthenticationRequest {
+			// RAND为16字节，AUTS为14字节
+			if len(authorization.Data) == 30 {
+				m[AV_RAND] = hex.EncodeToString(authorization.Data[:16])
+				m[AV_AUTS] = hex.EncodeToString(authorization.Data[16:])
+			}
+			continue
+		}
+		authenticate, _ := diameter.Find(group, diameter.AVPSIPAuthenticate, diameter.Vendor3GPP)
+		if len(authenticate.Data) != 32 {
+			return errors.New("ErrInvalidSIPAuthenticate")
+		}
+		ck, _ := diameter.Find(group, diameter.AVPConfidentialityKey, diameter.Vendor3GPP)
+		ik, _ := diameter.Find(group, diameter.AVPIntegrityKey, diameter.Vendor3GPP)
+		avs = append(avs, AuthVector{
+			RAND: hex.EncodeToString(authenticate.Data[:16]),
+			AUTN: hex.EncodeToString(authenticate.Data[16:]),
+			XRES: hex.EncodeToString(authorization.Data),
+			CK:   hex.EncodeToString(ck.Data),
+			IK:   hex.EncodeToString(ik.Data),
+		})
+	}
+	if method == modules.MultiMediaAuthenticationAnswer {
+		marshalAuthVectors(m, avs)
+	}
+	return nil
+}
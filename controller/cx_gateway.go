@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/diameter"
+	"github.com/VegetableManII/volte/modules"
+
+	"github.com/wonderivan/logger"
+)
+
+// Diameter连接的参数
+var (
+	CxDialTimeout      = 3 * time.Second
+	CxWatchdogInterval = 30 * time.Second
+)
+
+// Cx接口使用Diameter时的网关，在逻辑核心的Cx消息和Diameter消息之间转换，逻辑核心的处理流程不变
+// CSCF作为客户端连接HSS，HSS作为服务端接受CSCF的连接，没有Diameter连接的对端仍然使用原有格式
+type CxGateway struct {
+	sync.Mutex
+	local   diameter.Identity
+	hss     string // HSS的Diameter地址，作为客户端时使用
+	hssAddr string // HSS的实际地址，逻辑核心发往该地址的Cx消息改由Diameter发送
+	in      chan *modules.Package
+	peers   map[string]*diameter.Conn // 对端的实际地址 -> 连接
+	pending *Cache                    // 等待逻辑核心应答的对端请求
+}
+
+// 等待应答的对端请求，应答需要从请求到达的连接返回
+type cxPending struct {
+	conn *diameter.Conn
+	req  *diameter.Message
+}
+
+var CxPendingPrefix = "cx:"
+
+// 按配置接入Cx接口的Diameter网关，返回逻辑核心使用的上下行管道
+// entity为功能实体在网络域中的名称，HSS同时开始监听Diameter连接，Cx接口使用原有格式时原样返回管道
+func CxTransport(ctx context.Context, conf *config.Network, entity string, in, up, down chan *modules.Package) (chan *modules.Package, chan *modules.Package) {
+	if conf.Cx != config.CxDiameter {
+		return up, down
+	}
+	g := NewCxGateway(conf, entity, in)
+	if entity == "hss" {
+		if err := g.Listen(ctx, conf.Diameter); err != nil {
+			log.Panicln("Diameter监听失败", conf.Diameter, err)
+		}
+	}
+	return g.Intercept(ctx, up), g.Intercept(ctx, down)
+}
+
+func NewCxGateway(conf *config.Network, entity string, in chan *modules.Package) *CxGateway {
+	g := &CxGateway{
+		local: diameter.Identity{
+			Host:        conf.Host(entity),
+			Realm:       conf.DNS,
+			ProductName: "volte",
+			VendorID:    diameter.Vendor3GPP,
+			AppIDs:      []uint32{diameter.AppCx},
+		},
+		hssAddr: conf.Elements["HSS"].ActualAddr,
+		in:      in,
+		peers:   make(map[string]*diameter.Conn),
+		pending: initCache(),
+	}
+	if entity != "hss" {
+		g.hss = conf.Diameter
+	}
+	return g
+}
+
+// HSS接受CSCF的连接，对端以Origin-Host对应的实际地址区分
+func (g *CxGateway) Listen(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("[%v] Diameter服务监听启动成功 %v", ctx.Value("Entity"), ln.Addr())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				logger.Warn("[%v] Diameter服务监听退出 %v", ctx.Value("Entity"), err)
+				return
+			}
+			go g.accept(ctx, nc)
+		}
+	}()
+	return nil
+}
+
+func (g *CxGateway) accept(ctx context.Context, nc net.Conn) {
+	c, err := diameter.Accept(nc, g.local, CxDialTimeout)
+	if err != nil {
+		logger.Error("[%v] Diameter能力交换失败 %v, peer: %v", ctx.Value("Entity"), err, nc.RemoteAddr())
+		nc.Close()
+		return
+	}
+	addr, ok := config.Resolve(c.Peer.Host)
+	if !ok {
+		logger.Error("[%v] 无法解析Diameter对端 %v", ctx.Value("Entity"), c.Peer.Host)
+		c.Close()
+		return
+	}
+	logger.Info("[%v] Diameter对端连接成功 %v(%v)", ctx.Value("Entity"), c.Peer.Host, addr)
+	g.register(addr, c)
+	g.serve(ctx, addr, c)
+}
+
+// 作为客户端时连接HSS，已有连接时直接使用
+func (g *CxGateway) dial(ctx context.Context) (*diameter.Conn, error) {
+	g.Lock()
+	c := g.peers[g.hssAddr]
+	g.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	c, err := diameter.Dial(g.hss, g.local, CxDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("[%v] Diameter连接HSS成功 %v", ctx.Value("Entity"), c.Peer.Host)
+	g.register(g.hssAddr, c)
+	go g.serve(ctx, g.hssAddr, c)
+	return c, nil
+}
+
+// 保存对端的连接，对端重新连接时关闭原有的连接
+func (g *CxGateway) register(addr string, c *diameter.Conn) {
+	g.Lock()
+	defer g.Unlock()
+	if old := g.peers[addr]; old != nil {
+		old.Close()
+	}
+	g.peers[addr] = c
+}
+
+// 接收对端的消息，转换后交给逻辑核心，连接断开时删除
+func (g *CxGateway) serve(ctx context.Context, addr string, c *diameter.Conn) {
+	defer modules.Recover(ctx)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		g.Lock()
+		if g.peers[addr] == c {
+			delete(g.peers, addr)
+		}
+		g.Unlock()
+	}()
+	go c.Watchdog(done, CxWatchdogInterval)
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			logger.Warn("[%v] Diameter连接断开 %v, peer: %v", ctx.Value("Entity"), err, addr)
+			return
+		}
+		method, table, err := decodeCx(msg)
+		if err != nil {
+			logger.Error("[%v] Diameter消息解析失败 %v, code: %v", ctx.Value("Entity"), err, msg.Code)
+			if msg.IsRequest() {
+				ans := msg.Answer(diameter.Unsigned32(diameter.AVPResultCode, 0, diameter.UnableToComply))
+				ans.Add(g.local.Origin()...)
+				c.WriteMessage(ans)
+			}
+			continue
+		}
+		if msg.IsRequest() {
+			g.pending.Set(CxPendingPrefix+msg.SessionID(), &cxPending{conn: c, req: msg}, defExpire)
+		}
+		// 记录对端的实际地址，逻辑核心按来源应答
+		pkg := new(modules.Package)
+		pkg.SetShortConn(addr)
+		pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(table))
+		select {
+		case g.in <- pkg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 拦截逻辑核心发出的消息，能够经Diameter发送的Cx消息不再交给原来的发送协程
+func (g *CxGateway) Intercept(ctx context.Context, out chan *modules.Package) chan *modules.Package {
+	core := make(chan *modules.Package, cap(out))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case pkg := <-core:
+				if !g.send(ctx, pkg) {
+					out <- pkg
+				}
+			}
+		}
+	}()
+	return core
+}
+
+// 经Diameter发送Cx消息，返回false时使用原有格式发送
+// 应答返回到请求到达的连接，请求发给已连接的对端，CSCF发往HSS的请求在需要时建立连接
+func (g *CxGateway) send(ctx context.Context, pkg *modules.Package) bool {
+	route := pkg.GetRoute()
+	cmd, ok := cxCommands[route[1]]
+	if route[0] != modules.EPCPROTOCAL || !ok {
+		return false
+	}
+	table := modules.StrLineUnmarshal(pkg.GetData())
+	var conn *diameter.Conn
+	var req *diameter.Message
+	if cmd.request {
+		g.Lock()
+		conn = g.peers[pkg.GetShortConn()]
+		g.Unlock()
+		if conn == nil && len(g.hss) > 0 && pkg.GetShortConn() == g.hssAddr {
+			var err error
+			if conn, err = g.dial(ctx); err != nil {
+				logger.Error("[%v] Diameter连接HSS失败，使用原有格式 %v", ctx.Value("Entity"), err)
+				return false
+			}
+		}
+	} else if v, ok := g.pending.Get(CxPendingPrefix + table[CX_SESSION]); ok {
+		g.pending.Delete(CxPendingPrefix + table[CX_SESSION])
+		conn, req = v.(*cxPending).conn, v.(*cxPending).req
+	}
+	if conn == nil {
+		return false
+	}
+	msg, err := encodeCx(g.local, route[1], table)
+	if err != nil {
+		logger.Error("[%v] Diameter消息编码失败 %v", ctx.Value("Entity"), err)
+		return true
+	}
+	if req != nil {
+		msg.HopByHop, msg.EndToEnd = req.HopByHop, req.EndToEnd
+	}
+	if err = conn.WriteMessage(msg); err != nil {
+		logger.Error("[%v] Diameter消息发送失败 %v, peer: %v", ctx.Value("Entity"), err, conn.RemoteAddr())
+	}
+	return true
+}
@@ -1,38 +1,56 @@
 package controller
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/xml"
+	"errors"
 	"log"
-	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/modules"
 	"github.com/wmnsk/milenage"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 
 	"github.com/wonderivan/logger"
 )
 
+var ErrUserUnknown = errors.New("ErrUserUnknown")
+
 type HssEntity struct {
 	*Mux
-	dbclient *gorm.DB
+	conf  *config.Network
+	store SubscriberStore
 }
 
-func (h *HssEntity) Init(dbconf string) {
+func (h *HssEntity) Init(conf *config.Network, sc config.Store) {
 	// 初始化路由
 	h.Mux = new(Mux)
+	h.conf = conf
 	h.router = make(map[[2]byte]BaseSignallingT)
-	// 初始化数据库连接
-	db, err := gorm.Open("mysql", dbconf)
+	// 初始化用户数据存储
+	store, err := OpenSubscriberStore(sc)
 	if err != nil {
-		log.Panicln("HSS初始化数据库连接失败", err)
+		log.Panicln("HSS初始化用户数据存储失败", sc.Driver, err)
 	}
-	h.dbclient = db
+	h.store = store
+}
+
+// 注册消息路由
+func (h *HssEntity) RegistRouter() {
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.MultiMediaAuthenticationRequest}, h.MultimediaAuthorizationRequestF)
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.UserAuthorizationRequest}, h.UserAuthorizationRequestF)
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.LocationInfoRequest}, h.LocationInfoRequestF)
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.ServerAssignmentRequest}, h.ServerAssignmentRequestF)
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.RegistrationTerminationAnswer}, h.RegistrationTerminationAnswerF)
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.AuthenticationInformationRequest}, h.AuthenticationInformationRequestF)
+	h.Regist([2]byte{modules.EPCPROTOCAL, modules.UpdateLocationRequest}, h.UpdateLocationRequestF)
 }
 
 // HSS可以接收epc电路协议也可以接收SIP协议
@@ -60,78 +78,362 @@ func (h *HssEntity) CoreProcessor(ctx context.Context, in, up, down chan *module
 	}
 }
 
+// 注册时I-CSCF查询S-CSCF(UAR)，用户已分配S-CSCF时返回该S-CSCF，否则返回本域的S-CSCF
 func (h *HssEntity) UserAuthorizationRequestF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
 	defer modules.Recover(ctx)
 
 	logger.Info("[%v] Receive From I-CSCF: \n%v", ctx.Value("Entity"), string(p.GetData()))
 	table := modules.StrLineUnmarshal(p.GetData())
 	user := table["UserName"]
-	alloc := ServerAllocTable{
-		SipUserName: user,
-		ServerAddr:  config.Elements["SCSCF"].VirtualAddr,
-		BindT:       time.Now(),
-		UnBindT:     time.Now(),
-		Ctime:       time.Now(),
-		Utime:       time.Now(),
+	response := map[string]string{
+		"UserName": user,
+		CX_SESSION: table[CX_SESSION],
 	}
-	err := CreateAllocServerRecord(ctx, h.dbclient, &alloc)
-	if err != nil {
+	// 失败时也要应答，否则I-CSCF的注册事务得不到响应
+	defer func() {
+		p.SetShortConn(h.cxOrigin(p, "ICSCF"))
+		p.Construct(modules.EPCPROTOCAL, modules.UserAuthorizationAnswer, modules.StrLineMarshal(response))
+		modules.Send(p, down)
+	}()
+	server, assigned, err := h.assignedServer(ctx, user)
+	switch {
+	case err == ErrUserUnknown:
+		response[CX_RESULT] = ResultErrorUserUnknown
+	case err != nil:
+		response[CX_RESULT] = ResultUnableToComply
 		return err
+	case assigned:
+		response[CX_RESULT] = ResultSubsequentRegistration
+		response[CX_SERVER] = server
+	default:
+		response[CX_RESULT] = ResultFirstRegistration
+		response[CX_SERVER] = server
 	}
+	return nil
+}
+
+// 呼叫时I-CSCF查询为被叫服务的S-CSCF(LIR)，被叫未分配S-CSCF时返回本域的S-CSCF处理未注册业务
+func (h *HssEntity) LocationInfoRequestF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From I-CSCF: \n%v", ctx.Value("Entity"), string(p.GetData()))
+	table := modules.StrLineUnmarshal(p.GetData())
+	user := table["UserName"]
 	response := map[string]string{
-		"S-CSCF":   config.Elements["SCSCF"].ActualAddr,
 		"UserName": user,
+		CX_SESSION: table[CX_SESSION],
+	}
+	// 失败时也要应答，否则I-CSCF的呼叫事务得不到响应
+	defer func() {
+		p.SetShortConn(h.cxOrigin(p, "ICSCF"))
+		p.Construct(modules.EPCPROTOCAL, modules.LocationInfoAnswer, modules.StrLineMarshal(response))
+		modules.Send(p, down)
+	}()
+	server, assigned, err := h.assignedServer(ctx, user)
+	switch {
+	case err == ErrUserUnknown:
+		response[CX_RESULT] = ResultErrorUserUnknown
+	case err != nil:
+		response[CX_RESULT] = ResultUnableToComply
+		return err
+	case assigned:
+		response[CX_RESULT] = ResultSuccess
+		response[CX_SERVER] = server
+	default:
+		response[CX_RESULT] = ResultUnregisteredService
+		response[CX_SERVER] = server
+	}
+	return nil
+}
+
+// S-CSCF通知为用户服务或不再为用户服务(SAR)，分配记录写入server_alloc
+// 用户改由其他S-CSCF服务时要求原S-CSCF注销用户
+func (h *HssEntity) ServerAssignmentRequestF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From S-CSCF: \n%v", ctx.Value("Entity"), string(p.GetData()))
+	table := modules.StrLineUnmarshal(p.GetData())
+	user := table["UserName"]
+	server := table[CX_SERVER]
+	if len(server) == 0 {
+		server = h.cxOrigin(p, "SCSCF")
+	}
+	response := map[string]string{
+		"UserName": user,
+		CX_RESULT:  ResultUnableToComply,
+		CX_SESSION: table[CX_SESSION],
+	}
+	// 失败时也要应答，存储出错时结果为ResultUnableToComply
+	defer func() {
+		p.SetShortConn(server)
+		p.Construct(modules.EPCPROTOCAL, modules.ServerAssignmentAnswer, modules.StrLineMarshal(response))
+		modules.Send(p, down)
+	}()
+	assignment := table[CX_ASSIGNMENT]
+	switch _, err := h.store.GetUserBySipUserName(ctx, user); {
+	case err != nil:
+		response[CX_RESULT] = ResultErrorUserUnknown
+		return nil
+	case assignment == AssignmentRegistration || assignment == AssignmentReRegistration || assignment == AssignmentUnregisteredUser:
+		old, err := h.store.GetServerAssignment(ctx, user)
+		if err != nil {
+			return err
+		}
+		if err = h.store.AssignServer(ctx, user, server); err != nil {
+			return err
+		}
+		if old != nil && old.Assigned() && old.ServerAddr != server {
+			h.registrationTermination(ctx, user, old.ServerAddr, ReasonNewServerAssigned, down)
+		}
+		// 用户的业务签约数据随SAA下发
+		profile, err := h.store.GetServiceProfile(ctx, user)
+		if err != nil {
+			return err
+		}
+		if len(profile.IFC) > 0 {
+			if response[USER_DATA], err = profile.Encode(); err != nil {
+				return err
+			}
+		}
+	case assignment == AssignmentTimeoutDeregistration || assignment == AssignmentUserDeregistration || assignment == AssignmentAdministrativeDeregister:
+		// 只有当前为用户服务的S-CSCF可以解除分配
+		old, err := h.store.GetServerAssignment(ctx, user)
+		if err != nil {
+			return err
+		}
+		if old != nil && old.ServerAddr == server {
+			if err = h.store.UnassignServer(ctx, user); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	response[CX_RESULT] = ResultSuccess
+	return nil
+}
+
+// S-CSCF注销用户后的应答(RTA)
+func (h *HssEntity) RegistrationTerminationAnswerF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From S-CSCF: \n%v", ctx.Value("Entity"), string(p.GetData()))
+	table := modules.StrLineUnmarshal(p.GetData())
+	if !isCxSuccess(table[CX_RESULT]) {
+		return errors.New("ErrRegistrationTermination")
 	}
-	p.SetShortConn(config.Elements["ICSCF"].ActualAddr)
-	p.Construct(modules.EPCPROTOCAL, modules.UserAuthorizationAnswer, modules.StrLineMarshal(response))
-	modules.Send(p, down)
 	return nil
 }
 
+// 要求S-CSCF注销用户(RTR)
+func (h *HssEntity) registrationTermination(ctx context.Context, user, server, reason string, down chan *modules.Package) {
+	request := map[string]string{
+		"UserName": user,
+		CX_REASON:  reason,
+	}
+	pkg := new(modules.Package)
+	pkg.SetShortConn(server)
+	pkg.Construct(modules.EPCPROTOCAL, modules.RegistrationTerminationRequest, modules.StrLineMarshal(request))
+	modules.Send(pkg, down)
+	logger.Info("[%v] HSS要求%v注销%v, 原因%v", ctx.Value("Entity"), server, user, reason)
+}
+
+// Cx请求的来源，经Diameter到达的请求为对端的实际地址，原有格式的请求使用配置的功能实体地址
+func (h *HssEntity) cxOrigin(p *modules.Package, element string) string {
+	if origin := p.GetShortConn(); len(origin) > 0 {
+		return origin
+	}
+	return h.conf.Elements[element].ActualAddr
+}
+
+// 为用户服务的S-CSCF，用户未分配S-CSCF时返回本域的S-CSCF
+func (h *HssEntity) assignedServer(ctx context.Context, un string) (string, bool, error) {
+	if _, err := h.store.GetUserBySipUserName(ctx, un); err != nil {
+		return "", false, ErrUserUnknown
+	}
+	alloc, err := h.store.GetServerAssignment(ctx, un)
+	if err != nil {
+		return "", false, err
+	}
+	if alloc != nil && alloc.Assigned() {
+		return alloc.ServerAddr, true, nil
+	}
+	return h.conf.Elements["SCSCF"].ActualAddr, false, nil
+}
+
 func (h *HssEntity) MultimediaAuthorizationRequestF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
 	defer modules.Recover(ctx)
 
 	logger.Info("[%v] Receive From S-CSCF: \n%v", ctx.Value("Entity"), string(p.GetData()))
 	table := modules.StrLineUnmarshal(p.GetData())
 	un := table["UserName"]
-	user, err := GetUserBySipUserName(ctx, h.dbclient, un)
+	response := map[string]string{
+		"UserName": un,
+		CX_SESSION: table[CX_SESSION],
+	}
+	// 应答发给请求的来源，原有格式的请求没有来源地址，发给MAR中的S-CSCF
+	origin := p.GetShortConn()
+	if len(origin) == 0 {
+		origin = table[CX_SERVER]
+	}
+	if len(origin) == 0 {
+		origin = h.conf.Elements["SCSCF"].ActualAddr
+	}
+	// 失败时也要应答，否则S-CSCF的注册事务得不到响应
+	defer func() {
+		p.SetShortConn(origin)
+		p.Construct(modules.EPCPROTOCAL, modules.MultiMediaAuthenticationAnswer, modules.StrLineMarshal(response))
+		modules.Send(p, down)
+	}()
+	user, err := h.store.GetUserBySipUserName(ctx, un)
 	if err != nil {
+		response[CX_RESULT] = ResultErrorUserUnknown
 		return err
 	}
-	AUTN, XRES, CK, IK, RAND, err := generateAV(user.RootK, user.Opc)
+	response[CX_RESULT] = ResultUnableToComply
+	// 按请求的个数生成鉴权向量，SQN依次递增
+	n, _ := strconv.Atoi(table[AV_NUM])
+	if n <= 0 {
+		n = 1
+	} else if n > MaxAVNum {
+		n = MaxAVNum
+	}
+	sqn, err := h.advanceSQN(ctx, user, table, n)
 	if err != nil {
 		return err
 	}
-	var response = map[string]string{
-		"UserName": un,
-		AV_AUTN:    hex.EncodeToString(AUTN),
-		AV_XRES:    hex.EncodeToString(XRES),
-		AV_RAND:    hex.EncodeToString(RAND),
-		AV_CK:      hex.EncodeToString(CK),
-		AV_IK:      hex.EncodeToString(IK),
-	}
-	// 在接收消息的步骤中已经设置同步连接
-	p.SetShortConn(config.Elements["SCSCF"].ActualAddr)
-	p.Construct(modules.EPCPROTOCAL, modules.MultiMediaAuthenticationAnswer, modules.StrLineMarshal(response))
-	modules.Send(p, down)
+	avs := make([]AuthVector, 0, n)
+	for i := 0; i < n; i++ {
+		sqn = nextSQN(sqn)
+		AUTN, XRES, CK, IK, RAND, err := generateAV(user.RootK, user.Opc, sqn, h.conf.AMF)
+		if err != nil {
+			return err
+		}
+		avs = append(avs, AuthVector{
+			RAND: hex.EncodeToString(RAND),
+			AUTN: hex.EncodeToString(AUTN),
+			XRES: hex.EncodeToString(XRES),
+			CK:   hex.EncodeToString(CK),
+			IK:   hex.EncodeToString(IK),
+		})
+	}
+	// 用户的业务签约数据随鉴权向量一起下发(SIP-User-Data)
+	profile, err := h.store.GetServiceProfile(ctx, un)
+	if err != nil {
+		return err
+	}
+	var data string
+	if len(profile.IFC) > 0 {
+		if data, err = profile.Encode(); err != nil {
+			return err
+		}
+		response[USER_DATA] = data
+	}
+	marshalAuthVectors(response, avs)
+	response[CX_RESULT] = ResultSuccess
 	return nil
 }
 
-func generateRandN(n int) []byte {
-	r := make([]byte, 0, 16)
-	for i := 0; i < n; i++ {
-		rand.Seed(time.Now().UnixNano())
-		i := rand.Intn(128)
-		r = append(r, byte(i))
+// 为n个鉴权向量预留SQN，返回预留前的SQN，终端携带AUTS请求重新同步时以终端的SQN为准
+// 读取和更新SQN在存储中原子地完成，并发的请求不会使用相同的SQN
+func (h *HssEntity) advanceSQN(ctx context.Context, user *UserTable, table map[string]string, n int) (uint64, error) {
+	var ms *uint64
+	if len(table[AV_AUTS]) > 0 {
+		sqn, err := resyncSQN(user.RootK, user.Opc, table[AV_RAND], table[AV_AUTS])
+		if err != nil {
+			return 0, err
+		}
+		logger.Info("[%v] HSS重新同步SQN,IMSI=%v,SQN=%x", ctx.Value("Entity"), user.IMSI, sqn)
+		ms = &sqn
 	}
-	return r
+	return h.store.AdvanceSQN(ctx, user.IMSI, n, ms)
 }
 
-func generateAV(K, Opc string) (AUTN, XRES, CK, IK, RAND []byte, err error) {
-	// 生成固定SQN
-	SQN := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+// MME请求EPS鉴权向量(S6a AIR)，每次生成一个鉴权向量
+func (h *HssEntity) AuthenticationInformationRequestF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From MME: \n%v", ctx.Value("Entity"), string(p.GetData()))
+	table := modules.StrLineUnmarshal(p.GetData())
+	imsi := table[EPC_UE_IDENTITY]
+	response := map[string]string{EPC_UE_IDENTITY: imsi}
+	defer func() {
+		p.SetShortConn(h.conf.Elements["MME"].ActualAddr)
+		p.Construct(modules.EPCPROTOCAL, modules.AuthenticationInformationAnswer, modules.StrLineMarshal(response))
+		modules.Send(p, down)
+	}()
+	user, err := h.store.GetUserByIMSI(ctx, imsi)
+	if err != nil {
+		response[CX_RESULT] = ResultErrorUserUnknown
+		return err
+	}
+	response[CX_RESULT] = ResultUnableToComply
+	sqn, err := h.advanceSQN(ctx, user, table, 1)
+	if err != nil {
+		return err
+	}
+	AUTN, XRES, _, _, RAND, err := generateAV(user.RootK, user.Opc, nextSQN(sqn), h.conf.AMF)
+	if err != nil {
+		return err
+	}
+	response[CX_RESULT] = ResultSuccess
+	response[AV_RAND] = hex.EncodeToString(RAND)
+	response[AV_AUTN] = hex.EncodeToString(AUTN)
+	response[AV_XRES] = hex.EncodeToString(XRES)
+	return nil
+}
+
+// MME登记UE的位置(S6a ULR)，返回签约的APN和IMS用户名
+func (h *HssEntity) UpdateLocationRequestF(ctx context.Context, p *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From MME: \n%v", ctx.Value("Entity"), string(p.GetData()))
+	table := modules.StrLineUnmarshal(p.GetData())
+	imsi := table[EPC_UE_IDENTITY]
+	response := map[string]string{EPC_UE_IDENTITY: imsi}
+	user, err := h.store.GetUserByIMSI(ctx, imsi)
+	if err != nil {
+		response[CX_RESULT] = ResultErrorUserUnknown
+	} else {
+		response[CX_RESULT] = ResultSuccess
+		response[EPC_APN] = user.Apn
+		response[EPC_USER_NAME] = user.SipUserName
+	}
+	p.SetShortConn(h.conf.Elements["MME"].ActualAddr)
+	p.Construct(modules.EPCPROTOCAL, modules.UpdateLocationAnswer, modules.StrLineMarshal(response))
+	modules.Send(p, down)
+	return err
+}
+
+// 使用密码学安全的随机数生成器
+func generateRandN(n int) ([]byte, error) {
+	r := make([]byte, n)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SQN由SEQ和IND组成，IND占低5位(3GPP TS 33.102 C.3.2)
+const (
+	sqnIndBits = 5
+	sqnIndMask = 1<<sqnIndBits - 1
+	sqnMask    = 1<<48 - 1
+)
+
+// 生成下一个SQN，SEQ递增，IND循环使用
+func nextSQN(sqn uint64) uint64 {
+	seq := sqn>>sqnIndBits + 1
+	ind := (sqn + 1) & sqnIndMask
+	return (seq<<sqnIndBits | ind) & sqnMask
+}
+
+func generateAV(K, Opc string, sqn uint64, amf uint16) (AUTN, XRES, CK, IK, RAND []byte, err error) {
 	// 生成16字节随机数RAND
-	RAND = generateRandN(16)
+	RAND, err = generateRandN(16)
+	if err != nil {
+		return
+	}
 	// 根据Milenage算法生成四元鉴权向量组
 
 	kbs, err := hex.DecodeString(K)
@@ -142,31 +444,63 @@ func generateAV(K, Opc string) (AUTN, XRES, CK, IK, RAND []byte, err error) {
 	if err != nil {
 		return
 	}
-	milenage := milenage.NewWithOPc(
-		kbs,
-		opcbs,
-		RAND,
-		binary.BigEndian.Uint64(SQN),
-		0x0000,
-	)
-	MAC, err := milenage.F1()
+	m := milenage.NewWithOPc(kbs, opcbs, RAND, sqn, amf)
+	MAC, err := m.F1()
 	if err != nil {
 		return
 	}
-	XRES, CK, IK, AK, err := milenage.F2345()
+	XRES, CK, IK, _, err = m.F2345()
 	if err != nil {
 		return
 	}
-	AUTN = xor(SQN, AK)
-	AUTN = append(AUTN, []byte{0x00, 0x00}...)
-	AUTN = append(AUTN, MAC...)
-
-	log.Printf("RootK=%v, Opc=%v, AMF=0x00 0x00, SQN=%x, RAND=%x, MAC=%x, XRES=%x, CK=%x, IK=%x, AK=%x, SQN^AK=%v",
-		K, Opc, SQN, RAND, MAC, XRES, AK, CK, IK, xor(SQN, AK))
+	AUTN, err = m.GenerateAUTN()
+	if err != nil {
+		return
+	}
+	// 密钥和XRES不写入日志
+	logger.Debug("HSS生成鉴权向量 AMF=%04x, SQN=%012x, RAND=%x, MAC=%x, AUTN=%x", amf, sqn, RAND, MAC, AUTN)
 
 	return
 }
 
+// 根据终端返回的AUTS恢复终端的SQN，校验MAC-S(3GPP TS 33.102 6.3.5)
+func resyncSQN(K, Opc, RAND, AUTS string) (uint64, error) {
+	kbs, err := hex.DecodeString(K)
+	if err != nil {
+		return 0, err
+	}
+	opcbs, err := hex.DecodeString(Opc)
+	if err != nil {
+		return 0, err
+	}
+	rbs, err := hex.DecodeString(RAND)
+	if err != nil {
+		return 0, err
+	}
+	auts, err := hex.DecodeString(AUTS)
+	if err != nil {
+		return 0, err
+	}
+	if len(rbs) != 16 || len(auts) != 14 {
+		return 0, errors.New("ErrInvalidAUTS")
+	}
+	m := milenage.NewWithOPc(kbs, opcbs, rbs, 0, 0)
+	AKS, err := m.F5Star()
+	if err != nil {
+		return 0, err
+	}
+	sqnMS := xor(auts[:6], AKS)
+	// 重新同步时AMF固定为0
+	MACS, err := m.F1Star(sqnMS, []byte{0x00, 0x00})
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(MACS, auts[6:]) {
+		return 0, errors.New("ErrMACSMismatch")
+	}
+	return binary.BigEndian.Uint64(append([]byte{0x00, 0x00}, sqnMS...)), nil
+}
+
 func xor(a []byte, b []byte) []byte {
 	l3 := 0
 	l1 := len(a)
@@ -214,6 +548,52 @@ func (ServerAllocTable) TableName() string {
 	return "server_alloc"
 }
 
+// 未解绑的分配记录的解绑时间，与server_alloc表的默认值一致
+var unboundTime = time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// S-CSCF是否正在为用户服务，解绑时间早于绑定时间
+func (a ServerAllocTable) Assigned() bool {
+	return a.UnBindT.Before(a.BindT)
+}
+
+// 将用户分配给S-CSCF，已有记录时更新，否则创建新记录
+func (a *ServerAllocTable) assign(un, addr string, now time.Time) {
+	if a.ID == 0 {
+		a.SipUserName = un
+		a.Ctime = now
+	}
+	a.ServerAddr = addr
+	a.BindT = now
+	a.UnBindT = unboundTime
+	a.Utime = now
+}
+
+// 用户最近的S-CSCF分配记录，没有记录时返回nil
+func GetAllocServerRecord(ctx context.Context, db *gorm.DB, un string) (*ServerAllocTable, error) {
+	ret := new(ServerAllocTable)
+	err := db.Where("sip_username=?", un).Order("id desc").First(ret).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Error("[%v] HSS获取SCSCF分配记录失败,Sip_User_Name=%v,ERR=%v", ctx.Value("Entity"), un, err)
+		return nil, err
+	}
+	return ret, nil
+}
+
+func SaveAllocServerRecord(ctx context.Context, db *gorm.DB, alloc *ServerAllocTable) error {
+	if alloc.ID == 0 {
+		return CreateAllocServerRecord(ctx, db, alloc)
+	}
+	err := db.Save(alloc).Error
+	if err != nil {
+		logger.Error("[%v] HSS更新SCSCF分配记录失败,USER=%v,ERR=%v", ctx.Value("Entity"), *alloc, err)
+		return err
+	}
+	return nil
+}
+
 func CreateAllocServerRecord(ctx context.Context, db *gorm.DB, alloc *ServerAllocTable) error {
 	err := db.Create(alloc).Error
 	if err != nil {
@@ -225,25 +605,193 @@ func CreateAllocServerRecord(ctx context.Context, db *gorm.DB, alloc *ServerAllo
 
 type UserTable struct {
 	ID          int64     `gorm:"column:id"`
-	IMSI        string    `gorm:"column:imsi" json:"imsi"`
-	RootK       string    `gorm:"column:root_k"`
-	Opc         string    `gorm:"column:opc"`
-	Mnc         string    `gorm:"column:mnc" json:"mnc"` // 移动网号
-	Mcc         int32     `gorm:"column:mcc" json:"mcc"` // 国家码
-	Apn         string    `gorm:"column:apn" json:"apn"`
-	SipUserName string    `gorm:"column:sip_username" json:"sip_username"`
-	SipDNS      string    `gorm:"column:sip_dns" json:"sip_dns"`
+	IMSI        string    `gorm:"column:imsi;unique_index:uqidx_imsi" json:"imsi" yaml:"imsi"`
+	RootK       string    `gorm:"column:root_k" json:"root_k" yaml:"root_k"`
+	Opc         string    `gorm:"column:opc" json:"opc" yaml:"opc"`
+	Mnc         string    `gorm:"column:mnc" json:"mnc" yaml:"mnc"` // 移动网号
+	Mcc         int32     `gorm:"column:mcc" json:"mcc" yaml:"mcc"` // 国家码
+	Apn         string    `gorm:"column:apn" json:"apn" yaml:"apn"`
+	SipUserName string    `gorm:"column:sip_username;unique_index:uqidx_sip_username" json:"sip_username" yaml:"sip_username"`
+	SipDNS      string    `gorm:"column:sip_dns" json:"sip_dns" yaml:"sip_dns"`
+	IP          string    `gorm:"column:ip" json:"ip" yaml:"ip"` // 静态地址，IPv4和IPv6以逗号分隔
 	Ctime       time.Time `gorm:"column:ctime"`
 	Utime       time.Time `gorm:"column:utime"`
+	// 初始过滤准则，创建用户时写入ifc表
+	IFC []FilterCriteria `gorm:"-" json:"ifc" yaml:"ifc"`
 }
 
 func (UserTable) TableName() string {
 	return "users"
 }
 
-func GetUserByIMSI(ctx context.Context, db *gorm.DB, imsi string) (*User, error) {
-	ret := new(User)
-	err := db.Model(User{}).Where("imsi=?", imsi).Find(ret).Error
+type SessionTable struct {
+	ID      int64     `gorm:"column:id"`
+	IMSI    string    `gorm:"column:imsi" json:"imsi"`
+	Apn     string    `gorm:"column:apn" json:"apn"`
+	IP      string    `gorm:"column:ip" json:"ip"`
+	PgwAddr string    `gorm:"column:pgw_addr" json:"pgw_addr"`
+	Expire  time.Time `gorm:"column:expire" json:"expire"` // 地址租约的到期时间
+	Ctime   time.Time `gorm:"column:ctime"`
+	Utime   time.Time `gorm:"column:utime"`
+}
+
+func (SessionTable) TableName() string {
+	return "session"
+}
+
+// 配置了静态地址的用户，IMSI -> ip
+func GetStaticIPs(ctx context.Context, db *gorm.DB) (map[string]string, error) {
+	var users []UserTable
+	if err := db.Where("ip<>''").Find(&users).Error; err != nil {
+		logger.Error("[%v] 获取静态地址失败,ERR=%v", ctx.Value("Entity"), err)
+		return nil, err
+	}
+	ret := make(map[string]string, len(users))
+	for _, u := range users {
+		ret[u.IMSI] = u.IP
+	}
+	return ret, nil
+}
+
+// PGW分配的全部地址租约
+func GetSessions(ctx context.Context, db *gorm.DB, pgw string) ([]SessionTable, error) {
+	var ret []SessionTable
+	err := db.Where("pgw_addr=?", pgw).Find(&ret).Error
+	if err != nil {
+		logger.Error("[%v] 获取地址租约失败,PGW=%v,ERR=%v", ctx.Value("Entity"), pgw, err)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 保存地址租约，同一PGW的同一地址只保留最新的记录
+func SaveSession(ctx context.Context, db *gorm.DB, sess *SessionTable) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("pgw_addr=? AND ip=?", sess.PgwAddr, sess.IP).Delete(&SessionTable{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(sess).Error
+	})
+	if err != nil {
+		logger.Error("[%v] 保存地址租约失败,IP=%v,ERR=%v", ctx.Value("Entity"), sess.IP, err)
+	}
+	return err
+}
+
+func DeleteSession(ctx context.Context, db *gorm.DB, pgw, ip string) error {
+	err := db.Where("pgw_addr=? AND ip=?", pgw, ip).Delete(&SessionTable{}).Error
+	if err != nil {
+		logger.Error("[%v] 删除地址租约失败,IP=%v,ERR=%v", ctx.Value("Entity"), ip, err)
+	}
+	return err
+}
+
+type SqnTable struct {
+	ID    int64     `gorm:"column:id"`
+	IMSI  string    `gorm:"column:imsi" json:"imsi"`
+	Sqn   uint64    `gorm:"column:sqn" json:"sqn"`
+	Ctime time.Time `gorm:"column:ctime"`
+	Utime time.Time `gorm:"column:utime"`
+}
+
+func (SqnTable) TableName() string {
+	return "sqn"
+}
+
+// 并发更新SQN冲突时的重试次数
+const sqnRetries = 8
+
+var ErrSqnConflict = errors.New("ErrSqnConflict")
+
+// 为n个鉴权向量递增SQN，返回递增前的SQN，ms不为nil时从终端的SQN开始递增
+// 按读取时的值条件更新，其他请求已经更新时重新读取，记录不存在时并发创建由唯一索引保证只有一个成功
+func AdvanceSqn(ctx context.Context, db *gorm.DB, imsi string, n int, ms *uint64) (uint64, error) {
+	var err error
+	for i := 0; i < sqnRetries; i++ {
+		rec := new(SqnTable)
+		err = db.Where("imsi=?", imsi).Find(rec).Error
+		found := err == nil
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			break
+		}
+		base := rec.Sqn
+		if ms != nil {
+			base = *ms
+		}
+		sqn := base
+		for j := 0; j < n; j++ {
+			sqn = nextSQN(sqn)
+		}
+		now := time.Now()
+		if !found {
+			if err = db.Create(&SqnTable{IMSI: imsi, Sqn: sqn, Ctime: now, Utime: now}).Error; err == nil {
+				return base, nil
+			}
+			continue
+		}
+		res := db.Model(&SqnTable{}).Where("imsi=? AND sqn=?", imsi, rec.Sqn).Updates(map[string]interface{}{"sqn": sqn, "utime": now})
+		if err = res.Error; err != nil {
+			break
+		}
+		if res.RowsAffected == 1 {
+			return base, nil
+		}
+		err = ErrSqnConflict
+	}
+	logger.Error("[%v] HSS更新SQN失败,IMSI=%v,ERR=%v", ctx.Value("Entity"), imsi, err)
+	return 0, err
+}
+
+type IfcTable struct {
+	ID          int64     `gorm:"column:id"`
+	SipUserName string    `gorm:"column:sip_username" json:"sip_username"`
+	Priority    int       `gorm:"column:priority" json:"priority"`
+	Criteria    string    `gorm:"column:criteria" json:"criteria"` // InitialFilterCriteria的XML
+	Ctime       time.Time `gorm:"column:ctime"`
+	Utime       time.Time `gorm:"column:utime"`
+}
+
+func (IfcTable) TableName() string {
+	return "ifc"
+}
+
+// 查询用户的业务签约数据，没有iFC的用户返回空的ServiceProfile
+func GetServiceProfile(ctx context.Context, db *gorm.DB, un string) (*ServiceProfile, error) {
+	var rows []IfcTable
+	err := db.Where("sip_username=?", un).Order("priority").Find(&rows).Error
+	if err != nil {
+		logger.Error("[%v] HSS获取iFC失败,Sip_User_Name=%v,ERR=%v", ctx.Value("Entity"), un, err)
+		return nil, err
+	}
+	profile := new(ServiceProfile)
+	for _, row := range rows {
+		var fc FilterCriteria
+		if err = xml.Unmarshal([]byte(row.Criteria), &fc); err != nil {
+			logger.Error("[%v] HSS解析iFC失败,ID=%v,ERR=%v", ctx.Value("Entity"), row.ID, err)
+			return nil, err
+		}
+		profile.IFC = append(profile.IFC, fc)
+	}
+	return profile, nil
+}
+
+func CreateFilterCriteria(ctx context.Context, db *gorm.DB, un string, fc FilterCriteria) error {
+	data, err := xml.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	row := IfcTable{SipUserName: un, Priority: fc.Priority, Criteria: string(data), Ctime: now, Utime: now}
+	if err = db.Create(&row).Error; err != nil {
+		logger.Error("[%v] HSS创建iFC失败,Sip_User_Name=%v,ERR=%v", ctx.Value("Entity"), un, err)
+		return err
+	}
+	return nil
+}
+
+func GetUserByIMSI(ctx context.Context, db *gorm.DB, imsi string) (*UserTable, error) {
+	ret := new(UserTable)
+	err := db.Where("imsi=?", imsi).Find(ret).Error
 	if err != nil {
 		logger.Error("[%v] HSS获取用户信息失败,IMSI=%v,ERR=%v", ctx.Value("Entity"), imsi, err)
 		return nil, err
@@ -253,7 +801,7 @@ func GetUserByIMSI(ctx context.Context, db *gorm.DB, imsi string) (*User, error)
 
 func GetUserBySipUserName(ctx context.Context, db *gorm.DB, un string) (*UserTable, error) {
 	ret := new(UserTable)
-	err := db.Model(User{}).Where("sip_username=?", un).Find(ret).Error
+	err := db.Where("sip_username=?", un).Find(ret).Error
 	if err != nil {
 		logger.Error("[%v] HSS获取用户信息失败,Sip_User_Name=%v,ERR=%v", ctx.Value("Entity"), un, err)
 		return nil, err
@@ -0,0 +1,449 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/sql/migrations"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/wonderivan/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// HSS用户数据存储，用户签约数据和S-CSCF分配记录的读写接口
+type SubscriberStore interface {
+	GetUserBySipUserName(ctx context.Context, un string) (*UserTable, error)
+	GetUserByIMSI(ctx context.Context, imsi string) (*UserTable, error)
+	CreateUser(ctx context.Context, user *UserTable) error
+	CreateAllocServerRecord(ctx context.Context, alloc *ServerAllocTable) error
+	GetServerAssignment(ctx context.Context, un string) (*ServerAllocTable, error)
+	AssignServer(ctx context.Context, un, addr string) error
+	UnassignServer(ctx context.Context, un string) error
+	AdvanceSQN(ctx context.Context, imsi string, n int, ms *uint64) (uint64, error)
+	GetServiceProfile(ctx context.Context, un string) (*ServiceProfile, error)
+}
+
+// 根据配置创建用户数据存储，mysql和sqlite打开时执行数据库迁移，配置了初始用户数据时写入不存在的用户
+func OpenSubscriberStore(sc config.Store) (SubscriberStore, error) {
+	var users []UserTable
+	if len(sc.Seed) > 0 {
+		var err error
+		users, err = LoadSeedUsers(sc.Seed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch sc.Driver {
+	case "mysql", "sqlite":
+		db, err := OpenDatabase(sc)
+		if err != nil {
+			return nil, err
+		}
+		s := &gormStore{db}
+		if err = s.seed(users); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return NewMemoryStore(users...)
+	}
+	return nil, errors.New("ErrUnknownStoreDriver")
+}
+
+// 打开mysql或sqlite数据库，执行尚未执行的迁移脚本
+func OpenDatabase(sc config.Store) (*gorm.DB, error) {
+	dialects := map[string]string{"mysql": "mysql", "sqlite": "sqlite3"}
+	dialect, ok := dialects[sc.Driver]
+	if !ok {
+		return nil, errors.New("ErrUnknownStoreDriver")
+	}
+	db, err := gorm.Open(dialect, sc.DSN)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrations.Migrate(db.DB(), sc.Driver)
+	for _, m := range applied {
+		logger.Info("HSS数据库迁移完成 %04d_%v", m.Version, m.Name)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// 读取初始用户数据文件，json文件按json解析，其余按yaml解析，格式见sql/users.yml
+func LoadSeedUsers(file string) ([]UserTable, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var seed struct {
+		Users []UserTable `json:"users" yaml:"users"`
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		err = json.Unmarshal(data, &seed)
+	} else {
+		err = yaml.Unmarshal(data, &seed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seed.Users, nil
+}
+
+// 基于gorm的存储，mysql和sqlite共用
+type gormStore struct {
+	db *gorm.DB
+}
+
+func (s *gormStore) GetUserBySipUserName(ctx context.Context, un string) (*UserTable, error) {
+	return GetUserBySipUserName(ctx, s.db, un)
+}
+
+func (s *gormStore) GetUserByIMSI(ctx context.Context, imsi string) (*UserTable, error) {
+	return GetUserByIMSI(ctx, s.db, imsi)
+}
+
+func (s *gormStore) CreateUser(ctx context.Context, user *UserTable) error {
+	if err := validateUserIFC(user); err != nil {
+		return err
+	}
+	fillUserDefault(user)
+	if err := CreateUser(ctx, s.db, user); err != nil {
+		return err
+	}
+	for _, fc := range user.IFC {
+		if err := CreateFilterCriteria(ctx, s.db, user.SipUserName, fc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *gormStore) CreateAllocServerRecord(ctx context.Context, alloc *ServerAllocTable) error {
+	return CreateAllocServerRecord(ctx, s.db, alloc)
+}
+
+// 用户当前的S-CSCF分配记录，server_alloc中最近的一条，没有记录时返回nil
+func (s *gormStore) GetServerAssignment(ctx context.Context, un string) (*ServerAllocTable, error) {
+	return GetAllocServerRecord(ctx, s.db, un)
+}
+
+func (s *gormStore) AssignServer(ctx context.Context, un, addr string) error {
+	alloc, err := GetAllocServerRecord(ctx, s.db, un)
+	if err != nil {
+		return err
+	}
+	if alloc == nil {
+		alloc = new(ServerAllocTable)
+	}
+	alloc.assign(un, addr, time.Now())
+	return SaveAllocServerRecord(ctx, s.db, alloc)
+}
+
+func (s *gormStore) UnassignServer(ctx context.Context, un string) error {
+	alloc, err := GetAllocServerRecord(ctx, s.db, un)
+	if err != nil || alloc == nil || !alloc.Assigned() {
+		return err
+	}
+	now := time.Now()
+	alloc.UnBindT = now
+	alloc.Utime = now
+	return SaveAllocServerRecord(ctx, s.db, alloc)
+}
+
+func (s *gormStore) AdvanceSQN(ctx context.Context, imsi string, n int, ms *uint64) (uint64, error) {
+	return AdvanceSqn(ctx, s.db, imsi, n, ms)
+}
+
+func (s *gormStore) GetServiceProfile(ctx context.Context, un string) (*ServiceProfile, error) {
+	return GetServiceProfile(ctx, s.db, un)
+}
+
+// 写入初始用户数据，已存在的用户不覆盖
+func (s *gormStore) seed(users []UserTable) error {
+	ctx := context.Background()
+	for i := range users {
+		var count int
+		err := s.db.Model(&UserTable{}).Where("sip_username=? OR imsi=?", users[i].SipUserName, users[i].IMSI).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if err = s.CreateUser(ctx, &users[i]); err != nil {
+			return err
+		}
+		logger.Info("HSS写入初始用户 %v", users[i].SipUserName)
+	}
+	return nil
+}
+
+// 内存存储，不依赖数据库，进程退出后数据丢失
+type memoryStore struct {
+	sync.RWMutex
+	users    []*UserTable
+	allocs   []*ServerAllocTable
+	sqns     map[string]uint64
+	sessions map[string]*SessionTable // PGW地址和租约地址 -> 租约
+}
+
+func NewMemoryStore(users ...UserTable) (SubscriberStore, error) {
+	s := &memoryStore{sqns: make(map[string]uint64)}
+	for i := range users {
+		if err := s.CreateUser(context.Background(), &users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *memoryStore) GetUserBySipUserName(ctx context.Context, un string) (*UserTable, error) {
+	return s.find(ctx, func(u *UserTable) bool { return u.SipUserName == un })
+}
+
+func (s *memoryStore) GetUserByIMSI(ctx context.Context, imsi string) (*UserTable, error) {
+	return s.find(ctx, func(u *UserTable) bool { return u.IMSI == imsi })
+}
+
+func (s *memoryStore) find(ctx context.Context, match func(u *UserTable) bool) (*UserTable, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, u := range s.users {
+		if match(u) {
+			ret := *u
+			return &ret, nil
+		}
+	}
+	return nil, errors.New("ErrUserNotExist")
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, user *UserTable) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, u := range s.users {
+		if u.IMSI == user.IMSI || u.SipUserName == user.SipUserName {
+			logger.Error("[%v] HSS创建用户信息失败,USER=%v,ERR=用户已存在", ctx.Value("Entity"), *user)
+			return errors.New("ErrUserExist")
+		}
+	}
+	if err := validateUserIFC(user); err != nil {
+		return err
+	}
+	fillUserDefault(user)
+	user.ID = int64(len(s.users) + 1)
+	u := *user
+	s.users = append(s.users, &u)
+	return nil
+}
+
+func (s *memoryStore) CreateAllocServerRecord(ctx context.Context, alloc *ServerAllocTable) error {
+	s.Lock()
+	defer s.Unlock()
+	alloc.ID = int64(len(s.allocs) + 1)
+	a := *alloc
+	s.allocs = append(s.allocs, &a)
+	return nil
+}
+
+func (s *memoryStore) GetServerAssignment(ctx context.Context, un string) (*ServerAllocTable, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if a := s.lastAlloc(un); a != nil {
+		ret := *a
+		return &ret, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) AssignServer(ctx context.Context, un, addr string) error {
+	s.Lock()
+	defer s.Unlock()
+	a := s.lastAlloc(un)
+	if a == nil {
+		a = new(ServerAllocTable)
+		a.assign(un, addr, time.Now())
+		a.ID = int64(len(s.allocs) + 1)
+		s.allocs = append(s.allocs, a)
+		return nil
+	}
+	a.assign(un, addr, time.Now())
+	return nil
+}
+
+func (s *memoryStore) UnassignServer(ctx context.Context, un string) error {
+	s.Lock()
+	defer s.Unlock()
+	if a := s.lastAlloc(un); a != nil && a.Assigned() {
+		a.UnBindT = time.Now()
+		a.Utime = a.UnBindT
+	}
+	return nil
+}
+
+func (s *memoryStore) lastAlloc(un string) *ServerAllocTable {
+	for i := len(s.allocs) - 1; i >= 0; i-- {
+		if s.allocs[i].SipUserName == un {
+			return s.allocs[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AdvanceSQN(ctx context.Context, imsi string, n int, ms *uint64) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	base := s.sqns[imsi]
+	if ms != nil {
+		base = *ms
+	}
+	sqn := base
+	for i := 0; i < n; i++ {
+		sqn = nextSQN(sqn)
+	}
+	s.sqns[imsi] = sqn
+	return base, nil
+}
+
+func (s *memoryStore) GetServiceProfile(ctx context.Context, un string) (*ServiceProfile, error) {
+	s.RLock()
+	defer s.RUnlock()
+	profile := new(ServiceProfile)
+	for _, u := range s.users {
+		if u.SipUserName == un {
+			profile.IFC = append(profile.IFC, u.IFC...)
+		}
+	}
+	profile.IFC = profile.Sorted()
+	return profile, nil
+}
+
+// 创建用户前检查iFC，任一iFC无效时不创建用户
+func validateUserIFC(user *UserTable) error {
+	for _, fc := range user.IFC {
+		if err := fc.Validate(); err != nil {
+			logger.Error("HSS创建用户信息失败,USER=%v,ERR=iFC无效 %v", user.SipUserName, fc.ApplicationServer.ServerName)
+			return err
+		}
+	}
+	return nil
+}
+
+// 与users表的默认值保持一致
+func fillUserDefault(user *UserTable) {
+	if len(user.Mnc) == 0 {
+		user.Mnc = "01"
+	}
+	if user.Mcc == 0 {
+		user.Mcc = 86
+	}
+	if len(user.Apn) == 0 {
+		user.Apn = "hebeiyidong"
+	}
+	if len(user.SipDNS) == 0 {
+		user.SipDNS = "3gpp.net"
+	}
+	if user.Ctime.IsZero() {
+		user.Ctime = time.Now()
+	}
+	if user.Utime.IsZero() {
+		user.Utime = time.Now()
+	}
+}
+
+// PGW地址租约的持久化，租约保存在session表中，静态地址读取users表的ip字段
+type LeaseStore interface {
+	GetUserByIMSI(ctx context.Context, imsi string) (*UserTable, error)
+	StaticIPs(ctx context.Context) (map[string]string, error)
+	LoadLeases(ctx context.Context, pgw string) ([]SessionTable, error)
+	SaveLease(ctx context.Context, s *SessionTable) error
+	DeleteLease(ctx context.Context, pgw, ip string) error
+}
+
+// 打开PGW使用的存储，与HSS使用同一个数据库，不写入初始用户数据
+// 内存存储只读取初始用户数据中的静态地址，租约不能跨重启保存
+func OpenLeaseStore(sc config.Store) (LeaseStore, error) {
+	if sc.Driver == "memory" {
+		s, err := OpenSubscriberStore(sc)
+		if err != nil {
+			return nil, err
+		}
+		return s.(*memoryStore), nil
+	}
+	db, err := OpenDatabase(sc)
+	if err != nil {
+		return nil, err
+	}
+	return &gormStore{db}, nil
+}
+
+func (s *gormStore) StaticIPs(ctx context.Context) (map[string]string, error) {
+	return GetStaticIPs(ctx, s.db)
+}
+
+func (s *gormStore) LoadLeases(ctx context.Context, pgw string) ([]SessionTable, error) {
+	return GetSessions(ctx, s.db, pgw)
+}
+
+func (s *gormStore) SaveLease(ctx context.Context, sess *SessionTable) error {
+	return SaveSession(ctx, s.db, sess)
+}
+
+func (s *gormStore) DeleteLease(ctx context.Context, pgw, ip string) error {
+	return DeleteSession(ctx, s.db, pgw, ip)
+}
+
+func (s *memoryStore) StaticIPs(ctx context.Context) (map[string]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	ret := make(map[string]string)
+	for _, u := range s.users {
+		if len(u.IP) > 0 {
+			ret[u.IMSI] = u.IP
+		}
+	}
+	return ret, nil
+}
+
+func (s *memoryStore) LoadLeases(ctx context.Context, pgw string) ([]SessionTable, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var ret []SessionTable
+	for _, sess := range s.sessions {
+		if sess.PgwAddr == pgw {
+			ret = append(ret, *sess)
+		}
+	}
+	return ret, nil
+}
+
+func (s *memoryStore) SaveLease(ctx context.Context, sess *SessionTable) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*SessionTable)
+	}
+	v := *sess
+	s.sessions[sess.PgwAddr+" "+sess.IP] = &v
+	return nil
+}
+
+func (s *memoryStore) DeleteLease(ctx context.Context, pgw, ip string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, pgw+" "+ip)
+	return nil
+}
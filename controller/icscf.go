@@ -9,9 +9,6 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"fmt"
-	"strconv"
-	"strings"
 
 	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/modules"
@@ -21,27 +18,38 @@ import (
 )
 
 type RegistCombine struct {
-	Req  *sip.Message
-	XRES string
+	Req       *sip.Message
+	AV        *AuthVector // 本次鉴权使用的向量
+	Algorithm string      // 本次鉴权使用的摘要算法
 }
-type User struct {
-	Domain      string
-	AccessPoint string // 接入基站
-}
-
 type I_CscfEntity struct {
 	*Mux
-	iCache *Cache
+	conf    *config.Network
+	iCache  *Cache
+	server  *sip.Server
+	txLayer *sip.TransactionLayer
 }
 
 // 暂时先试用固定的uri，后期实现dns使用域名加IP的映射方式
-func (i *I_CscfEntity) Init(domain, host string) {
+func (i *I_CscfEntity) Init(conf *config.Network) {
 	i.Mux = new(Mux)
-	sip.ServerDomain = domain
-	sip.ServerIP = strings.Split(host, ":")[0]
-	sip.ServerPort, _ = strconv.Atoi(strings.Split(host, ":")[1])
+	i.conf = conf
+	server, err := sip.NewServer(conf.Host("i-cscf"), conf.Elements["ICSCF"].ActualAddr)
+	if err != nil {
+		logger.Fatal("监听地址格式错误 %v", err)
+	}
+	i.server = server
 	i.router = make(map[[2]byte]BaseSignallingT)
 	i.iCache = initCache()
+	i.txLayer = sip.NewTransactionLayer()
+}
+
+// 注册消息路由
+func (i *I_CscfEntity) RegistRouter() {
+	i.Regist([2]byte{modules.EPCPROTOCAL, modules.UserAuthorizationAnswer}, i.UserAuthorizationAnswerF)
+	i.Regist([2]byte{modules.EPCPROTOCAL, modules.LocationInfoAnswer}, i.LocationInfoAnswerF)
+	i.Regist([2]byte{modules.SIPPROTOCAL, modules.SipRequest}, i.SIPREQUESTF)
+	i.Regist([2]byte{modules.SIPPROTOCAL, modules.SipResponse}, i.SIPRESPONSEF)
 }
 
 func (i *I_CscfEntity) CoreProcessor(ctx context.Context, in, up, down chan *modules.Package) {
@@ -73,30 +81,63 @@ func (i *I_CscfEntity) SIPREQUESTF(ctx context.Context, pkg *modules.Package, up
 	if err != nil {
 		return err
 	}
-	// 增加Via头部信息
+	logger.Info("[%v][%v] Receive SIP Request: \n%v", ctx.Value("Entity"), i.server.Domain, string(pkg.GetData()))
 	sipreq.Header.MaxForwards.Reduce()
-	sipreq.Header.Via.SetReceivedInfo("UDP", fmt.Sprintf("%s:%d", sip.ServerIP, sip.ServerPort))
-	sipreq.Header.Via.AddServerInfo()
+	sipreq.Header.Via.SetReceivedInfo(pkg.GetTransport(), pkg.GetRemoteAddr())
+	send, err := responseSender(&sipreq, nil, up, down)
+	if err != nil {
+		return err
+	}
+	sipreq.PreprocessRoute(i.server)
 	switch sipreq.RequestLine.Method {
 	case sip.MethodRegister:
-		logger.Info("[%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+		if _, isNew := i.txLayer.ServerRequest(&sipreq, send); !isNew {
+			return nil
+		}
 		//根据Request-URI获取对应域，向HSS询问对应域的cscf的IP地址
 		user := sipreq.Header.From.Username()
-		// 先缓存请求
+		// 先缓存请求，收到HSS响应后再增加Via头部信息进行转发
 		i.iCache.setUserRegistReq(UARegPrefix+user, &sipreq)
 		// 向HSS发起UAR，查询信息
 		table := map[string]string{
 			"UserName": user,
 		}
-		pkg.SetShortConn(config.Elements["HSS"].ActualAddr)
+		pkg.SetShortConn(i.conf.Elements["HSS"].ActualAddr)
 		pkg.Construct(modules.EPCPROTOCAL, modules.UserAuthorizationRequest, modules.StrLineMarshal(table))
 		modules.Send(pkg, up)
-	case sip.MethodInvite, sip.MethodPrack, sip.MethodUpdate:
+	case sip.MethodAck:
+		if absorbAck(i.txLayer, &sipreq) {
+			return nil
+		}
+		next, err := i.nextHop(&sipreq)
+		if err != nil {
+			return err
+		}
+		sipreq.Header.Via.AddServerInfo(i.server)
+		next.sender(up, down)(&sipreq)
+	case sip.MethodCancel:
+		return cancelRequest(i.txLayer, &sipreq, send)
+	case sip.MethodInvite, sip.MethodPrack, sip.MethodUpdate, sip.MethodBye:
 		// 收到来自其他域的请求
-		logger.Info("[%v][%v] Receive From Other Domain: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["SCSCF"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipreq.String())
-		modules.Send(pkg, down)
+		stx, isNew := i.txLayer.ServerRequest(&sipreq, send)
+		if !isNew {
+			return nil
+		}
+		if sipreq.RequestLine.Method == sip.MethodInvite {
+			stx.Respond(sip.NewResponse(sip.StatusTrying, &sipreq))
+		}
+		// 没有预加载路由的初始请求，向HSS查询为被叫服务的S-CSCF
+		if _, e := sipreq.Header.To.Arguments.Get("tag"); e != nil && sipreq.Header.Route.Len() == 0 {
+			return i.locationInfo(&sipreq, up)
+		}
+		next, err := i.nextHop(&sipreq)
+		if err != nil {
+			stx.Respond(sip.NewResponse(sip.StatusNotFound, &sipreq))
+			return err
+		}
+		// 增加Via头部信息
+		sipreq.Header.Via.AddServerInfo(i.server)
+		i.txLayer.Forward(stx, &sipreq, next.sender(up, down))
 	}
 	return nil
 }
@@ -110,25 +151,26 @@ func (i *I_CscfEntity) SIPRESPONSEF(ctx context.Context, pkg *modules.Package, u
 		// TODO 错误处理
 		return err
 	}
+	logger.Info("[%v][%v] Receive SIP Response: \n%v", ctx.Value("Entity"), i.server.Domain, string(pkg.GetData()))
+	// 匹配客户端事务，重传的应答由事务层吸收
+	if _, pass := i.txLayer.ClientResponse(&sipresp); !pass {
+		return nil
+	}
 	// 删除第一个Via头部信息
-	sipresp.Header.Via.RemoveFirst()
+	sipresp.Header.Via.RemoveFirst(i.server)
 	sipresp.Header.MaxForwards.Reduce()
-	via, _ := sipresp.Header.Via.FirstAddrInfo()
-	// 判断下一跳是否是s-cscf
-	if strings.Contains(via, "s-cscf") {
-		// 跨域
-		logger.Info("[%v][%v] Receive From SCSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["OTHER-SCSCF"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-		modules.Send(pkg, down)
+	if isTrying(&sipresp) {
 		return nil
 	}
-	logger.Info("[%v][%v] Receive From SCSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-	pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-	pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-	modules.Send(pkg, down)
+	return forwardResponse(i.txLayer, &sipresp, nil, up, down)
+}
 
-	return nil
+// 请求的下一跳，I-CSCF作为域的入口，没有预加载路由的请求交给本域的S-CSCF
+func (i *I_CscfEntity) nextHop(req *sip.Message) (NextHop, error) {
+	if req.Header.Route.Len() > 0 {
+		return resolveHop(req.NextHopHost(), nil)
+	}
+	return NextHop{Host: i.conf.Elements["SCSCF"].ActualAddr, Up: true}, nil
 }
 
 func (i *I_CscfEntity) UserAuthorizationAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
@@ -136,16 +178,74 @@ func (i *I_CscfEntity) UserAuthorizationAnswerF(ctx context.Context, pkg *module
 
 	logger.Info("[%v] Receive From HSS: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
 	resp := modules.StrLineUnmarshal(pkg.GetData())
-	scscf := resp["S-CSCF"]
+	scscf := resp[CX_SERVER]
 	user := resp["UserName"]
 	sipreq, ok := i.iCache.getUserRegistReq(UARegPrefix + user)
 	if !ok {
 		logger.Info("[%v] %s's REGISTER Message Not Found or Expired.", ctx.Value("Entity"), user)
 		return errors.New("RequestNotFound")
 	}
-	// 转发给S-CSCF
-	pkg.SetShortConn(scscf)
-	pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
+	stx := i.txLayer.MatchServer(sipreq)
+	if stx == nil {
+		return errors.New("ErrTransactionNotFound")
+	}
+	// 用户不存在时拒绝注册(3GPP TS 24.229 5.3.1.2)，HSS处理失败时返回服务器错误
+	if !isCxSuccess(resp[CX_RESULT]) || len(scscf) == 0 {
+		status := sip.StatusForbidden
+		if resp[CX_RESULT] == ResultUnableToComply {
+			status = sip.StatusServerInternalError
+		}
+		stx.Respond(sip.NewResponse(status, sipreq))
+		return nil
+	}
+	// 增加Via头部信息后转发给S-CSCF
+	sipreq.Header.Via.AddServerInfo(i.server)
+	i.txLayer.Forward(stx, sipreq, NextHop{Host: scscf, Up: true}.sender(up, down))
+	return nil
+}
+
+// 缓存初始请求并向HSS发起LIR，LIA中的会话标识用于找回请求
+func (i *I_CscfEntity) locationInfo(sipreq *sip.Message, up chan *modules.Package) error {
+	session := sip.NewTag()
+	i.iCache.setUserRegistReq(LIRPrefix+session, sipreq)
+	table := map[string]string{
+		"UserName": sipreq.RequestLine.RequestURI.Username,
+		CX_SESSION: session,
+	}
+	pkg := new(modules.Package)
+	pkg.SetShortConn(i.conf.Elements["HSS"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.LocationInfoRequest, modules.StrLineMarshal(table))
 	modules.Send(pkg, up)
 	return nil
 }
+
+// 按LIA中的S-CSCF转发初始请求，被叫不存在时返回404
+func (i *I_CscfEntity) LocationInfoAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From HSS: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	resp := modules.StrLineUnmarshal(pkg.GetData())
+	key := LIRPrefix + resp[CX_SESSION]
+	sipreq, ok := i.iCache.getUserRegistReq(key)
+	if !ok {
+		return errors.New("RequestNotFound")
+	}
+	i.iCache.Delete(key)
+	stx := i.txLayer.MatchServer(sipreq)
+	if stx == nil {
+		return errors.New("ErrTransactionNotFound")
+	}
+	scscf := resp[CX_SERVER]
+	// 被叫不存在时返回404，HSS处理失败时返回480(3GPP TS 24.229 5.3.2.1)
+	if !isCxSuccess(resp[CX_RESULT]) || len(scscf) == 0 {
+		status := sip.StatusNotFound
+		if resp[CX_RESULT] == ResultUnableToComply {
+			status = sip.StatusNoResponse
+		}
+		stx.Respond(sip.NewResponse(status, sipreq))
+		return nil
+	}
+	sipreq.Header.Via.AddServerInfo(i.server)
+	i.txLayer.Forward(stx, sipreq, NextHop{Host: scscf, Up: true}.sender(up, down))
+	return nil
+}
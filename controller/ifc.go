@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/VegetableManII/volte/sip"
+)
+
+// 触发点中的会话类型(3GPP TS 29.228 附录B.2.2)
+const (
+	SessionCaseOriginating             = 0 // 主叫侧
+	SessionCaseTerminatingRegistered   = 1 // 被叫侧，被叫已注册
+	SessionCaseTerminatingUnregistered = 2 // 被叫侧，被叫未注册
+	SessionCaseOriginatingUnregistered = 3 // 主叫侧，代替未注册用户发起
+)
+
+// 应用服务器无法访问时的默认处理(3GPP TS 29.228 附录B.2.3)
+const (
+	DefaultHandlingContinued  = 0 // 跳过该AS继续评估后续的iFC
+	DefaultHandlingTerminated = 1 // 终止会话，第三方注册失败时注销用户
+)
+
+// ODI路由的用户名前缀，请求经AS返回时据此继续评估iFC
+const ODIUserPrefix = "odi-"
+
+var ErrInvalidFilterCriteria = errors.New("ErrInvalidFilterCriteria")
+
+// 用户的业务签约数据，HSS随MAA下发给S-CSCF(3GPP TS 29.228 附录E)
+type ServiceProfile struct {
+	XMLName xml.Name         `xml:"ServiceProfile"`
+	IFC     []FilterCriteria `xml:"InitialFilterCriteria"`
+}
+
+// 初始过滤准则(iFC)，请求满足触发点时经应用服务器处理
+type FilterCriteria struct {
+	XMLName           xml.Name          `xml:"InitialFilterCriteria" json:"-" yaml:"-"`
+	Priority          int               `xml:"Priority" json:"priority" yaml:"priority"` // 数值小的优先评估
+	TriggerPoint      *TriggerPoint     `xml:"TriggerPoint,omitempty" json:"trigger_point" yaml:"trigger_point"`
+	ApplicationServer ApplicationServer `xml:"ApplicationServer" json:"application_server" yaml:"application_server"`
+}
+
+// 触发点，由按组划分的业务点触发条件(SPT)组成
+// CNF为各组之间与、组内或，DNF为各组之间或、组内与
+type TriggerPoint struct {
+	ConditionTypeCNF bool  `xml:"ConditionTypeCNF" json:"condition_type_cnf" yaml:"condition_type_cnf"`
+	SPT              []SPT `xml:"SPT" json:"spt" yaml:"spt"`
+}
+
+// 业务点触发条件，每个条件只使用一种匹配方式
+type SPT struct {
+	ConditionNegated bool       `xml:"ConditionNegated" json:"condition_negated" yaml:"condition_negated"`
+	Group            []int      `xml:"Group" json:"group" yaml:"group"`
+	Method           string     `xml:"Method,omitempty" json:"method,omitempty" yaml:"method,omitempty"`
+	RequestURI       string     `xml:"RequestURI,omitempty" json:"request_uri,omitempty" yaml:"request_uri,omitempty"` // 正则表达式
+	SIPHeader        *SIPHeader `xml:"SIPHeader,omitempty" json:"sip_header,omitempty" yaml:"sip_header,omitempty"`
+	SessionCase      *int       `xml:"SessionCase,omitempty" json:"session_case,omitempty" yaml:"session_case,omitempty"`
+}
+
+// 头域匹配条件，Content为空时只要求头域存在
+type SIPHeader struct {
+	Header  string `xml:"Header" json:"header" yaml:"header"`
+	Content string `xml:"Content,omitempty" json:"content,omitempty" yaml:"content,omitempty"` // 正则表达式
+}
+
+// 应用服务器，ServerName为SIP地址，如sip:mmtel.hebeiyidong.3gpp.net
+type ApplicationServer struct {
+	ServerName      string `xml:"ServerName" json:"server_name" yaml:"server_name"`
+	DefaultHandling int    `xml:"DefaultHandling" json:"default_handling" yaml:"default_handling"`
+	ServiceInfo     string `xml:"ServiceInfo,omitempty" json:"service_info,omitempty" yaml:"service_info,omitempty"`
+}
+
+// 初始请求的iFC评估进度，请求经AS返回时通过ODI路由找回并继续评估(3GPP TS 24.229 5.4.3.2)
+type IfcState struct {
+	User        string // 服务用户，主叫侧为主叫，被叫侧为被叫
+	SessionCase int
+	Next        int  // 下一个待评估的iFC在按优先级排序后的序号
+	Call        Call // 已确定的主被叫接入信息
+}
+
+// 是否是主叫侧的评估
+func (st IfcState) IsOriginating() bool {
+	return st.SessionCase == SessionCaseOriginating || st.SessionCase == SessionCaseOriginatingUnregistered
+}
+
+// 检查iFC的格式，应用服务器地址必须有效，正则表达式必须能够编译
+func (fc FilterCriteria) Validate() error {
+	if _, err := sip.NewURI(fc.ApplicationServer.ServerName); err != nil || len(fc.ApplicationServer.ServerName) == 0 {
+		return ErrInvalidFilterCriteria
+	}
+	if fc.TriggerPoint == nil {
+		return nil
+	}
+	for _, spt := range fc.TriggerPoint.SPT {
+		if len(spt.RequestURI) > 0 {
+			if _, err := regexp.Compile(spt.RequestURI); err != nil {
+				return ErrInvalidFilterCriteria
+			}
+		}
+		if spt.SIPHeader != nil {
+			if _, err := regexp.Compile(spt.SIPHeader.Content); err != nil || len(spt.SIPHeader.Header) == 0 {
+				return ErrInvalidFilterCriteria
+			}
+		}
+	}
+	return nil
+}
+
+// 从序号from开始按优先级查找第一个匹配请求的iFC，返回该iFC和下一个待评估的序号
+func (p *ServiceProfile) Match(req *sip.Message, sessionCase int, from int) (*FilterCriteria, int) {
+	if p == nil {
+		return nil, from
+	}
+	ifc := p.Sorted()
+	for i := from; i < len(ifc); i++ {
+		if ifc[i].TriggerPoint.Match(req, sessionCase) {
+			return &ifc[i], i + 1
+		}
+	}
+	return nil, len(ifc)
+}
+
+// 按优先级排序后的iFC
+func (p *ServiceProfile) Sorted() []FilterCriteria {
+	ifc := append([]FilterCriteria{}, p.IFC...)
+	sort.SliceStable(ifc, func(i, j int) bool { return ifc[i].Priority < ifc[j].Priority })
+	return ifc
+}
+
+// MAA中携带的业务签约数据，XML的base64编码，不带填充以免与消息的分隔符冲突
+func (p ServiceProfile) Encode() (string, error) {
+	data, err := xml.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+func DecodeServiceProfile(str string) (*ServiceProfile, error) {
+	data, err := base64.RawStdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	p := new(ServiceProfile)
+	if err = xml.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// 请求是否满足触发点，没有触发点时无条件匹配
+func (tp *TriggerPoint) Match(req *sip.Message, sessionCase int) bool {
+	if tp == nil || len(tp.SPT) == 0 {
+		return true
+	}
+	var order []int
+	groups := make(map[int][]bool)
+	for _, spt := range tp.SPT {
+		matched := spt.Match(req, sessionCase)
+		ids := spt.Group
+		if len(ids) == 0 {
+			ids = []int{0}
+		}
+		for _, id := range ids {
+			if _, ok := groups[id]; !ok {
+				order = append(order, id)
+			}
+			groups[id] = append(groups[id], matched)
+		}
+	}
+	for _, id := range order {
+		if tp.ConditionTypeCNF {
+			// 组内为或，有一组不满足即不匹配
+			if !containsBool(groups[id], true) {
+				return false
+			}
+		} else if !containsBool(groups[id], false) {
+			// 组内为与，有一组满足即匹配
+			return true
+		}
+	}
+	return tp.ConditionTypeCNF
+}
+
+func containsBool(results []bool, v bool) bool {
+	for _, r := range results {
+		if r == v {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求是否满足单个条件
+func (spt SPT) Match(req *sip.Message, sessionCase int) bool {
+	var matched bool
+	switch {
+	case len(spt.Method) > 0:
+		matched = strings.EqualFold(req.RequestLine.Method, spt.Method)
+	case len(spt.RequestURI) > 0:
+		matched = matchRegexp(spt.RequestURI, req.RequestLine.RequestURI.String())
+	case spt.SIPHeader != nil:
+		values := req.Header.Values(spt.SIPHeader.Header)
+		matched = len(values) > 0 && len(spt.SIPHeader.Content) == 0
+		for _, v := range values {
+			if len(spt.SIPHeader.Content) > 0 && matchRegexp(spt.SIPHeader.Content, v) {
+				matched = true
+				break
+			}
+		}
+	case spt.SessionCase != nil:
+		matched = *spt.SessionCase == sessionCase
+	}
+	return matched != spt.ConditionNegated
+}
+
+func matchRegexp(expr, str string) bool {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(str)
+}
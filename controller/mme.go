@@ -0,0 +1,365 @@
+/*
+MME的主要功能：
+1、UE附着时经HSS完成EPS-AKA鉴权(3GPP TS 33.401 6.1)，向HSS登记位置后请求PGW建立会话
+2、UE去附着或PGW发起去附着时释放UE的上下文
+*/
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/modules"
+
+	"github.com/wonderivan/logger"
+)
+
+var ErrEmmContextNotExist = errors.New("ErrEmmContextNotExist")
+
+// UE的移动性管理状态，附着流程中的消息只在对应的状态下处理
+const (
+	EmmWaitAuthVector   = iota // 等待HSS返回鉴权向量
+	EmmWaitAuthResponse        // 等待UE的鉴权响应
+	EmmWaitLocation            // 等待HSS的位置更新应答
+	EmmWaitSession             // 等待PGW建立会话
+	EmmRegistered              // 已附着
+)
+
+// MME保存的UE上下文，附着完成前超时删除
+type EmmContext struct {
+	IMSI    string
+	EnbID   string
+	State   int
+	AV      AuthVector // 当前使用的鉴权向量，只保存RAND、AUTN和XRES
+	APN     string
+	Resync  bool         // 已经重新同步过SQN，再次同步失败时拒绝附着
+	enb     *net.UDPConn // 接收附着请求的连接，发往UE的消息经该连接发给基站
+	enbAddr *net.UDPAddr
+}
+
+type MmeEntity struct {
+	*Mux
+	conf   *config.Network
+	mCache *Cache
+}
+
+func (m *MmeEntity) Init(conf *config.Network) {
+	// 初始化路由
+	m.Mux = new(Mux)
+	m.conf = conf
+	m.router = make(map[[2]byte]BaseSignallingT)
+	m.mCache = initCache()
+}
+
+// 注册消息路由
+func (m *MmeEntity) RegistRouter() {
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.AttachRequest}, m.AttachRequestF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.AuthenticationInformationAnswer}, m.AuthenticationInformationAnswerF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.AuthenticationResponse}, m.AuthenticationResponseF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.UpdateLocationAnswer}, m.UpdateLocationAnswerF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.CreateSessionResponse}, m.CreateSessionResponseF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.DetachRequest}, m.DetachRequestF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.DetachAccept}, m.DetachAcceptF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.DeleteSessionResponse}, m.DeleteSessionResponseF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.DeleteBearerRequest}, m.DeleteBearerRequestF)
+	m.Regist([2]byte{modules.EPCPROTOCAL, modules.CreateBearerRequest}, m.CreateBearerRequestF)
+}
+
+func (m *MmeEntity) CoreProcessor(ctx context.Context, in, up, down chan *modules.Package) {
+	for {
+		select {
+		case pkg := <-in:
+			f, ok := m.router[pkg.GetRoute()]
+			if !ok {
+				logger.Error("[%v] MME不支持的消息类型数据 %x", ctx.Value("Entity"), pkg.GetRoute())
+				continue
+			}
+			err := f(ctx, pkg, up, down)
+			if err != nil {
+				logger.Error("[%v] MME消息处理失败 %x %v %v", ctx.Value("Entity"), pkg.GetRoute(), string(pkg.GetData()), err)
+			}
+		case <-ctx.Done():
+			// 释放资源
+			logger.Warn("[%v] MME逻辑核心退出", ctx.Value("Entity"))
+			return
+		}
+	}
+}
+
+// 附着请求，建立UE上下文后向HSS请求鉴权向量
+func (m *MmeEntity) AttachRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := &EmmContext{
+		IMSI:    args[EPC_UE_IDENTITY],
+		EnbID:   args[EPC_CELL_ID],
+		State:   EmmWaitAuthVector,
+		enb:     pkg.GetLongConn(),
+		enbAddr: pkg.GetLongConnAddr(),
+	}
+	if len(ec.IMSI) == 0 {
+		m.reject(ctx, ec, EmmUEIdentityNotDerived, down)
+		return ErrUEIdentityNotExist
+	}
+	m.mCache.setEmmContext(EmmPrefix+ec.IMSI, ec, false)
+	m.authenticationInformation(ec, nil, up)
+	return nil
+}
+
+// 向HSS请求鉴权向量(AIR)，resync携带重新同步使用的RAND和AUTS
+func (m *MmeEntity) authenticationInformation(ec *EmmContext, resync map[string]string, up chan *modules.Package) {
+	request := map[string]string{EPC_UE_IDENTITY: ec.IMSI}
+	for k, v := range resync {
+		request[k] = v
+	}
+	pkg := new(modules.Package)
+	pkg.SetShortConn(m.conf.Elements["HSS"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.AuthenticationInformationRequest, modules.StrLineMarshal(request))
+	modules.Send(pkg, up)
+}
+
+// HSS返回鉴权向量(AIA)，向UE发起鉴权
+func (m *MmeEntity) AuthenticationInformationAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From HSS: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := m.context(args, EmmWaitAuthVector)
+	if ec == nil {
+		return ErrEmmContextNotExist
+	}
+	if !isCxSuccess(args[CX_RESULT]) {
+		cause := EmmNetworkFailure
+		if args[CX_RESULT] == ResultErrorUserUnknown {
+			cause = EmmEPSNotAllowed
+		}
+		m.reject(ctx, ec, cause, down)
+		return nil
+	}
+	ec.AV = AuthVector{RAND: args[AV_RAND], AUTN: args[AV_AUTN], XRES: args[AV_XRES]}
+	ec.State = EmmWaitAuthResponse
+	request := map[string]string{
+		EPC_UE_IDENTITY: ec.IMSI,
+		AV_RAND:         ec.AV.RAND,
+		AV_AUTN:         ec.AV.AUTN,
+	}
+	m.toUE(ec, modules.AuthenticationRequest, request, down)
+	return nil
+}
+
+// UE的鉴权响应，RES与XRES一致时向HSS登记位置
+// UE校验AUTN时发现SQN不同步则返回AUTS，携带AUTS重新请求鉴权向量(3GPP TS 33.102 6.3.5)
+func (m *MmeEntity) AuthenticationResponseF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := m.context(args, EmmWaitAuthResponse)
+	if ec == nil {
+		return ErrEmmContextNotExist
+	}
+	if auts := args[AV_AUTS]; len(auts) > 0 {
+		if ec.Resync {
+			m.reject(ctx, ec, EmmIllegalUE, down)
+			return nil
+		}
+		ec.Resync = true
+		ec.State = EmmWaitAuthVector
+		m.authenticationInformation(ec, map[string]string{AV_RAND: ec.AV.RAND, AV_AUTS: auts}, up)
+		return nil
+	}
+	if !equalRES(args[EPC_RES], ec.AV.XRES) {
+		logger.Warn("[%v] MME鉴权失败 IMSI=%v", ctx.Value("Entity"), ec.IMSI)
+		m.reject(ctx, ec, EmmIllegalUE, down)
+		return nil
+	}
+	ec.State = EmmWaitLocation
+	request := map[string]string{
+		EPC_UE_IDENTITY: ec.IMSI,
+		CX_SERVER:       m.conf.Host("mme"),
+	}
+	pkg = new(modules.Package)
+	pkg.SetShortConn(m.conf.Elements["HSS"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.UpdateLocationRequest, modules.StrLineMarshal(request))
+	modules.Send(pkg, up)
+	return nil
+}
+
+// HSS返回签约数据(ULA)，请求PGW建立会话
+func (m *MmeEntity) UpdateLocationAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From HSS: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := m.context(args, EmmWaitLocation)
+	if ec == nil {
+		return ErrEmmContextNotExist
+	}
+	if !isCxSuccess(args[CX_RESULT]) {
+		m.reject(ctx, ec, EmmEPSNotAllowed, down)
+		return nil
+	}
+	ec.APN = args[EPC_APN]
+	ec.State = EmmWaitSession
+	request := map[string]string{
+		EPC_UE_IDENTITY: ec.IMSI,
+		EPC_CELL_ID:     ec.EnbID,
+		EPC_APN:         ec.APN,
+	}
+	pkg = new(modules.Package)
+	pkg.SetShortConn(m.conf.Elements["PGW"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.CreateSessionRequest, modules.StrLineMarshal(request))
+	modules.Send(pkg, up)
+	return nil
+}
+
+// PGW建立会话的应答，成功时通知UE附着成功，应答中的地址原样下发
+func (m *MmeEntity) CreateSessionResponseF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := m.context(args, EmmWaitSession)
+	if ec == nil {
+		return ErrEmmContextNotExist
+	}
+	if args[EPC_CAUSE] != GtpRequestAccepted {
+		m.reject(ctx, ec, EmmESMFailure, down)
+		return nil
+	}
+	ec.State = EmmRegistered
+	m.mCache.setEmmContext(EmmPrefix+ec.IMSI, ec, true)
+	logger.Info("[%v] MME附着成功 IMSI=%v 基站=%v", ctx.Value("Entity"), ec.IMSI, ec.EnbID)
+	delete(args, EPC_CAUSE)
+	args[EPC_CELL_ID] = ec.EnbID
+	m.toUE(ec, modules.AttachAccept, args, down)
+	return nil
+}
+
+// UE发起的去附着，删除UE上下文并请求PGW删除会话，UE关机时不应答(3GPP TS 24.301 5.5.2.2)
+func (m *MmeEntity) DetachRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	imsi := args[EPC_UE_IDENTITY]
+	if len(imsi) == 0 {
+		return ErrUEIdentityNotExist
+	}
+	if ec := m.mCache.getEmmContext(EmmPrefix + imsi); ec != nil {
+		m.mCache.Delete(EmmPrefix + imsi)
+		if ec.State >= EmmWaitSession {
+			request := map[string]string{EPC_UE_IDENTITY: imsi}
+			req := new(modules.Package)
+			req.SetShortConn(m.conf.Elements["PGW"].ActualAddr)
+			req.Construct(modules.EPCPROTOCAL, modules.DeleteSessionRequest, modules.StrLineMarshal(request))
+			modules.Send(req, up)
+		}
+	}
+	if args[EPC_DETACH_TYPE] == DetachSwitchOff {
+		return nil
+	}
+	response := map[string]string{
+		EPC_UE_IDENTITY: imsi,
+		EPC_CELL_ID:     args[EPC_CELL_ID],
+	}
+	pkg.Construct(modules.EPCPROTOCAL, modules.DetachAccept, modules.StrLineMarshal(response))
+	modules.Send(pkg, down)
+	return nil
+}
+
+// UE对网络侧去附着的应答，UE上下文在发起去附着时已经删除
+func (m *MmeEntity) DetachAcceptF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	return nil
+}
+
+// PGW删除会话的应答
+func (m *MmeEntity) DeleteSessionResponseF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	return nil
+}
+
+// PGW为IMS会话建立专用承载，转发给已附着的UE
+func (m *MmeEntity) CreateBearerRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := m.context(args, EmmRegistered)
+	if ec == nil {
+		return ErrEmmContextNotExist
+	}
+	args[EPC_CELL_ID] = ec.EnbID
+	m.toUE(ec, modules.CreateBearerRequest, args, down)
+	return nil
+}
+
+// PGW删除承载，删除专用承载时转发给UE，删除默认承载时PGW已经释放会话，由MME发起去附着并删除UE上下文
+func (m *MmeEntity) DeleteBearerRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	ec := m.mCache.getEmmContext(EmmPrefix + args[EPC_UE_IDENTITY])
+	if ec == nil {
+		return nil
+	}
+	if ebi := args[EPC_BEARER_ID]; len(ebi) > 0 && ebi != strconv.Itoa(DefaultBearerID) {
+		args[EPC_CELL_ID] = ec.EnbID
+		m.toUE(ec, modules.DeleteBearerRequest, args, down)
+		return nil
+	}
+	m.mCache.Delete(EmmPrefix + ec.IMSI)
+	request := map[string]string{
+		EPC_UE_IDENTITY: ec.IMSI,
+		EPC_CELL_ID:     ec.EnbID,
+		EPC_DETACH_TYPE: args[EPC_DETACH_TYPE],
+	}
+	m.toUE(ec, modules.DetachRequest, request, down)
+	return nil
+}
+
+// 处于state状态的UE上下文，不存在或状态不一致时返回nil
+func (m *MmeEntity) context(args map[string]string, state int) *EmmContext {
+	ec := m.mCache.getEmmContext(EmmPrefix + args[EPC_UE_IDENTITY])
+	if ec == nil || ec.State != state {
+		return nil
+	}
+	return ec
+}
+
+// 拒绝附着，删除UE上下文
+func (m *MmeEntity) reject(ctx context.Context, ec *EmmContext, cause string, down chan *modules.Package) {
+	logger.Warn("[%v] MME拒绝附着 IMSI=%v 原因=%v", ctx.Value("Entity"), ec.IMSI, cause)
+	m.mCache.Delete(EmmPrefix + ec.IMSI)
+	response := map[string]string{
+		EPC_UE_IDENTITY: ec.IMSI,
+		EPC_CELL_ID:     ec.EnbID,
+		EPC_CAUSE:       cause,
+	}
+	m.toUE(ec, modules.AttachReject, response, down)
+}
+
+// 经UE附着的基站向UE发送消息
+func (m *MmeEntity) toUE(ec *EmmContext, method byte, args map[string]string, down chan *modules.Package) {
+	pkg := new(modules.Package)
+	pkg.SetLongConn(ec.enb)
+	pkg.SetLongAddr(ec.enbAddr)
+	pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(args))
+	modules.Send(pkg, down)
+}
+
+// 比较UE的RES与鉴权向量中的XRES
+func equalRES(res, xres string) bool {
+	a, err := hex.DecodeString(res)
+	if err != nil || len(a) == 0 {
+		return false
+	}
+	b, err := hex.DecodeString(xres)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,288 @@
+/*
+PCRF的主要功能：
+1、经Rx接收P-CSCF上报的IMS会话媒体信息，按媒体类型推导QoS规则(3GPP TS 29.213 6.3)
+2、经Gx向PGW安装或删除PCC规则，PGW按规则建立或删除专用承载
+*/
+package controller
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/modules"
+	"github.com/VegetableManII/volte/sip"
+
+	"github.com/wonderivan/logger"
+)
+
+// 媒体未携带带宽时使用的保证比特率，单位kbps
+var (
+	DefaultVoiceBitrate = 64
+	DefaultVideoBitrate = 384
+)
+
+// Rx上报的媒体信息(3GPP TS 29.214 5.3.7)
+type MediaComponent struct {
+	Number    int    // 媒体在SDP中的序号，从1开始
+	Type      string // SDP的媒体类型
+	Bandwidth int    // 单位kbps，未携带时为0
+}
+
+// PCC规则，每个规则对应一个专用承载
+type QosRule struct {
+	Name string // 会话的Call-ID加媒体序号
+	QCI  int
+	GBR  int // 单位kbps
+}
+
+// IMS会话的Rx会话，按用户记录已经安装的规则，同一域内的呼叫双方共用一个会话
+type RxSession struct {
+	CallID string
+	Rules  map[string][]QosRule // IMS用户名 -> 规则
+}
+
+type PcrfEntity struct {
+	*Mux
+	conf   *config.Network
+	pCache *Cache
+}
+
+func (p *PcrfEntity) Init(conf *config.Network) {
+	// 初始化路由
+	p.Mux = new(Mux)
+	p.conf = conf
+	p.router = make(map[[2]byte]BaseSignallingT)
+	p.pCache = initCache()
+}
+
+// 注册消息路由
+func (p *PcrfEntity) RegistRouter() {
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.AARequest}, p.AARequestF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.SessionTerminationRequest}, p.SessionTerminationRequestF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.ReAuthAnswer}, p.ReAuthAnswerF)
+}
+
+func (p *PcrfEntity) CoreProcessor(ctx context.Context, in, up, down chan *modules.Package) {
+	for {
+		select {
+		case pkg := <-in:
+			f, ok := p.router[pkg.GetRoute()]
+			if !ok {
+				logger.Error("[%v] PCRF不支持的消息类型数据 %x", ctx.Value("Entity"), pkg.GetRoute())
+				continue
+			}
+			err := f(ctx, pkg, up, down)
+			if err != nil {
+				logger.Error("[%v] PCRF消息处理失败 %x %v %v", ctx.Value("Entity"), pkg.GetRoute(), string(pkg.GetData()), err)
+			}
+		case <-ctx.Done():
+			// 释放资源
+			logger.Warn("[%v] PCRF逻辑核心退出", ctx.Value("Entity"))
+			return
+		}
+	}
+}
+
+// P-CSCF上报会话的媒体信息(Rx AAR)，推导用户的规则后与已安装的规则比较，向PGW安装新增的规则，删除不再使用的规则
+func (p *PcrfEntity) AARequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	callID, user := args[EPC_CALL_ID], args[EPC_USER_NAME]
+	response := map[string]string{
+		EPC_CALL_ID:   callID,
+		EPC_USER_NAME: user,
+		CX_RESULT:     ResultSuccess,
+	}
+	if len(callID) == 0 || len(user) == 0 {
+		response[CX_RESULT] = ResultUnableToComply
+		p.answer(modules.AAAnswer, response, up)
+		return ErrCallIDNotExist
+	}
+	sess := p.pCache.getRxSession(RxSessionPrefix + callID)
+	if sess == nil {
+		sess = &RxSession{CallID: callID, Rules: make(map[string][]QosRule)}
+		p.pCache.setRxSession(RxSessionPrefix+callID, sess)
+	}
+	rules := qosRules(callID, unmarshalMediaComponents(args))
+	install, remove := diffRules(sess.Rules[user], rules)
+	sess.Rules[user] = rules
+	if len(install) > 0 || len(remove) > 0 {
+		p.reAuth(ctx, user, callID, install, remove, up)
+	}
+	p.answer(modules.AAAnswer, response, up)
+	return nil
+}
+
+// IMS会话结束(Rx STR)，删除会话中各个用户的规则
+func (p *PcrfEntity) SessionTerminationRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	callID := modules.StrLineUnmarshal(pkg.GetData())[EPC_CALL_ID]
+	response := map[string]string{
+		EPC_CALL_ID: callID,
+		CX_RESULT:   ResultSuccess,
+	}
+	sess := p.pCache.getRxSession(RxSessionPrefix + callID)
+	if sess == nil {
+		response[CX_RESULT] = ResultUnknownSessionID
+		p.answer(modules.SessionTerminationAnswer, response, up)
+		return nil
+	}
+	p.pCache.Delete(RxSessionPrefix + callID)
+	for user, rules := range sess.Rules {
+		if len(rules) > 0 {
+			p.reAuth(ctx, user, callID, nil, rules, up)
+		}
+	}
+	p.answer(modules.SessionTerminationAnswer, response, up)
+	return nil
+}
+
+// PGW执行规则的结果(Gx RAA)
+func (p *PcrfEntity) ReAuthAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	if !isCxSuccess(args[CX_RESULT]) {
+		logger.Warn("[%v] PGW执行PCC规则失败 用户=%v Call-ID=%v 结果=%v", ctx.Value("Entity"), args[EPC_USER_NAME], args[EPC_CALL_ID], args[CX_RESULT])
+	}
+	return nil
+}
+
+// 向PGW安装或删除用户的规则(Gx RAR)
+func (p *PcrfEntity) reAuth(ctx context.Context, user, callID string, install, remove []QosRule, up chan *modules.Package) {
+	logger.Info("[%v] PCRF下发PCC规则 用户=%v 安装=%+v 删除=%+v", ctx.Value("Entity"), user, install, remove)
+	request := map[string]string{
+		EPC_USER_NAME: user,
+		EPC_CALL_ID:   callID,
+	}
+	marshalRules(request, install)
+	request[GX_RULE_REMOVE] = strconv.Itoa(len(remove))
+	for i, r := range remove {
+		request[avKey(GX_RULE_REMOVE, i+1)] = r.Name
+	}
+	pkg := new(modules.Package)
+	pkg.SetShortConn(p.conf.Elements["PGW"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.ReAuthRequest, modules.StrLineMarshal(request))
+	modules.Send(pkg, up)
+}
+
+func (p *PcrfEntity) answer(method byte, response map[string]string, up chan *modules.Package) {
+	pkg := new(modules.Package)
+	pkg.SetShortConn(p.conf.Elements["PCSCF"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(response))
+	modules.Send(pkg, up)
+}
+
+// 按媒体类型推导QoS规则(3GPP TS 29.213 6.3)，语音使用QCI 1，视频使用QCI 2，其他媒体使用默认承载
+func qosRules(callID string, media []MediaComponent) []QosRule {
+	var rules []QosRule
+	for _, m := range media {
+		r := QosRule{Name: callID + "-" + strconv.Itoa(m.Number), GBR: m.Bandwidth}
+		switch m.Type {
+		case "audio":
+			r.QCI = QCIConversationalVoice
+		case "video":
+			r.QCI = QCIConversationalVideo
+		default:
+			continue
+		}
+		if r.GBR == 0 {
+			r.GBR = defaultGBR(r.QCI)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// 比较已安装的规则和新的规则，QoS发生变化的规则先删除再安装
+func diffRules(old, rules []QosRule) (install, remove []QosRule) {
+	installed := make(map[string]QosRule)
+	for _, r := range old {
+		installed[r.Name] = r
+	}
+	kept := make(map[string]bool)
+	for _, r := range rules {
+		if o, ok := installed[r.Name]; ok && o == r {
+			kept[r.Name] = true
+			continue
+		}
+		install = append(install, r)
+	}
+	for _, r := range old {
+		if !kept[r.Name] {
+			remove = append(remove, r)
+		}
+	}
+	return
+}
+
+// SDP中的媒体转换为Rx的媒体信息，端口为0的媒体已被拒绝，不上报(3GPP TS 29.214 B.3)
+func mediaComponents(sdp string) []MediaComponent {
+	var media []MediaComponent
+	for i, m := range sip.ParseSDPMedia(sdp) {
+		if m.Port == 0 {
+			continue
+		}
+		media = append(media, MediaComponent{Number: i + 1, Type: m.Type, Bandwidth: m.Bandwidth})
+	}
+	return media
+}
+
+// 将媒体信息写入AAR
+func marshalMediaComponents(m map[string]string, media []MediaComponent) {
+	m[RX_MEDIA] = strconv.Itoa(len(media))
+	for i, c := range media {
+		m[avKey(RX_MEDIA_NUMBER, i+1)] = strconv.Itoa(c.Number)
+		m[avKey(RX_MEDIA_TYPE, i+1)] = c.Type
+		m[avKey(RX_BANDWIDTH, i+1)] = strconv.Itoa(c.Bandwidth)
+	}
+}
+
+// 从AAR中读取媒体信息
+func unmarshalMediaComponents(m map[string]string) []MediaComponent {
+	n, _ := strconv.Atoi(m[RX_MEDIA])
+	media := make([]MediaComponent, 0, n)
+	for i := 1; i <= n; i++ {
+		c := MediaComponent{Type: m[avKey(RX_MEDIA_TYPE, i)]}
+		c.Number, _ = strconv.Atoi(m[avKey(RX_MEDIA_NUMBER, i)])
+		c.Bandwidth, _ = strconv.Atoi(m[avKey(RX_BANDWIDTH, i)])
+		media = append(media, c)
+	}
+	return media
+}
+
+// 将安装的规则写入RAR
+func marshalRules(m map[string]string, rules []QosRule) {
+	m[GX_RULE_INSTALL] = strconv.Itoa(len(rules))
+	for i, r := range rules {
+		m[avKey(GX_RULE_NAME, i+1)] = r.Name
+		m[avKey(EPC_QCI, i+1)] = strconv.Itoa(r.QCI)
+		m[avKey(GX_GBR, i+1)] = strconv.Itoa(r.GBR)
+	}
+}
+
+// 从RAR中读取安装的规则
+func unmarshalRules(m map[string]string) []QosRule {
+	n, _ := strconv.Atoi(m[GX_RULE_INSTALL])
+	rules := make([]QosRule, 0, n)
+	for i := 1; i <= n; i++ {
+		r := QosRule{Name: m[avKey(GX_RULE_NAME, i)]}
+		r.QCI, _ = strconv.Atoi(m[avKey(EPC_QCI, i)])
+		r.GBR, _ = strconv.Atoi(m[avKey(GX_GBR, i)])
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// 从RAR中读取删除的规则名
+func unmarshalRuleNames(m map[string]string) []string {
+	n, _ := strconv.Atoi(m[GX_RULE_REMOVE])
+	names := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		names = append(names, m[avKey(GX_RULE_REMOVE, i)])
+	}
+	return names
+}
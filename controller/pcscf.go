@@ -8,9 +8,9 @@ package controller
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/modules"
@@ -21,15 +21,33 @@ import (
 
 type P_CscfEntity struct {
 	*Mux
+	conf    *config.Network
+	pCache  *Cache
+	server  *sip.Server
+	txLayer *sip.TransactionLayer
 }
 
 // 暂时先试用固定的uri，后期实现dns使用域名加IP的映射方式
-func (p *P_CscfEntity) Init(domain, host string) {
+func (p *P_CscfEntity) Init(conf *config.Network) {
 	p.Mux = new(Mux)
-	sip.ServerDomain = domain
-	sip.ServerIP = strings.Split(host, ":")[0]
-	sip.ServerPort, _ = strconv.Atoi(strings.Split(host, ":")[1])
+	p.conf = conf
+	server, err := sip.NewServer(conf.Host("p-cscf"), conf.Elements["PCSCF"].ActualAddr)
+	if err != nil {
+		logger.Fatal("监听地址格式错误 %v", err)
+	}
+	p.server = server
 	p.router = make(map[[2]byte]BaseSignallingT)
+	p.pCache = initCache()
+	p.txLayer = sip.NewTransactionLayer()
+}
+
+// 注册消息路由
+func (p *P_CscfEntity) RegistRouter() {
+	p.Regist([2]byte{modules.SIPPROTOCAL, modules.SipRequest}, p.SIPREQUESTF)
+	p.Regist([2]byte{modules.SIPPROTOCAL, modules.SipResponse}, p.SIPRESPONSEF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.DetachIndication}, p.DetachIndicationF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.AAAnswer}, p.RxAnswerF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.SessionTerminationAnswer}, p.RxAnswerF)
 }
 
 func (p *P_CscfEntity) CoreProcessor(ctx context.Context, in, up, down chan *modules.Package) {
@@ -62,55 +80,82 @@ func (p *P_CscfEntity) SIPREQUESTF(ctx context.Context, pkg *modules.Package, up
 		// TODO 错误处理
 		return err
 	}
+	logger.Info("[%v][%v] Receive SIP Request: \n%v", ctx.Value("Entity"), p.server.Domain, string(pkg.GetData()))
 	sipreq.Header.MaxForwards.Reduce()
-	sipreq.Header.Via.SetReceivedInfo("UDP", fmt.Sprintf("%s:%d", sip.ServerIP, sip.ServerPort))
+	sipreq.Header.Via.SetReceivedInfo(pkg.GetTransport(), pkg.GetRemoteAddr())
+	access := p.accessHop()
+	send, err := responseSender(&sipreq, &access, up, down)
+	if err != nil {
+		return err
+	}
+	// 发给本服务器的NOTIFY是代替UE订阅的注册状态通知
+	if sipreq.RequestLine.Method == sip.MethodNotify && p.server.IsHost(sipreq.RequestLine.RequestURI.Domain) {
+		return p.regNotify(ctx, &sipreq, send)
+	}
+	// 核心网发来的请求都通过Route(Path或Record-Route)指向本服务器，没有Route的请求来自UE
+	fromUE := sipreq.Header.Route.Len() == 0
+	sipreq.PreprocessRoute(p.server)
 	switch sipreq.RequestLine.Method {
 	case sip.MethodRegister:
-		logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
-
-		sipreq.Header.Via.AddServerInfo()
-		// 检查头部内容是否首次注册
-		if strings.Contains(sipreq.Header.Authorization, "response") { // 包含响应内容则为第二次注册请求
-			pkg.SetShortConn(config.Elements["ICSCF"].ActualAddr)
-			pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-			modules.Send(pkg, up)
-		} else {
-			// 第一次注册请求，P-CSCF处理，填充Authorization头部
-			user := sipreq.Header.From.URI.Username
+		stx, isNew := p.txLayer.ServerRequest(&sipreq, send)
+		if !isNew { // 重传的请求由事务层处理
+			return nil
+		}
+		// 终端未携带Authorization时按首次注册填充，并标明未建立完整性保护(3GPP TS 24.229 5.2.2.1)
+		if sipreq.Header.Authorization == nil {
 			domain := sipreq.Header.From.URI.Domain
-			username := user + "@" + domain
-			auth := fmt.Sprintf("Digest username=%s integrity protection:no", username)
-			sipreq.Header.Authorization = auth
-			// 第一次注册请求SCSCF还未与UE绑定所以转发给ICSCF
-			pkg.SetShortConn(config.Elements["ICSCF"].ActualAddr)
-			pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-			modules.Send(pkg, up)
-		}
-	case sip.MethodInvite, sip.MethodPrack, sip.MethodUpdate:
-		via, _ := sipreq.Header.Via.FirstAddrInfo()
-		if strings.Contains(via, "s-cscf") { // INVITE请求来自SCSCF
-			logger.Info("[%v][%v] Receive From SCSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-			// 向下行转发请求
-			sipreq.Header.Via.AddServerInfo()
-			pkg.SetShortConn(config.Elements["PGW"].ActualAddr)
-			pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-			modules.Send(pkg, down)
-		} else { // INVITE请求来自PGW
-			logger.Info("[%v][%v] Receive From PGW: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-			sipresp := sip.NewResponse(sip.StatusTrying, &sipreq)
-			sipreq.Header.Via.AddServerInfo()
-			// 向上行转发请求
-			pkg.SetShortConn(config.Elements["SCSCF"].ActualAddr)
-			pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-			modules.Send(pkg, up)
-			// 向主叫响应trying
-			if sipreq.RequestLine.Method == sip.MethodInvite {
-				pkg0 := new(modules.Package)
-				pkg0.SetShortConn(config.Elements["PGW"].ActualAddr)
-				pkg0.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-				modules.Send(pkg0, down)
+			sipreq.Header.Authorization = &sip.Credentials{
+				Scheme:   sip.SchemeDigest,
+				Username: sipreq.Header.From.URI.Username + "@" + domain,
+				Realm:    domain,
+				URI:      "sip:" + domain,
 			}
 		}
+		if _, ok := sipreq.Header.Authorization.Params.Get("integrity-protected"); !ok {
+			sipreq.Header.Authorization.Params.Set("integrity-protected", "no")
+		}
+		// 注册请求按Request-URI发往归属域的I-CSCF，Path记录发往UE的请求需要经过本服务器
+		next, err := resolveHop(sipreq.NextHopHost(), nil)
+		if err != nil {
+			stx.Respond(sip.NewResponse(sip.StatusNotFound, &sipreq))
+			return err
+		}
+		sipreq.Header.Path.AddServerInfo(p.server)
+		sipreq.Header.Via.AddServerInfo(p.server)
+		p.txLayer.Forward(stx, &sipreq, next.sender(up, down))
+	case sip.MethodAck:
+		if absorbAck(p.txLayer, &sipreq) {
+			return nil
+		}
+		next, err := p.nextHop(&sipreq, fromUE)
+		if err != nil {
+			return err
+		}
+		sipreq.Header.Via.AddServerInfo(p.server)
+		next.sender(up, down)(&sipreq)
+	case sip.MethodCancel:
+		return cancelRequest(p.txLayer, &sipreq, send)
+	case sip.MethodInvite, sip.MethodPrack, sip.MethodUpdate, sip.MethodBye, sip.MethodSubscribe, sip.MethodNotify:
+		stx, isNew := p.txLayer.ServerRequest(&sipreq, send)
+		if !isNew {
+			return nil
+		}
+		if sipreq.RequestLine.Method == sip.MethodInvite {
+			stx.Respond(sip.NewResponse(sip.StatusTrying, &sipreq))
+		}
+		next, err := p.nextHop(&sipreq, fromUE)
+		if err != nil {
+			stx.Respond(sip.NewResponse(sip.StatusForbidden, &sipreq))
+			return err
+		}
+		if isDialogCreating(&sipreq) {
+			sipreq.Header.RecordRoute.AddServerInfo(p.server)
+		}
+		if sipreq.RequestLine.Method == sip.MethodBye {
+			p.releaseBearer(ctx, sipreq.Header.CallID, down)
+		}
+		sipreq.Header.Via.AddServerInfo(p.server)
+		p.txLayer.Forward(stx, &sipreq, next.sender(up, down))
 	}
 	return nil
 }
@@ -124,21 +169,228 @@ func (p *P_CscfEntity) SIPRESPONSEF(ctx context.Context, pkg *modules.Package, u
 		// TODO 错误处理
 		return err
 	}
+	logger.Info("[%v][%v] Receive SIP Response: \n%v", ctx.Value("Entity"), p.server.Domain, string(pkg.GetData()))
+	// 匹配客户端事务，重传的应答由事务层吸收
+	if _, pass := p.txLayer.ClientResponse(&sipresp); !pass {
+		return nil
+	}
 	// 删除第一个Via头部信息
-	sipresp.Header.Via.RemoveFirst()
+	sipresp.Header.Via.RemoveFirst(p.server)
 	sipresp.Header.MaxForwards.Reduce()
-	// 判断下一跳是否是s-cscf
-	via, _ := sipresp.Header.Via.FirstAddrInfo()
-	if strings.Contains(via, "s-cscf") {
-		logger.Info("[%v][%v] Receive From PGW: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["SCSCF"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-		modules.Send(pkg, up)
-	} else { // 来自上行ICSCF的一般响应
-		logger.Info("[%v][%v] Receive From SCSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["PGW"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-		modules.Send(pkg, down)
+	if sipresp.Header.Via.Len() == 0 {
+		return p.localResponse(ctx, &sipresp)
+	}
+	if isTrying(&sipresp) {
+		return nil
+	}
+	// 注册成功后保存Service-Route，作为UE后续请求的预加载路由
+	if sipresp.Header.CSeq.Method == sip.MethodRegister && sipresp.ResponseLine.StatusCode == sip.StatusOK.Code &&
+		sipresp.Header.ServiceRoute.Len() > 0 {
+		p.pCache.setServiceRoute(ServiceRoutePrefix+sipresp.Header.To.Username(), sipresp.Header.ServiceRoute.Items())
+		p.subscribeReg(ctx, &sipresp, up, down)
+	}
+	if sipresp.Header.CSeq.Method == sip.MethodInvite {
+		p.bearerControl(ctx, &sipresp, down)
+	}
+	access := p.accessHop()
+	return forwardResponse(p.txLayer, &sipresp, &access, up, down)
+}
+
+// INVITE的应答携带SDP应答时为本服务器服务的UE建立专用承载，会话建立失败时删除会话的专用承载(3GPP TS 24.229 5.2.7)
+// 配置了PCRF时经Rx上报媒体信息，由PCRF决定建立的专用承载，否则直接请求PGW建立语音专用承载，同一会话由PGW只建立一次
+// PCRF与PGW同在EPC侧，消息都经下行发送
+func (p *P_CscfEntity) bearerControl(ctx context.Context, resp *sip.Message, down chan *modules.Package) {
+	callID := resp.Header.CallID
+	code := resp.ResponseLine.StatusCode
+	if code >= 300 {
+		if !p.pCache.isConfirmedCall(ConfirmedCallPrefix + callID) {
+			p.releaseBearer(ctx, callID, down)
+		}
+		return
+	}
+	if code >= 200 {
+		p.pCache.setConfirmedCall(ConfirmedCallPrefix + callID)
+	}
+	if !resp.HasSDP() {
+		return
+	}
+	// 删除本服务器的Via后只剩UE的Via时应答发往主叫UE，否则应答来自被叫UE
+	ue := resp.Header.To.Username()
+	if resp.Header.Via.Len() == 1 {
+		ue = resp.Header.From.Username()
+	}
+	request := map[string]string{
+		EPC_USER_NAME: ue,
+		EPC_CALL_ID:   callID,
+	}
+	pkg := new(modules.Package)
+	if pcrf := p.conf.Elements["PCRF"].ActualAddr; len(pcrf) > 0 {
+		marshalMediaComponents(request, mediaComponents(resp.Body))
+		pkg.SetShortConn(pcrf)
+		pkg.Construct(modules.EPCPROTOCAL, modules.AARequest, modules.StrLineMarshal(request))
+	} else {
+		request[EPC_QCI] = strconv.Itoa(QCIConversationalVoice)
+		pkg.SetShortConn(p.conf.Elements["PGW"].ActualAddr)
+		pkg.Construct(modules.EPCPROTOCAL, modules.BearerResourceAllocation, modules.StrLineMarshal(request))
+	}
+	modules.Send(pkg, down)
+}
+
+// 会话结束，配置了PCRF时结束Rx会话，否则请求PGW删除会话的专用承载
+func (p *P_CscfEntity) releaseBearer(ctx context.Context, callID string, down chan *modules.Package) {
+	p.pCache.Delete(ConfirmedCallPrefix + callID)
+	request := modules.StrLineMarshal(map[string]string{EPC_CALL_ID: callID})
+	pkg := new(modules.Package)
+	if pcrf := p.conf.Elements["PCRF"].ActualAddr; len(pcrf) > 0 {
+		pkg.SetShortConn(pcrf)
+		pkg.Construct(modules.EPCPROTOCAL, modules.SessionTerminationRequest, request)
+	} else {
+		pkg.SetShortConn(p.conf.Elements["PGW"].ActualAddr)
+		pkg.Construct(modules.EPCPROTOCAL, modules.BearerResourceRelease, request)
+	}
+	modules.Send(pkg, down)
+}
+
+// PCRF对Rx请求的应答
+func (p *P_CscfEntity) RxAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From PCRF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	if !isCxSuccess(args[CX_RESULT]) {
+		logger.Warn("[%v] PCRF策略控制失败 Call-ID=%v 结果=%v", ctx.Value("Entity"), args[EPC_CALL_ID], args[CX_RESULT])
+	}
+	return nil
+}
+
+// 用户注册成功后代替UE订阅注册状态(3GPP TS 24.229 5.2.3)，已有订阅时不重复订阅
+func (p *P_CscfEntity) subscribeReg(ctx context.Context, resp *sip.Message, up, down chan *modules.Package) {
+	key := RegSubscriptionPrefix + resp.Header.To.Username()
+	if p.pCache.getRegSubscription(key) != nil {
+		return
+	}
+	aor := resp.Header.To.URI
+	aor.Arguments = sip.Args{}
+	self := p.server.URI("")
+	self.Arguments = sip.Args{}
+	info := &RegSubscribeInfo{CallID: sip.NewCallID(p.server.Domain), LocalTag: sip.NewTag(), CSeq: 1}
+	from := sip.User{URI: self, Arguments: sip.Args{}}
+	from.Arguments.Set("tag", info.LocalTag)
+	req := sip.NewRequest(sip.MethodSubscribe, aor, from, sip.User{URI: aor, Arguments: sip.Args{}}, info.CallID, info.CSeq)
+	// 按Service-Route发往用户注册的S-CSCF
+	req.Header.Route.Prepend(resp.Header.ServiceRoute.Items()...)
+	req.Header.Event = &sip.Event{Type: sip.EventReg}
+	req.Header.Expires = sip.NewExpires(DefaultRegSubExpires)
+	req.Header.Contact.Add(sip.User{URI: self, Arguments: sip.Args{}})
+	next, err := resolveHop(req.NextHopHost(), nil)
+	if err != nil {
+		logger.Error("[%v] 注册状态订阅无法发送 %v: %v", ctx.Value("Entity"), req.NextHopHost(), err)
+		return
+	}
+	p.pCache.setRegSubscription(key, info, DefaultRegSubExpires*time.Second)
+	req.Header.Via.SetReceivedInfo("UDP", p.server.IpHost())
+	req.Header.Via.AddServerInfo(p.server)
+	p.txLayer.Request(req, next.sender(up, down))
+}
+
+// 注册状态通知，用户的注册终止后删除Service-Route，UE需要重新注册(3GPP TS 24.229 5.2.3)
+func (p *P_CscfEntity) regNotify(ctx context.Context, req *sip.Message, send sip.TransportFunc) error {
+	stx, isNew := p.txLayer.ServerRequest(req, send)
+	if !isNew {
+		return nil
+	}
+	if req.Header.Event == nil || req.Header.Event.Type != sip.EventReg {
+		stx.Respond(sip.NewResponse(sip.StatusBadEvent, req))
+		return nil
+	}
+	key := RegSubscriptionPrefix + req.Header.From.Username()
+	if sub := p.pCache.getRegSubscription(key); sub == nil || sub.CallID != req.Header.CallID {
+		stx.Respond(sip.NewResponse(sip.StatusCallTransactionDoesNotExist, req))
+		return ErrSubscriptionNotExist
+	}
+	info, err := sip.ParseRegInfo(req.Body)
+	if err != nil {
+		stx.Respond(sip.NewResponse(sip.StatusBadRequest, req))
+		return err
+	}
+	stx.Respond(sip.NewResponse(sip.StatusOK, req))
+	for _, reg := range info.Registrations {
+		if reg.State != sip.RegStateTerminated {
+			continue
+		}
+		aor, err := sip.NewURI(reg.AOR)
+		if err != nil {
+			continue
+		}
+		p.pCache.Delete(ServiceRoutePrefix + aor.Username)
+		logger.Info("[%v] %v的注册已终止", ctx.Value("Entity"), aor)
+	}
+	if req.Header.SubscriptionState != nil && req.Header.SubscriptionState.IsTerminated() {
+		p.pCache.Delete(key)
+	}
+	return nil
+}
+
+// PGW通知UE已去附着，IMS信令承载已经释放(3GPP TS 24.229 5.2.8.1.2)
+// 删除用户的Service-Route，并通知为用户服务的S-CSCF注销用户，用户未注册时忽略
+func (p *P_CscfEntity) DetachIndicationF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From PGW: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	name := modules.StrLineUnmarshal(pkg.GetData())[EPC_USER_NAME]
+	routes := p.pCache.getServiceRoute(ServiceRoutePrefix + name)
+	if len(routes) == 0 {
+		return nil
+	}
+	p.pCache.Delete(ServiceRoutePrefix + name)
+	next, err := resolveHop(routes[0].URI.Domain, nil)
+	if err != nil {
+		return err
+	}
+	pkg.SetShortConn(next.Host)
+	modules.Send(pkg, up)
+	return nil
+}
+
+// 本服务器发起的SUBSCRIBE的应答，成功时记录S-CSCF的标签，失败时删除订阅
+func (p *P_CscfEntity) localResponse(ctx context.Context, resp *sip.Message) error {
+	if resp.Header.CSeq.Method != sip.MethodSubscribe {
+		return nil
+	}
+	key := RegSubscriptionPrefix + resp.Header.To.Username()
+	info := p.pCache.getRegSubscription(key)
+	if info == nil || info.CallID != resp.Header.CallID {
+		return nil
+	}
+	code := resp.ResponseLine.StatusCode
+	if code >= 300 {
+		p.pCache.Delete(key)
+		logger.Warn("[%v] 注册状态订阅失败 %v", ctx.Value("Entity"), code)
+		return nil
+	}
+	if code >= 200 {
+		info.RemoteTag, _ = resp.Header.To.Arguments.Get("tag")
 	}
 	return nil
 }
+
+// 接入侧的下一跳，发往UE的消息都经过PGW
+func (p *P_CscfEntity) accessHop() NextHop {
+	return NextHop{Host: p.conf.Elements["PGW"].ActualAddr}
+}
+
+// 请求的下一跳(RFC3261-16.6)
+// UE发起的请求使用注册时的Service-Route作为预加载路由，核心网发来的请求在Route用尽后经PGW发往UE
+func (p *P_CscfEntity) nextHop(req *sip.Message, fromUE bool) (NextHop, error) {
+	if fromUE {
+		routes := p.pCache.getServiceRoute(ServiceRoutePrefix + req.Header.From.Username())
+		if routes == nil {
+			return NextHop{}, errors.New("ErrUserNotRegistered")
+		}
+		req.Header.Route.Prepend(routes...)
+	}
+	if req.Header.Route.Len() == 0 {
+		return p.accessHop(), nil
+	}
+	return resolveHop(req.NextHopHost(), nil)
+}
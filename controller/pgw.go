@@ -7,11 +7,13 @@ package controller
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
+	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/modules"
@@ -20,48 +22,301 @@ import (
 	"github.com/wonderivan/logger"
 )
 
+// UE的地址池，IPv4按地址分配，IPv6网段短于/64时按/64前缀分配(3GPP TS 23.401 5.3.1.2.2)，否则按地址分配
+// 地址按16字节计算
 type Pool struct {
-	CurIP  uint32
-	Mask   uint32
-	LastIP uint32
+	CurIP   net.IP // 最近一次分配的地址或前缀
+	FirstIP net.IP // 第一个可以分配的地址或前缀
+	LastIP  net.IP // 最后一个可以分配的地址或前缀
+	Unit    int    // 每次分配的前缀长度，按地址分配时为128，按前缀分配时为64
 	sync.Mutex
 }
 
+var (
+	ErrUEIdentityNotExist = errors.New("ErrUEIdentityNotExist")
+	ErrEmptyPool          = errors.New("ErrEmptyPool")
+)
+
+// UE附着后PGW保存的上下文，去附着或地址租约到期时删除
+type UEContext struct {
+	IMSI     string
+	EnbID    string       // UE附着的基站
+	UserName string       // IMS用户名，去附着时通知IMS侧注销用户
+	Mme      string       // 经MME附着时MME的地址，网络侧发起去附着时由MME通知UE
+	Bearers  []*Bearer    // 默认承载和IMS会话的专用承载
+	enb      *net.UDPConn // 接收附着请求的连接，网络侧发起去附着时使用
+}
+
 type PgwEntity struct {
 	*Mux
+	conf   *config.Network
 	pool   *Pool
+	pool6  *Pool        // IPv4v6双栈时的IPv6地址池
+	alloc  *IPAllocator // pool上的地址分配
+	alloc6 *IPAllocator
+	leases LeaseStore // 地址租约的持久化，为nil时租约只保存在内存中
 	pCache *Cache
 }
 
-func initpool(cidr string) *Pool {
-	_, net, err := net.ParseCIDR(cidr)
+func initpool(cidr string) (*Pool, error) {
+	_, n, err := net.ParseCIDR(cidr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	ip := binary.BigEndian.Uint32(net.IP)
-	mask := binary.BigEndian.Uint32(net.Mask)
-	last := ip | ^mask
-	return &Pool{
-		CurIP:  ip,
-		Mask:   mask,
-		LastIP: last,
+	ones, bits := n.Mask.Size()
+	// IPv4地址按16字节的IPv4映射地址计算
+	ip := n.IP.To16()
+	mask := net.CIDRMask(ones+128-bits, 128)
+	last := make(net.IP, net.IPv6len)
+	for i := range last {
+		last[i] = ip[i] | ^mask[i]
 	}
+	pool := &Pool{CurIP: ip, Unit: 128}
+	switch {
+	case bits == 8*net.IPv4len:
+		// 最后一个地址为广播地址
+		pool.LastIP = addIP(last, 128, -1)
+	case ones < 64:
+		pool.Unit = 64
+		pool.LastIP = last.Mask(net.CIDRMask(64, 128))
+	default:
+		pool.LastIP = last
+	}
+	// 网段的第一个地址或前缀不分配
+	pool.FirstIP = addIP(ip, pool.Unit, 1)
+	// /31、/32、/128等网段去掉首尾后没有可以分配的地址
+	if bytes.Compare(pool.FirstIP, pool.LastIP) > 0 {
+		return nil, ErrEmptyPool
+	}
+	return pool, nil
+}
+
+// 地址加上n个分配单位
+func addIP(ip net.IP, unit int, n int64) net.IP {
+	v := new(big.Int).SetBytes(ip.To16())
+	step := new(big.Int).Lsh(big.NewInt(n), uint(128-unit))
+	b := v.Add(v, step).Bytes()
+	res := make(net.IP, net.IPv6len)
+	copy(res[net.IPv6len-len(b):], b)
+	return res
 }
 
-func (p *PgwEntity) Init(dhcp string) {
+func (p *PgwEntity) Init(conf *config.Network, sc config.Store) {
 	// 初始化路由
 	p.Mux = new(Mux)
+	p.conf = conf
 	p.router = make(map[[2]byte]BaseSignallingT)
-	p.pool = initpool(dhcp)
 	p.pCache = initCache()
 	// 初始化IP地址池子
+	var err error
+	if p.pool, err = initpool(conf.Dhcp); err != nil {
+		panic(err)
+	}
+	p.alloc = NewIPAllocator(p.pool, conf.LeaseTime)
+	if len(conf.Dhcp6) > 0 {
+		if p.pool6, err = initpool(conf.Dhcp6); err != nil {
+			panic(err)
+		}
+		p.alloc6 = NewIPAllocator(p.pool6, conf.LeaseTime)
+	}
+	// 恢复重启前的租约，读取失败时只在内存中分配
+	ctx := context.WithValue(context.Background(), "Entity", "PGW")
+	leases, err := OpenLeaseStore(sc)
+	if err != nil {
+		logger.Error("[%v] PGW打开地址租约存储失败，租约不会持久化 %v", ctx.Value("Entity"), err)
+		return
+	}
+	p.leases = leases
+	if err = p.restoreLeases(ctx, time.Now()); err != nil {
+		logger.Error("[%v] PGW恢复地址租约失败 %v", ctx.Value("Entity"), err)
+	}
+}
+
+func (p *PgwEntity) allocators() []*IPAllocator {
+	if p.alloc6 == nil {
+		return []*IPAllocator{p.alloc}
+	}
+	return []*IPAllocator{p.alloc, p.alloc6}
+}
+
+// 地址族对应的分配器
+func (p *PgwEntity) allocator(ip net.IP) *IPAllocator {
+	for _, a := range p.allocators() {
+		if a.Accepts(ip) {
+			return a
+		}
+	}
+	return nil
+}
 
+// 保留用户的静态地址，恢复未到期的租约，删除已到期的租约
+func (p *PgwEntity) restoreLeases(ctx context.Context, now time.Time) error {
+	statics, err := p.leases.StaticIPs(ctx)
+	if err != nil {
+		return err
+	}
+	for imsi, str := range statics {
+		for _, ip := range parseStaticIPs(str) {
+			if a := p.allocator(ip); a != nil {
+				a.Reserve(imsi, ip)
+			}
+		}
+	}
+	pgw := p.conf.Elements["PGW"].ActualAddr
+	sessions, err := p.leases.LoadLeases(ctx, pgw)
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		ip, err := parseLeaseKey(sess.IP)
+		if err != nil {
+			logger.Error("[%v] PGW地址租约格式错误 %v", ctx.Value("Entity"), sess.IP)
+			continue
+		}
+		_, static := statics[sess.IMSI]
+		l := &Lease{IMSI: sess.IMSI, Key: ip, Static: static, Expire: sess.Expire}
+		if a := p.allocator(ip); a != nil && a.Restore(l, now) {
+			continue
+		}
+		p.leases.DeleteLease(ctx, pgw, sess.IP)
+	}
+	for _, a := range p.allocators() {
+		logger.Info("[%v] PGW地址池 %+v", ctx.Value("Entity"), a.Usage())
+	}
+	return nil
+}
+
+// UE的签约数据，没有存储或用户不存在时返回nil
+func (p *PgwEntity) subscriber(ctx context.Context, imsi string) *UserTable {
+	if p.leases == nil || len(imsi) == 0 {
+		return nil
+	}
+	user, err := p.leases.GetUserByIMSI(ctx, imsi)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// 为UE分配地址，用户配置了静态地址时分配静态地址，分配的租约写入存储
+func (p *PgwEntity) allocate(ctx context.Context, imsi string, user *UserTable) ([]*Lease, error) {
+	var statics []net.IP
+	if user != nil {
+		statics = parseStaticIPs(user.IP)
+	}
+	now := time.Now()
+	var ret []*Lease
+	allocs := p.allocators()
+	for _, a := range allocs {
+		var static net.IP
+		for _, ip := range statics {
+			if a.Accepts(ip) {
+				static = ip
+				a.Reserve(imsi, ip)
+				break
+			}
+		}
+		l, err := a.Allocate(imsi, static, now)
+		if err != nil {
+			// 双栈时撤销已经分配的其他地址族的地址
+			for i, l := range ret {
+				allocs[i].Cancel(l)
+			}
+			p.deleteLeases(ctx, ret)
+			return nil, err
+		}
+		p.saveLease(ctx, l, now)
+		logger.Info("[%v] PGW分配地址 IMSI=%v IP=%v %+v", ctx.Value("Entity"), imsi, l, a.Usage())
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
+
+func (p *PgwEntity) saveLease(ctx context.Context, l *Lease, now time.Time) {
+	if p.leases == nil {
+		return
+	}
+	sess := &SessionTable{
+		IMSI:    l.IMSI,
+		Apn:     p.conf.Name,
+		IP:      l.String(),
+		PgwAddr: p.conf.Elements["PGW"].ActualAddr,
+		Expire:  l.Expire,
+		Ctime:   now,
+		Utime:   now,
+	}
+	p.leases.SaveLease(ctx, sess)
+}
+
+func (p *PgwEntity) deleteLeases(ctx context.Context, leases []*Lease) {
+	if p.leases == nil {
+		return
+	}
+	pgw := p.conf.Elements["PGW"].ActualAddr
+	for _, l := range leases {
+		p.leases.DeleteLease(ctx, pgw, l.String())
+	}
+}
+
+// UE去附着时释放分配的地址
+func (p *PgwEntity) releaseIP(ctx context.Context, imsi string) {
+	var released []*Lease
+	for _, a := range p.allocators() {
+		if l, ok := a.Release(imsi); ok {
+			logger.Info("[%v] PGW释放地址 IMSI=%v IP=%v", ctx.Value("Entity"), imsi, l)
+			released = append(released, l)
+		}
+	}
+	p.deleteLeases(ctx, released)
+}
+
+// 回收到期的租约，UE仍然附着时由网络侧发起去附着，UE需要重新附着
+func (p *PgwEntity) sweepLeases(ctx context.Context, now time.Time, up, down chan *modules.Package) {
+	for _, a := range p.allocators() {
+		expired := a.Expire(now)
+		for _, l := range expired {
+			logger.Info("[%v] PGW地址租约到期 IMSI=%v IP=%v", ctx.Value("Entity"), l.IMSI, l)
+		}
+		p.deleteLeases(ctx, expired)
+		for _, l := range expired {
+			if len(l.IMSI) > 0 {
+				p.Detach(ctx, l.IMSI, DetachReattachRequired, up, down)
+			}
+		}
+	}
+}
+
+// 地址池的使用情况，双栈时第二个为IPv6地址池
+func (p *PgwEntity) PoolUsage() []PoolUsage {
+	var ret []PoolUsage
+	for _, a := range p.allocators() {
+		ret = append(ret, a.Usage())
+	}
+	return ret
+}
+
+// 注册消息路由
+func (p *PgwEntity) RegistRouter() {
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.AttachRequest}, p.AttachRequestF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.DetachRequest}, p.DetachRequestF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.DetachAccept}, p.DetachAcceptF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.CreateSessionRequest}, p.CreateSessionRequestF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.DeleteSessionRequest}, p.DeleteSessionRequestF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.BearerResourceAllocation}, p.BearerResourceAllocationF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.BearerResourceRelease}, p.BearerResourceReleaseF)
+	p.Regist([2]byte{modules.EPCPROTOCAL, modules.ReAuthRequest}, p.ReAuthRequestF)
+	p.Regist([2]byte{modules.SIPPROTOCAL, modules.SipRequest}, p.SIPREQUESTF)
+	p.Regist([2]byte{modules.SIPPROTOCAL, modules.SipResponse}, p.SIPRESPONSEF)
 }
 
 func (p *PgwEntity) CoreProcessor(ctx context.Context, in, up, down chan *modules.Package) {
 	var err error
+	sweep := time.NewTicker(LeaseSweepInterval)
+	defer sweep.Stop()
 	for {
 		select {
+		case now := <-sweep.C:
+			p.sweepLeases(ctx, now, up, down)
 		case pkg := <-in:
 			// 兼容心跳包
 			if pkg.IsBeatHeart() {
@@ -92,13 +347,11 @@ func (p *PgwEntity) AttachRequestF(ctx context.Context, pkg *modules.Package, up
 	logger.Info("[%v] Receive From MME(ENB): \n%v", ctx.Value("Entity"), string(pkg.GetData()))
 	data := pkg.GetData()
 	args := modules.StrLineUnmarshal(data)
-	// 分配IP地址
-	ip, err := p.getIP()
-	if err != nil {
+	enb := args[EPC_CELL_ID]
+	uc := &UEContext{IMSI: args[EPC_UE_IDENTITY], EnbID: enb, enb: pkg.GetLongConn()}
+	if err := p.createSession(ctx, uc, args); err != nil {
 		return err
 	}
-	args["IP"] = ip.String()
-	enb := args["UTRAN-CELL-ID-3GPP"]
 	p.pCache.updateAddress(AddrPrefix+enb, pkg.GetLongConnAddr())
 	// Attach过程仅仅是基站和PGW的交互过程消息体可以直接保存基站的网络连接
 	// 接收Attach消息时，消息体携带基站的网络连接，所以无需通过基站标识从缓存中查找
@@ -107,6 +360,171 @@ func (p *PgwEntity) AttachRequestF(ctx context.Context, pkg *modules.Package, up
 	return nil
 }
 
+// 为UE分配地址并保存UE上下文，分配的地址写入args
+// 同一UE在租约内重新附着时分配相同的地址，IPv6网段按前缀分配时UE的地址为前缀加上接口标识::1
+func (p *PgwEntity) createSession(ctx context.Context, uc *UEContext, args map[string]string) error {
+	user := p.subscriber(ctx, uc.IMSI)
+	leases, err := p.allocate(ctx, uc.IMSI, user)
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		ip := l.Address()
+		if ip.To4() != nil {
+			args["IP"] = ip.String()
+			continue
+		}
+		args["IPV6"] = ip.String()
+		if prefix := l.Prefix(); prefix != nil {
+			args["IPV6-PREFIX"] = prefix.String()
+		}
+	}
+	// 只有IPv6的PDN
+	if len(args["IP"]) == 0 {
+		args["IP"] = args["IPV6"]
+	}
+	// 附着时建立IMS信令使用的默认承载
+	uc.Bearers = []*Bearer{defaultBearer()}
+	args[EPC_BEARER_ID] = strconv.Itoa(DefaultBearerID)
+	args[EPC_QCI] = strconv.Itoa(QCIIMSSignalling)
+	// 保存UE上下文，没有UE标识的UE无法去附着，地址在租约到期后回收
+	if len(uc.IMSI) > 0 {
+		if user != nil {
+			uc.UserName = user.SipUserName
+		}
+		p.pCache.setUEContext(UEPrefix+uc.IMSI, uc)
+	}
+	return nil
+}
+
+// MME请求建立会话，应答携带分配的地址和原因值
+func (p *PgwEntity) CreateSessionRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From MME: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	mme := p.conf.Elements["MME"].ActualAddr
+	uc := &UEContext{IMSI: args[EPC_UE_IDENTITY], EnbID: args[EPC_CELL_ID], Mme: mme}
+	response := map[string]string{EPC_UE_IDENTITY: uc.IMSI}
+	err := p.createSession(ctx, uc, response)
+	switch err {
+	case nil:
+		response[EPC_CAUSE] = GtpRequestAccepted
+	case ErrNotEnoughIP:
+		response[EPC_CAUSE] = GtpAllDynamicAddressesOccupied
+	default:
+		response[EPC_CAUSE] = GtpSystemFailure
+	}
+	pkg.SetShortConn(mme)
+	pkg.Construct(modules.EPCPROTOCAL, modules.CreateSessionResponse, modules.StrLineMarshal(response))
+	modules.Send(pkg, up)
+	return err
+}
+
+// MME请求删除会话，UE已经去附着
+func (p *PgwEntity) DeleteSessionRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From MME: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	imsi := args[EPC_UE_IDENTITY]
+	response := map[string]string{
+		EPC_UE_IDENTITY: imsi,
+		EPC_CAUSE:       GtpRequestAccepted,
+	}
+	if p.pCache.getUEContext(UEPrefix+imsi) == nil {
+		response[EPC_CAUSE] = GtpContextNotFound
+	}
+	p.release(ctx, imsi, up)
+	pkg.SetShortConn(p.conf.Elements["MME"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.DeleteSessionResponse, modules.StrLineMarshal(response))
+	modules.Send(pkg, up)
+	return nil
+}
+
+// UE发起的去附着，释放UE上下文后应答，UE关机时不应答(3GPP TS 24.301 5.5.2.2)
+func (p *PgwEntity) DetachRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	imsi := args[EPC_UE_IDENTITY]
+	if len(imsi) == 0 {
+		return ErrUEIdentityNotExist
+	}
+	p.release(ctx, imsi, up)
+	if args[EPC_DETACH_TYPE] == DetachSwitchOff {
+		return nil
+	}
+	response := map[string]string{
+		EPC_UE_IDENTITY: imsi,
+		EPC_CELL_ID:     args[EPC_CELL_ID],
+	}
+	pkg.Construct(modules.EPCPROTOCAL, modules.DetachAccept, modules.StrLineMarshal(response))
+	modules.Send(pkg, down)
+	return nil
+}
+
+// UE对网络侧去附着的应答，UE上下文在发起去附着时已经释放
+func (p *PgwEntity) DetachAcceptF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	return nil
+}
+
+// 网络侧发起去附着，通知UE后释放UE上下文
+func (p *PgwEntity) Detach(ctx context.Context, imsi, detachType string, up, down chan *modules.Package) {
+	uc := p.pCache.getUEContext(UEPrefix + imsi)
+	if uc == nil {
+		p.releaseIP(ctx, imsi)
+		return
+	}
+	request := map[string]string{
+		EPC_UE_IDENTITY: imsi,
+		EPC_DETACH_TYPE: detachType,
+	}
+	// 经MME附着的UE删除默认承载，由MME发起去附着
+	method := modules.DeleteBearerRequest
+	if len(uc.Mme) == 0 {
+		method = modules.DetachRequest
+		request[EPC_CELL_ID] = uc.EnbID
+	}
+	p.toUE(ctx, uc, method, request, up, down)
+	p.release(ctx, imsi, up)
+}
+
+// 释放UE的地址和上下文，基站上没有其他UE时删除基站的地址，通知IMS侧注销用户
+func (p *PgwEntity) release(ctx context.Context, imsi string, up chan *modules.Package) {
+	p.releaseIP(ctx, imsi)
+	uc := p.pCache.getUEContext(UEPrefix + imsi)
+	if uc == nil {
+		return
+	}
+	p.pCache.Delete(UEPrefix + imsi)
+	logger.Info("[%v] PGW释放UE上下文 IMSI=%v 基站=%v", ctx.Value("Entity"), imsi, uc.EnbID)
+	if !p.enbInUse(uc.EnbID) {
+		p.pCache.Delete(AddrPrefix + uc.EnbID)
+	}
+	if len(uc.UserName) == 0 {
+		return
+	}
+	indication := map[string]string{
+		EPC_UE_IDENTITY: imsi,
+		EPC_USER_NAME:   uc.UserName,
+	}
+	pkg := new(modules.Package)
+	pkg.SetShortConn(p.conf.Elements["PCSCF"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.DetachIndication, modules.StrLineMarshal(indication))
+	modules.Send(pkg, up)
+}
+
+// 基站上是否还有附着的UE
+func (p *PgwEntity) enbInUse(enb string) bool {
+	for k, v := range p.pCache.Items() {
+		if strings.HasPrefix(k, UEPrefix) && v.Object.(*UEContext).EnbID == enb {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *PgwEntity) SIPREQUESTF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
 	defer modules.Recover(ctx)
 
@@ -127,7 +545,7 @@ func (p *PgwEntity) SIPREQUESTF(ctx context.Context, pkg *modules.Package, up, d
 	} else {
 		// 来自下游节点，向上游转发
 		logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
+		pkg.SetShortConn(p.conf.Elements["PCSCF"].ActualAddr)
 		modules.Send(pkg, up) // 上行
 	}
 	return nil
@@ -155,22 +573,8 @@ func (p *PgwEntity) SIPRESPONSEF(ctx context.Context, pkg *modules.Package, up,
 		modules.Send(pkg, down)
 	} else {
 		logger.Info("[%v] Receive From eNodeB: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
+		pkg.SetShortConn(p.conf.Elements["PCSCF"].ActualAddr)
 		modules.Send(pkg, up)
 	}
 	return nil
 }
-
-func (p *PgwEntity) getIP() (net.IP, error) {
-	p.pool.Lock()
-	cur := p.pool.CurIP
-	last := p.pool.LastIP
-	p.pool.Unlock()
-	cur = cur + 1
-	if cur == last {
-		return nil, errors.New("ErrNotEnoughIP")
-	}
-	ip := make([]byte, 4)
-	binary.BigEndian.PutUint32(ip, cur)
-	return ip, nil
-}
@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/VegetableManII/volte/modules"
+
+	"github.com/wonderivan/logger"
+)
+
+var (
+	ErrNoBearerID        = errors.New("ErrNoBearerID")
+	ErrUEContextNotExist = errors.New("ErrUEContextNotExist")
+	ErrCallIDNotExist    = errors.New("ErrCallIDNotExist")
+	ErrUnsupportedQCI    = errors.New("ErrUnsupportedQCI")
+)
+
+// 标准QCI(3GPP TS 23.203 6.1.7.2)，IMS信令使用默认承载，语音和视频使用GBR的专用承载
+const (
+	QCIConversationalVoice = 1
+	QCIConversationalVideo = 2
+	QCIIMSSignalling       = 5
+)
+
+// EPS承载标识，默认承载使用5，专用承载依次使用6~15(3GPP TS 24.007 11.2.3.1.5)
+const (
+	DefaultBearerID = 5
+	MaxBearerID     = 15
+)
+
+// UE的EPS承载，专用承载对应PCRF安装的一个PCC规则，规则删除时删除
+// 没有PCRF时专用承载由P-CSCF直接请求，规则名为会话的Call-ID，会话结束时删除
+type Bearer struct {
+	ID     int
+	QCI    int
+	GBR    int    // 保证比特率，单位kbps，默认承载为0
+	CallID string // 专用承载所属会话的Call-ID，默认承载为空
+	Rule   string // 专用承载对应的规则名
+}
+
+// UE附着时建立的默认承载
+func defaultBearer() *Bearer {
+	return &Bearer{ID: DefaultBearerID, QCI: QCIIMSSignalling}
+}
+
+// 按规则建立专用承载，规则已经安装时返回已有的承载和false
+func (uc *UEContext) addBearer(callID string, rule QosRule) (*Bearer, bool, error) {
+	used := make(map[int]bool)
+	for _, b := range uc.Bearers {
+		if b.ID != DefaultBearerID && b.Rule == rule.Name {
+			return b, false, nil
+		}
+		used[b.ID] = true
+	}
+	for id := DefaultBearerID + 1; id <= MaxBearerID; id++ {
+		if !used[id] {
+			b := &Bearer{ID: id, QCI: rule.QCI, GBR: rule.GBR, CallID: callID, Rule: rule.Name}
+			uc.Bearers = append(uc.Bearers, b)
+			return b, true, nil
+		}
+	}
+	return nil, false, ErrNoBearerID
+}
+
+// 删除规则对应的专用承载，规则未安装时返回nil
+func (uc *UEContext) removeBearer(rule string) *Bearer {
+	for i, b := range uc.Bearers {
+		if b.ID != DefaultBearerID && b.Rule == rule {
+			uc.Bearers = append(uc.Bearers[:i], uc.Bearers[i+1:]...)
+			return b
+		}
+	}
+	return nil
+}
+
+// 删除会话的专用承载，返回被删除的承载
+func (uc *UEContext) removeBearers(callID string) []*Bearer {
+	var removed []*Bearer
+	kept := uc.Bearers[:0]
+	for _, b := range uc.Bearers {
+		if b.ID != DefaultBearerID && b.CallID == callID {
+			removed = append(removed, b)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	uc.Bearers = kept
+	return removed
+}
+
+// 专用承载默认的保证比特率，语音和视频以外的承载不保证比特率
+func defaultGBR(qci int) int {
+	switch qci {
+	case QCIConversationalVoice:
+		return DefaultVoiceBitrate
+	case QCIConversationalVideo:
+		return DefaultVideoBitrate
+	}
+	return 0
+}
+
+// 按IMS用户名查找UE上下文
+func (p *PgwEntity) ueByUserName(name string) *UEContext {
+	if len(name) == 0 {
+		return nil
+	}
+	for k, v := range p.pCache.Items() {
+		if !strings.HasPrefix(k, UEPrefix) {
+			continue
+		}
+		if uc := v.Object.(*UEContext); uc.UserName == name {
+			return uc
+		}
+	}
+	return nil
+}
+
+// PCRF安装或删除用户的PCC规则(Gx RAR)，先删除再安装，每个规则对应一个专用承载
+func (p *PgwEntity) ReAuthRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From PCRF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	callID := args[EPC_CALL_ID]
+	response := map[string]string{
+		EPC_USER_NAME: args[EPC_USER_NAME],
+		EPC_CALL_ID:   callID,
+		CX_RESULT:     ResultSuccess,
+	}
+	defer func() {
+		pkg.SetShortConn(p.conf.Elements["PCRF"].ActualAddr)
+		pkg.Construct(modules.EPCPROTOCAL, modules.ReAuthAnswer, modules.StrLineMarshal(response))
+		modules.Send(pkg, up)
+	}()
+	uc := p.ueByUserName(args[EPC_USER_NAME])
+	if uc == nil {
+		response[CX_RESULT] = ResultUnknownSessionID
+		return ErrUEContextNotExist
+	}
+	for _, name := range unmarshalRuleNames(args) {
+		b := uc.removeBearer(name)
+		if b == nil {
+			continue
+		}
+		logger.Info("[%v] PGW删除专用承载 IMSI=%v EBI=%v 规则=%v", ctx.Value("Entity"), uc.IMSI, b.ID, b.Rule)
+		request := map[string]string{
+			EPC_UE_IDENTITY: uc.IMSI,
+			EPC_CELL_ID:     uc.EnbID,
+			EPC_BEARER_ID:   strconv.Itoa(b.ID),
+		}
+		p.toUE(ctx, uc, modules.DeleteBearerRequest, request, up, down)
+	}
+	for _, r := range unmarshalRules(args) {
+		b, created, err := uc.addBearer(callID, r)
+		if err != nil {
+			response[CX_RESULT] = ResultUnableToComply
+			return err
+		}
+		if !created {
+			continue
+		}
+		logger.Info("[%v] PGW建立专用承载 IMSI=%v EBI=%v QCI=%v GBR=%v 规则=%v", ctx.Value("Entity"), uc.IMSI, b.ID, b.QCI, b.GBR, b.Rule)
+		request := map[string]string{
+			EPC_UE_IDENTITY: uc.IMSI,
+			EPC_CELL_ID:     uc.EnbID,
+			EPC_BEARER_ID:   strconv.Itoa(b.ID),
+			EPC_QCI:         strconv.Itoa(b.QCI),
+			EPC_GBR:         strconv.Itoa(b.GBR),
+		}
+		p.toUE(ctx, uc, modules.CreateBearerRequest, request, up, down)
+	}
+	return nil
+}
+
+// 没有PCRF时P-CSCF收到SDP应答后为UE请求专用承载，同一会话只建立一次
+func (p *PgwEntity) BearerResourceAllocationF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	callID := args[EPC_CALL_ID]
+	if len(callID) == 0 {
+		return ErrCallIDNotExist
+	}
+	qci, err := strconv.Atoi(args[EPC_QCI])
+	if err != nil || qci < 1 || qci == QCIIMSSignalling || qci > 9 {
+		return ErrUnsupportedQCI
+	}
+	uc := p.ueByUserName(args[EPC_USER_NAME])
+	if uc == nil {
+		return ErrUEContextNotExist
+	}
+	b, created, err := uc.addBearer(callID, QosRule{Name: callID, QCI: qci, GBR: defaultGBR(qci)})
+	if err != nil || !created {
+		return err
+	}
+	logger.Info("[%v] PGW建立专用承载 IMSI=%v EBI=%v QCI=%v Call-ID=%v", ctx.Value("Entity"), uc.IMSI, b.ID, b.QCI, callID)
+	request := map[string]string{
+		EPC_UE_IDENTITY: uc.IMSI,
+		EPC_CELL_ID:     uc.EnbID,
+		EPC_BEARER_ID:   strconv.Itoa(b.ID),
+		EPC_QCI:         strconv.Itoa(b.QCI),
+		EPC_GBR:         strconv.Itoa(b.GBR),
+	}
+	p.toUE(ctx, uc, modules.CreateBearerRequest, request, up, down)
+	return nil
+}
+
+// 没有PCRF时IMS会话结束，删除各个UE上该会话的专用承载
+func (p *PgwEntity) BearerResourceReleaseF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+	logger.Info("[%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	callID := modules.StrLineUnmarshal(pkg.GetData())[EPC_CALL_ID]
+	if len(callID) == 0 {
+		return ErrCallIDNotExist
+	}
+	for k, v := range p.pCache.Items() {
+		if !strings.HasPrefix(k, UEPrefix) {
+			continue
+		}
+		uc := v.Object.(*UEContext)
+		for _, b := range uc.removeBearers(callID) {
+			logger.Info("[%v] PGW删除专用承载 IMSI=%v EBI=%v Call-ID=%v", ctx.Value("Entity"), uc.IMSI, b.ID, callID)
+			request := map[string]string{
+				EPC_UE_IDENTITY: uc.IMSI,
+				EPC_CELL_ID:     uc.EnbID,
+				EPC_BEARER_ID:   strconv.Itoa(b.ID),
+			}
+			p.toUE(ctx, uc, modules.DeleteBearerRequest, request, up, down)
+		}
+	}
+	return nil
+}
+
+// 向UE发送承载管理的消息，经MME附着时发给MME，由MME转发给UE，否则经UE附着的基站发送
+func (p *PgwEntity) toUE(ctx context.Context, uc *UEContext, method byte, args map[string]string, up, down chan *modules.Package) {
+	pkg := new(modules.Package)
+	pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(args))
+	if len(uc.Mme) > 0 {
+		pkg.SetShortConn(uc.Mme)
+		modules.Send(pkg, up)
+		return
+	}
+	raddr := p.pCache.getAddress(AddrPrefix + uc.EnbID)
+	if raddr == nil || uc.enb == nil {
+		logger.Warn("[%v] PGW无法通知UE IMSI=%v 基站=%v", ctx.Value("Entity"), uc.IMSI, uc.EnbID)
+		return
+	}
+	pkg.SetLongConn(uc.enb)
+	pkg.SetLongAddr(raddr)
+	modules.Send(pkg, down)
+}
@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotEnoughIP = errors.New("ErrNotEnoughIP")
+	ErrIPInUse     = errors.New("ErrIPInUse")
+	ErrInvalidIP   = errors.New("ErrInvalidIP")
+	ErrIPOutOfPool = errors.New("ErrIPOutOfPool")
+)
+
+// 默认的租约时间，UE在租约内重新附着时续租，到期后地址被回收
+var (
+	DefaultLeaseTime   = 24 * time.Hour
+	LeaseSweepInterval = time.Minute
+)
+
+// UE的地址租约，按前缀分配时Key为前缀的起始地址
+type Lease struct {
+	IMSI   string
+	Key    net.IP
+	Unit   int  // 前缀长度，与地址池相同
+	Static bool // users.ip中配置的静态地址
+	Expire time.Time
+}
+
+// UE使用的地址，按/64前缀分配时接口标识为::1
+func (l *Lease) Address() net.IP {
+	if l.Unit == 64 {
+		return addIP(l.Key, 128, 1)
+	}
+	if v4 := l.Key.To4(); v4 != nil {
+		return v4
+	}
+	return l.Key
+}
+
+// 分配给UE的前缀，按地址分配时为nil
+func (l *Lease) Prefix() *net.IPNet {
+	if l.Unit != 64 {
+		return nil
+	}
+	return &net.IPNet{IP: l.Key, Mask: net.CIDRMask(64, 128)}
+}
+
+// 持久化时的地址，前缀使用CIDR格式
+func (l *Lease) String() string {
+	if p := l.Prefix(); p != nil {
+		return p.String()
+	}
+	return l.Address().String()
+}
+
+// 地址池的使用情况
+type PoolUsage struct {
+	Total  uint64 // 可以分配的地址或前缀个数，超过uint64时为最大值
+	Used   int    // 已分配的租约
+	Static int    // 已分配的租约中的静态地址
+}
+
+// 地址池上的分配器，按UE记录租约，释放的地址可以重新分配
+type IPAllocator struct {
+	sync.Mutex
+	pool     *Pool
+	ttl      time.Duration
+	leases   map[string]*Lease // 地址或前缀 -> 租约
+	ues      map[string]*Lease // IMSI -> 租约
+	reserved map[string]string // 用户的静态地址 -> IMSI，不参与动态分配
+}
+
+func NewIPAllocator(pool *Pool, ttl time.Duration) *IPAllocator {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTime
+	}
+	return &IPAllocator{
+		pool:     pool,
+		ttl:      ttl,
+		leases:   make(map[string]*Lease),
+		ues:      make(map[string]*Lease),
+		reserved: make(map[string]string),
+	}
+}
+
+// 地址在池中对应的分配单位
+func (a *IPAllocator) key(ip net.IP) net.IP {
+	return ip.To16().Mask(net.CIDRMask(a.pool.Unit, 128))
+}
+
+// 地址族与地址池相同
+func (a *IPAllocator) Accepts(ip net.IP) bool {
+	return (ip.To4() != nil) == (a.pool.FirstIP.To4() != nil)
+}
+
+// 地址在池中可以分配的范围内，网段的第一个地址和广播地址不能分配
+func (a *IPAllocator) Contains(ip net.IP) bool {
+	key := a.key(ip)
+	return bytes.Compare(key, a.pool.FirstIP.To16()) >= 0 && bytes.Compare(key, a.pool.LastIP.To16()) <= 0
+}
+
+// 为用户保留静态地址，动态分配时跳过，多个用户配置了同一地址时保留给先配置的用户
+func (a *IPAllocator) Reserve(imsi string, ip net.IP) {
+	a.Lock()
+	defer a.Unlock()
+	k := a.key(ip).String()
+	if _, ok := a.reserved[k]; !ok {
+		a.reserved[k] = imsi
+	}
+}
+
+// 为UE分配地址，已有租约时续租，static不为nil时分配静态地址
+// 没有IMSI的UE每次分配新的地址
+func (a *IPAllocator) Allocate(imsi string, static net.IP, now time.Time) (*Lease, error) {
+	a.Lock()
+	defer a.Unlock()
+	if l, ok := a.ues[imsi]; ok && len(imsi) > 0 {
+		if static == nil || a.key(static).Equal(l.Key) {
+			l.Expire = now.Add(a.ttl)
+			ret := *l
+			return &ret, nil
+		}
+		// 静态地址发生变化
+		a.release(l)
+	}
+	var key net.IP
+	if static != nil {
+		if !a.Accepts(static) || !a.Contains(static) {
+			return nil, ErrIPOutOfPool
+		}
+		key = a.key(static)
+		if l, ok := a.leases[key.String()]; ok && l.IMSI != imsi {
+			return nil, ErrIPInUse
+		}
+		if owner, ok := a.reserved[key.String()]; ok && owner != imsi {
+			return nil, ErrIPInUse
+		}
+	} else {
+		var err error
+		if key, err = a.next(); err != nil {
+			return nil, err
+		}
+	}
+	l := &Lease{IMSI: imsi, Key: key, Unit: a.pool.Unit, Static: static != nil, Expire: now.Add(a.ttl)}
+	a.add(l)
+	ret := *l
+	return &ret, nil
+}
+
+// 从上次分配的位置向后查找空闲的地址，到达末尾后从头查找
+func (a *IPAllocator) next() (net.IP, error) {
+	a.pool.Lock()
+	defer a.pool.Unlock()
+	// 地址池为空时从头查找的地址也在网段以外
+	if bytes.Compare(a.pool.FirstIP, a.pool.LastIP) > 0 {
+		return nil, ErrNotEnoughIP
+	}
+	cur := a.pool.CurIP
+	// 最多检查已占用个数加一个位置，其中必有空闲的地址
+	for i := 0; i <= len(a.leases)+len(a.reserved); i++ {
+		cur = addIP(cur, a.pool.Unit, 1)
+		if bytes.Compare(cur, a.pool.LastIP) > 0 || bytes.Compare(cur, a.pool.FirstIP) < 0 {
+			cur = a.pool.FirstIP
+		}
+		k := cur.String()
+		_, leased := a.leases[k]
+		if _, reserved := a.reserved[k]; !leased && !reserved {
+			a.pool.CurIP = cur
+			return cur, nil
+		}
+		if cur.Equal(a.pool.CurIP) {
+			break
+		}
+	}
+	return nil, ErrNotEnoughIP
+}
+
+func (a *IPAllocator) add(l *Lease) {
+	a.leases[l.Key.String()] = l
+	if len(l.IMSI) > 0 {
+		a.ues[l.IMSI] = l
+	}
+}
+
+func (a *IPAllocator) release(l *Lease) {
+	delete(a.leases, l.Key.String())
+	if a.ues[l.IMSI] == l {
+		delete(a.ues, l.IMSI)
+	}
+}
+
+// 撤销刚分配的租约，UE的其他地址族分配失败时使用
+func (a *IPAllocator) Cancel(l *Lease) {
+	a.Lock()
+	defer a.Unlock()
+	if cur, ok := a.leases[l.Key.String()]; ok && cur.IMSI == l.IMSI {
+		a.release(cur)
+	}
+}
+
+// 恢复持久化的租约，已到期、不在地址池范围内或地址已经恢复过的租约被忽略
+func (a *IPAllocator) Restore(l *Lease, now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+	if !l.Expire.After(now) || !a.Accepts(l.Key) || !a.Contains(l.Key) {
+		return false
+	}
+	key := a.key(l.Key)
+	if _, ok := a.leases[key.String()]; ok {
+		return false
+	}
+	l.Key = key
+	l.Unit = a.pool.Unit
+	a.add(l)
+	return true
+}
+
+// 释放UE的租约，返回被释放的租约
+func (a *IPAllocator) Release(imsi string) (*Lease, bool) {
+	a.Lock()
+	defer a.Unlock()
+	l, ok := a.ues[imsi]
+	if !ok {
+		return nil, false
+	}
+	a.release(l)
+	return l, true
+}
+
+// 回收到期的租约
+func (a *IPAllocator) Expire(now time.Time) []*Lease {
+	a.Lock()
+	defer a.Unlock()
+	var expired []*Lease
+	for _, l := range a.leases {
+		if !l.Expire.After(now) {
+			expired = append(expired, l)
+		}
+	}
+	for _, l := range expired {
+		a.release(l)
+	}
+	return expired
+}
+
+// 地址池的使用情况
+func (a *IPAllocator) Usage() PoolUsage {
+	a.Lock()
+	defer a.Unlock()
+	u := PoolUsage{Used: len(a.leases)}
+	for _, l := range a.leases {
+		if l.Static {
+			u.Static++
+		}
+	}
+	first := new(big.Int).SetBytes(a.pool.FirstIP.To16())
+	last := new(big.Int).SetBytes(a.pool.LastIP.To16())
+	total := last.Sub(last, first)
+	total.Rsh(total, uint(128-a.pool.Unit))
+	total.Add(total, big.NewInt(1))
+	if total.IsUint64() {
+		u.Total = total.Uint64()
+	} else {
+		u.Total = math.MaxUint64
+	}
+	return u
+}
+
+// users.ip中的地址，多个地址以逗号分隔，按地址族选择
+func parseStaticIPs(str string) (ips []net.IP) {
+	for _, s := range strings.Split(str, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(s)); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return
+}
+
+// 持久化的租约地址，前缀为CIDR格式
+func parseLeaseKey(str string) (net.IP, error) {
+	if strings.Contains(str, "/") {
+		ip, _, err := net.ParseCIDR(str)
+		return ip, err
+	}
+	if ip := net.ParseIP(str); ip != nil {
+		return ip, nil
+	}
+	return nil, ErrInvalidIP
+}
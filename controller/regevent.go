@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/VegetableManII/volte/sip"
+)
+
+// 注册状态事件订阅的有效时间(秒)，P-CSCF和UE订阅时使用600000(3GPP TS 24.229 5.2.3)
+const (
+	DefaultRegSubExpires = 600000
+	MinRegSubExpires     = 60
+)
+
+var (
+	ErrSubscriptionNotExist = errors.New("ErrSubscriptionNotExist")
+	ErrSubscribeForbidden   = errors.New("ErrSubscribeForbidden")
+	ErrSubscribeOutOfOrder  = errors.New("ErrSubscribeOutOfOrder")
+)
+
+// S-CSCF作为通知方维护的一个注册状态事件订阅(RFC3680)
+// 对话的本端为S-CSCF，对端为订阅者
+type RegSubscription struct {
+	ID          sip.DialogID // Call-ID + 本端标签(To) + 对端标签(From)
+	AOR         sip.URI      // 订阅的公共用户标识
+	Subscriber  sip.User     // 订阅者(From)
+	Target      sip.URI      // 订阅者的Contact，NOTIFY的Request-URI
+	RouteSet    []sip.User   // NOTIFY的路由集合，即SUBSCRIBE的Record-Route
+	AccessPoint string       // 订阅者为UE时的接入基站
+	Expires     time.Time    // 订阅的过期时间
+	RemoteSeq   int          // 订阅者最近一次SUBSCRIBE的CSeq
+	LocalSeq    int          // 本端最近一次NOTIFY的CSeq
+	Version     int          // 下一次通知的reginfo版本号(RFC3680-5.3)
+}
+
+// 注册状态事件的通知方，按对话标识保存订阅
+type RegEventServer struct {
+	sync.Mutex
+	subs map[string]*RegSubscription
+	now  func() time.Time
+}
+
+func NewRegEventServer() *RegEventServer {
+	return &RegEventServer{
+		subs: make(map[string]*RegSubscription),
+		now:  time.Now,
+	}
+}
+
+// 处理SUBSCRIBE，To没有标签时创建新的订阅，否则刷新已有的订阅
+// 返回订阅和本次授予的有效时间，有效时间为0时订阅已删除，需要发送最后一次通知
+func (e *RegEventServer) Subscribe(req *sip.Message) (*RegSubscription, int, error) {
+	expires := DefaultRegSubExpires
+	if v, ok := req.Header.Expires.Value(); ok {
+		expires = v
+	}
+	if expires > 0 && expires < MinRegSubExpires {
+		return nil, 0, ErrIntervalTooBrief
+	}
+	if expires > DefaultRegSubExpires {
+		expires = DefaultRegSubExpires
+	}
+	e.Lock()
+	defer e.Unlock()
+	now := e.now()
+	var sub *RegSubscription
+	if toTag, err := req.Header.To.Arguments.Get("tag"); err == nil {
+		fromTag, _ := req.Header.From.Arguments.Get("tag")
+		id := sip.DialogID{CallID: req.Header.CallID, LocalTag: toTag, RemoteTag: fromTag}
+		if sub = e.subs[id.String()]; sub == nil {
+			return nil, 0, ErrSubscriptionNotExist
+		}
+		if req.Header.CSeq.CSeq <= sub.RemoteSeq {
+			return nil, 0, ErrSubscribeOutOfOrder
+		}
+	} else {
+		fromTag, _ := req.Header.From.Arguments.Get("tag")
+		aor := req.RequestLine.RequestURI
+		aor.Arguments = sip.Args{}
+		sub = &RegSubscription{
+			ID:         sip.DialogID{CallID: req.Header.CallID, LocalTag: sip.NewTag(), RemoteTag: fromTag},
+			AOR:        aor,
+			Subscriber: req.Header.From,
+			RouteSet:   req.Header.RecordRoute.Items(),
+		}
+		e.subs[sub.ID.String()] = sub
+	}
+	sub.RemoteSeq = req.Header.CSeq.CSeq
+	sub.AccessPoint = req.Header.AccessNetworkInfo
+	if contact, ok := req.Header.Contact.FirstItem(); ok {
+		sub.Target = contact.URI
+	}
+	sub.Expires = now.Add(time.Duration(expires) * time.Second)
+	if expires == 0 {
+		delete(e.subs, sub.ID.String())
+	}
+	return sub, expires, nil
+}
+
+// 查询订阅了指定用户注册状态的全部订阅
+func (e *RegEventServer) ByAOR(name string) []*RegSubscription {
+	e.Lock()
+	defer e.Unlock()
+	var result []*RegSubscription
+	for _, sub := range e.subs {
+		if sub.AOR.Username == name {
+			result = append(result, sub)
+		}
+	}
+	return result
+}
+
+// 删除订阅
+func (e *RegEventServer) Remove(id sip.DialogID) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.subs, id.String())
+}
+
+// 删除并返回已过期的订阅
+func (e *RegEventServer) Expire() []*RegSubscription {
+	e.Lock()
+	defer e.Unlock()
+	now := e.now()
+	var expired []*RegSubscription
+	for key, sub := range e.subs {
+		if !sub.Expires.After(now) {
+			expired = append(expired, sub)
+			delete(e.subs, key)
+		}
+	}
+	return expired
+}
+
+// 构造发给订阅者的NOTIFY(RFC6665-4.2.2)，每次通知CSeq和reginfo版本号递增
+func (e *RegEventServer) Notify(sub *RegSubscription, state sip.SubscriptionState, reg sip.Registration, contact sip.URI) *sip.Message {
+	e.Lock()
+	sub.LocalSeq++
+	info := sip.RegInfo{Version: sub.Version, State: sip.RegInfoFull, Registrations: []sip.Registration{reg}}
+	sub.Version++
+	if state.State != sip.SubscriptionTerminated {
+		if state.Expires = int(sub.Expires.Sub(e.now()) / time.Second); state.Expires < 0 {
+			state.Expires = 0
+		}
+	}
+	from := sip.User{URI: sub.AOR, Arguments: sip.Args{}}
+	from.Arguments.Set("tag", sub.ID.LocalTag)
+	to := sub.Subscriber
+	e.Unlock()
+
+	req := sip.NewRequest(sip.MethodNotify, sub.Target, from, to, sub.ID.CallID, sub.LocalSeq)
+	req.Header.Route.Prepend(sub.RouteSet...)
+	req.Header.Contact.Add(sip.User{URI: contact, Arguments: sip.Args{}})
+	req.Header.Event = &sip.Event{Type: sip.EventReg}
+	req.Header.SubscriptionState = &state
+	req.Header.AccessNetworkInfo = sub.AccessPoint
+	req.Header.ContentType = sip.ContentTypeRegInfo
+	req.Body = info.String()
+	return req
+}
+
+// 用户的注册状态，active为当前有效的绑定，removed为本次删除的绑定，event为删除的原因
+func regRegistration(aor sip.URI, active, removed []Binding, event string, now time.Time) sip.Registration {
+	reg := sip.Registration{
+		AOR:   aor.String(),
+		ID:    regInfoID(aor.String()),
+		State: sip.RegStateActive,
+	}
+	if len(active) == 0 {
+		reg.State = sip.RegStateTerminated
+	}
+	for _, b := range active {
+		ev := sip.RegEventRegistered
+		if b.Refreshed {
+			ev = sip.RegEventRefreshed
+		}
+		reg.Contacts = append(reg.Contacts, regContact(b, sip.RegStateActive, ev, now))
+	}
+	for _, b := range removed {
+		reg.Contacts = append(reg.Contacts, regContact(b, sip.RegStateTerminated, event, now))
+	}
+	return reg
+}
+
+func regContact(b Binding, state, event string, now time.Time) sip.RegContact {
+	c := sip.RegContact{
+		ID:     regInfoID(b.Contact.URI.String()),
+		State:  state,
+		Event:  event,
+		CallID: b.CallID,
+		CSeq:   b.CSeq,
+		URI:    b.Contact.URI.String(),
+	}
+	if state == sip.RegStateActive {
+		c.Expires = b.ExpiresIn(now)
+	}
+	return c
+}
+
+// 注册和联系地址在reginfo中的标识，同一个地址的标识保持不变
+func regInfoID(str string) string {
+	sum := md5.Sum([]byte(str))
+	return hex.EncodeToString(sum[:6])
+}
+
+// 已有绑定中被本次注册删除的绑定
+func removedBindings(before, after []Binding) (removed []Binding) {
+	for _, old := range before {
+		found := false
+		for _, b := range after {
+			if b.Contact.URI.IsEqual(old.Contact.URI) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			removed = append(removed, old)
+		}
+	}
+	return
+}
@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VegetableManII/volte/sip"
+)
+
+// 注册绑定的过期时间(秒)
+const (
+	DefaultExpires = 3600   // 请求中未指定过期时间时使用
+	MinExpires     = 60     // 小于该值的注册请求返回423
+	MaxExpires     = 600000 // 大于该值时缩短为该值
+)
+
+var (
+	ErrIntervalTooBrief    = errors.New("ErrIntervalTooBrief")
+	ErrInvalidWildcard     = errors.New("ErrInvalidWildcard")
+	ErrRegisterOutOfOrder  = errors.New("ErrRegisterOutOfOrder")
+	ErrInvalidContactParam = errors.New("ErrInvalidContactParam")
+)
+
+// 公共用户标识(IMPU)注册的一个联系地址
+type Binding struct {
+	AOR         sip.URI    // 注册的公共用户标识，取自To
+	Contact     sip.User   // 联系地址，保留+sip.instance等参数
+	Expires     time.Time  // 过期时间
+	CallID      string     // 建立绑定的注册请求的Call-ID
+	CSeq        int        // 建立绑定的注册请求的CSeq
+	AccessPoint string     // 接入基站
+	Path        []sip.User // 注册请求经过的代理(RFC3327)，发往用户的请求以此为路由
+	Updated     time.Time  // 最近一次注册或刷新的时间
+	Refreshed   bool       // 是否由刷新注册更新
+}
+
+// 剩余的有效时间(秒)
+func (b Binding) ExpiresIn(now time.Time) int {
+	if d := b.Expires.Sub(now); d > 0 {
+		return int((d + time.Second - 1) / time.Second)
+	}
+	return 0
+}
+
+// S-CSCF的注册服务器，按用户名保存联系地址绑定(RFC3261-10.3)
+type Registrar struct {
+	sync.Mutex
+	bindings map[string][]*Binding
+	now      func() time.Time
+}
+
+func NewRegistrar() *Registrar {
+	return &Registrar{
+		bindings: make(map[string][]*Binding),
+		now:      time.Now,
+	}
+}
+
+// 处理鉴权通过的注册请求，返回处理后用户全部有效的绑定
+// 请求中没有Contact时只查询，Expires为0时删除对应绑定，"*"删除全部绑定
+func (r *Registrar) Register(req *sip.Message) ([]Binding, error) {
+	r.Lock()
+	defer r.Unlock()
+	aor := req.Header.To.URI
+	aor.Arguments = sip.Args{}
+	name := aor.Username
+	now := r.now()
+	r.purge(name, now)
+
+	if req.Header.Contact.IsWildcard() {
+		// "*"只能单独出现且Expires必须为0(RFC3261-10.3 step 6)
+		if req.Header.Contact.Len() > 0 || !req.Header.Expires.IsRequestLogOut() {
+			return nil, ErrInvalidWildcard
+		}
+		for _, b := range r.bindings[name] {
+			if b.CallID == req.Header.CallID && req.Header.CSeq.CSeq <= b.CSeq {
+				return nil, ErrRegisterOutOfOrder
+			}
+		}
+		delete(r.bindings, name)
+		return nil, nil
+	}
+
+	contacts := req.Header.Contact.Items()
+	expires := make([]int, len(contacts))
+	for i, contact := range contacts {
+		e, err := contactExpires(contact, req.Header.Expires)
+		if err != nil {
+			return nil, err
+		}
+		if e > 0 && e < MinExpires {
+			return nil, ErrIntervalTooBrief
+		}
+		if e > MaxExpires {
+			e = MaxExpires
+		}
+		expires[i] = e
+		// 同一个Call-ID的请求CSeq必须递增，否则整个请求不生效(RFC3261-10.3 step 7)
+		if b := r.find(name, contact.URI); b != nil && b.CallID == req.Header.CallID && req.Header.CSeq.CSeq <= b.CSeq {
+			return nil, ErrRegisterOutOfOrder
+		}
+	}
+	for i, contact := range contacts {
+		b := r.find(name, contact.URI)
+		if expires[i] == 0 {
+			if b != nil {
+				r.remove(name, b)
+			}
+			continue
+		}
+		refreshed := b != nil
+		if !refreshed {
+			b = new(Binding)
+			r.bindings[name] = append(r.bindings[name], b)
+		}
+		contact.Arguments = contact.Arguments.Clone()
+		contact.Arguments.Del("expires")
+		*b = Binding{
+			AOR:         aor,
+			Contact:     contact,
+			Expires:     now.Add(time.Duration(expires[i]) * time.Second),
+			CallID:      req.Header.CallID,
+			CSeq:        req.Header.CSeq.CSeq,
+			AccessPoint: req.Header.AccessNetworkInfo,
+			Path:        req.Header.Path.Items(),
+			Updated:     now,
+			Refreshed:   refreshed,
+		}
+	}
+	if len(r.bindings[name]) == 0 {
+		delete(r.bindings, name)
+	}
+	return r.list(name), nil
+}
+
+// 查询用户全部有效的绑定，最近注册的在前
+func (r *Registrar) Bindings(name string) []Binding {
+	r.Lock()
+	defer r.Unlock()
+	r.purge(name, r.now())
+	return r.list(name)
+}
+
+// 查询发往用户的请求使用的绑定，暂不支持分叉，使用最近注册的联系地址
+func (r *Registrar) Lookup(name string) (Binding, bool) {
+	bindings := r.Bindings(name)
+	if len(bindings) == 0 {
+		return Binding{}, false
+	}
+	return bindings[0], true
+}
+
+// 删除全部用户已过期的绑定，返回按用户名分组的过期绑定
+func (r *Registrar) Expire() map[string][]Binding {
+	r.Lock()
+	defer r.Unlock()
+	now := r.now()
+	expired := make(map[string][]Binding)
+	for name, bindings := range r.bindings {
+		for _, b := range bindings {
+			if !b.Expires.After(now) {
+				expired[name] = append(expired[name], *b)
+			}
+		}
+		if len(expired[name]) > 0 {
+			r.purge(name, now)
+		}
+	}
+	return expired
+}
+
+// 网络侧注销用户，删除全部绑定并返回删除前有效的绑定
+func (r *Registrar) RemoveAll(name string) []Binding {
+	r.Lock()
+	defer r.Unlock()
+	r.purge(name, r.now())
+	removed := r.list(name)
+	delete(r.bindings, name)
+	return removed
+}
+
+// 将绑定写入注册应答的Contact，expires参数为剩余的有效时间(RFC3261-10.3 step 8)
+func (r *Registrar) ContactList(bindings []Binding) (list sip.ContactList) {
+	now := r.now()
+	for _, b := range bindings {
+		contact := b.Contact
+		contact.Arguments = contact.Arguments.Clone()
+		contact.Arguments.Set("expires", strconv.Itoa(b.ExpiresIn(now)))
+		list.Add(contact)
+	}
+	return
+}
+
+func (r *Registrar) find(name string, uri sip.URI) *Binding {
+	for _, b := range r.bindings[name] {
+		if b.Contact.URI.IsEqual(uri) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (r *Registrar) remove(name string, target *Binding) {
+	bindings := r.bindings[name]
+	for i, b := range bindings {
+		if b == target {
+			r.bindings[name] = append(bindings[:i], bindings[i+1:]...)
+			return
+		}
+	}
+}
+
+// 删除已过期的绑定
+func (r *Registrar) purge(name string, now time.Time) {
+	var alive []*Binding
+	for _, b := range r.bindings[name] {
+		if b.Expires.After(now) {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) == 0 {
+		delete(r.bindings, name)
+		return
+	}
+	r.bindings[name] = alive
+}
+
+func (r *Registrar) list(name string) []Binding {
+	result := make([]Binding, 0, len(r.bindings[name]))
+	for _, b := range r.bindings[name] {
+		result = append(result, *b)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Updated.After(result[j].Updated) })
+	return result
+}
+
+// 联系地址的过期时间，Contact的expires参数优先于Expires头域(RFC3261-10.2.1.1)
+func contactExpires(contact sip.User, header sip.Expires) (int, error) {
+	if v, err := contact.Arguments.Get("expires"); err == nil {
+		e, err := strconv.Atoi(v)
+		if err != nil || e < 0 {
+			return 0, ErrInvalidContactParam
+		}
+		return e, nil
+	}
+	if e, ok := header.Value(); ok {
+		return e, nil
+	}
+	return DefaultExpires, nil
+}
@@ -11,9 +11,9 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/modules"
@@ -28,24 +28,63 @@ type S_CscfEntity struct {
 	core chan *modules.Package
 	Host string
 	*Mux
-	sCache *Cache
+	conf      *config.Network
+	sCache    *Cache
+	registrar *Registrar
+	regEvent  *RegEventServer
+	server    *sip.Server
+	txLayer   *sip.TransactionLayer
+	dialogs   *sip.DialogSet
 }
 
+// 会话主被叫两侧的接入信息，由初始INVITE确定，对话内的请求按Route路由
+type Call struct {
+	CallerAccessPoint string // 主叫接入基站，为空时不需要修改
+	CalleeAccessPoint string // 被叫接入基站，为空时不需要修改
+}
+
+// Service-Route中标识主叫侧请求的用户名(3GPP TS 24.229)
+const OrigUser = "orig"
+
+// 检查注册绑定和注册状态订阅是否过期的间隔
+var RegSweepInterval = 10 * time.Second
+
 // 暂时先试用固定的uri，后期实现dns使用域名加IP的映射方式
-func (s *S_CscfEntity) Init(domain, host string) {
+func (s *S_CscfEntity) Init(conf *config.Network) {
 	s.Mux = new(Mux)
-	s.Host = host
-	sip.ServerDomain = domain
-	sip.ServerIP = strings.Split(host, ":")[0]
-	sip.ServerPort, _ = strconv.Atoi(strings.Split(host, ":")[1])
+	s.conf = conf
+	s.Host = conf.Elements["SCSCF"].ActualAddr
+	server, err := sip.NewServer(conf.Host("s-cscf"), s.Host)
+	if err != nil {
+		logger.Fatal("监听地址格式错误 %v", err)
+	}
+	s.server = server
 	s.router = make(map[[2]byte]BaseSignallingT)
 	s.sCache = initCache()
+	s.registrar = NewRegistrar()
+	s.regEvent = NewRegEventServer()
+	s.txLayer = sip.NewTransactionLayer()
+	s.dialogs = sip.NewDialogSet()
+}
+
+// 注册消息路由
+func (s *S_CscfEntity) RegistRouter() {
+	s.Regist([2]byte{modules.SIPPROTOCAL, modules.SipRequest}, s.SIPREQUESTF)
+	s.Regist([2]byte{modules.EPCPROTOCAL, modules.MultiMediaAuthenticationAnswer}, s.MutimediaAuthorizationAnswerF)
+	s.Regist([2]byte{modules.EPCPROTOCAL, modules.ServerAssignmentAnswer}, s.ServerAssignmentAnswerF)
+	s.Regist([2]byte{modules.EPCPROTOCAL, modules.RegistrationTerminationRequest}, s.RegistrationTerminationRequestF)
+	s.Regist([2]byte{modules.SIPPROTOCAL, modules.SipResponse}, s.SIPRESPONSEF)
+	s.Regist([2]byte{modules.EPCPROTOCAL, modules.DetachIndication}, s.DetachIndicationF)
 }
 
 func (s *S_CscfEntity) CoreProcessor(ctx context.Context, in, up, down chan *modules.Package) {
 	s.core = in
+	sweep := time.NewTicker(RegSweepInterval)
+	defer sweep.Stop()
 	for {
 		select {
+		case <-sweep.C:
+			s.sweepRegistrations(ctx, up, down)
 		case pkg := <-in:
 			f, ok := s.router[pkg.GetRoute()]
 			if !ok {
@@ -72,107 +111,240 @@ func (s *S_CscfEntity) SIPREQUESTF(ctx context.Context, pkg *modules.Package, up
 	if err != nil {
 		return err
 	}
-	// 增加Via头部信息
+	logger.Info("[%v][%v] Receive SIP Request: \n%v", ctx.Value("Entity"), s.server.Domain, string(pkg.GetData()))
 	user := sipreq.Header.From.Username()
 	sipreq.Header.MaxForwards.Reduce()
-	sipreq.Header.Via.SetReceivedInfo("UDP", fmt.Sprintf("%s:%d", sip.ServerIP, sip.ServerPort))
+	sipreq.Header.Via.SetReceivedInfo(pkg.GetTransport(), pkg.GetRemoteAddr())
+	send, err := responseSender(&sipreq, nil, up, down)
+	if err != nil {
+		return err
+	}
+	// 通过Service-Route到达的请求为主叫侧请求，经AS返回的请求按ODI继续之前的iFC评估
+	route, _ := sipreq.PreprocessRoute(s.server)
+	originating := route.URI.Username == OrigUser
+	var state *IfcState
+	if odi := route.URI.Username; strings.HasPrefix(odi, ODIUserPrefix) {
+		state = s.sCache.getIfcState(ODIPrefix + strings.TrimPrefix(odi, ODIUserPrefix))
+	}
 	switch sipreq.RequestLine.Method {
 	case sip.MethodRegister:
-		logger.Info("[%v] Receive From I-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
-
-		if !strings.Contains(sipreq.Header.Authorization, "response") {
-			// 首次注册请求，请求HSS鉴权向量
-			s.sCache.setUserRegistReq(MARegPrefix+user, &sipreq)
+		stx, isNew := s.txLayer.ServerRequest(&sipreq, send)
+		if !isNew { // 重传的请求由事务层处理
+			return nil
+		}
+		cred := sipreq.Header.Authorization
+		if cred == nil {
+			cred = &sip.Credentials{Scheme: sip.SchemeDigest}
+		}
+		_, resync := cred.Params.Get("auts")
+		av, algorithm := s.sCache.getUserRegistAV(MARegPrefix + user)
+		if resync || av == nil || len(cred.Nonce) == 0 || len(cred.Response) == 0 {
+			// 首次注册请求、鉴权已过期或终端请求重新同步SQN，请求HSS鉴权向量
 			m := map[string]string{
 				"UserName": user,
+				CX_SERVER:  s.Host,
+			}
+			if resync {
+				RAND, AUTS, err := resyncParams(cred)
+				if err != nil {
+					stx.Respond(sip.NewResponse(sip.StatusBadRequest, &sipreq))
+					return err
+				}
+				m[AV_RAND] = hex.EncodeToString(RAND)
+				m[AV_AUTS] = hex.EncodeToString(AUTS)
+				// 缓存的鉴权向量与终端不同步，全部丢弃
+				s.sCache.Delete(AuthVectorPrefix + user)
+			}
+			s.sCache.setUserRegistReq(MARegPrefix+user, &sipreq)
+			if av, ok := s.sCache.popAuthVector(AuthVectorPrefix + user); ok {
+				// 使用缓存的鉴权向量，不需要请求HSS
+				return s.challenge(ctx, user, av)
 			}
+			m[AV_NUM] = strconv.Itoa(s.conf.AVNum)
 			pkg.Construct(modules.EPCPROTOCAL, modules.MultiMediaAuthenticationRequest, modules.StrLineMarshal(m))
-			pkg.SetShortConn(config.Elements["HSS"].ActualAddr)
+			pkg.SetShortConn(s.conf.Elements["HSS"].ActualAddr)
 			modules.Send(pkg, up)
-		} else { // 第二次发起注册，进行用户身份验证
-			pkg.SetShortConn(config.Elements["ICSCF"].ActualAddr)
+			return nil
+		}
+		// 第二次发起注册，进行用户身份验证，每个鉴权向量只验证一次
+		s.sCache.delUserRegistReqXRES(MARegPrefix + user)
+		info, err := verifyAKAResponse(cred, &sipreq, av, algorithm)
+		if err != nil {
+			logger.Warn("[%v] %v鉴权失败: %v", ctx.Value("Entity"), user, err)
+			stx.Respond(sip.NewResponse(sip.StatusForbidden, &sipreq))
+			return nil
+		}
+		// 鉴权通过后更新用户的联系地址绑定
+		before := s.registrar.Bindings(sipreq.Header.To.Username())
+		bindings, err := s.registrar.Register(&sipreq)
+		if err != nil {
+			logger.Warn("[%v] %v注册绑定失败: %v", ctx.Value("Entity"), user, err)
+			stx.Respond(registerErrorResponse(err, &sipreq))
+			return nil
+		}
+		if len(bindings) == 0 {
+			logger.Info("[%v] %v注销成功", ctx.Value("Entity"), user)
+		} else {
+			logger.Info("[%v] %v注册成功, %v个联系地址", ctx.Value("Entity"), user, len(bindings))
+		}
+		// 首次注册和全部注销时通知HSS
+		name := sipreq.Header.To.Username()
+		if len(before) == 0 && len(bindings) > 0 {
+			s.serverAssignment(name, AssignmentRegistration, up)
+		} else if len(before) > 0 && len(bindings) == 0 {
+			s.serverAssignment(name, AssignmentUserDeregistration, up)
+		}
+		// 注册成功，返回当前的全部绑定以及Path和Service-Route(RFC3261-10.3、RFC3327、RFC3608)
+		sipresp := sip.NewResponse(sip.StatusOK, &sipreq)
+		sipresp.Header.AuthenticationInfo = info
+		sipresp.Header.Contact = s.registrar.ContactList(bindings)
+		sipresp.Header.Expires = sip.Expires{}
+		sipresp.Header.Path = sipreq.Header.Path
+		if len(bindings) > 0 {
+			sipresp.Header.ServiceRoute.Prepend(sip.User{URI: s.server.URI(OrigUser), Arguments: sip.Args{}})
+		}
+		stx.Respond(sipresp)
+		// 通知注册状态的订阅者
+		if removed := removedBindings(before, bindings); len(removed) > 0 || sipreq.Header.Contact.Len() > 0 {
+			aor := sipreq.Header.To.URI
+			aor.Arguments = sip.Args{}
+			s.notifyRegistration(ctx, aor, bindings, removed, sip.RegEventUnregistered, up, down)
+		}
+		// 向签约的AS发起第三方注册
+		s.thirdPartyRegister(ctx, &sipreq, bindings, up, down)
+	case sip.MethodSubscribe:
+		return s.subscribeRequest(ctx, &sipreq, send, up, down)
+	case sip.MethodAck, sip.MethodBye:
+		return s.dialogRequest(ctx, &sipreq, send, up, down)
+	case sip.MethodCancel:
+		return cancelRequest(s.txLayer, &sipreq, send)
+	case sip.MethodInvite, sip.MethodPrack, sip.MethodUpdate:
+		// 对话内的请求直接使用已建立会话的路由信息
+		if _, e := sipreq.Header.To.Arguments.Get("tag"); e == nil {
+			return s.dialogRequest(ctx, &sipreq, send, up, down)
+		}
+		stx, isNew := s.txLayer.ServerRequest(&sipreq, send)
+		if !isNew {
+			return nil
+		}
+		if sipreq.RequestLine.Method == sip.MethodInvite {
+			stx.Respond(sip.NewResponse(sip.StatusTrying, &sipreq))
+		}
+		return s.initialRequest(ctx, stx, &sipreq, originating, state, up, down)
+	}
+	return nil
+}
 
-			values := parseAuthentication(sipreq.Header.Authorization)
-			XRES := s.sCache.getUserRegistXRES(MARegPrefix + user)
-			res, err := base64.RawStdEncoding.DecodeString(values["response"])
+// 初始请求的路由
+// 主叫侧：先按主叫的iFC触发AS，被叫属于其他域时按Request-URI发往对应域的I-CSCF，被叫属于本域时直接执行被叫侧的路由
+// 被叫侧：先按被叫的iFC触发AS，再以用户注册时的Path作为预加载路由，Request-URI改为用户注册的联系地址
+// state为经AS返回的请求的iFC评估进度，为nil时是新的初始请求
+func (s *S_CscfEntity) initialRequest(ctx context.Context, stx *sip.ServerTransaction, sipreq *sip.Message, originating bool, state *IfcState, up, down chan *modules.Package) error {
+	fresh := state == nil
+	if fresh {
+		state = &IfcState{SessionCase: SessionCaseTerminatingRegistered, User: sipreq.RequestLine.RequestURI.Username}
+		if originating {
+			state = &IfcState{SessionCase: SessionCaseOriginating, User: sipreq.Header.From.Username()}
+		}
+	}
+	if state.IsOriginating() {
+		caller, ok := s.registrar.Lookup(state.User)
+		if !ok {
+			// 主叫用户在系统中找不到
+			stx.Respond(sip.NewResponse(sip.StatusRequestTerminated, sipreq))
+			return errors.New("ErrCallerNotExist")
+		}
+		state.Call.CallerAccessPoint = caller.AccessPoint
+		if s.routeToAS(ctx, stx, sipreq, state, fresh, up, down) {
+			return nil
+		}
+		logger.Warn("caller domain: %v, request domain: %v", caller.AOR.Domain, sipreq.RequestLine.RequestURI.Domain)
+		if sipreq.Header.Route.Len() > 0 || caller.AOR.Domain != sipreq.RequestLine.RequestURI.Domain {
+			next, err := resolveHop(sipreq.NextHopHost(), nil)
 			if err != nil {
-				logger.Error("[%v] 解码response失败: %v", ctx.Value("Entity"), err)
+				stx.Respond(sip.NewResponse(sip.StatusNotFound, sipreq))
 				return err
 			}
-			RES := hex.EncodeToString(res)
-			logger.Warn("[%v] XRES: %v, RES: %v(byte: %x)", ctx.Value("Entity"), XRES, RES, res)
-			if XRES != "" && RES == XRES { // 验证通过
-				// 用户完成注册后，登记用户信息到系统中
-				u := new(User)
-				name := sipreq.Header.From.Username()
-				u.Domain = sipreq.Header.From.URI.Domain
-				u.AccessPoint = sipreq.Header.AccessNetworkInfo
-				s.sCache.delUserRegistReqXRES(MARegPrefix + user)
-				s.sCache.updateUserInfo(UeInfoPrefix+name, u)
-				logger.Info("[%v] %v注册成功, %v", ctx.Value("Entity"), sip.ServerDomainHost(), u)
-				// 注册成功
-				sipresp := sip.NewResponse(sip.StatusOK, &sipreq)
-				sipresp.Header.ServiceRoute = config.Elements["SCSCF"].VirtualAddr
-				pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-				modules.Send(pkg, down)
-			} else { // 验证不通过
-				s.sCache.delUserRegistReqXRES(MARegPrefix + user)
-				sresp := sip.NewResponse(sip.StatusUnauthorized, &sipreq)
-				logger.Info("[%v] 发起对UE鉴权: %v", ctx.Value("Entity"), sresp.String())
-				pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sresp.String())
-				modules.Send(pkg, down)
-			}
+			s.forwardInitial(stx, sipreq, state.Call, fresh, next, up, down)
+			return nil
 		}
-	case sip.MethodInvite, sip.MethodPrack, sip.MethodUpdate:
-		// 来自另一个域的请求
-		if first, _ := sipreq.Header.Via.FirstAddrInfo(); strings.Contains(first, "i-cscf") {
-			logger.Info("[%v][%v] Receive From Other ICSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-			// 查询被叫用户，修改无线接入点信息，直接向下行转发
-			callee := sipreq.RequestLine.RequestURI.Username
-			logger.Warn("被叫%v", callee)
-			user := s.sCache.getUserInfo(UeInfoPrefix + callee)
-			if user == nil {
-				logger.Error("被叫信息不存在%v", callee)
-				return errors.New("ErrCalleeNotExist")
-			}
-			logger.Warn("被叫接入点%v", user.AccessPoint)
-			sipreq.Header.Via.AddServerInfo()
-			sipreq.Header.AccessNetworkInfo = user.AccessPoint
-			pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-			pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-			modules.Send(pkg, down)
-		} else {
-			// 同一域的请求
-			logger.Info("[%v][%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-			sipreq.Header.Via.AddServerInfo()
-			domain := sipreq.RequestLine.RequestURI.Domain
-			user := sipreq.Header.From.URI.Username
-			caller := s.sCache.getUserInfo(UeInfoPrefix + user)
-			logger.Warn("caller: %v, callee domain: %v", caller, domain)
-			if caller == nil {
-				// 主叫用户在系统中找不到
-				sipresp := sip.NewResponse(sip.StatusRequestTerminated, &sipreq)
-				pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-				pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-				modules.Send(pkg, down)
-				return nil
-			}
-			logger.Warn("caller domain: %v, request domain: %v", caller.Domain, domain)
-			// INVITE 回话建立请求，分为 同域 和 不同域
-			// 向对应域的ICSCF发起请求
-			if caller.Domain == domain { // 同一域 直接返回被叫地址，无需更改无线接入点
-				pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-				pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-				modules.Send(pkg, down)
-			} else { // 不同域 查询对应域的ICSCF网络地址,向对应域发起请求
-				pkg.SetShortConn(config.Elements["OTHER-ICSCF"].ActualAddr)
-				pkg.Construct(modules.SIPPROTOCAL, modules.SipRequest, sipreq.String())
-				modules.Send(pkg, up)
+		// 被叫属于本域，开始被叫侧的iFC评估
+		state = &IfcState{SessionCase: SessionCaseTerminatingRegistered, User: sipreq.RequestLine.RequestURI.Username, Call: state.Call}
+	}
+	user, registered := s.registrar.Lookup(state.User)
+	if !registered && state.SessionCase == SessionCaseTerminatingRegistered {
+		state.SessionCase = SessionCaseTerminatingUnregistered
+	}
+	if s.routeToAS(ctx, stx, sipreq, state, fresh, up, down) {
+		return nil
+	}
+	// AS可能修改了Request-URI，按当前的被叫投递
+	if callee := sipreq.RequestLine.RequestURI.Username; callee != state.User {
+		user, registered = s.registrar.Lookup(callee)
+	}
+	if !registered || len(user.Path) == 0 {
+		logger.Error("被叫信息不存在%v", sipreq.RequestLine.RequestURI.Username)
+		stx.Respond(sip.NewResponse(sip.StatusNotFound, sipreq))
+		return errors.New("ErrCalleeNotExist")
+	}
+	logger.Warn("被叫%v接入点%v", user.AOR.Username, user.AccessPoint)
+	state.Call.CalleeAccessPoint = user.AccessPoint
+	sipreq.Header.AccessNetworkInfo = user.AccessPoint
+	sipreq.Header.Route.Prepend(user.Path...)
+	sipreq.RequestLine.RequestURI = user.Contact.URI
+	next, err := resolveHop(sipreq.NextHopHost(), nil)
+	if err != nil {
+		stx.Respond(sip.NewResponse(sip.StatusNotFound, sipreq))
+		return err
+	}
+	s.forwardInitial(stx, sipreq, state.Call, fresh, next, up, down)
+	return nil
+}
+
+// 按优先级评估服务用户的iFC，匹配时在Route前加入AS和本服务器的ODI地址，AS处理后请求按ODI返回继续评估
+// AS无法访问时按默认处理跳过该AS或终止请求，返回请求是否已处理
+func (s *S_CscfEntity) routeToAS(ctx context.Context, stx *sip.ServerTransaction, sipreq *sip.Message, state *IfcState, recordRoute bool, up, down chan *modules.Package) bool {
+	profile := s.sCache.getServiceProfile(ServiceProfilePrefix + state.User)
+	for {
+		fc, next := profile.Match(sipreq, state.SessionCase, state.Next)
+		if fc == nil {
+			return false
+		}
+		state.Next = next
+		as, err := sip.NewURI(fc.ApplicationServer.ServerName)
+		var hop NextHop
+		if err == nil {
+			hop, err = resolveHop(as.Domain, nil)
+		}
+		if err != nil {
+			logger.Error("[%v] AS无法访问 %v: %v", ctx.Value("Entity"), fc.ApplicationServer.ServerName, err)
+			if fc.ApplicationServer.DefaultHandling == DefaultHandlingTerminated {
+				stx.Respond(sip.NewResponse(sip.StatusServerInternalError, sipreq))
+				return true
 			}
+			continue
 		}
+		logger.Info("[%v] %v触发AS %v", ctx.Value("Entity"), state.User, fc.ApplicationServer.ServerName)
+		token := sip.NewTag()
+		s.sCache.setIfcState(ODIPrefix+token, *state)
+		as.Arguments = as.Arguments.Clone()
+		as.Arguments.Set("lr", "")
+		sipreq.Header.Route.Prepend(sip.User{URI: as, Arguments: sip.Args{}}, sip.User{URI: s.server.URI(ODIUserPrefix + token), Arguments: sip.Args{}})
+		s.forwardInitial(stx, sipreq, state.Call, recordRoute, hop, up, down)
+		return true
+	}
+}
 
+// 转发初始请求，经AS返回的请求不再重复加入Record-Route
+func (s *S_CscfEntity) forwardInitial(stx *sip.ServerTransaction, sipreq *sip.Message, call Call, recordRoute bool, next NextHop, up, down chan *modules.Package) {
+	if sipreq.RequestLine.Method == sip.MethodInvite {
+		s.sCache.setCall(CallPrefix+sipreq.Header.CallID, &call, false)
 	}
-	return nil
+	if recordRoute && isDialogCreating(sipreq) {
+		sipreq.Header.RecordRoute.AddServerInfo(s.server)
+	}
+	sipreq.Header.Via.AddServerInfo(s.server)
+	s.txLayer.Forward(stx, sipreq, next.sender(up, down))
 }
 
 func (s *S_CscfEntity) SIPRESPONSEF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
@@ -183,34 +355,113 @@ func (s *S_CscfEntity) SIPRESPONSEF(ctx context.Context, pkg *modules.Package, u
 		// TODO 错误处理
 		return err
 	}
+	logger.Info("[%v][%v] Receive SIP Response: \n%v", ctx.Value("Entity"), s.server.Domain, string(pkg.GetData()))
+	// 匹配客户端事务，重传的应答由事务层吸收
+	if _, pass := s.txLayer.ClientResponse(&sipresp); !pass {
+		return nil
+	}
 	// 删除Via头部信息
-	sipresp.Header.Via.RemoveFirst()
+	sipresp.Header.Via.RemoveFirst(s.server)
 	sipresp.Header.MaxForwards.Reduce()
-	next, _ := sipresp.Header.Via.FirstAddrInfo()
-	// 如果下一跳via包含i-cscf说明是另一个域的响应
-	if strings.Contains(next, "i-cscf") {
-		logger.Info("[%v][%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-		pkg.SetShortConn(config.Elements["ICSCF"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-		modules.Send(pkg, up)
+	if sipresp.Header.Via.Len() == 0 {
+		return s.localResponse(ctx, &sipresp, up, down)
+	}
+	if isTrying(&sipresp) {
+		return nil
+	}
+	// 应答发往请求方，修改为请求方的无线接入点，不属于任何对话的应答是初始INVITE的应答
+	if call := s.sCache.getCall(CallPrefix + sipresp.Header.CallID); call != nil {
+		dialog, fromCaller := s.dialogs.Match(&sipresp)
+		ap := call.CalleeAccessPoint
+		if dialog == nil || fromCaller {
+			ap = call.CallerAccessPoint
+		}
+		if len(ap) > 0 {
+			sipresp.Header.AccessNetworkInfo = ap
+		}
+	}
+	s.updateDialog(&sipresp)
+	return forwardResponse(s.txLayer, &sipresp, nil, up, down)
+}
+
+// 对话内请求，按照对话的路由集合(Route)转发，不再重复初始INVITE的路由逻辑
+func (s *S_CscfEntity) dialogRequest(ctx context.Context, sipreq *sip.Message, send sip.TransportFunc, up, down chan *modules.Package) error {
+	method := sipreq.RequestLine.Method
+	// ACK不创建事务，2xx的ACK沿对话路由无状态转发
+	var stx *sip.ServerTransaction
+	if method == sip.MethodAck {
+		if absorbAck(s.txLayer, sipreq) {
+			return nil
+		}
+	} else {
+		var isNew bool
+		if stx, isNew = s.txLayer.ServerRequest(sipreq, send); !isNew {
+			return nil
+		}
+	}
+	dialog, fromCaller := s.dialogs.Match(sipreq)
+	call := s.sCache.getCall(CallPrefix + sipreq.Header.CallID)
+	if dialog == nil || call == nil {
+		if stx != nil {
+			stx.Respond(sip.NewResponse(sip.StatusCallTransactionDoesNotExist, sipreq))
+		}
+		return errors.New("ErrDialogNotExist")
+	}
+	if err := dialog.CheckRequest(sipreq, fromCaller); err != nil {
+		// ACK没有事务，校验失败时直接丢弃
+		if stx != nil {
+			stx.Respond(sip.NewResponse(sip.StatusServerInternalError, sipreq))
+		}
+		return err
+	}
+	next, err := resolveHop(sipreq.NextHopHost(), nil)
+	if err != nil {
+		if stx != nil {
+			stx.Respond(sip.NewResponse(sip.StatusNotFound, sipreq))
+		}
+		return err
+	}
+	ap := call.CalleeAccessPoint
+	if !fromCaller {
+		ap = call.CallerAccessPoint
+	}
+	if len(ap) > 0 {
+		sipreq.Header.AccessNetworkInfo = ap
+	}
+	sipreq.Header.Via.AddServerInfo(s.server)
+	if stx == nil {
+		next.sender(up, down)(sipreq)
 		return nil
 	}
-	// 下一跳是p-cscf，则说明响应来自另一个域,更新无线接入点
-	if strings.Contains(next, "p-cscf") {
-		logger.Info("[%v][%v] Receive From I-CSCF: \n%v", ctx.Value("Entity"), sip.ServerDomain, string(pkg.GetData()))
-		caller := sipresp.Header.To.URI.Username
-		logger.Warn("主叫%v", caller)
-		user := s.sCache.getUserInfo(UeInfoPrefix + caller)
-		logger.Warn("主叫接入点%v", user.AccessPoint)
-		sipresp.Header.AccessNetworkInfo = user.AccessPoint
-	}
-	// INVITE请求，被叫响应应答
-	pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-	pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-	modules.Send(pkg, down)
+	s.txLayer.Forward(stx, sipreq, next.sender(up, down))
+	// BYE结束对话，Call-ID下没有其他对话时清除会话信息
+	if method == sip.MethodBye {
+		s.dialogs.Terminate(dialog)
+		if len(s.dialogs.FindByCallID(sipreq.Header.CallID)) == 0 {
+			s.sCache.Delete(CallPrefix + sipreq.Header.CallID)
+		}
+	}
 	return nil
 }
 
+// 根据INVITE的应答维护对话，对话确认后会话信息不再过期，会话建立失败时清除会话信息
+func (s *S_CscfEntity) updateDialog(resp *sip.Message) {
+	if resp.Header.CSeq.Method != sip.MethodInvite {
+		return
+	}
+	key := CallPrefix + resp.Header.CallID
+	dialog := s.dialogs.UpdateWithResponse(resp)
+	if dialog != nil && dialog.IsConfirmed() {
+		if call := s.sCache.getCall(key); call != nil {
+			s.sCache.setCall(key, call, true)
+		}
+		return
+	}
+	if resp.ResponseLine.StatusCode >= 300 && len(s.dialogs.FindByCallID(resp.Header.CallID)) == 0 {
+		s.sCache.Delete(key)
+	}
+}
+
 func (s *S_CscfEntity) MutimediaAuthorizationAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
 	defer modules.Recover(ctx)
 
@@ -218,60 +469,441 @@ func (s *S_CscfEntity) MutimediaAuthorizationAnswerF(ctx context.Context, pkg *m
 	// 获得用户鉴权信息
 	resp := modules.StrLineUnmarshal(pkg.GetData())
 	user := resp["UserName"]
-	AUTN := resp["AUTN"]
-	XRES := resp["XRES"]
-	RAND := resp["RAND"]
+	if !isCxSuccess(resp[CX_RESULT]) {
+		// 用户不存在时拒绝注册，HSS处理失败时返回服务器错误
+		status := sip.StatusServerInternalError
+		if resp[CX_RESULT] == ResultErrorUserUnknown {
+			status = sip.StatusForbidden
+		}
+		s.rejectRegister(user, status)
+		return errors.New("ErrMultimediaAuth")
+	}
+	avs := unmarshalAuthVectors(resp)
+	if len(avs) == 0 {
+		return errors.New("ErrAuthVectorNotExist")
+	}
+	// 第一个向量用于本次鉴权，其余的缓存用于后续注册
+	s.sCache.pushAuthVectors(AuthVectorPrefix+user, avs[1:])
+	// 保存用户的业务签约数据，没有iFC的用户不触发AS
+	if data, ok := resp[USER_DATA]; ok {
+		profile, err := DecodeServiceProfile(data)
+		if err != nil {
+			return err
+		}
+		s.sCache.setServiceProfile(ServiceProfilePrefix+user, profile)
+	} else {
+		s.sCache.Delete(ServiceProfilePrefix + user)
+	}
+	return s.challenge(ctx, user, avs[0])
+}
+
+// 拒绝等待鉴权向量的注册请求
+func (s *S_CscfEntity) rejectRegister(user string, status sip.StatusCodeItem) {
+	req, ok := s.sCache.getUserRegistReq(MARegPrefix + user)
+	s.sCache.delUserRegistReqXRES(MARegPrefix + user)
+	if !ok {
+		return
+	}
+	if stx := s.txLayer.MatchServer(req); stx != nil {
+		stx.Respond(sip.NewResponse(status, req))
+	}
+}
+
+// 使用鉴权向量向终端发起鉴权
+func (s *S_CscfEntity) challenge(ctx context.Context, user string, av AuthVector) error {
 	// 首先获取缓存中的请求
 	req, ok := s.sCache.getUserRegistReq(MARegPrefix + user)
 	if !ok {
 		// 鉴权请求已过期
-		sipresp := sip.NewResponse(sip.StatusGone, req)
-		pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-		modules.Send(pkg, down)
 		return errors.New("ErrRequestExpired")
 	}
+	stx := s.txLayer.MatchServer(req)
+	if stx == nil {
+		s.sCache.delUserRegistReqXRES(MARegPrefix + user)
+		return errors.New("ErrTransactionNotFound")
+	}
+	// 终端在首次注册请求中声明支持AKAv2时使用AKAv2，否则使用AKAv1
+	algorithm := sip.AlgorithmAKAv1MD5
+	if cred := req.Header.Authorization; cred != nil && strings.EqualFold(cred.Algorithm, sip.AlgorithmAKAv2MD5) {
+		algorithm = sip.AlgorithmAKAv2MD5
+	}
 	// 保存用户鉴权
-	err := s.sCache.setUserRegistXRES(MARegPrefix+user, XRES)
+	err := s.sCache.setUserRegistAV(MARegPrefix+user, av, algorithm)
 	if err != nil {
-		sipresp := sip.NewResponse(sip.StatusServerTimeout, req)
-		pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-		pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-		modules.Send(pkg, down)
+		stx.Respond(sip.NewResponse(sip.StatusServerTimeout, req))
 		// 删除注册请求
 		s.sCache.delUserRegistReqXRES(MARegPrefix + user)
 		return err
 	}
-	// 组装WWW-Authenticate
-	autn, _ := hex.DecodeString(AUTN)
-	rand, _ := hex.DecodeString(RAND)
-	nonce := append(rand, autn...)
-	wwwAuth := fmt.Sprintf(`Digest realm=hebeiyidomg.3gpp.net nonce=%s qop=auth-int algorithm=AKAv1-MD5`, base64.StdEncoding.EncodeToString(nonce))
+	// 组装WWW-Authenticate，nonce为RAND和AUTN拼接后的base64编码(RFC3310-3.2)
+	nonce, err := akaNonce(av)
+	if err != nil {
+		return err
+	}
 	// 向终端发起鉴权
-
 	sipresp := sip.NewResponse(sip.StatusUnauthorized, req)
-	sipresp.Header.WWWAuthenticate = wwwAuth
-	// 用户鉴权信息经过s-cscf发起
-	// 转发给s-cscf的时候会携带自身的via header
-	sipresp.Header.Via.RemoveFirst()
-	sipresp.Header.MaxForwards.Reduce()
-	pkg.SetShortConn(config.Elements["PCSCF"].ActualAddr)
-	pkg.Construct(modules.SIPPROTOCAL, modules.SipResponse, sipresp.String())
-	modules.Send(pkg, down)
+	sipresp.Header.WWWAuthenticate = &sip.Challenge{
+		Scheme:    sip.SchemeDigest,
+		Realm:     s.conf.DNS,
+		Nonce:     nonce,
+		Algorithm: algorithm,
+		Qop:       []string{sip.QopAuth, sip.QopAuthInt},
+	}
+	// 用户鉴权信息经过I-CSCF原路返回
+	stx.Respond(sipresp)
 	logger.Info("[%v] MAA响应: %v", ctx.Value("Entity"), sipresp.String())
 	return nil
 }
 
-func parseAuthentication(authHeader string) map[string]string {
-	res := make(map[string]string)
-	auth := strings.TrimLeft(authHeader, "Digest ")
-	logger.Warn("Authorization := %v", auth)
-	items := strings.Split(auth, ",")
-	for _, item := range items {
-		val := strings.Split(item, "=")
-		if len(val) >= 2 {
-			res[val[0]] = val[1]
+// 鉴权质询中的nonce
+func akaNonce(av AuthVector) (string, error) {
+	rand, err := hex.DecodeString(av.RAND)
+	if err != nil {
+		return "", err
+	}
+	autn, err := hex.DecodeString(av.AUTN)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(append(rand, autn...)), nil
+}
+
+// 按质询时使用的鉴权向量和算法校验终端的摘要认证响应(RFC3310-3.3)，返回Authentication-Info
+func verifyAKAResponse(cred *sip.Credentials, req *sip.Message, av *AuthVector, algorithm string) (*sip.AuthenticationInfo, error) {
+	if len(cred.Algorithm) > 0 && !strings.EqualFold(cred.Algorithm, algorithm) {
+		return nil, errors.New("ErrAlgorithmMismatch")
+	}
+	nonce, err := akaNonce(*av)
+	if err != nil {
+		return nil, err
+	}
+	if got, err := decodeAuthParam(cred.Nonce); err != nil || base64.StdEncoding.EncodeToString(got) != nonce {
+		return nil, errors.New("ErrNonceMismatch")
+	}
+	if len(cred.Qop) > 0 && cred.Qop != sip.QopAuth && cred.Qop != sip.QopAuthInt {
+		return nil, errors.New("ErrUnsupportedQop")
+	}
+	xres, _ := hex.DecodeString(av.XRES)
+	ik, _ := hex.DecodeString(av.IK)
+	ck, _ := hex.DecodeString(av.CK)
+	password, err := sip.AKAPassword(algorithm, xres, ik, ck)
+	if err != nil {
+		return nil, err
+	}
+	expect := sip.DigestResponse(cred.DigestParams(req.RequestLine.Method, req.Body), password)
+	if !strings.EqualFold(expect, cred.Response) {
+		return nil, errors.New("ErrResponseMismatch")
+	}
+	if len(cred.Qop) == 0 {
+		return nil, nil
+	}
+	// 服务器认证结果，计算方式与response相同但不包含请求方法(RFC2617-3.2.3)
+	return &sip.AuthenticationInfo{
+		Qop:     cred.Qop,
+		RspAuth: sip.DigestResponse(cred.DigestParams("", ""), password),
+		CNonce:  cred.CNonce,
+		NC:      cred.NC,
+	}, nil
+}
+
+// 重新同步请求中nonce携带的RAND和终端计算的AUTS(RFC3310-3.4)
+func resyncParams(cred *sip.Credentials) (RAND, AUTS []byte, err error) {
+	nonce, err := decodeAuthParam(cred.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	auts, _ := cred.Params.Get("auts")
+	AUTS, err = decodeAuthParam(auts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nonce) < 16 || len(AUTS) != 14 {
+		return nil, nil, errors.New("ErrInvalidAUTS")
+	}
+	return nonce[:16], AUTS, nil
+}
+
+// 鉴权参数为base64编码，填充可以省略
+func decodeAuthParam(val string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(val, "="))
+}
+
+// 处理注册状态事件的订阅(RFC3680)，应答后立即发送当前的注册状态(RFC6665-4.2.1.2)
+func (s *S_CscfEntity) subscribeRequest(ctx context.Context, sipreq *sip.Message, send sip.TransportFunc, up, down chan *modules.Package) error {
+	stx, isNew := s.txLayer.ServerRequest(sipreq, send)
+	if !isNew {
+		return nil
+	}
+	if sipreq.Header.Event == nil || sipreq.Header.Event.Type != sip.EventReg {
+		stx.Respond(sip.NewResponse(sip.StatusBadEvent, sipreq))
+		return nil
+	}
+	if _, err := sipreq.Header.To.Arguments.Get("tag"); err != nil && !s.authorizeRegSubscribe(sipreq) {
+		stx.Respond(sip.NewResponse(sip.StatusForbidden, sipreq))
+		return ErrSubscribeForbidden
+	}
+	sub, expires, err := s.regEvent.Subscribe(sipreq)
+	switch err {
+	case nil:
+	case ErrIntervalTooBrief:
+		resp := sip.NewResponse(sip.StatusIntervalTooBrief, sipreq)
+		resp.Header.MinExpires = sip.NewExpires(MinRegSubExpires)
+		stx.Respond(resp)
+		return nil
+	case ErrSubscriptionNotExist:
+		stx.Respond(sip.NewResponse(sip.StatusCallTransactionDoesNotExist, sipreq))
+		return err
+	default:
+		stx.Respond(sip.NewResponse(sip.StatusServerInternalError, sipreq))
+		return err
+	}
+	resp := sip.NewResponse(sip.StatusOK, sipreq)
+	resp.Header.To.Arguments = resp.Header.To.Arguments.Clone()
+	resp.Header.To.Arguments.Set("tag", sub.ID.LocalTag)
+	resp.Header.Expires = sip.NewExpires(expires)
+	resp.Header.Contact.Reset()
+	resp.Header.Contact.Add(sip.User{URI: s.server.URI(""), Arguments: sip.Args{}})
+	stx.Respond(resp)
+	logger.Info("[%v] %v订阅%v的注册状态, 有效时间%v", ctx.Value("Entity"), sipreq.Header.From.URI, sub.AOR, expires)
+
+	state := sip.SubscriptionState{State: sip.SubscriptionActive}
+	if expires == 0 {
+		state = sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: sip.ReasonTimeout}
+	}
+	active := s.registrar.Bindings(sub.AOR.Username)
+	s.sendNotify(ctx, sub, state, regRegistration(sub.AOR, active, nil, "", s.registrar.now()), up, down)
+	return nil
+}
+
+// 注册状态只允许用户本人或用户注册时经过的P-CSCF订阅(3GPP TS 24.229 5.4.2.1.1)
+func (s *S_CscfEntity) authorizeRegSubscribe(req *sip.Message) bool {
+	name := req.RequestLine.RequestURI.Username
+	bindings := s.registrar.Bindings(name)
+	if len(bindings) == 0 {
+		return false
+	}
+	if req.Header.From.URI.Username == name {
+		return true
+	}
+	for _, b := range bindings {
+		for _, p := range b.Path {
+			if p.URI.Domain == req.Header.From.URI.Domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 用户的注册状态变化后通知全部订阅者，用户的绑定全部删除时终止订阅
+func (s *S_CscfEntity) notifyRegistration(ctx context.Context, aor sip.URI, active, removed []Binding, event string, up, down chan *modules.Package) {
+	reg := regRegistration(aor, active, removed, event, s.registrar.now())
+	state := sip.SubscriptionState{State: sip.SubscriptionActive}
+	if len(active) == 0 {
+		state = sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: sip.ReasonNoResource}
+	}
+	for _, sub := range s.regEvent.ByAOR(aor.Username) {
+		if state.IsTerminated() {
+			s.regEvent.Remove(sub.ID)
 		}
+		s.sendNotify(ctx, sub, state, reg, up, down)
+	}
+}
+
+// 向订阅者发送NOTIFY，经过订阅建立时的路由集合
+func (s *S_CscfEntity) sendNotify(ctx context.Context, sub *RegSubscription, state sip.SubscriptionState, reg sip.Registration, up, down chan *modules.Package) {
+	notify := s.regEvent.Notify(sub, state, reg, s.server.URI(""))
+	next, err := resolveHop(notify.NextHopHost(), nil)
+	if err != nil {
+		logger.Error("[%v] 注册状态通知无法发送 %v: %v", ctx.Value("Entity"), notify.NextHopHost(), err)
+		s.regEvent.Remove(sub.ID)
+		return
+	}
+	notify.Header.Via.SetReceivedInfo("UDP", s.server.IpHost())
+	notify.Header.Via.AddServerInfo(s.server)
+	s.txLayer.Request(notify, next.sender(up, down))
+}
+
+// 定期删除过期的注册绑定和订阅，并通知订阅者
+func (s *S_CscfEntity) sweepRegistrations(ctx context.Context, up, down chan *modules.Package) {
+	for name, expired := range s.registrar.Expire() {
+		logger.Info("[%v] %v的%v个联系地址已过期", ctx.Value("Entity"), name, len(expired))
+		active := s.registrar.Bindings(name)
+		s.notifyRegistration(ctx, expired[0].AOR, active, expired, sip.RegEventExpired, up, down)
+		if len(active) == 0 {
+			s.serverAssignment(name, AssignmentTimeoutDeregistration, up)
+		}
+	}
+	for _, sub := range s.regEvent.Expire() {
+		active := s.registrar.Bindings(sub.AOR.Username)
+		state := sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: sip.ReasonTimeout}
+		s.sendNotify(ctx, sub, state, regRegistration(sub.AOR, active, nil, "", s.registrar.now()), up, down)
+	}
+}
+
+// 网络侧注销用户，通知订阅者后终止订阅，event为deactivated时用户可以重新注册，为rejected时不能重新注册
+func (s *S_CscfEntity) networkDeregister(ctx context.Context, name, event string, up, down chan *modules.Package) bool {
+	removed := s.registrar.RemoveAll(name)
+	if len(removed) == 0 {
+		return false
+	}
+	logger.Info("[%v] 网络侧注销%v", ctx.Value("Entity"), name)
+	s.notifyRegistration(ctx, removed[0].AOR, nil, removed, event, up, down)
+	return true
+}
+
+// 向HSS发送SAR，通知本服务器为用户服务或不再为用户服务
+func (s *S_CscfEntity) serverAssignment(name, assignment string, up chan *modules.Package) {
+	request := map[string]string{
+		"UserName":    name,
+		CX_SERVER:     s.Host,
+		CX_ASSIGNMENT: assignment,
+	}
+	pkg := new(modules.Package)
+	pkg.SetShortConn(s.conf.Elements["HSS"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.ServerAssignmentRequest, modules.StrLineMarshal(request))
+	modules.Send(pkg, up)
+}
+
+// HSS对SAR的应答，携带业务签约数据时更新缓存
+func (s *S_CscfEntity) ServerAssignmentAnswerF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From HSS: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	resp := modules.StrLineUnmarshal(pkg.GetData())
+	if !isCxSuccess(resp[CX_RESULT]) {
+		return errors.New("ErrServerAssignment")
+	}
+	if data, ok := resp[USER_DATA]; ok {
+		profile, err := DecodeServiceProfile(data)
+		if err != nil {
+			return err
+		}
+		s.sCache.setServiceProfile(ServiceProfilePrefix+resp["UserName"], profile)
+	}
+	return nil
+}
+
+// HSS要求注销用户(RTR)，删除用户的绑定和缓存的鉴权、业务数据后应答RTA
+func (s *S_CscfEntity) RegistrationTerminationRequestF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From HSS: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	req := modules.StrLineUnmarshal(pkg.GetData())
+	name := req["UserName"]
+	// 永久终止的用户不能重新注册，其余原因用户可以重新注册到新的S-CSCF
+	event := sip.RegEventDeactivated
+	if req[CX_REASON] == ReasonPermanentTermination {
+		event = sip.RegEventRejected
+	}
+	s.networkDeregister(ctx, name, event, up, down)
+	s.sCache.Delete(AuthVectorPrefix + name)
+	s.sCache.Delete(MARegPrefix + name)
+	s.sCache.Delete(ServiceProfilePrefix + name)
+	response := map[string]string{
+		"UserName": name,
+		CX_RESULT:  ResultSuccess,
+		CX_SESSION: req[CX_SESSION],
+	}
+	pkg.SetShortConn(s.conf.Elements["HSS"].ActualAddr)
+	pkg.Construct(modules.EPCPROTOCAL, modules.RegistrationTerminationAnswer, modules.StrLineMarshal(response))
+	modules.Send(pkg, up)
+	return nil
+}
+
+// UE去附着后P-CSCF要求注销用户，用户可以在重新附着后注册，注销后通知HSS不再为用户服务
+func (s *S_CscfEntity) DetachIndicationF(ctx context.Context, pkg *modules.Package, up, down chan *modules.Package) error {
+	defer modules.Recover(ctx)
+
+	logger.Info("[%v] Receive From P-CSCF: \n%v", ctx.Value("Entity"), string(pkg.GetData()))
+	name := modules.StrLineUnmarshal(pkg.GetData())[EPC_USER_NAME]
+	if s.networkDeregister(ctx, name, sip.RegEventDeactivated, up, down) {
+		s.serverAssignment(name, AssignmentAdministrativeDeregister, up)
+	}
+	return nil
+}
+
+// 本服务器发起的请求的应答，订阅者拒绝NOTIFY时删除订阅(RFC6665-4.2.2)
+// 第三方注册失败且默认处理为终止时注销用户(3GPP TS 24.229 5.4.1.7)
+func (s *S_CscfEntity) localResponse(ctx context.Context, resp *sip.Message, up, down chan *modules.Package) error {
+	if resp.Header.CSeq.Method == sip.MethodRegister && resp.ResponseLine.StatusCode >= 200 {
+		reg := s.sCache.popThirdPartyRegister(ThirdPartyRegPrefix + resp.Header.CallID)
+		if reg == nil || resp.ResponseLine.StatusCode < 300 {
+			return nil
+		}
+		logger.Warn("[%v] %v的第三方注册失败 %v", ctx.Value("Entity"), reg.User, resp.ResponseLine.StatusCode)
+		if reg.DefaultHandling == DefaultHandlingTerminated && s.networkDeregister(ctx, reg.User, sip.RegEventDeactivated, up, down) {
+			s.serverAssignment(reg.User, AssignmentAdministrativeDeregister, up)
+		}
+		return nil
+	}
+	if resp.Header.CSeq.Method != sip.MethodNotify || resp.ResponseLine.StatusCode < 300 {
+		return nil
+	}
+	fromTag, _ := resp.Header.From.Arguments.Get("tag")
+	toTag, _ := resp.Header.To.Arguments.Get("tag")
+	s.regEvent.Remove(sip.DialogID{CallID: resp.Header.CallID, LocalTag: fromTag, RemoteTag: toTag})
+	logger.Warn("[%v] 订阅者拒绝注册状态通知 %v", ctx.Value("Entity"), resp.ResponseLine.StatusCode)
+	return nil
+}
+
+// 用户注册、刷新或注销成功后，向REGISTER匹配的iFC中的AS发起第三方注册(3GPP TS 24.229 5.4.1.7)
+// Expires为用户绑定中最长的剩余有效时间，用户全部注销时为0
+func (s *S_CscfEntity) thirdPartyRegister(ctx context.Context, sipreq *sip.Message, bindings []Binding, up, down chan *modules.Package) {
+	name := sipreq.Header.To.Username()
+	profile := s.sCache.getServiceProfile(ServiceProfilePrefix + name)
+	expires := 0
+	now := s.registrar.now()
+	for _, b := range bindings {
+		if e := b.ExpiresIn(now); e > expires {
+			expires = e
+		}
+	}
+	aor := sip.User{URI: sipreq.Header.To.URI, Arguments: sip.Args{}}
+	aor.URI.Arguments = sip.Args{}
+	for next := 0; ; {
+		var fc *FilterCriteria
+		if fc, next = profile.Match(sipreq, SessionCaseOriginating, next); fc == nil {
+			return
+		}
+		as, err := sip.NewURI(fc.ApplicationServer.ServerName)
+		var hop NextHop
+		if err == nil {
+			hop, err = resolveHop(as.Domain, nil)
+		}
+		if err != nil {
+			logger.Error("[%v] AS无法访问 %v: %v", ctx.Value("Entity"), fc.ApplicationServer.ServerName, err)
+			if fc.ApplicationServer.DefaultHandling == DefaultHandlingTerminated && expires > 0 {
+				if s.networkDeregister(ctx, name, sip.RegEventDeactivated, up, down) {
+					s.serverAssignment(name, AssignmentAdministrativeDeregister, up)
+				}
+				return
+			}
+			continue
+		}
+		from := sip.User{URI: s.server.URI(""), Arguments: sip.Args{}}
+		from.Arguments.Set("tag", sip.NewTag())
+		req := sip.NewRequest(sip.MethodRegister, as, from, aor, sip.NewCallID(s.server.Domain), 1)
+		req.Header.Contact.Add(sip.User{URI: s.server.URI(""), Arguments: sip.Args{}})
+		req.Header.Expires = sip.NewExpires(expires)
+		req.Header.AccessNetworkInfo = sipreq.Header.AccessNetworkInfo
+		req.Header.Via.SetReceivedInfo("UDP", s.server.IpHost())
+		req.Header.Via.AddServerInfo(s.server)
+		s.sCache.setThirdPartyRegister(ThirdPartyRegPrefix+req.Header.CallID, &ThirdPartyRegister{User: name, DefaultHandling: fc.ApplicationServer.DefaultHandling})
+		logger.Info("[%v] %v向AS %v发起第三方注册, 有效时间%v", ctx.Value("Entity"), name, fc.ApplicationServer.ServerName, expires)
+		s.txLayer.Request(req, hop.sender(up, down))
+	}
+}
+
+// 注册绑定失败时的应答，注册间隔过短时返回支持的最小过期时间(RFC3261-10.3 step 7)
+func registerErrorResponse(err error, req *sip.Message) *sip.Message {
+	switch err {
+	case ErrIntervalTooBrief:
+		resp := sip.NewResponse(sip.StatusIntervalTooBrief, req)
+		resp.Header.MinExpires = sip.NewExpires(MinExpires)
+		return resp
+	case ErrRegisterOutOfOrder:
+		return sip.NewResponse(sip.StatusServerInternalError, req)
 	}
-	return res
+	return sip.NewResponse(sip.StatusBadRequest, req)
 }
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/modules"
+	"github.com/VegetableManII/volte/sip"
+)
+
+var ErrInvalidCA = errors.New("ErrInvalidCA")
+
+// 按配置开启CSCF的面向连接传输，TCP与UDP使用相同的监听地址，返回携带传输的上下文
+// 发送协程需要使用返回的上下文
+func StreamTransport(ctx context.Context, host string, in chan *modules.Package) context.Context {
+	conf := config.SIP()
+	var streams []*modules.Stream
+	if conf.TCP {
+		s, err := modules.ListenStream(ctx, modules.TransportTCP, host, nil, in)
+		if err != nil {
+			log.Panicln("TCP监听失败", host, err)
+		}
+		streams = append(streams, s)
+	}
+	if addr, ok := config.TLSAddr(host); ok {
+		tc, err := tlsConfig(conf)
+		if err != nil {
+			log.Panicln("TLS证书读取失败", err)
+		}
+		s, err := modules.ListenStream(ctx, modules.TransportTLS, addr, tc, in)
+		if err != nil {
+			log.Panicln("TLS监听失败", addr, err)
+		}
+		streams = append(streams, s)
+	}
+	return modules.WithStreams(ctx, streams...)
+}
+
+// TLS的证书同时用于监听和主动建立的连接，配置了CA时用于校验双方的证书
+func tlsConfig(conf config.SIPTransport) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(conf.CA) > 0 {
+		pem, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCA
+		}
+		tc.RootCAs = pool
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// 请求的传输协议(RFC3261-18.1.1)，下一跳URI指定了传输协议时使用指定的协议，否则使用配置的默认协议
+// 默认使用UDP时超过MTU的请求改用TCP
+func requestTransport(req *sip.Message, size int) string {
+	if t := req.NextHopURI().Transport(); len(t) > 0 {
+		return t
+	}
+	t := config.SIP().Transport
+	if t == modules.TransportUDP && size > modules.MaxUDPRequestSize {
+		return modules.TransportTCP
+	}
+	return t
+}
+
+// 面向连接的传输只用于CSCF之间，对端没有对应的监听地址时使用UDP，返回实际使用的协议和地址
+func streamHost(transport, host string) (string, string) {
+	if !config.IsCSCF(host) {
+		return modules.TransportUDP, host
+	}
+	switch transport {
+	case modules.TransportTCP:
+		if config.SIP().TCP {
+			return modules.TransportTCP, host
+		}
+	case modules.TransportTLS:
+		if addr, ok := config.TLSAddr(host); ok {
+			return modules.TransportTLS, addr
+		}
+	}
+	return modules.TransportUDP, host
+}
@@ -1,11 +1,26 @@
 package controller
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/diameter"
+	"github.com/VegetableManII/volte/modules"
+	"github.com/VegetableManII/volte/sip"
 	"github.com/jinzhu/gorm"
+	"github.com/wmnsk/milenage"
 )
 
 func TestCreateUser(t *testing.T) {
@@ -28,3 +43,1988 @@ func TestCreateUser(t *testing.T) {
 		t.Log(err)
 	}
 }
+
+func TestLoadSeedUsers(t *testing.T) {
+	users, err := LoadSeedUsers("../sql/users.yml")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(users) != 1 || users[0].SipUserName != "jiqimao" || users[0].RootK != "465b5ce8b199b49faa5f0a2ee238a6bc" {
+		t.Fatalf("users = %+v", users)
+	}
+	file := filepath.Join(t.TempDir(), "users.json")
+	data := `{"users":[{"imsi":"987654321","root_k":"00","opc":"11","sip_username":"daxiong"}]}`
+	if err = ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	users, err = LoadSeedUsers(file)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(users) != 1 || users[0].IMSI != "987654321" || users[0].Opc != "11" {
+		t.Fatalf("users = %+v", users)
+	}
+}
+
+func TestSubscriberStore(t *testing.T) {
+	stores := map[string]config.Store{
+		"memory": {Driver: "memory", Seed: "../sql/users.yml"},
+		"sqlite": {Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "volte.db"), Seed: "../sql/users.yml"},
+	}
+	for name, sc := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := OpenSubscriberStore(sc)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			u, err := store.GetUserBySipUserName(ctx, "jiqimao")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if u.IMSI != "123456789" || u.Opc != "cd63cb71954a9f4e48a5994e37a02baf" {
+				t.Fatalf("user = %+v", u)
+			}
+			if _, err = store.GetUserBySipUserName(ctx, "daxiong"); err == nil {
+				t.Fatalf("want error for unknown user")
+			}
+			err = store.CreateUser(ctx, &UserTable{IMSI: "987654321", SipUserName: "daxiong"})
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err = store.CreateUser(ctx, &UserTable{IMSI: "987654321", SipUserName: "daxiong"}); err == nil {
+				t.Fatalf("want error for duplicated user")
+			}
+			u, err = store.GetUserByIMSI(ctx, "987654321")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if u.SipUserName != "daxiong" || u.Mcc != 86 {
+				t.Fatalf("user = %+v", u)
+			}
+			alloc := ServerAllocTable{SipUserName: "daxiong", ServerAddr: "10.0.1.23:5055"}
+			if err = store.CreateAllocServerRecord(ctx, &alloc); err != nil {
+				t.Fatalf("%v", err)
+			}
+			// 预留0个SQN时只读取当前的SQN
+			if sqn, err := store.AdvanceSQN(ctx, "987654321", 0, nil); err != nil || sqn != 0 {
+				t.Fatalf("sqn = %x, err = %v", sqn, err)
+			}
+			base := uint64(0x21)
+			for _, want := range []uint64{nextSQN(0x21), nextSQN(nextSQN(0x21))} {
+				if sqn, err := store.AdvanceSQN(ctx, "987654321", 1, &base); err != nil || sqn != base {
+					t.Fatalf("sqn = %x, err = %v", sqn, err)
+				}
+				if sqn, err := store.AdvanceSQN(ctx, "987654321", 0, nil); err != nil || sqn != want {
+					t.Fatalf("sqn = %x, want %x, err = %v", sqn, want, err)
+				}
+				base = want
+			}
+			// 并发的请求预留的SQN互不重叠
+			bases := make(chan uint64, 8)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					base, err := store.AdvanceSQN(ctx, "987654321", 2, nil)
+					if err != nil {
+						t.Errorf("%v", err)
+					}
+					bases <- base
+				}()
+			}
+			wg.Wait()
+			close(bases)
+			seen := make(map[uint64]bool)
+			for base := range bases {
+				if seen[base] {
+					t.Errorf("duplicated sqn %x", base)
+				}
+				seen[base] = true
+			}
+			want := base
+			for i := 0; i < 16; i++ {
+				want = nextSQN(want)
+			}
+			if sqn, _ := store.AdvanceSQN(ctx, "987654321", 0, nil); sqn != want {
+				t.Errorf("sqn = %x, want %x", sqn, want)
+			}
+			// 重新同步时从终端的SQN开始
+			ms := uint64(0x400)
+			if base, err := store.AdvanceSQN(ctx, "987654321", 1, &ms); err != nil || base != ms {
+				t.Errorf("resync base = %x, err = %v", base, err)
+			}
+			if base, err := store.AdvanceSQN(ctx, "123456789", 1, nil); err != nil || base != 0 {
+				t.Errorf("new sqn base = %x, err = %v", base, err)
+			}
+			// 解绑时间不早于绑定时间的记录没有分配S-CSCF
+			if a, err := store.GetServerAssignment(ctx, "daxiong"); err != nil || a.Assigned() {
+				t.Fatalf("assignment = %+v, err = %v", a, err)
+			}
+			if a, err := store.GetServerAssignment(ctx, "panghu"); err != nil || a != nil {
+				t.Fatalf("assignment = %+v, err = %v", a, err)
+			}
+			for _, addr := range []string{"127.0.0.1:54323", "127.0.0.1:44323"} {
+				if err = store.AssignServer(ctx, "daxiong", addr); err != nil {
+					t.Fatalf("%v", err)
+				}
+				if a, err := store.GetServerAssignment(ctx, "daxiong"); err != nil || !a.Assigned() || a.ServerAddr != addr {
+					t.Fatalf("assignment = %+v, err = %v", a, err)
+				}
+			}
+			if err = store.UnassignServer(ctx, "daxiong"); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if a, err := store.GetServerAssignment(ctx, "daxiong"); err != nil || a.Assigned() {
+				t.Fatalf("assignment = %+v, err = %v", a, err)
+			}
+			if profile, err := store.GetServiceProfile(ctx, "daxiong"); err != nil || len(profile.IFC) != 0 {
+				t.Fatalf("profile = %+v, err = %v", profile, err)
+			}
+			invalid := UserTable{IMSI: "555", SipUserName: "panghu", IFC: []FilterCriteria{{}}}
+			if err = store.CreateUser(ctx, &invalid); err != ErrInvalidFilterCriteria {
+				t.Fatalf("err = %v, want ErrInvalidFilterCriteria", err)
+			}
+			err = store.CreateUser(ctx, &UserTable{IMSI: "555", SipUserName: "panghu", IFC: testIFC()})
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			profile, err := store.GetServiceProfile(ctx, "panghu")
+			if err != nil || len(profile.IFC) != 2 || profile.IFC[0].Priority != 0 || profile.IFC[1].ApplicationServer.DefaultHandling != DefaultHandlingTerminated {
+				t.Fatalf("profile = %+v, err = %v", profile, err)
+			}
+		})
+	}
+	if _, err := OpenSubscriberStore(config.Store{Driver: "redis"}); err == nil {
+		t.Fatalf("want error for unknown driver")
+	}
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	sc := config.Store{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "volte.db")}
+	db, err := OpenDatabase(sc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	db.Close()
+	// 重复执行不会重新执行已执行的版本
+	db, err = OpenDatabase(sc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer db.Close()
+	models := []interface{}{&UserTable{}, &ServerAllocTable{}, &SessionTable{}, &SqnTable{}, &IfcTable{}}
+	for _, m := range models {
+		scope := db.NewScope(m)
+		table := scope.TableName()
+		if !db.Dialect().HasTable(table) {
+			t.Fatalf("table %v not exist", table)
+		}
+		for _, f := range scope.Fields() {
+			if f.IsIgnored {
+				continue
+			}
+			if !db.Dialect().HasColumn(table, f.DBName) {
+				t.Errorf("column %v.%v not exist", table, f.DBName)
+			}
+		}
+	}
+}
+
+func TestNextSQN(t *testing.T) {
+	tests := []struct {
+		sqn, want uint64
+	}{
+		{0, 0x21},
+		{0x21, 0x42},
+		{0x3f, 0x40},
+		{0x1f, 0x20},
+		{1<<48 - 1, 0},
+	}
+	for _, tt := range tests {
+		if got := nextSQN(tt.sqn); got != tt.want {
+			t.Errorf("nextSQN(%x) = %x, want %x", tt.sqn, got, tt.want)
+		}
+	}
+}
+
+// 3GPP TS 35.208 测试集1
+const (
+	testK   = "465b5ce8b199b49faa5f0a2ee238a6bc"
+	testOPc = "cd63cb71954a9f4e48a5994e37a02baf"
+)
+
+func TestGenerateAV(t *testing.T) {
+	AUTN, XRES, CK, IK, RAND, err := generateAV(testK, testOPc, 0xff9bb4d0b607, 0xb9b9)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	k, _ := hex.DecodeString(testK)
+	opc, _ := hex.DecodeString(testOPc)
+	m := milenage.NewWithOPc(k, opc, RAND, 0, 0)
+	res, ck, ik, ak, _ := m.F2345()
+	if !bytes.Equal(res, XRES) || !bytes.Equal(ck, CK) || !bytes.Equal(ik, IK) {
+		t.Fatalf("AV mismatch")
+	}
+	if sqn := xor(AUTN[:6], ak); hex.EncodeToString(sqn) != "ff9bb4d0b607" {
+		t.Fatalf("SQN = %x", sqn)
+	}
+	if hex.EncodeToString(AUTN[6:8]) != "b9b9" {
+		t.Fatalf("AMF = %x", AUTN[6:8])
+	}
+}
+
+func TestResyncSQN(t *testing.T) {
+	k, _ := hex.DecodeString(testK)
+	opc, _ := hex.DecodeString(testOPc)
+	rand, _ := hex.DecodeString("23553cbe9637a89d218ae64dae47bf35")
+	// 终端根据自身的SQN生成AUTS
+	m := milenage.NewWithOPc(k, opc, rand, 0xff9bb4d0b607, 0)
+	auts, err := m.GenerateAUTS()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sqn, err := resyncSQN(testK, testOPc, hex.EncodeToString(rand), hex.EncodeToString(auts))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if sqn != 0xff9bb4d0b607 {
+		t.Fatalf("sqn = %x", sqn)
+	}
+	auts[13] ^= 0x01
+	if _, err = resyncSQN(testK, testOPc, hex.EncodeToString(rand), hex.EncodeToString(auts)); err == nil {
+		t.Fatalf("want error for invalid MAC-S")
+	}
+}
+
+func TestGenerateRandN(t *testing.T) {
+	a, err := generateRandN(16)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b, _ := generateRandN(16)
+	if len(a) != 16 || bytes.Equal(a, b) {
+		t.Fatalf("RAND = %x, %x", a, b)
+	}
+}
+
+func TestAuthVectorBatch(t *testing.T) {
+	var avs []AuthVector
+	for i := 0; i < 3; i++ {
+		AUTN, XRES, CK, IK, RAND, err := generateAV(testK, testOPc, uint64(0x20*(i+1)), 0)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		avs = append(avs, AuthVector{
+			RAND: hex.EncodeToString(RAND),
+			AUTN: hex.EncodeToString(AUTN),
+			XRES: hex.EncodeToString(XRES),
+			CK:   hex.EncodeToString(CK),
+			IK:   hex.EncodeToString(IK),
+		})
+	}
+	m := map[string]string{"UserName": "jiqimao"}
+	marshalAuthVectors(m, avs)
+	got := unmarshalAuthVectors(modules.StrLineUnmarshal([]byte(modules.StrLineMarshal(m))))
+	if len(got) != len(avs) {
+		t.Fatalf("got %d vectors, want %d", len(got), len(avs))
+	}
+	for i := range avs {
+		if got[i] != avs[i] {
+			t.Fatalf("vector %d = %+v, want %+v", i, got[i], avs[i])
+		}
+	}
+	// S-CSCF缓存未使用的向量，按顺序逐个取出
+	c := initCache()
+	c.pushAuthVectors(AuthVectorPrefix+"jiqimao", got[1:])
+	for i := 1; i < len(avs); i++ {
+		av, ok := c.popAuthVector(AuthVectorPrefix + "jiqimao")
+		if !ok || av != avs[i] {
+			t.Fatalf("pop %d = %+v, %v", i, av, ok)
+		}
+	}
+	if _, ok := c.popAuthVector(AuthVectorPrefix + "jiqimao"); ok {
+		t.Fatalf("want empty cache")
+	}
+}
+
+func TestVerifyAKAResponse(t *testing.T) {
+	AUTN, XRES, CK, IK, RAND, err := generateAV(testK, testOPc, 0x20, 0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	av := &AuthVector{
+		RAND: hex.EncodeToString(RAND),
+		AUTN: hex.EncodeToString(AUTN),
+		XRES: hex.EncodeToString(XRES),
+		CK:   hex.EncodeToString(CK),
+		IK:   hex.EncodeToString(IK),
+	}
+	nonce, _ := akaNonce(*av)
+	req := &sip.Message{RequestLine: sip.RequestLine{Method: sip.MethodRegister}}
+	for _, alg := range []string{sip.AlgorithmAKAv1MD5, sip.AlgorithmAKAv2MD5} {
+		// 终端根据质询计算RES和摘要
+		password, _ := sip.AKAPassword(alg, XRES, IK, CK)
+		cred := &sip.Credentials{
+			Scheme:    sip.SchemeDigest,
+			Username:  "jiqimao@hebeiyidong.3gpp.net",
+			Realm:     "hebeiyidong.3gpp.net",
+			Nonce:     nonce,
+			URI:       "sip:hebeiyidong.3gpp.net",
+			Algorithm: alg,
+			Qop:       sip.QopAuth,
+			NC:        "00000001",
+			CNonce:    "0a4f113b",
+		}
+		cred.Response = sip.DigestResponse(cred.DigestParams(sip.MethodRegister, ""), password)
+		// 经过消息编解码后验证
+		cred, err = sip.ParseCredentials(cred.String())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		info, err := verifyAKAResponse(cred, req, av, alg)
+		if err != nil {
+			t.Fatalf("%v: %v", alg, err)
+		}
+		if info == nil || info.RspAuth != sip.DigestResponse(cred.DigestParams("", ""), password) {
+			t.Errorf("%v: Authentication-Info = %+v", alg, info)
+		}
+		cred.CNonce = "0a4f113c"
+		if _, err := verifyAKAResponse(cred, req, av, alg); err == nil {
+			t.Errorf("%v: want error for wrong response", alg)
+		}
+	}
+	// 质询使用AKAv1时不接受AKAv2的响应
+	cred := &sip.Credentials{Nonce: nonce, Response: "x", Algorithm: sip.AlgorithmAKAv2MD5}
+	if _, err := verifyAKAResponse(cred, req, av, sip.AlgorithmAKAv1MD5); err == nil {
+		t.Errorf("want error for algorithm mismatch")
+	}
+}
+
+func testRegisterRequest(t *testing.T, cseq int, contact, expires string) *sip.Message {
+	str := "REGISTER sip:hebeiyidong.3gpp.net SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.0.100:45508;branch=z9hG4bK1158493fb1e25c83f14f5e7ee368\r\n" +
+		"From: <sip:jiqimao@hebeiyidong.3gpp.net>;tag=22365c3a331\r\n" +
+		"To: <sip:jiqimao@hebeiyidong.3gpp.net>\r\n" +
+		"Call-ID: 93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100\r\n" +
+		"CSeq: " + strconv.Itoa(cseq) + " REGISTER\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Path: <sip:p-cscf.hebeiyidong.3gpp.net:54321;lr>\r\n"
+	if len(contact) > 0 {
+		str += "Contact: " + contact + "\r\n"
+	}
+	if len(expires) > 0 {
+		str += "Expires: " + expires + "\r\n"
+	}
+	msg, err := sip.NewMessage(strings.NewReader(str + "Content-Length: 0\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return &msg
+}
+
+func TestRegistrar(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	r := NewRegistrar()
+	r.now = func() time.Time { return now }
+
+	// 注册两个联系地址，expires参数优先于Expires头域
+	bindings, err := r.Register(testRegisterRequest(t, 1, "<sip:jiqimao@10.0.0.1:5060>;expires=120, <sip:jiqimao@10.0.0.2:5060>", "600"))
+	if err != nil || len(bindings) != 2 {
+		t.Fatalf("register = %v, %v", bindings, err)
+	}
+	list := r.ContactList(bindings).Items()
+	want := map[string]string{"10.0.0.1:5060": "120", "10.0.0.2:5060": "600"}
+	for _, c := range list {
+		if v, _ := c.Arguments.Get("expires"); v != want[c.URI.Domain] {
+			t.Errorf("contact %v expires = %v", c.URI, v)
+		}
+	}
+	// 重复的CSeq不生效
+	if _, err = r.Register(testRegisterRequest(t, 1, "<sip:jiqimao@10.0.0.1:5060>", "600")); err != ErrRegisterOutOfOrder {
+		t.Errorf("want ErrRegisterOutOfOrder, got %v", err)
+	}
+	// 过期时间过短
+	if _, err = r.Register(testRegisterRequest(t, 2, "<sip:jiqimao@10.0.0.1:5060>", "30")); err != ErrIntervalTooBrief {
+		t.Errorf("want ErrIntervalTooBrief, got %v", err)
+	}
+	// 刷新第一个联系地址，最近注册的作为路由使用的绑定
+	now = now.Add(100 * time.Second)
+	if bindings, err = r.Register(testRegisterRequest(t, 3, "<sip:jiqimao@10.0.0.1:5060>", "3600")); err != nil || len(bindings) != 2 {
+		t.Fatalf("refresh = %v, %v", bindings, err)
+	}
+	b, ok := r.Lookup("jiqimao")
+	if !ok || b.Contact.URI.Domain != "10.0.0.1:5060" || b.ExpiresIn(now) != 3600 || len(b.Path) != 1 || b.AOR.Domain != "hebeiyidong.3gpp.net" {
+		t.Errorf("lookup = %+v", b)
+	}
+	if _, err := b.Contact.Arguments.Get("expires"); err == nil {
+		t.Errorf("stored contact should not keep expires param")
+	}
+	// 查询不修改绑定
+	if bindings, err = r.Register(testRegisterRequest(t, 4, "", "")); err != nil || len(bindings) != 2 {
+		t.Errorf("query = %v, %v", bindings, err)
+	}
+	// 第二个联系地址过期
+	now = now.Add(600 * time.Second)
+	if bindings = r.Bindings("jiqimao"); len(bindings) != 1 {
+		t.Errorf("bindings after expiry = %v", bindings)
+	}
+	// 注销单个联系地址
+	if bindings, err = r.Register(testRegisterRequest(t, 5, "<sip:jiqimao@10.0.0.1:5060>;expires=0", "")); err != nil || len(bindings) != 0 {
+		t.Errorf("deregister = %v, %v", bindings, err)
+	}
+	if _, ok = r.Lookup("jiqimao"); ok {
+		t.Errorf("lookup after deregister should fail")
+	}
+	// "*"注销全部联系地址
+	r.Register(testRegisterRequest(t, 6, "<sip:jiqimao@10.0.0.1:5060>", ""))
+	if _, err = r.Register(testRegisterRequest(t, 7, "*", "600")); err != ErrInvalidWildcard {
+		t.Errorf("want ErrInvalidWildcard, got %v", err)
+	}
+	if bindings, err = r.Register(testRegisterRequest(t, 8, "*", "0")); err != nil || len(bindings) != 0 || len(r.Bindings("jiqimao")) != 0 {
+		t.Errorf("wildcard deregister = %v, %v", bindings, err)
+	}
+}
+
+func testSubscribeRequest(t *testing.T, cseq int, toTag, expires string) *sip.Message {
+	to := "<sip:jiqimao@hebeiyidong.3gpp.net>"
+	if len(toTag) > 0 {
+		to += ";tag=" + toTag
+	}
+	str := "SUBSCRIBE sip:jiqimao@hebeiyidong.3gpp.net SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP p-cscf.hebeiyidong.3gpp.net:54321;branch=z9hG4bK29386c8d05bcfbac\r\n" +
+		"From: <sip:p-cscf.hebeiyidong.3gpp.net:54321>;tag=4fa3\r\n" +
+		"To: " + to + "\r\n" +
+		"Call-ID: 0a1b2c3d@p-cscf.hebeiyidong.3gpp.net\r\n" +
+		"CSeq: " + strconv.Itoa(cseq) + " SUBSCRIBE\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Contact: <sip:p-cscf.hebeiyidong.3gpp.net:54321>\r\n" +
+		"Event: reg\r\n"
+	if len(expires) > 0 {
+		str += "Expires: " + expires + "\r\n"
+	}
+	msg, err := sip.NewMessage(strings.NewReader(str + "Content-Length: 0\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return &msg
+}
+
+func TestRegEventServer(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	e := NewRegEventServer()
+	e.now = func() time.Time { return now }
+
+	if _, _, err := e.Subscribe(testSubscribeRequest(t, 1, "", "30")); err != ErrIntervalTooBrief {
+		t.Errorf("want ErrIntervalTooBrief, got %v", err)
+	}
+	sub, expires, err := e.Subscribe(testSubscribeRequest(t, 1, "", "900000"))
+	if err != nil || expires != DefaultRegSubExpires || len(sub.ID.LocalTag) == 0 {
+		t.Fatalf("subscribe = %+v, %v, %v", sub, expires, err)
+	}
+	if sub.AOR.Username != "jiqimao" || sub.Target.Domain != "p-cscf.hebeiyidong.3gpp.net:54321" {
+		t.Errorf("subscription = %+v", sub)
+	}
+	if _, _, err = e.Subscribe(testSubscribeRequest(t, 2, "unknown", "600")); err != ErrSubscriptionNotExist {
+		t.Errorf("want ErrSubscriptionNotExist, got %v", err)
+	}
+	if _, _, err = e.Subscribe(testSubscribeRequest(t, 1, sub.ID.LocalTag, "600")); err != ErrSubscribeOutOfOrder {
+		t.Errorf("want ErrSubscribeOutOfOrder, got %v", err)
+	}
+	if _, expires, err = e.Subscribe(testSubscribeRequest(t, 2, sub.ID.LocalTag, "600")); err != nil || expires != 600 {
+		t.Fatalf("refresh = %v, %v", expires, err)
+	}
+	if subs := e.ByAOR("jiqimao"); len(subs) != 1 || subs[0] != sub {
+		t.Errorf("subscriptions = %v", subs)
+	}
+
+	// 通知中包含当前绑定和本次删除的绑定
+	active := []Binding{{
+		AOR:     sub.AOR,
+		Contact: sip.User{URI: sip.URI{Scheme: "sip", Username: "jiqimao", Domain: "10.0.0.1:5060"}},
+		Expires: now.Add(time.Hour),
+	}}
+	removed := []Binding{{Contact: sip.User{URI: sip.URI{Scheme: "sip", Username: "jiqimao", Domain: "10.0.0.2:5060"}}}}
+	reg := regRegistration(sub.AOR, active, removed, sip.RegEventExpired, now)
+	if reg.State != sip.RegStateActive || len(reg.Contacts) != 2 || reg.Contacts[0].Event != sip.RegEventRegistered ||
+		reg.Contacts[0].Expires != 3600 || reg.Contacts[1].State != sip.RegStateTerminated || reg.Contacts[1].Event != sip.RegEventExpired {
+		t.Errorf("registration = %+v", reg)
+	}
+	server := sip.URI{Scheme: "sip", Domain: "s-cscf.hebeiyidong.3gpp.net:54323"}
+	for i := 0; i < 2; i++ {
+		notify := e.Notify(sub, sip.SubscriptionState{State: sip.SubscriptionActive}, reg, server)
+		if notify.Header.CSeq.CSeq != i+1 || notify.Header.SubscriptionState.Expires != 600 {
+			t.Errorf("notify header = %+v", notify.Header)
+		}
+		info, err := sip.ParseRegInfo(notify.Body)
+		if err != nil || info.Version != i {
+			t.Errorf("notify body = %+v, %v", info, err)
+		}
+		if tag, _ := notify.Header.From.Arguments.Get("tag"); tag != sub.ID.LocalTag {
+			t.Errorf("notify from tag = %v", tag)
+		}
+	}
+
+	now = now.Add(601 * time.Second)
+	if expired := e.Expire(); len(expired) != 1 || len(e.ByAOR("jiqimao")) != 0 {
+		t.Errorf("expired = %v", expired)
+	}
+	// Expires为0的订阅只获取一次状态
+	if sub, expires, err = e.Subscribe(testSubscribeRequest(t, 3, "", "0")); err != nil || expires != 0 || len(e.ByAOR("jiqimao")) != 0 {
+		t.Errorf("fetch = %+v, %v, %v", sub, expires, err)
+	}
+}
+
+func TestRegistrarExpire(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	r := NewRegistrar()
+	r.now = func() time.Time { return now }
+	r.Register(testRegisterRequest(t, 1, "<sip:jiqimao@10.0.0.1:5060>;expires=120, <sip:jiqimao@10.0.0.2:5060>", "600"))
+	bindings, _ := r.Register(testRegisterRequest(t, 2, "<sip:jiqimao@10.0.0.2:5060>", "600"))
+	for _, b := range bindings {
+		if b.Refreshed != (b.Contact.URI.Domain == "10.0.0.2:5060") {
+			t.Errorf("binding %v refreshed = %v", b.Contact.URI, b.Refreshed)
+		}
+	}
+	now = now.Add(121 * time.Second)
+	expired := r.Expire()
+	if len(expired["jiqimao"]) != 1 || expired["jiqimao"][0].Contact.URI.Domain != "10.0.0.1:5060" {
+		t.Errorf("expired = %v", expired)
+	}
+	if removed := r.RemoveAll("jiqimao"); len(removed) != 1 || len(r.Bindings("jiqimao")) != 0 {
+		t.Errorf("removed = %v", removed)
+	}
+}
+
+func testIFC() []FilterCriteria {
+	orig := SessionCaseOriginating
+	return []FilterCriteria{
+		{
+			// 被叫侧的非INVITE请求
+			Priority: 10,
+			TriggerPoint: &TriggerPoint{SPT: []SPT{
+				{ConditionNegated: true, Group: []int{0}, Method: sip.MethodInvite},
+				{Group: []int{0}, SessionCase: &[]int{SessionCaseTerminatingRegistered}[0]},
+			}},
+			ApplicationServer: ApplicationServer{ServerName: "sip:mmtel.hebeiyidong.3gpp.net", DefaultHandling: DefaultHandlingTerminated},
+		},
+		{
+			// 主叫侧携带MMTEL业务标识的INVITE或注册
+			Priority: 0,
+			TriggerPoint: &TriggerPoint{ConditionTypeCNF: true, SPT: []SPT{
+				{Group: []int{0}, Method: sip.MethodInvite},
+				{Group: []int{0}, Method: sip.MethodRegister},
+				{Group: []int{1}, SessionCase: &orig},
+				{Group: []int{2}, SIPHeader: &SIPHeader{Header: "Accept-Contact", Content: "mmtel"}},
+				{Group: []int{2}, RequestURI: `^sip:hebeiyidong\.3gpp\.net`},
+			}},
+			ApplicationServer: ApplicationServer{ServerName: "sip:mmtel.hebeiyidong.3gpp.net"},
+		},
+	}
+}
+
+func TestFilterCriteria(t *testing.T) {
+	profile := &ServiceProfile{IFC: testIFC()}
+	data, err := profile.Encode()
+	if err != nil || strings.Contains(data, "=") {
+		t.Fatalf("data = %v, err = %v", data, err)
+	}
+	if profile, err = DecodeServiceProfile(data); err != nil || len(profile.IFC) != 2 {
+		t.Fatalf("profile = %+v, err = %v", profile, err)
+	}
+	register := testRegisterRequest(t, 1, "<sip:jiqimao@10.0.0.1:5060>", "600")
+	invite := testRegisterRequest(t, 1, "", "")
+	invite.RequestLine.Method = sip.MethodInvite
+	invite.RequestLine.RequestURI, _ = sip.NewURI("sip:daxiong@hebeiyidong.3gpp.net")
+	tests := []struct {
+		name        string
+		req         *sip.Message
+		sessionCase int
+		from        int
+		priority    int // -1表示没有匹配
+		next        int
+	}{
+		{"register", register, SessionCaseOriginating, 0, 0, 1},
+		{"register terminating", register, SessionCaseTerminatingRegistered, 0, 10, 2},
+		{"register from next", register, SessionCaseOriginating, 1, -1, 2},
+		{"invite without mmtel", invite, SessionCaseOriginating, 0, -1, 2},
+		{"invite terminating", invite, SessionCaseTerminatingRegistered, 0, -1, 2},
+	}
+	for _, tt := range tests {
+		fc, next := profile.Match(tt.req, tt.sessionCase, tt.from)
+		if (fc == nil) != (tt.priority < 0) || (fc != nil && fc.Priority != tt.priority) || next != tt.next {
+			t.Errorf("%v: fc = %+v, next = %v", tt.name, fc, next)
+		}
+	}
+	// 满足任一组内条件即可
+	invite.Header.UnsupportLines = append(invite.Header.UnsupportLines, `Accept-Contact: *;+g.3gpp.icsi-ref="urn%3Aurn-7%3A3gpp-service.ims.icsi.mmtel"`)
+	if fc, next := profile.Match(invite, SessionCaseOriginating, 0); fc == nil || fc.Priority != 0 || next != 1 {
+		t.Errorf("mmtel invite: fc = %+v, next = %v", fc, next)
+	}
+	// 没有触发点时无条件匹配
+	if !(*TriggerPoint)(nil).Match(invite, SessionCaseTerminatingUnregistered) {
+		t.Errorf("nil trigger point not matched")
+	}
+	if err = (FilterCriteria{ApplicationServer: ApplicationServer{ServerName: "sip:as"}, TriggerPoint: &TriggerPoint{SPT: []SPT{{RequestURI: "("}}}}).Validate(); err == nil {
+		t.Errorf("want error for invalid regexp")
+	}
+}
+
+// 调用HSS的Cx消息处理，返回HSS发出的消息
+func testCxRequest(t *testing.T, h *HssEntity, method byte, f BaseSignallingT, m map[string]string) []map[string]string {
+	pkg := new(modules.Package)
+	pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(m))
+	down := make(chan *modules.Package, 4)
+	if err := f(context.Background(), pkg, nil, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	close(down)
+	var result []map[string]string
+	for p := range down {
+		ans := modules.StrLineUnmarshal(p.GetData())
+		ans["Route"] = hex.EncodeToString([]byte{p.GetRoute()[1]})
+		ans["Host"] = p.GetShortConn()
+		result = append(result, ans)
+	}
+	return result
+}
+
+func TestCxServerAssignment(t *testing.T) {
+	store, err := NewMemoryStore(UserTable{IMSI: "123456789", SipUserName: "jiqimao", IFC: testIFC()})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf := &config.Network{Elements: map[string]*config.Node{
+		"SCSCF": {ActualAddr: "127.0.0.1:54323"},
+		"ICSCF": {ActualAddr: "127.0.0.1:54322"},
+	}}
+	h := &HssEntity{conf: conf, store: store}
+	route := func(method byte) string { return hex.EncodeToString([]byte{method}) }
+
+	// 未分配S-CSCF时，注册返回本域的S-CSCF，呼叫返回未注册业务
+	ans := testCxRequest(t, h, modules.UserAuthorizationRequest, h.UserAuthorizationRequestF, map[string]string{"UserName": "jiqimao"})
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultFirstRegistration || ans[0][CX_SERVER] != "127.0.0.1:54323" {
+		t.Fatalf("UAA = %v", ans)
+	}
+	ans = testCxRequest(t, h, modules.LocationInfoRequest, h.LocationInfoRequestF, map[string]string{"UserName": "jiqimao", CX_SESSION: "s1"})
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultUnregisteredService || ans[0][CX_SESSION] != "s1" {
+		t.Fatalf("LIA = %v", ans)
+	}
+	ans = testCxRequest(t, h, modules.LocationInfoRequest, h.LocationInfoRequestF, map[string]string{"UserName": "daxiong"})
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultErrorUserUnknown {
+		t.Fatalf("LIA = %v", ans)
+	}
+
+	// S-CSCF注册用户后，SAA携带业务签约数据
+	sar := map[string]string{"UserName": "jiqimao", CX_SERVER: "127.0.0.1:54323", CX_ASSIGNMENT: AssignmentRegistration}
+	ans = testCxRequest(t, h, modules.ServerAssignmentRequest, h.ServerAssignmentRequestF, sar)
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultSuccess || ans[0]["Host"] != "127.0.0.1:54323" {
+		t.Fatalf("SAA = %v", ans)
+	}
+	if profile, err := DecodeServiceProfile(ans[0][USER_DATA]); err != nil || len(profile.IFC) != 2 {
+		t.Fatalf("profile = %+v, err = %v", profile, err)
+	}
+	ans = testCxRequest(t, h, modules.UserAuthorizationRequest, h.UserAuthorizationRequestF, map[string]string{"UserName": "jiqimao"})
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultSubsequentRegistration {
+		t.Fatalf("UAA = %v", ans)
+	}
+
+	// 用户改由其他S-CSCF服务，要求原S-CSCF注销用户
+	sar[CX_SERVER] = "127.0.0.1:54333"
+	ans = testCxRequest(t, h, modules.ServerAssignmentRequest, h.ServerAssignmentRequestF, sar)
+	if len(ans) != 2 || ans[0]["Route"] != route(modules.RegistrationTerminationRequest) || ans[0]["Host"] != "127.0.0.1:54323" || ans[0][CX_REASON] != ReasonNewServerAssigned {
+		t.Fatalf("RTR = %v", ans)
+	}
+	ans = testCxRequest(t, h, modules.LocationInfoRequest, h.LocationInfoRequestF, map[string]string{"UserName": "jiqimao"})
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultSuccess || ans[0][CX_SERVER] != "127.0.0.1:54333" {
+		t.Fatalf("LIA = %v", ans)
+	}
+
+	// 只有当前服务的S-CSCF可以解除分配
+	sar[CX_ASSIGNMENT] = AssignmentTimeoutDeregistration
+	sar[CX_SERVER] = "127.0.0.1:54323"
+	testCxRequest(t, h, modules.ServerAssignmentRequest, h.ServerAssignmentRequestF, sar)
+	if a, _ := store.GetServerAssignment(context.Background(), "jiqimao"); !a.Assigned() {
+		t.Fatalf("assignment = %+v", a)
+	}
+	sar[CX_SERVER] = "127.0.0.1:54333"
+	testCxRequest(t, h, modules.ServerAssignmentRequest, h.ServerAssignmentRequestF, sar)
+	if a, _ := store.GetServerAssignment(context.Background(), "jiqimao"); a.Assigned() {
+		t.Fatalf("assignment = %+v", a)
+	}
+
+	// 存储出错时也要应答，结果为5012
+	h.store = testFailStore{store}
+	sar[CX_ASSIGNMENT] = AssignmentRegistration
+	for _, tt := range []struct {
+		method byte
+		f      BaseSignallingT
+		m      map[string]string
+	}{
+		{modules.UserAuthorizationRequest, h.UserAuthorizationRequestF, map[string]string{"UserName": "jiqimao"}},
+		{modules.LocationInfoRequest, h.LocationInfoRequestF, map[string]string{"UserName": "jiqimao", CX_SESSION: "s2"}},
+		{modules.ServerAssignmentRequest, h.ServerAssignmentRequestF, sar},
+	} {
+		down := make(chan *modules.Package, 1)
+		if err := tt.f(context.Background(), testCxPackage(tt.method, "", tt.m), nil, down); err != errTestStore {
+			t.Errorf("%x err = %v", tt.method, err)
+		}
+		if ans := modules.StrLineUnmarshal(testReceive(t, down).GetData()); ans[CX_RESULT] != ResultUnableToComply || ans[CX_SESSION] != tt.m[CX_SESSION] {
+			t.Errorf("%x answer = %v", tt.method, ans)
+		}
+	}
+}
+
+var errTestStore = errors.New("errTestStore")
+
+// 读取分配记录失败的存储
+type testFailStore struct {
+	SubscriberStore
+}
+
+func (testFailStore) GetServerAssignment(ctx context.Context, un string) (*ServerAllocTable, error) {
+	return nil, errTestStore
+}
+
+func TestCxDiameterCodec(t *testing.T) {
+	local := diameter.Identity{Host: "hss.hebeiyidong.3gpp.net", Realm: "hebeiyidong.3gpp.net"}
+	profile, _ := ServiceProfile{IFC: testIFC()}.Encode()
+	avs := map[string]string{"UserName": "daxiong", CX_SESSION: "s;1;3", CX_RESULT: ResultSuccess, USER_DATA: profile}
+	marshalAuthVectors(avs, []AuthVector{
+		{RAND: strings.Repeat("01", 16), AUTN: strings.Repeat("02", 16), XRES: strings.Repeat("03", 8), CK: strings.Repeat("04", 16), IK: strings.Repeat("05", 16)},
+		{RAND: strings.Repeat("11", 16), AUTN: strings.Repeat("12", 16), XRES: strings.Repeat("13", 8), CK: strings.Repeat("14", 16), IK: strings.Repeat("15", 16)},
+	})
+	cases := []struct {
+		method byte
+		m      map[string]string
+	}{
+		{modules.UserAuthorizationRequest, map[string]string{"UserName": "daxiong", CX_SESSION: "i;1;1"}},
+		{modules.UserAuthorizationAnswer, map[string]string{"UserName": "daxiong", CX_SESSION: "i;1;1", CX_RESULT: ResultFirstRegistration, CX_SERVER: "127.0.0.1:54323"}},
+		{modules.MultiMediaAuthenticationRequest, map[string]string{"UserName": "daxiong", CX_SESSION: "s;1;2", AV_NUM: "2", AV_RAND: strings.Repeat("ab", 16), AV_AUTS: strings.Repeat("cd", 14)}},
+		{modules.MultiMediaAuthenticationAnswer, avs},
+		{modules.ServerAssignmentRequest, map[string]string{"UserName": "daxiong", CX_SESSION: "s;1;4", CX_SERVER: "127.0.0.1:54323", CX_ASSIGNMENT: AssignmentUserDeregistration}},
+		{modules.ServerAssignmentAnswer, map[string]string{"UserName": "daxiong", CX_SESSION: "s;1;4", CX_RESULT: ResultErrorUserUnknown}},
+		{modules.LocationInfoAnswer, map[string]string{"UserName": "daxiong", CX_SESSION: "tag", CX_RESULT: ResultUnregisteredService, CX_SERVER: "127.0.0.1:54323"}},
+		{modules.RegistrationTerminationRequest, map[string]string{"UserName": "daxiong", CX_SESSION: "h;1;5", CX_REASON: ReasonNewServerAssigned}},
+		{modules.RegistrationTerminationAnswer, map[string]string{"UserName": "daxiong", CX_SESSION: "h;1;5", CX_RESULT: ResultSuccess}},
+	}
+	for _, c := range cases {
+		msg, err := encodeCx(local, c.method, c.m)
+		if err != nil {
+			t.Fatalf("encode %x: %v", c.method, err)
+		}
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("marshal %x: %v", c.method, err)
+		}
+		msg, err = diameter.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("unmarshal %x: %v", c.method, err)
+		}
+		method, m, err := decodeCx(msg)
+		if err != nil || method != c.method {
+			t.Fatalf("decode %x = %x, %v", c.method, method, err)
+		}
+		for k, v := range c.m {
+			if m[k] != v {
+				t.Errorf("%x %v = %v, want %v", c.method, k, m[k], v)
+			}
+		}
+	}
+	// 首次注册的结果码为3GPP定义的实验结果码
+	msg, _ := encodeCx(local, modules.UserAuthorizationAnswer, cases[1].m)
+	if _, ok := msg.Find(diameter.AVPExperimentalResult, 0); !ok {
+		t.Error("UAA without Experimental-Result")
+	}
+	msg, _ = encodeCx(local, modules.ServerAssignmentRequest, map[string]string{"UserName": "daxiong"})
+	if !msg.IsRequest() || !strings.HasPrefix(msg.SessionID(), "hss.hebeiyidong.3gpp.net;") {
+		t.Errorf("SAR = %+v", msg)
+	}
+	if a, _ := msg.Find(diameter.AVPPublicIdentity, diameter.Vendor3GPP); a.String() != "sip:daxiong@hebeiyidong.3gpp.net" {
+		t.Errorf("public identity = %v", a.String())
+	}
+	if _, err := encodeCx(local, modules.ServerAssignmentRequest, map[string]string{CX_ASSIGNMENT: "UNKNOWN"}); err == nil {
+		t.Error("encode invalid assignment type")
+	}
+	if _, err := encodeCx(local, modules.AttachRequest, nil); err != ErrUnsupportedCxCommand {
+		t.Errorf("encode attach = %v", err)
+	}
+}
+
+// HSS的MAA经Diameter编码后发给S-CSCF，失败时也要应答
+func TestCxMultimediaAuthDiameter(t *testing.T) {
+	store, err := NewMemoryStore(UserTable{IMSI: "460001", RootK: testK, Opc: testOPc, SipUserName: "jiqimao", IFC: testIFC()})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf := &config.Network{Elements: map[string]*config.Node{"SCSCF": {ActualAddr: "127.0.0.1:54323"}}}
+	h := &HssEntity{conf: conf, store: store}
+	local := diameter.Identity{Host: "hss.hebeiyidong.3gpp.net", Realm: "hebeiyidong.3gpp.net"}
+	roundTrip := func(m map[string]string) map[string]string {
+		t.Helper()
+		msg, err := encodeCx(local, modules.MultiMediaAuthenticationAnswer, m)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if msg, err = diameter.Unmarshal(data); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		method, m, err := decodeCx(msg)
+		if err != nil || method != modules.MultiMediaAuthenticationAnswer {
+			t.Fatalf("decode = %x, %v", method, err)
+		}
+		return m
+	}
+
+	ans := testCxRequest(t, h, modules.MultiMediaAuthenticationRequest, h.MultimediaAuthorizationRequestF, map[string]string{"UserName": "jiqimao", CX_SESSION: "s;1;1", AV_NUM: "2"})
+	if len(ans) != 1 || ans[0][CX_RESULT] != ResultSuccess || ans[0]["Host"] != "127.0.0.1:54323" {
+		t.Fatalf("MAA = %v", ans)
+	}
+	m := roundTrip(ans[0])
+	if m[CX_RESULT] != ResultSuccess || len(unmarshalAuthVectors(m)) != 2 || len(m[USER_DATA]) == 0 {
+		t.Errorf("MAA = %v", m)
+	}
+
+	// 用户不存在时应答5001
+	pkg := testCxPackage(modules.MultiMediaAuthenticationRequest, "", map[string]string{"UserName": "daxiong", CX_SESSION: "s;1;2"})
+	down := make(chan *modules.Package, 1)
+	if err = h.MultimediaAuthorizationRequestF(context.Background(), pkg, nil, down); err == nil {
+		t.Errorf("want error for unknown user")
+	}
+	m = modules.StrLineUnmarshal(testReceive(t, down).GetData())
+	if m = roundTrip(m); m[CX_RESULT] != ResultErrorUserUnknown || len(unmarshalAuthVectors(m)) != 0 {
+		t.Errorf("MAA = %v", m)
+	}
+	// 同步失败时应答5012
+	pkg = testCxPackage(modules.MultiMediaAuthenticationRequest, "", map[string]string{"UserName": "jiqimao", AV_RAND: strings.Repeat("00", 16), AV_AUTS: strings.Repeat("00", 14)})
+	if err = h.MultimediaAuthorizationRequestF(context.Background(), pkg, nil, down); err == nil {
+		t.Errorf("want error for invalid AUTS")
+	}
+	if m = roundTrip(modules.StrLineUnmarshal(testReceive(t, down).GetData())); m[CX_RESULT] != ResultUnableToComply {
+		t.Errorf("MAA = %v", m)
+	}
+
+	// 应答发给请求的来源，而不是配置的S-CSCF
+	ans = testCxRequest(t, h, modules.MultiMediaAuthenticationRequest, h.MultimediaAuthorizationRequestF, map[string]string{"UserName": "jiqimao", CX_SERVER: "127.0.0.1:54333"})
+	if len(ans) != 1 || ans[0]["Host"] != "127.0.0.1:54333" {
+		t.Errorf("MAA host = %v", ans)
+	}
+	for _, tt := range []struct {
+		method byte
+		f      BaseSignallingT
+	}{
+		{modules.MultiMediaAuthenticationRequest, h.MultimediaAuthorizationRequestF},
+		{modules.UserAuthorizationRequest, h.UserAuthorizationRequestF},
+		{modules.LocationInfoRequest, h.LocationInfoRequestF},
+	} {
+		pkg = testCxPackage(tt.method, "127.0.0.1:54343", map[string]string{"UserName": "jiqimao", CX_SERVER: "127.0.0.1:54333"})
+		tt.f(context.Background(), pkg, nil, down)
+		if p := testReceive(t, down); p.GetShortConn() != "127.0.0.1:54343" {
+			t.Errorf("%x answer host = %v", tt.method, p.GetShortConn())
+		}
+	}
+}
+
+// 测试用的功能实体消息
+func testCxPackage(method byte, host string, m map[string]string) *modules.Package {
+	pkg := new(modules.Package)
+	pkg.SetShortConn(host)
+	pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(m))
+	return pkg
+}
+
+func testReceive(t *testing.T, ch chan *modules.Package) *modules.Package {
+	select {
+	case pkg := <-ch:
+		return pkg
+	case <-time.After(3 * time.Second):
+		t.Fatal("receive timeout")
+	}
+	return nil
+}
+
+func TestCxGateway(t *testing.T) {
+	if err := config.Load("../config.yml"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf, err := config.NewNetwork("hebeiyidong")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf.Cx, conf.Diameter = config.CxDiameter, ln.Addr().String()
+	ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hssAddr, scscfAddr := conf.Elements["HSS"].ActualAddr, conf.Elements["SCSCF"].ActualAddr
+
+	hssIn, hssOut := make(chan *modules.Package, 4), make(chan *modules.Package, 4)
+	_, hssDown := CxTransport(ctx, conf, "hss", hssIn, nil, hssOut)
+	scscfIn, scscfOut := make(chan *modules.Package, 4), make(chan *modules.Package, 4)
+	scscfUp, _ := CxTransport(ctx, conf, "s-cscf", scscfIn, scscfOut, nil)
+
+	// S-CSCF发往HSS的SAR经Diameter到达HSS
+	scscfUp <- testCxPackage(modules.ServerAssignmentRequest, hssAddr, map[string]string{
+		"UserName": "daxiong", CX_SERVER: scscfAddr, CX_ASSIGNMENT: AssignmentRegistration,
+	})
+	pkg := testReceive(t, hssIn)
+	sar := modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.ServerAssignmentRequest || sar["UserName"] != "daxiong" || sar[CX_SERVER] != scscfAddr || sar[CX_ASSIGNMENT] != AssignmentRegistration || len(sar[CX_SESSION]) == 0 {
+		t.Fatalf("SAR = %v", sar)
+	}
+	// HSS的应答按会话标识返回到请求的连接
+	hssDown <- testCxPackage(modules.ServerAssignmentAnswer, scscfAddr, map[string]string{
+		"UserName": "daxiong", CX_RESULT: ResultSuccess, CX_SESSION: sar[CX_SESSION],
+	})
+	pkg = testReceive(t, scscfIn)
+	if saa := modules.StrLineUnmarshal(pkg.GetData()); pkg.GetRoute()[1] != modules.ServerAssignmentAnswer || saa[CX_RESULT] != ResultSuccess || saa[CX_SESSION] != sar[CX_SESSION] {
+		t.Fatalf("SAA = %v", saa)
+	}
+	// HSS向已连接的S-CSCF发起RTR
+	hssDown <- testCxPackage(modules.RegistrationTerminationRequest, scscfAddr, map[string]string{
+		"UserName": "daxiong", CX_REASON: ReasonPermanentTermination,
+	})
+	pkg = testReceive(t, scscfIn)
+	rtr := modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.RegistrationTerminationRequest || rtr[CX_REASON] != ReasonPermanentTermination {
+		t.Fatalf("RTR = %v", rtr)
+	}
+	scscfUp <- testCxPackage(modules.RegistrationTerminationAnswer, hssAddr, map[string]string{
+		"UserName": "daxiong", CX_RESULT: ResultSuccess, CX_SESSION: rtr[CX_SESSION],
+	})
+	pkg = testReceive(t, hssIn)
+	if rta := modules.StrLineUnmarshal(pkg.GetData()); pkg.GetRoute()[1] != modules.RegistrationTerminationAnswer || rta[CX_RESULT] != ResultSuccess {
+		t.Fatalf("RTA = %v", rta)
+	}
+
+	// 非Cx消息和没有对应请求的应答仍然交给原来的发送协程
+	scscfUp <- testCxPackage(modules.AttachRequest, hssAddr, nil)
+	if pkg = testReceive(t, scscfOut); pkg.GetRoute()[1] != modules.AttachRequest {
+		t.Fatalf("route = %v", pkg.GetRoute())
+	}
+	hssDown <- testCxPackage(modules.UserAuthorizationAnswer, conf.Elements["ICSCF"].ActualAddr, map[string]string{CX_RESULT: ResultSuccess})
+	if pkg = testReceive(t, hssOut); pkg.GetShortConn() != conf.Elements["ICSCF"].ActualAddr {
+		t.Fatalf("host = %v", pkg.GetShortConn())
+	}
+}
+
+func TestSIPTransportSelection(t *testing.T) {
+	if err := config.Load("../config.yml"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf, err := config.NewNetwork("hebeiyidong")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	icscf, pgw := conf.Elements["ICSCF"].ActualAddr, conf.Elements["PGW"].ActualAddr
+	out := make(chan *modules.Package, 1)
+
+	// CSCF之间的小消息使用UDP
+	req := testRegisterRequest(t, 1, "", "")
+	sipSender(NextHop{Host: icscf, Up: true}, out)(req)
+	pkg := testReceive(t, out)
+	if pkg.GetTransport() != modules.TransportUDP || req.Header.Via.FirstTransport() != "UDP" {
+		t.Errorf("small request = %v, via %v", pkg.GetTransport(), req.Header.Via.FirstTransport())
+	}
+
+	// 超过MTU的请求改用TCP，Via与实际的协议一致
+	req.Body = strings.Repeat("a", modules.MaxUDPRequestSize)
+	sipSender(NextHop{Host: icscf, Up: true}, out)(req)
+	pkg = testReceive(t, out)
+	if pkg.GetTransport() != modules.TransportTCP || pkg.GetShortConn() != icscf || !strings.Contains(string(pkg.GetData()), "Via: SIP/2.0/TCP") {
+		t.Errorf("large request = %v, %v", pkg.GetTransport(), pkg.GetShortConn())
+	}
+
+	// 发往PGW的消息只能使用UDP
+	sipSender(NextHop{Host: pgw}, out)(req)
+	if pkg = testReceive(t, out); pkg.GetTransport() != modules.TransportUDP {
+		t.Errorf("request to pgw = %v", pkg.GetTransport())
+	}
+
+	// 下一跳URI指定的传输协议，没有配置TLS时使用UDP
+	req.Body = ""
+	if tr := requestTransport(req, len(req.String())); tr != modules.TransportUDP {
+		t.Errorf("default transport = %v", tr)
+	}
+	req.RequestLine.RequestURI.Arguments.Set("transport", "tcp")
+	if tr := requestTransport(req, len(req.String())); tr != modules.TransportTCP {
+		t.Errorf("uri transport = %v", tr)
+	}
+	if tr, host := streamHost(modules.TransportTLS, icscf); tr != modules.TransportUDP || host != icscf {
+		t.Errorf("tls without certificate = %v %v", tr, host)
+	}
+
+	// 应答使用请求到达时的协议和连接
+	resp := sip.NewResponse(sip.StatusOK, req)
+	sipSender(NextHop{Host: icscf, Up: true, Transport: "TCP", Conn: "127.0.0.1:40000"}, out)(resp)
+	pkg = testReceive(t, out)
+	if pkg.GetTransport() != modules.TransportTCP || pkg.GetRemoteAddr() != "127.0.0.1:40000" {
+		t.Errorf("response = %v, %v", pkg.GetTransport(), pkg.GetRemoteAddr())
+	}
+}
+
+func testPool(t *testing.T, cidr string) *Pool {
+	pool, err := initpool(cidr)
+	if err != nil {
+		t.Fatalf("%v %v", cidr, err)
+	}
+	return pool
+}
+
+func TestPgwPool(t *testing.T) {
+	tests := []struct {
+		cidr   string
+		ip     string
+		prefix string
+	}{
+		{"10.0.1.0/24", "10.0.1.1", ""},
+		{"2001:db8:1::/48", "2001:db8:1:1::1", "2001:db8:1:1::/64"},
+		{"2001:db8:1::/64", "2001:db8:1::1", ""},
+		{"2001:db8:1::/120", "2001:db8:1::1", ""},
+	}
+	for _, tt := range tests {
+		l, err := NewIPAllocator(testPool(t, tt.cidr), 0).Allocate("", nil, time.Now())
+		if err != nil || l.Address().String() != tt.ip {
+			t.Errorf("%v ip = %v, %v", tt.cidr, l, err)
+			continue
+		}
+		if prefix := l.Prefix(); (prefix == nil && len(tt.prefix) > 0) || (prefix != nil && prefix.String() != tt.prefix) {
+			t.Errorf("%v prefix = %v", tt.cidr, prefix)
+		}
+	}
+
+	// 广播地址和超出网段的前缀不能分配
+	a := NewIPAllocator(testPool(t, "10.0.1.0/30"), 0)
+	a.Allocate("", nil, time.Now())
+	a.Allocate("", nil, time.Now())
+	if l, err := a.Allocate("", nil, time.Now()); err != ErrNotEnoughIP {
+		t.Errorf("broadcast allocated %v", l)
+	}
+	a = NewIPAllocator(testPool(t, "2001:db8:1::/63"), 0)
+	a.Allocate("", nil, time.Now())
+	if l, err := a.Allocate("", nil, time.Now()); err != ErrNotEnoughIP {
+		t.Errorf("prefix out of range allocated %v", l)
+	}
+
+	// 没有可以分配的地址的网段不能作为地址池
+	for _, cidr := range []string{"10.0.1.0/31", "10.0.1.1/32", "2001:db8:1::1/128"} {
+		if pool, err := initpool(cidr); err != ErrEmptyPool {
+			t.Errorf("%v pool = %+v %v", cidr, pool, err)
+		}
+	}
+	if pool := testPool(t, "2001:db8:1::/64"); pool.Unit != 128 || pool.FirstIP.String() != "2001:db8:1::1" || pool.LastIP.String() != "2001:db8:1:0:ffff:ffff:ffff:ffff" {
+		t.Errorf("/64 pool = %+v", pool)
+	}
+}
+
+func TestIPAllocator(t *testing.T) {
+	now := time.Now()
+	a := NewIPAllocator(testPool(t, "10.0.1.0/29"), time.Hour)
+	a.Reserve("460003", net.ParseIP("10.0.1.2"))
+	l1, _ := a.Allocate("460001", nil, now)
+	l2, _ := a.Allocate("460002", nil, now)
+	if l1.String() != "10.0.1.1" || l2.String() != "10.0.1.3" {
+		t.Fatalf("allocated %v %v", l1, l2)
+	}
+	// 租约内重新附着时续租原来的地址
+	if l, _ := a.Allocate("460001", nil, now.Add(time.Minute)); l.String() != "10.0.1.1" || !l.Expire.Equal(now.Add(time.Minute+time.Hour)) {
+		t.Errorf("renew = %v %v", l, l.Expire)
+	}
+	// 静态地址只能分配给配置的用户
+	if l, err := a.Allocate("460003", net.ParseIP("10.0.1.2"), now); err != nil || !l.Static || l.String() != "10.0.1.2" {
+		t.Errorf("static = %v %v", l, err)
+	}
+	if _, err := a.Allocate("460004", net.ParseIP("10.0.1.3"), now); err != ErrIPInUse {
+		t.Errorf("static in use = %v", err)
+	}
+	a.Reserve("460004", net.ParseIP("10.0.1.2"))
+	a.Release("460003")
+	if _, err := a.Allocate("460004", net.ParseIP("10.0.1.2"), now); err != ErrIPInUse {
+		t.Errorf("static reserved = %v", err)
+	}
+	a.Allocate("460003", net.ParseIP("10.0.1.2"), now)
+	// 网段的第一个地址、广播地址和地址池以外的地址不能作为静态地址
+	for _, ip := range []string{"10.0.1.0", "10.0.1.7", "10.0.2.1", "2001:db8::1"} {
+		if _, err := a.Allocate("460004", net.ParseIP(ip), now); err != ErrIPOutOfPool {
+			t.Errorf("static %v = %v", ip, err)
+		}
+	}
+	if u := a.Usage(); u.Total != 6 || u.Used != 3 || u.Static != 1 {
+		t.Errorf("usage = %+v", u)
+	}
+
+	// 释放的地址在其余地址用完后重新分配
+	if l, ok := a.Release("460001"); !ok || l.String() != "10.0.1.1" {
+		t.Errorf("release = %v %v", l, ok)
+	}
+	var got []string
+	for _, imsi := range []string{"460005", "460006", "460007", "460008"} {
+		l, err := a.Allocate(imsi, nil, now)
+		if err != nil {
+			t.Fatalf("%v %v", imsi, err)
+		}
+		got = append(got, l.String())
+	}
+	if strings.Join(got, ",") != "10.0.1.4,10.0.1.5,10.0.1.6,10.0.1.1" {
+		t.Errorf("allocated %v", got)
+	}
+	if _, err := a.Allocate("460009", nil, now); err != ErrNotEnoughIP {
+		t.Errorf("full pool = %v", err)
+	}
+
+	// 到期的租约被回收
+	a.Allocate("460002", nil, now.Add(30*time.Minute))
+	expired := a.Expire(now.Add(time.Hour))
+	if len(expired) != 5 {
+		t.Errorf("expired = %v", expired)
+	}
+	if u := a.Usage(); u.Used != 1 {
+		t.Errorf("usage after expire = %+v", u)
+	}
+
+	// 恢复租约时忽略地址池以外和已经恢复过的地址
+	a = NewIPAllocator(testPool(t, "10.0.1.0/29"), time.Hour)
+	for _, ip := range []string{"10.0.2.1", "10.0.1.7", "2001:db8::1"} {
+		if a.Restore(&Lease{IMSI: "460001", Key: net.ParseIP(ip), Expire: now.Add(time.Hour)}, now) {
+			t.Errorf("restored %v", ip)
+		}
+	}
+	if !a.Restore(&Lease{IMSI: "460001", Key: net.ParseIP("10.0.1.1"), Expire: now.Add(time.Hour)}, now) {
+		t.Errorf("lease not restored")
+	}
+	if a.Restore(&Lease{IMSI: "460002", Key: net.ParseIP("10.0.1.1"), Expire: now.Add(time.Hour)}, now) {
+		t.Errorf("duplicate lease restored")
+	}
+	if l, _ := a.Allocate("460001", nil, now); l.String() != "10.0.1.1" {
+		t.Errorf("restored = %v", l)
+	}
+	if _, ok := a.Release("460002"); ok {
+		t.Errorf("duplicate lease owned")
+	}
+}
+
+// /64网段按地址分配，没有可以分配的地址时不能分配网段以外的地址
+func TestIPAllocatorBounds(t *testing.T) {
+	now := time.Now()
+	a := NewIPAllocator(testPool(t, "2001:db8:1::/64"), time.Hour)
+	_, n, _ := net.ParseCIDR("2001:db8:1::/64")
+	for _, imsi := range []string{"460001", "460002"} {
+		l, err := a.Allocate(imsi, nil, now)
+		if err != nil || l.Prefix() != nil || !n.Contains(l.Address()) {
+			t.Errorf("/64 allocated %v %v", l, err)
+		}
+	}
+	if u := a.Usage(); u.Total != 1<<64-1 || u.Used != 2 {
+		t.Errorf("/64 usage = %+v", u)
+	}
+
+	// 与/31网段相同，去掉首尾后为空的地址池
+	ip := net.ParseIP("10.0.1.0").To16()
+	a = NewIPAllocator(&Pool{CurIP: ip, FirstIP: addIP(ip, 128, 1), LastIP: ip, Unit: 128}, time.Hour)
+	if l, err := a.Allocate("460001", nil, now); err != ErrNotEnoughIP {
+		t.Errorf("/31 allocated %v %v", l, err)
+	}
+	if u := a.Usage(); u.Total != 0 || u.Used != 0 {
+		t.Errorf("/31 usage = %+v", u)
+	}
+}
+
+func TestPgwLeasePersistence(t *testing.T) {
+	sc := config.Store{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "volte.db")}
+	store, err := OpenSubscriberStore(sc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx := context.Background()
+	if err = store.CreateUser(ctx, &UserTable{IMSI: "460001", SipUserName: "static", IP: "10.0.1.6, 2001:db8:1:9::"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf := &config.Network{
+		Name:     "hebeiyidong",
+		Dhcp:     "10.0.1.0/29",
+		Dhcp6:    "2001:db8:1::/60",
+		Elements: map[string]*config.Node{"PGW": {ActualAddr: "127.0.0.1:12348"}},
+	}
+	p := new(PgwEntity)
+	p.Init(conf, sc)
+	static, err := p.allocate(ctx, "460001", p.subscriber(ctx, "460001"))
+	if err != nil || len(static) != 2 || static[0].String() != "10.0.1.6" || static[1].String() != "2001:db8:1:9::/64" {
+		t.Fatalf("static = %v %v", static, err)
+	}
+	dynamic, _ := p.allocate(ctx, "460002", p.subscriber(ctx, "460002"))
+	p.allocate(ctx, "460003", p.subscriber(ctx, "460003"))
+	p.releaseIP(ctx, "460003")
+
+	// 重启后恢复未释放的租约，静态地址不参与动态分配
+	p = new(PgwEntity)
+	p.Init(conf, sc)
+	if u := p.PoolUsage(); len(u) != 2 || u[0].Used != 2 || u[0].Static != 1 || u[1].Used != 2 {
+		t.Errorf("usage = %+v", u)
+	}
+	if l, _ := p.allocate(ctx, "460002", p.subscriber(ctx, "460002")); l[0].String() != dynamic[0].String() || l[1].String() != dynamic[1].String() {
+		t.Errorf("restored = %v, want %v", l, dynamic)
+	}
+	p.sweepLeases(ctx, time.Now().Add(DefaultLeaseTime), nil, make(chan *modules.Package, 4))
+	if u := p.PoolUsage(); u[0].Used != 0 {
+		t.Errorf("usage after sweep = %+v", u)
+	}
+	p = new(PgwEntity)
+	p.Init(conf, sc)
+	if u := p.PoolUsage(); u[0].Used != 0 || u[1].Used != 0 {
+		t.Errorf("usage after restart = %+v", u)
+	}
+
+	// IPv6地址分配失败时撤销已经分配的IPv4地址
+	p.alloc6.Reserve("460001", net.ParseIP("2001:db8:1:9::"))
+	for i := 0; i < 14; i++ {
+		p.alloc6.Allocate("", nil, time.Now())
+	}
+	if l, err := p.allocate(ctx, "460004", nil); err != ErrNotEnoughIP {
+		t.Fatalf("allocate = %v %v", l, err)
+	}
+	if u := p.PoolUsage(); u[0].Used != 0 {
+		t.Errorf("usage after rollback = %+v", u)
+	}
+	if sessions, _ := p.leases.LoadLeases(ctx, "127.0.0.1:12348"); len(sessions) != 0 {
+		t.Errorf("sessions = %v", sessions)
+	}
+
+	// 不同PGW的租约可以使用相同的地址
+	other := &SessionTable{IMSI: "460005", IP: "10.0.1.1", PgwAddr: "127.0.0.1:22348", Expire: time.Now().Add(time.Hour)}
+	if err = p.leases.SaveLease(ctx, other); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = p.leases.SaveLease(ctx, &SessionTable{IMSI: "460006", IP: "10.0.1.1", PgwAddr: "127.0.0.1:12348", Expire: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if sessions, _ := p.leases.LoadLeases(ctx, "127.0.0.1:22348"); len(sessions) != 1 || sessions[0].IMSI != "460005" {
+		t.Errorf("other pgw sessions = %v", sessions)
+	}
+}
+
+// 测试用的PGW，用户460001签约了IMS用户jiqimao
+func testPgw(t *testing.T) *PgwEntity {
+	store, err := NewMemoryStore(UserTable{IMSI: "460001", SipUserName: "jiqimao"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf := &config.Network{
+		Dhcp: "10.0.1.0/29",
+		Elements: map[string]*config.Node{
+			"PGW":   {ActualAddr: "127.0.0.1:12348"},
+			"PCSCF": {ActualAddr: "127.0.0.1:54321"},
+			"PCRF":  {ActualAddr: "127.0.0.1:12350"},
+		},
+	}
+	p := new(PgwEntity)
+	p.Init(conf, config.Store{Driver: "memory"})
+	p.leases = store.(*memoryStore)
+	p.RegistRouter()
+	return p
+}
+
+func testEnbPackage(t *testing.T, method byte, conn *net.UDPConn, m map[string]string) *modules.Package {
+	pkg := new(modules.Package)
+	pkg.SetLongConn(conn)
+	pkg.SetLongAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000})
+	pkg.Construct(modules.EPCPROTOCAL, method, modules.StrLineMarshal(m))
+	return pkg
+}
+
+func TestPgwDetach(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	p := testPgw(t)
+	up, down := make(chan *modules.Package, 4), make(chan *modules.Package, 4)
+	attach := func(imsi string) {
+		pkg := testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: imsi})
+		if err := p.AttachRequestF(ctx, pkg, up, down); err != nil {
+			t.Fatalf("%v", err)
+		}
+		testReceive(t, down)
+	}
+	attach("460001")
+	attach("460002")
+
+	// UE发起的去附着释放地址，通知IMS侧注销签约了IMS的用户，基站上还有UE时保留基站地址
+	pkg := testEnbPackage(t, modules.DetachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001", EPC_DETACH_TYPE: DetachEPS})
+	if err = p.DetachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if pkg = testReceive(t, down); pkg.GetRoute()[1] != modules.DetachAccept {
+		t.Errorf("detach accept = %x", pkg.GetRoute())
+	}
+	pkg = testReceive(t, up)
+	m := modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.DetachIndication || pkg.GetShortConn() != "127.0.0.1:54321" || m[EPC_USER_NAME] != "jiqimao" {
+		t.Errorf("detach indication = %x %v %v", pkg.GetRoute(), pkg.GetShortConn(), m)
+	}
+	if u := p.PoolUsage(); u[0].Used != 1 {
+		t.Errorf("usage = %+v", u)
+	}
+	if p.pCache.getUEContext(UEPrefix+"460001") != nil || p.pCache.getAddress(AddrPrefix+"100") == nil {
+		t.Errorf("context not released")
+	}
+
+	// 租约到期时网络侧发起去附着，最后一个UE去附着后删除基站地址
+	p.sweepLeases(ctx, time.Now().Add(DefaultLeaseTime), up, down)
+	pkg = testReceive(t, down)
+	m = modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.DetachRequest || m[EPC_UE_IDENTITY] != "460002" || m[EPC_DETACH_TYPE] != DetachReattachRequired {
+		t.Errorf("network detach = %x %v", pkg.GetRoute(), m)
+	}
+	if pkg.GetLongConn() != conn || pkg.GetLongConnAddr().Port != 40000 {
+		t.Errorf("network detach sent to %v", pkg.GetLongConnAddr())
+	}
+	if p.pCache.getUEContext(UEPrefix+"460002") != nil || p.pCache.getAddress(AddrPrefix+"100") != nil {
+		t.Errorf("context not released")
+	}
+	// 没有签约IMS的用户不通知IMS侧
+	select {
+	case pkg = <-up:
+		t.Errorf("unexpected indication %v", string(pkg.GetData()))
+	default:
+	}
+
+	// UE关机时不应答
+	attach("460001")
+	pkg = testEnbPackage(t, modules.DetachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001", EPC_DETACH_TYPE: DetachSwitchOff})
+	if err = p.DetachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testReceive(t, up)
+	select {
+	case pkg = <-down:
+		t.Errorf("unexpected accept %x", pkg.GetRoute())
+	default:
+	}
+	if u := p.PoolUsage(); u[0].Used != 0 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestPcscfDetachIndication(t *testing.T) {
+	if err := config.Load("../config.yml"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf, err := config.NewNetwork("hebeiyidong")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	p := new(P_CscfEntity)
+	p.Init(conf)
+	scscf, _ := sip.NewURI("sip:orig@" + conf.Host("s-cscf") + ";lr")
+	p.pCache.setServiceRoute(ServiceRoutePrefix+"jiqimao", []sip.User{{URI: scscf, Arguments: sip.Args{}}})
+	up := make(chan *modules.Package, 1)
+	pkg := testCxPackage(modules.DetachIndication, "", map[string]string{EPC_USER_NAME: "jiqimao"})
+	if err = p.DetachIndicationF(context.Background(), pkg, up, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pkg = testReceive(t, up)
+	if pkg.GetShortConn() != conf.Elements["SCSCF"].ActualAddr {
+		t.Errorf("indication sent to %v", pkg.GetShortConn())
+	}
+	if p.pCache.getServiceRoute(ServiceRoutePrefix+"jiqimao") != nil {
+		t.Errorf("service route not deleted")
+	}
+	// 未注册的用户忽略
+	if err = p.DetachIndicationF(context.Background(), pkg, up, nil); err != nil || len(up) != 0 {
+		t.Errorf("unregistered user = %v %v", err, len(up))
+	}
+}
+
+// 测试用的MME，与HSS和PGW使用同一个网络域配置
+func testMme(t *testing.T) (*MmeEntity, *HssEntity, *PgwEntity) {
+	store, err := NewMemoryStore(UserTable{IMSI: "460001", RootK: testK, Opc: testOPc, Apn: "ims", SipUserName: "jiqimao"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	p := testPgw(t)
+	p.conf.Elements["HSS"] = &config.Node{ActualAddr: "127.0.0.1:12347"}
+	p.conf.Elements["MME"] = &config.Node{ActualAddr: "127.0.0.1:12349"}
+	h := &HssEntity{conf: p.conf, store: store}
+	m := new(MmeEntity)
+	m.Init(p.conf)
+	m.RegistRouter()
+	return m, h, p
+}
+
+// 取出发往host的消息，交给f处理
+func testRelay(t *testing.T, ch chan *modules.Package, method byte, host string, f BaseSignallingT, up, down chan *modules.Package) {
+	pkg := testReceive(t, ch)
+	if pkg.GetRoute()[1] != method || pkg.GetShortConn() != host {
+		t.Fatalf("message = %x %v, want %x %v", pkg.GetRoute(), pkg.GetShortConn(), method, host)
+	}
+	if err := f(context.Background(), pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// UE收到鉴权请求后计算RES
+func testAuthResponse(t *testing.T, conn *net.UDPConn, req *modules.Package) *modules.Package {
+	m := modules.StrLineUnmarshal(req.GetData())
+	k, _ := hex.DecodeString(testK)
+	opc, _ := hex.DecodeString(testOPc)
+	rand, _ := hex.DecodeString(m[AV_RAND])
+	res, _, _, _, err := milenage.NewWithOPc(k, opc, rand, 0, 0).F2345()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return testEnbPackage(t, modules.AuthenticationResponse, conn, map[string]string{
+		EPC_CELL_ID:     "100",
+		EPC_UE_IDENTITY: m[EPC_UE_IDENTITY],
+		EPC_RES:         hex.EncodeToString(res),
+	})
+}
+
+func TestMmeAttach(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	m, h, p := testMme(t)
+	up, down := make(chan *modules.Package, 4), make(chan *modules.Package, 4)
+	hss, mme, pgw := "127.0.0.1:12347", "127.0.0.1:12349", "127.0.0.1:12348"
+
+	// 附着请求 -> AIR -> AIA -> 鉴权请求
+	pkg := testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001"})
+	if err = m.AttachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testRelay(t, up, modules.AuthenticationInformationRequest, hss, h.AuthenticationInformationRequestF, up, up)
+	testRelay(t, up, modules.AuthenticationInformationAnswer, mme, m.AuthenticationInformationAnswerF, up, down)
+	pkg = testReceive(t, down)
+	if pkg.GetRoute()[1] != modules.AuthenticationRequest || pkg.GetLongConn() != conn || pkg.GetLongConnAddr().Port != 40000 {
+		t.Fatalf("authentication request = %x %v", pkg.GetRoute(), pkg.GetLongConnAddr())
+	}
+	if sqn, _ := h.store.AdvanceSQN(ctx, "460001", 0, nil); sqn != nextSQN(0) {
+		t.Errorf("SQN = %x", sqn)
+	}
+
+	// 鉴权响应 -> ULR -> ULA -> 建立会话 -> 附着成功
+	if err = m.AuthenticationResponseF(ctx, testAuthResponse(t, conn, pkg), up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testRelay(t, up, modules.UpdateLocationRequest, hss, h.UpdateLocationRequestF, up, up)
+	testRelay(t, up, modules.UpdateLocationAnswer, mme, m.UpdateLocationAnswerF, up, down)
+	pkg = testReceive(t, up)
+	if args := modules.StrLineUnmarshal(pkg.GetData()); args[EPC_APN] != "ims" || args[EPC_CELL_ID] != "100" {
+		t.Errorf("create session = %v", args)
+	}
+	if err = p.CreateSessionRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testRelay(t, up, modules.CreateSessionResponse, mme, m.CreateSessionResponseF, up, down)
+	pkg = testReceive(t, down)
+	args := modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.AttachAccept || args["IP"] != "10.0.1.1" || args[EPC_CELL_ID] != "100" || len(args[EPC_CAUSE]) > 0 {
+		t.Errorf("attach accept = %x %v", pkg.GetRoute(), args)
+	}
+	if ec := m.mCache.getEmmContext(EmmPrefix + "460001"); ec == nil || ec.State != EmmRegistered {
+		t.Errorf("emm context = %+v", ec)
+	}
+	if args[EPC_BEARER_ID] != "5" || args[EPC_QCI] != "5" {
+		t.Errorf("default bearer = %v", args)
+	}
+
+	// 专用承载的消息经MME转发给UE，删除专用承载时保留UE上下文
+	pkg = testReAuthRequest(pgw, "jiqimao", "c1", []QosRule{{Name: "c1-1", QCI: 1, GBR: 64}})
+	if err = p.ReAuthRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testRelay(t, up, modules.CreateBearerRequest, mme, m.CreateBearerRequestF, up, down)
+	testReceive(t, up)
+	pkg = testReceive(t, down)
+	args = modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.CreateBearerRequest || pkg.GetLongConn() != conn || args[EPC_BEARER_ID] != "6" || args[EPC_CELL_ID] != "100" {
+		t.Errorf("create bearer = %x %v", pkg.GetRoute(), args)
+	}
+	pkg = testReAuthRequest(pgw, "jiqimao", "c1", nil, "c1-1")
+	if err = p.ReAuthRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testRelay(t, up, modules.DeleteBearerRequest, mme, m.DeleteBearerRequestF, up, down)
+	testReceive(t, up)
+	pkg = testReceive(t, down)
+	if args = modules.StrLineUnmarshal(pkg.GetData()); pkg.GetRoute()[1] != modules.DeleteBearerRequest || args[EPC_BEARER_ID] != "6" {
+		t.Errorf("delete bearer = %x %v", pkg.GetRoute(), args)
+	}
+	if m.mCache.getEmmContext(EmmPrefix+"460001") == nil {
+		t.Errorf("emm context released")
+	}
+
+	// PGW发起的去附着由MME通知UE
+	p.Detach(ctx, "460001", DetachReattachRequired, up, down)
+	testRelay(t, up, modules.DeleteBearerRequest, mme, m.DeleteBearerRequestF, up, down)
+	if pkg = testReceive(t, up); pkg.GetRoute()[1] != modules.DetachIndication {
+		t.Errorf("detach indication = %x", pkg.GetRoute())
+	}
+	pkg = testReceive(t, down)
+	args = modules.StrLineUnmarshal(pkg.GetData())
+	if pkg.GetRoute()[1] != modules.DetachRequest || pkg.GetLongConn() != conn || args[EPC_DETACH_TYPE] != DetachReattachRequired {
+		t.Errorf("network detach = %x %v", pkg.GetRoute(), args)
+	}
+	if m.mCache.getEmmContext(EmmPrefix+"460001") != nil || p.pCache.getUEContext(UEPrefix+"460001") != nil {
+		t.Errorf("context not released")
+	}
+
+	// 重新附着后UE发起去附着，MME请求PGW删除会话
+	pkg = testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001"})
+	m.AttachRequestF(ctx, pkg, up, down)
+	testRelay(t, up, modules.AuthenticationInformationRequest, hss, h.AuthenticationInformationRequestF, up, up)
+	testRelay(t, up, modules.AuthenticationInformationAnswer, mme, m.AuthenticationInformationAnswerF, up, down)
+	m.AuthenticationResponseF(ctx, testAuthResponse(t, conn, testReceive(t, down)), up, down)
+	testRelay(t, up, modules.UpdateLocationRequest, hss, h.UpdateLocationRequestF, up, up)
+	testRelay(t, up, modules.UpdateLocationAnswer, mme, m.UpdateLocationAnswerF, up, down)
+	testRelay(t, up, modules.CreateSessionRequest, pgw, p.CreateSessionRequestF, up, down)
+	testRelay(t, up, modules.CreateSessionResponse, mme, m.CreateSessionResponseF, up, down)
+	testReceive(t, down)
+	pkg = testEnbPackage(t, modules.DetachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001", EPC_DETACH_TYPE: DetachEPS})
+	if err = m.DetachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if pkg = testReceive(t, down); pkg.GetRoute()[1] != modules.DetachAccept {
+		t.Errorf("detach accept = %x", pkg.GetRoute())
+	}
+	testRelay(t, up, modules.DeleteSessionRequest, pgw, p.DeleteSessionRequestF, up, down)
+	testReceive(t, up) // 通知IMS侧注销用户
+	pkg = testReceive(t, up)
+	if args = modules.StrLineUnmarshal(pkg.GetData()); pkg.GetRoute()[1] != modules.DeleteSessionResponse || args[EPC_CAUSE] != GtpRequestAccepted {
+		t.Errorf("delete session = %x %v", pkg.GetRoute(), args)
+	}
+	if u := p.PoolUsage(); u[0].Used != 0 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestMmeAttachReject(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	m, h, _ := testMme(t)
+	up, down := make(chan *modules.Package, 4), make(chan *modules.Package, 4)
+	hss, mme := "127.0.0.1:12347", "127.0.0.1:12349"
+	reject := func(cause string) {
+		t.Helper()
+		pkg := testReceive(t, down)
+		args := modules.StrLineUnmarshal(pkg.GetData())
+		if pkg.GetRoute()[1] != modules.AttachReject || args[EPC_CAUSE] != cause {
+			t.Errorf("attach reject = %x %v, want %v", pkg.GetRoute(), args, cause)
+		}
+	}
+
+	// 没有IMSI
+	pkg := testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100"})
+	if err = m.AttachRequestF(ctx, pkg, up, down); err != ErrUEIdentityNotExist {
+		t.Errorf("err = %v", err)
+	}
+	reject(EmmUEIdentityNotDerived)
+
+	// HSS中没有签约数据
+	pkg = testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460002"})
+	m.AttachRequestF(ctx, pkg, up, down)
+	pkg = testReceive(t, up)
+	h.AuthenticationInformationRequestF(ctx, pkg, up, up)
+	testRelay(t, up, modules.AuthenticationInformationAnswer, mme, m.AuthenticationInformationAnswerF, up, down)
+	reject(EmmEPSNotAllowed)
+
+	// RES与XRES不一致，上下文被删除，再次收到鉴权响应时不处理
+	pkg = testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001"})
+	m.AttachRequestF(ctx, pkg, up, down)
+	testRelay(t, up, modules.AuthenticationInformationRequest, hss, h.AuthenticationInformationRequestF, up, up)
+	testRelay(t, up, modules.AuthenticationInformationAnswer, mme, m.AuthenticationInformationAnswerF, up, down)
+	testReceive(t, down)
+	pkg = testEnbPackage(t, modules.AuthenticationResponse, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001", EPC_RES: "0011223344556677"})
+	if err = m.AuthenticationResponseF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	reject(EmmIllegalUE)
+	if err = m.AuthenticationResponseF(ctx, pkg, up, down); err != ErrEmmContextNotExist {
+		t.Errorf("err = %v", err)
+	}
+	if len(up) != 0 {
+		t.Errorf("unexpected location update")
+	}
+}
+
+// PCRF下发的Gx RAR
+func testReAuthRequest(host, user, callID string, install []QosRule, remove ...string) *modules.Package {
+	m := map[string]string{EPC_USER_NAME: user, EPC_CALL_ID: callID, GX_RULE_REMOVE: strconv.Itoa(len(remove))}
+	marshalRules(m, install)
+	for i, name := range remove {
+		m[avKey(GX_RULE_REMOVE, i+1)] = name
+	}
+	return testCxPackage(modules.ReAuthRequest, host, m)
+}
+
+func TestPgwBearer(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	p := testPgw(t)
+	up, down := make(chan *modules.Package, 16), make(chan *modules.Package, 16)
+	pkg := testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001"})
+	if err = p.AttachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// 附着时建立QCI 5的默认承载
+	args := modules.StrLineUnmarshal(testReceive(t, down).GetData())
+	if args[EPC_BEARER_ID] != "5" || args[EPC_QCI] != "5" {
+		t.Errorf("default bearer = %v", args)
+	}
+
+	reAuth := func(user string, install []QosRule, remove ...string) (string, error) {
+		err := p.ReAuthRequestF(ctx, testReAuthRequest("", user, "c1", install, remove...), up, down)
+		pkg := testReceive(t, up)
+		if pkg.GetRoute()[1] != modules.ReAuthAnswer || pkg.GetShortConn() != "127.0.0.1:12350" {
+			t.Errorf("answer = %x %v", pkg.GetRoute(), pkg.GetShortConn())
+		}
+		return modules.StrLineUnmarshal(pkg.GetData())[CX_RESULT], err
+	}
+	// 每个规则建立一个专用承载，承载标识依次分配，已经安装的规则不重复建立
+	voice, video := QosRule{Name: "c1-1", QCI: 1, GBR: 41}, QosRule{Name: "c1-2", QCI: 2, GBR: 384}
+	if result, err := reAuth("jiqimao", []QosRule{voice, video}); err != nil || result != ResultSuccess {
+		t.Fatalf("err = %v %v", err, result)
+	}
+	for i, r := range []QosRule{voice, video} {
+		pkg = testReceive(t, down)
+		args = modules.StrLineUnmarshal(pkg.GetData())
+		if pkg.GetRoute()[1] != modules.CreateBearerRequest || args[EPC_BEARER_ID] != strconv.Itoa(6+i) || args[EPC_QCI] != strconv.Itoa(r.QCI) ||
+			args[EPC_GBR] != strconv.Itoa(r.GBR) || args[EPC_UE_IDENTITY] != "460001" || pkg.GetLongConn() != conn {
+			t.Errorf("create bearer = %x %v", pkg.GetRoute(), args)
+		}
+	}
+	reAuth("jiqimao", []QosRule{voice})
+	if len(down) != 0 {
+		t.Errorf("duplicate bearer")
+	}
+	if result, err := reAuth("nobody", []QosRule{voice}); err != ErrUEContextNotExist || result != ResultUnknownSessionID {
+		t.Errorf("err = %v %v", err, result)
+	}
+
+	// 规则删除后删除专用承载，释放的承载标识可以重新使用
+	reAuth("jiqimao", nil, "c1-1", "c1-9")
+	pkg = testReceive(t, down)
+	if args = modules.StrLineUnmarshal(pkg.GetData()); pkg.GetRoute()[1] != modules.DeleteBearerRequest || args[EPC_BEARER_ID] != "6" {
+		t.Errorf("delete bearer = %x %v", pkg.GetRoute(), args)
+	}
+	if len(down) != 0 {
+		t.Errorf("unexpected message")
+	}
+	reAuth("jiqimao", []QosRule{{Name: "c1-3", QCI: 1, GBR: 64}})
+	if args = modules.StrLineUnmarshal(testReceive(t, down).GetData()); args[EPC_BEARER_ID] != "6" {
+		t.Errorf("reused bearer = %v", args)
+	}
+	if uc := p.pCache.getUEContext(UEPrefix + "460001"); len(uc.Bearers) != 3 {
+		t.Errorf("bearers = %v", uc.Bearers)
+	}
+
+	// 承载标识用完时安装失败
+	var rules []QosRule
+	for i := 4; i <= 12; i++ {
+		rules = append(rules, QosRule{Name: "c1-" + strconv.Itoa(i), QCI: 1, GBR: 64})
+	}
+	if result, err := reAuth("jiqimao", rules); err != ErrNoBearerID || result != ResultUnableToComply {
+		t.Errorf("err = %v %v", err, result)
+	}
+	if uc := p.pCache.getUEContext(UEPrefix + "460001"); len(uc.Bearers) != MaxBearerID-DefaultBearerID+1 {
+		t.Errorf("bearers = %d", len(uc.Bearers))
+	}
+}
+
+func TestPgwBearerResource(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	p := testPgw(t)
+	up, down := make(chan *modules.Package, 4), make(chan *modules.Package, 4)
+	pkg := testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001"})
+	if err = p.AttachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// 附着时建立QCI 5的默认承载
+	args := modules.StrLineUnmarshal(testReceive(t, down).GetData())
+	if args[EPC_BEARER_ID] != "5" || args[EPC_QCI] != "5" {
+		t.Errorf("default bearer = %v", args)
+	}
+
+	allocate := func(name, callID, qci string) error {
+		pkg := testCxPackage(modules.BearerResourceAllocation, "", map[string]string{EPC_USER_NAME: name, EPC_CALL_ID: callID, EPC_QCI: qci})
+		return p.BearerResourceAllocationF(ctx, pkg, up, down)
+	}
+	// 每个会话建立一个QCI 1的专用承载，承载标识依次分配，同一会话只建立一次
+	for i, callID := range []string{"c1", "c2", "c1"} {
+		if err = allocate("jiqimao", callID, "1"); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if i == 2 {
+			break
+		}
+		pkg = testReceive(t, down)
+		args = modules.StrLineUnmarshal(pkg.GetData())
+		if pkg.GetRoute()[1] != modules.CreateBearerRequest || args[EPC_BEARER_ID] != strconv.Itoa(6+i) || args[EPC_QCI] != "1" ||
+			args[EPC_UE_IDENTITY] != "460001" || pkg.GetLongConn() != conn {
+			t.Errorf("create bearer = %x %v", pkg.GetRoute(), args)
+		}
+	}
+	if len(down) != 0 {
+		t.Errorf("duplicate bearer")
+	}
+	if err = allocate("jiqimao", "c3", "5"); err != ErrUnsupportedQCI {
+		t.Errorf("err = %v", err)
+	}
+	if err = allocate("nobody", "c3", "1"); err != ErrUEContextNotExist {
+		t.Errorf("err = %v", err)
+	}
+
+	// 会话结束后删除专用承载，释放的承载标识可以重新使用
+	pkg = testCxPackage(modules.BearerResourceRelease, "", map[string]string{EPC_CALL_ID: "c1"})
+	if err = p.BearerResourceReleaseF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pkg = testReceive(t, down)
+	if args = modules.StrLineUnmarshal(pkg.GetData()); pkg.GetRoute()[1] != modules.DeleteBearerRequest || args[EPC_BEARER_ID] != "6" {
+		t.Errorf("delete bearer = %x %v", pkg.GetRoute(), args)
+	}
+	allocate("jiqimao", "c4", "1")
+	if args = modules.StrLineUnmarshal(testReceive(t, down).GetData()); args[EPC_BEARER_ID] != "6" {
+		t.Errorf("reused bearer = %v", args)
+	}
+	if uc := p.pCache.getUEContext(UEPrefix + "460001"); len(uc.Bearers) != 3 {
+		t.Errorf("bearers = %v", uc.Bearers)
+	}
+}
+
+func testInviteResponse(t *testing.T, code int, vias []string, sdp bool) *sip.Message {
+	str := "SIP/2.0 " + strconv.Itoa(code) + " Reason\r\n"
+	for _, v := range vias {
+		str += "Via: SIP/2.0/UDP " + v + ";branch=z9hG4bK" + v + "\r\n"
+	}
+	str += "From: <sip:jiqimao@hebeiyidong.3gpp.net>;tag=1\r\n" +
+		"To: <sip:daxiong@hebeiyidong.3gpp.net>;tag=2\r\n" +
+		"Call-ID: call-1\r\n" +
+		"CSeq: 1 INVITE\r\n"
+	body := ""
+	if sdp {
+		body = "v=0\r\nm=audio 49170 RTP/AVP 104\r\nm=video 0 RTP/AVP 99\r\n"
+		str += "Content-Type: application/sdp\r\n"
+	}
+	msg, err := sip.NewMessage(strings.NewReader(str + "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return &msg
+}
+
+func TestPcscfBearerControl(t *testing.T) {
+	if err := config.Load("../config.yml"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf, err := config.NewNetwork("hebeiyidong")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// 没有配置PCRF时P-CSCF直接请求PGW
+	conf.Elements["PCRF"] = &config.Node{}
+	p := new(P_CscfEntity)
+	p.Init(conf)
+	ctx := context.Background()
+	down := make(chan *modules.Package, 4)
+	expect := func(method byte, want map[string]string) {
+		t.Helper()
+		pkg := testReceive(t, down)
+		args := modules.StrLineUnmarshal(pkg.GetData())
+		if pkg.GetRoute()[1] != method || pkg.GetShortConn() != conf.Elements["PGW"].ActualAddr {
+			t.Errorf("message = %x %v", pkg.GetRoute(), pkg.GetShortConn())
+		}
+		for k, v := range want {
+			if args[k] != v {
+				t.Errorf("%v = %v, want %v", k, args[k], v)
+			}
+		}
+	}
+
+	// 来自被叫UE的SDP应答为被叫建立承载，发往主叫UE的SDP应答为主叫建立承载
+	p.bearerControl(ctx, testInviteResponse(t, 183, []string{"127.0.0.1:5060", "192.168.0.100:5060"}, true), down)
+	expect(modules.BearerResourceAllocation, map[string]string{EPC_USER_NAME: "daxiong", EPC_CALL_ID: "call-1", EPC_QCI: "1"})
+	p.bearerControl(ctx, testInviteResponse(t, 200, []string{"192.168.0.100:5060"}, true), down)
+	expect(modules.BearerResourceAllocation, map[string]string{EPC_USER_NAME: "jiqimao"})
+	// 没有SDP的应答不建立承载，会话建立后的失败应答不删除承载
+	p.bearerControl(ctx, testInviteResponse(t, 180, []string{"192.168.0.100:5060"}, false), down)
+	p.bearerControl(ctx, testInviteResponse(t, 491, []string{"192.168.0.100:5060"}, false), down)
+	if len(down) != 0 {
+		t.Errorf("unexpected message")
+	}
+	p.releaseBearer(ctx, "call-1", down)
+	expect(modules.BearerResourceRelease, map[string]string{EPC_CALL_ID: "call-1"})
+	// 会话建立失败时删除承载
+	p.bearerControl(ctx, testInviteResponse(t, 486, []string{"192.168.0.100:5060"}, false), down)
+	expect(modules.BearerResourceRelease, map[string]string{EPC_CALL_ID: "call-1"})
+}
+
+func TestPcscfMediaAuthorization(t *testing.T) {
+	if err := config.Load("../config.yml"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	conf, err := config.NewNetwork("hebeiyidong")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	p := new(P_CscfEntity)
+	p.Init(conf)
+	ctx := context.Background()
+	down := make(chan *modules.Package, 4)
+	expect := func(method byte, want map[string]string) {
+		t.Helper()
+		pkg := testReceive(t, down)
+		args := modules.StrLineUnmarshal(pkg.GetData())
+		if pkg.GetRoute()[1] != method || pkg.GetShortConn() != conf.Elements["PCRF"].ActualAddr {
+			t.Errorf("message = %x %v", pkg.GetRoute(), pkg.GetShortConn())
+		}
+		for k, v := range want {
+			if args[k] != v {
+				t.Errorf("%v = %v, want %v", k, args[k], v)
+			}
+		}
+	}
+
+	// 来自被叫UE的SDP应答上报被叫的媒体，发往主叫UE的SDP应答上报主叫的媒体，被拒绝的媒体不上报
+	p.bearerControl(ctx, testInviteResponse(t, 183, []string{"127.0.0.1:5060", "192.168.0.100:5060"}, true), down)
+	expect(modules.AARequest, map[string]string{EPC_USER_NAME: "daxiong", EPC_CALL_ID: "call-1", RX_MEDIA: "1",
+		avKey(RX_MEDIA_NUMBER, 1): "1", avKey(RX_MEDIA_TYPE, 1): "audio"})
+	p.bearerControl(ctx, testInviteResponse(t, 200, []string{"192.168.0.100:5060"}, true), down)
+	expect(modules.AARequest, map[string]string{EPC_USER_NAME: "jiqimao"})
+	// 没有SDP的应答不上报，会话建立后的失败应答不结束会话
+	p.bearerControl(ctx, testInviteResponse(t, 180, []string{"192.168.0.100:5060"}, false), down)
+	p.bearerControl(ctx, testInviteResponse(t, 491, []string{"192.168.0.100:5060"}, false), down)
+	if len(down) != 0 {
+		t.Errorf("unexpected message")
+	}
+	p.releaseBearer(ctx, "call-1", down)
+	expect(modules.SessionTerminationRequest, map[string]string{EPC_CALL_ID: "call-1"})
+	// 会话建立失败时结束会话
+	p.bearerControl(ctx, testInviteResponse(t, 486, []string{"192.168.0.100:5060"}, false), down)
+	expect(modules.SessionTerminationRequest, map[string]string{EPC_CALL_ID: "call-1"})
+}
+
+func TestPcrf(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	pgw := testPgw(t)
+	r := new(PcrfEntity)
+	r.Init(pgw.conf)
+	r.RegistRouter()
+	up, down := make(chan *modules.Package, 8), make(chan *modules.Package, 8)
+	pkg := testEnbPackage(t, modules.AttachRequest, conn, map[string]string{EPC_CELL_ID: "100", EPC_UE_IDENTITY: "460001"})
+	if err = pgw.AttachRequestF(ctx, pkg, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	testReceive(t, down)
+
+	aar := func(user string, sdp string) error {
+		m := map[string]string{EPC_USER_NAME: user, EPC_CALL_ID: "c1"}
+		marshalMediaComponents(m, mediaComponents(sdp))
+		return r.AARequestF(ctx, testCxPackage(modules.AARequest, "", m), up, down)
+	}
+	answer := func(method byte, result string) {
+		t.Helper()
+		pkg := testReceive(t, up)
+		if pkg.GetRoute()[1] != method || pkg.GetShortConn() != "127.0.0.1:54321" {
+			t.Errorf("answer = %x %v", pkg.GetRoute(), pkg.GetShortConn())
+		}
+		if args := modules.StrLineUnmarshal(pkg.GetData()); args[CX_RESULT] != result {
+			t.Errorf("result = %v, want %v", args[CX_RESULT], result)
+		}
+	}
+	// PCRF下发的规则交给PGW执行，返回PGW建立或删除的承载，PCRF的应答在RAA之前发出
+	reAuth := func(install []QosRule, remove []string, method byte, result string) []map[string]string {
+		t.Helper()
+		pkg := testReceive(t, up)
+		args := modules.StrLineUnmarshal(pkg.GetData())
+		if pkg.GetRoute()[1] != modules.ReAuthRequest || pkg.GetShortConn() != "127.0.0.1:12348" || args[EPC_USER_NAME] != "jiqimao" {
+			t.Fatalf("rar = %x %v %v", pkg.GetRoute(), pkg.GetShortConn(), args)
+		}
+		if got := unmarshalRules(args); !reflect.DeepEqual(got, install) {
+			t.Errorf("install = %+v, want %+v", got, install)
+		}
+		if got := unmarshalRuleNames(args); !reflect.DeepEqual(got, remove) {
+			t.Errorf("remove = %v, want %v", got, remove)
+		}
+		answer(method, result)
+		if err := pgw.ReAuthRequestF(ctx, pkg, up, down); err != nil {
+			t.Fatalf("%v", err)
+		}
+		testRelay(t, up, modules.ReAuthAnswer, "127.0.0.1:12350", r.ReAuthAnswerF, up, down)
+		var bearers []map[string]string
+		for len(down) > 0 {
+			bearers = append(bearers, modules.StrLineUnmarshal(testReceive(t, down).GetData()))
+		}
+		return bearers
+	}
+
+	// 语音和视频分别安装QCI 1和QCI 2的规则，未携带带宽时使用默认的保证比特率
+	sdp := "v=0\r\nm=audio 49170 RTP/AVP 104\r\nb=AS:41\r\nm=video 51372 RTP/AVP 99\r\nm=application 52000 UDP/BFCP *\r\n"
+	if err = aar("jiqimao", sdp); err != nil {
+		t.Fatalf("%v", err)
+	}
+	voice, video := QosRule{Name: "c1-1", QCI: 1, GBR: 41}, QosRule{Name: "c1-2", QCI: 2, GBR: DefaultVideoBitrate}
+	bearers := reAuth([]QosRule{voice, video}, []string{}, modules.AAAnswer, ResultSuccess)
+	if len(bearers) != 2 || bearers[0][EPC_BEARER_ID] != "6" || bearers[0][EPC_QCI] != "1" || bearers[1][EPC_BEARER_ID] != "7" || bearers[1][EPC_QCI] != "2" {
+		t.Errorf("bearers = %v", bearers)
+	}
+	// 相同的媒体不重复下发规则
+	aar("jiqimao", sdp)
+	answer(modules.AAAnswer, ResultSuccess)
+	// 视频被拒绝后删除视频的规则
+	aar("jiqimao", "v=0\r\nm=audio 49170 RTP/AVP 104\r\nb=AS:41\r\nm=video 0 RTP/AVP 99\r\n")
+	bearers = reAuth([]QosRule{}, []string{"c1-2"}, modules.AAAnswer, ResultSuccess)
+	if len(bearers) != 1 || bearers[0][EPC_BEARER_ID] != "7" {
+		t.Errorf("bearers = %v", bearers)
+	}
+	if err = aar("", sdp); err != ErrCallIDNotExist {
+		t.Errorf("err = %v", err)
+	}
+	answer(modules.AAAnswer, ResultUnableToComply)
+
+	// 会话结束后删除全部规则，重复结束的会话不存在
+	str := testCxPackage(modules.SessionTerminationRequest, "", map[string]string{EPC_CALL_ID: "c1"})
+	if err = r.SessionTerminationRequestF(ctx, str, up, down); err != nil {
+		t.Fatalf("%v", err)
+	}
+	bearers = reAuth([]QosRule{}, []string{"c1-1"}, modules.SessionTerminationAnswer, ResultSuccess)
+	if len(bearers) != 1 || bearers[0][EPC_BEARER_ID] != "6" {
+		t.Errorf("bearers = %v", bearers)
+	}
+	r.SessionTerminationRequestF(ctx, str, up, down)
+	answer(modules.SessionTerminationAnswer, ResultUnknownSessionID)
+	if uc := pgw.pCache.getUEContext(UEPrefix + "460001"); len(uc.Bearers) != 1 {
+		t.Errorf("bearers = %v", uc.Bearers)
+	}
+}
@@ -0,0 +1,168 @@
+package diameter
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// AVP标志位(RFC6733-4.1)
+const (
+	AVPFlagVendor    uint8 = 0x80 // 携带Vendor-ID
+	AVPFlagMandatory uint8 = 0x40 // 接收方必须支持
+	AVPFlagProtected uint8 = 0x20
+)
+
+// 属性值对(RFC6733-4.1)
+// 布局：Code(4) | Flags(1) | Length(3) | [Vendor-ID(4)] | Data | 填充到4字节对齐
+type AVP struct {
+	Code     uint32
+	Flags    uint8
+	VendorID uint32 // 0表示IETF定义的AVP
+	Data     []byte
+}
+
+// 创建AVP，默认设置M标志，厂商AVP同时设置V标志
+func NewAVP(code, vendor uint32, data []byte) AVP {
+	a := AVP{Code: code, Flags: AVPFlagMandatory, VendorID: vendor, Data: data}
+	if vendor != 0 {
+		a.Flags |= AVPFlagVendor
+	}
+	return a
+}
+
+// Unsigned32和Enumerated类型
+func Unsigned32(code, vendor uint32, v uint32) AVP {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, v)
+	return NewAVP(code, vendor, data)
+}
+
+// UTF8String和DiameterIdentity类型
+func UTF8String(code, vendor uint32, s string) AVP {
+	return NewAVP(code, vendor, []byte(s))
+}
+
+// OctetString类型
+func OctetString(code, vendor uint32, b []byte) AVP {
+	return NewAVP(code, vendor, append([]byte{}, b...))
+}
+
+// Grouped类型，数据为多个AVP的编码
+func Grouped(code, vendor uint32, avps ...AVP) AVP {
+	var data []byte
+	for _, a := range avps {
+		data = append(data, a.Marshal()...)
+	}
+	return NewAVP(code, vendor, data)
+}
+
+// Address类型，2字节地址族后跟地址(RFC6733-4.3.1)
+func Address(code, vendor uint32, ip net.IP) AVP {
+	if v4 := ip.To4(); v4 != nil {
+		return NewAVP(code, vendor, append([]byte{0, 1}, v4...))
+	}
+	return NewAVP(code, vendor, append([]byte{0, 2}, ip.To16()...))
+}
+
+// 头部长度，携带Vendor-ID时为12字节
+func (a AVP) headerLen() int {
+	if a.Flags&AVPFlagVendor != 0 {
+		return 12
+	}
+	return 8
+}
+
+// 编码后的长度，不包含填充
+func (a AVP) Len() int {
+	return a.headerLen() + len(a.Data)
+}
+
+// 编码，末尾填充到4字节对齐
+func (a AVP) Marshal() []byte {
+	l := a.Len()
+	buf := make([]byte, pad4(l))
+	binary.BigEndian.PutUint32(buf[0:4], a.Code)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(l))
+	buf[4] = a.Flags
+	if a.Flags&AVPFlagVendor != 0 {
+		binary.BigEndian.PutUint32(buf[8:12], a.VendorID)
+	}
+	copy(buf[a.headerLen():], a.Data)
+	return buf
+}
+
+func (a AVP) Uint32() (uint32, error) {
+	if len(a.Data) != 4 {
+		return 0, errors.New("diameter: avp is not unsigned32")
+	}
+	return binary.BigEndian.Uint32(a.Data), nil
+}
+
+func (a AVP) String() string {
+	return string(a.Data)
+}
+
+// Address类型的地址
+func (a AVP) IP() (net.IP, error) {
+	if len(a.Data) == 6 && a.Data[1] == 1 || len(a.Data) == 18 && a.Data[1] == 2 {
+		return net.IP(a.Data[2:]), nil
+	}
+	return nil, errors.New("diameter: avp is not address")
+}
+
+// Grouped类型包含的AVP
+func (a AVP) Group() ([]AVP, error) {
+	return parseAVPs(a.Data)
+}
+
+// 依次解析连续的多个AVP
+func parseAVPs(data []byte) (avps []AVP, err error) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("diameter: avp header too short")
+		}
+		a := AVP{
+			Code:  binary.BigEndian.Uint32(data[0:4]),
+			Flags: data[4],
+		}
+		l := int(binary.BigEndian.Uint32(data[4:8]) & 0xffffff)
+		if l < a.headerLen() || l > len(data) {
+			return nil, errors.New("diameter: avp length error")
+		}
+		if a.Flags&AVPFlagVendor != 0 {
+			a.VendorID = binary.BigEndian.Uint32(data[8:12])
+		}
+		a.Data = append([]byte{}, data[a.headerLen():l]...)
+		avps = append(avps, a)
+		if l = pad4(l); l > len(data) {
+			l = len(data)
+		}
+		data = data[l:]
+	}
+	return
+}
+
+// 在多个AVP中查找第一个匹配的AVP
+func Find(avps []AVP, code, vendor uint32) (AVP, bool) {
+	for _, a := range avps {
+		if a.Code == code && a.VendorID == vendor {
+			return a, true
+		}
+	}
+	return AVP{}, false
+}
+
+// 在多个AVP中查找全部匹配的AVP
+func FindAll(avps []AVP, code, vendor uint32) (result []AVP) {
+	for _, a := range avps {
+		if a.Code == code && a.VendorID == vendor {
+			result = append(result, a)
+		}
+	}
+	return
+}
+
+func pad4(l int) int {
+	return (l + 3) &^ 3
+}
@@ -0,0 +1,76 @@
+package diameter
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAVPMarshal(t *testing.T) {
+	// Origin-Host长度不是4的倍数，需要填充
+	a := UTF8String(AVPOriginHost, 0, "hss")
+	want := []byte{0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x00, 0x0b, 'h', 's', 's', 0x00}
+	if data := a.Marshal(); !bytes.Equal(data, want) {
+		t.Errorf("marshal = %x, want %x", data, want)
+	}
+	// 厂商AVP携带Vendor-ID
+	a = Unsigned32(AVPServerAssignmentType, Vendor3GPP, 1)
+	want = []byte{0x00, 0x00, 0x02, 0x66, 0xc0, 0x00, 0x00, 0x10, 0x00, 0x00, 0x28, 0xaf, 0x00, 0x00, 0x00, 0x01}
+	if data := a.Marshal(); !bytes.Equal(data, want) {
+		t.Errorf("marshal = %x, want %x", data, want)
+	}
+}
+
+func TestAVPGrouped(t *testing.T) {
+	item := Grouped(AVPSIPAuthDataItem, Vendor3GPP,
+		Unsigned32(AVPSIPItemNumber, Vendor3GPP, 1),
+		UTF8String(AVPSIPAuthenticationScheme, Vendor3GPP, "Digest-AKAv1-MD5"),
+		OctetString(AVPConfidentialityKey, Vendor3GPP, []byte{0x01, 0x02, 0x03}),
+	)
+	avps, err := parseAVPs(item.Marshal())
+	if err != nil || len(avps) != 1 {
+		t.Fatalf("parse = %v, %v", avps, err)
+	}
+	group, err := avps[0].Group()
+	if err != nil || len(group) != 3 {
+		t.Fatalf("group = %v, %v", group, err)
+	}
+	if n, ok := Find(group, AVPSIPItemNumber, Vendor3GPP); !ok {
+		t.Error("item number not found")
+	} else if v, _ := n.Uint32(); v != 1 {
+		t.Errorf("item number = %v", v)
+	}
+	if s, _ := Find(group, AVPSIPAuthenticationScheme, Vendor3GPP); s.String() != "Digest-AKAv1-MD5" {
+		t.Errorf("scheme = %v", s.String())
+	}
+	if ck, _ := Find(group, AVPConfidentialityKey, Vendor3GPP); !bytes.Equal(ck.Data, []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("ck = %x", ck.Data)
+	}
+	// 厂商标识不同的AVP不匹配
+	if _, ok := Find(group, AVPSIPItemNumber, 0); ok {
+		t.Error("found avp with wrong vendor")
+	}
+}
+
+func TestAVPAddress(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "2001:db8::1"} {
+		a := Address(AVPHostIPAddress, 0, net.ParseIP(ip))
+		got, err := a.IP()
+		if err != nil || !got.Equal(net.ParseIP(ip)) {
+			t.Errorf("address %v = %v, %v", ip, got, err)
+		}
+	}
+}
+
+func TestParseAVPsError(t *testing.T) {
+	data := UTF8String(AVPOriginHost, 0, "hss.hebeiyidong.3gpp.net").Marshal()
+	if _, err := parseAVPs(data[:6]); err == nil {
+		t.Error("short header parsed")
+	}
+	if _, err := parseAVPs(data[:12]); err == nil {
+		t.Error("truncated avp parsed")
+	}
+	if _, err := Unsigned32(AVPResultCode, 0, 1).Group(); err == nil {
+		t.Error("unsigned32 parsed as grouped")
+	}
+}
@@ -0,0 +1,295 @@
+package diameter
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrCapabilitiesExchange = errors.New("diameter: capabilities exchange failed")
+	ErrNoCommonApplication  = errors.New("diameter: no common application")
+)
+
+// 本端的Diameter身份，用于能力交换和填写Origin-Host、Origin-Realm
+type Identity struct {
+	Host        string   // DiameterIdentity，如s-cscf.hebeiyidong.3gpp.net
+	Realm       string   // 网络域名，如hebeiyidong.3gpp.net
+	ProductName string   // 产品名称
+	VendorID    uint32   // 厂商标识
+	AppIDs      []uint32 // 支持的应用，能力交换时双方至少要有一个共同的应用
+}
+
+// 源主机和源域，每条消息都需要携带
+func (id Identity) Origin() []AVP {
+	return []AVP{
+		UTF8String(AVPOriginHost, 0, id.Host),
+		UTF8String(AVPOriginRealm, 0, id.Realm),
+	}
+}
+
+// 是否支持应用
+func (id Identity) Supports(app uint32) bool {
+	for _, a := range id.AppIDs {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+// 一条完成能力交换的对等连接(RFC6733-5)
+// 连接上的请求由发送方分配逐跳标识，应答原样返回
+type Conn struct {
+	nc       net.Conn
+	local    Identity
+	Peer     Identity // 能力交换得到的对端身份
+	wmu      sync.Mutex
+	hbh      uint32
+	e2e      uint32
+	state    uint32 // Origin-State-Id，每次启动不同
+	lastRecv int64  // 最近一次收到消息的时间，用于看门狗检测
+}
+
+func newConn(nc net.Conn, local Identity) *Conn {
+	now := time.Now()
+	return &Conn{
+		nc:    nc,
+		local: local,
+		hbh:   uint32(now.UnixNano()),
+		// 端到端标识的高12位为启动时间的低12位(RFC6733-3)
+		e2e:      uint32(now.Unix())<<20 | uint32(now.UnixNano())&0xfffff,
+		state:    uint32(now.Unix()),
+		lastRecv: now.UnixNano(),
+	}
+}
+
+// 连接到对端并发起能力交换
+func Dial(addr string, local Identity, timeout time.Duration) (*Conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Client(nc, local, timeout)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 作为发起方在已建立的连接上发送CER，等待CEA
+func Client(nc net.Conn, local Identity, timeout time.Duration) (*Conn, error) {
+	c := newConn(nc, local)
+	if err := c.WriteMessage(c.capabilities(baseRequest(CodeCapabilitiesExchange))); err != nil {
+		return nil, err
+	}
+	nc.SetReadDeadline(time.Now().Add(timeout))
+	defer nc.SetReadDeadline(time.Time{})
+	cea, err := ReadMessage(nc)
+	if err != nil {
+		return nil, err
+	}
+	if cea.Code != CodeCapabilitiesExchange || cea.IsRequest() {
+		return nil, ErrCapabilitiesExchange
+	}
+	if code, _ := cea.ResultCode(); code != Success {
+		return nil, ErrCapabilitiesExchange
+	}
+	c.Peer = parseCapabilities(cea)
+	if !c.commonApplication() {
+		return nil, ErrNoCommonApplication
+	}
+	return c, nil
+}
+
+// 作为接收方等待CER并应答CEA，没有共同的应用时应答失败
+func Accept(nc net.Conn, local Identity, timeout time.Duration) (*Conn, error) {
+	c := newConn(nc, local)
+	nc.SetReadDeadline(time.Now().Add(timeout))
+	cer, err := ReadMessage(nc)
+	nc.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if cer.Code != CodeCapabilitiesExchange || !cer.IsRequest() {
+		return nil, ErrCapabilitiesExchange
+	}
+	c.Peer = parseCapabilities(cer)
+	if !c.commonApplication() {
+		c.WriteMessage(c.capabilities(cer.Answer(Unsigned32(AVPResultCode, 0, NoCommonApplication))))
+		return nil, ErrNoCommonApplication
+	}
+	if err = c.WriteMessage(c.capabilities(cer.Answer(Unsigned32(AVPResultCode, 0, Success)))); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 基础协议的请求只在相邻的对端之间传递，不能代理
+func baseRequest(code uint32) *Message {
+	return &Message{Flags: FlagRequest, Code: code, AppID: AppCommon}
+}
+
+// 能力交换消息的内容
+func (c *Conn) capabilities(m *Message) *Message {
+	m.Add(c.local.Origin()...)
+	if addr, ok := c.nc.LocalAddr().(*net.TCPAddr); ok {
+		m.Add(Address(AVPHostIPAddress, 0, addr.IP))
+	}
+	m.Add(Unsigned32(AVPVendorID, 0, c.local.VendorID))
+	m.Add(UTF8String(AVPProductName, 0, c.local.ProductName))
+	m.Add(Unsigned32(AVPOriginStateID, 0, c.state))
+	if c.local.VendorID != 0 {
+		m.Add(Unsigned32(AVPSupportedVendorID, 0, c.local.VendorID))
+	}
+	for _, app := range c.local.AppIDs {
+		if c.local.VendorID == 0 {
+			m.Add(Unsigned32(AVPAuthApplicationID, 0, app))
+			continue
+		}
+		m.Add(Grouped(AVPVendorSpecificApplicationID, 0,
+			Unsigned32(AVPVendorID, 0, c.local.VendorID),
+			Unsigned32(AVPAuthApplicationID, 0, app)))
+	}
+	return m
+}
+
+// 从CER/CEA中读取对端身份
+func parseCapabilities(m *Message) (id Identity) {
+	if a, ok := m.Find(AVPOriginHost, 0); ok {
+		id.Host = a.String()
+	}
+	if a, ok := m.Find(AVPOriginRealm, 0); ok {
+		id.Realm = a.String()
+	}
+	if a, ok := m.Find(AVPProductName, 0); ok {
+		id.ProductName = a.String()
+	}
+	if a, ok := m.Find(AVPVendorID, 0); ok {
+		id.VendorID, _ = a.Uint32()
+	}
+	for _, a := range m.FindAll(AVPAuthApplicationID, 0) {
+		if app, err := a.Uint32(); err == nil {
+			id.AppIDs = append(id.AppIDs, app)
+		}
+	}
+	for _, a := range m.FindAll(AVPVendorSpecificApplicationID, 0) {
+		group, err := a.Group()
+		if err != nil {
+			continue
+		}
+		if app, ok := Find(group, AVPAuthApplicationID, 0); ok {
+			if v, err := app.Uint32(); err == nil {
+				id.AppIDs = append(id.AppIDs, v)
+			}
+		}
+	}
+	return
+}
+
+func (c *Conn) commonApplication() bool {
+	for _, app := range c.local.AppIDs {
+		if c.Peer.Supports(app) {
+			return true
+		}
+	}
+	return false
+}
+
+// 发送消息，未分配标识的请求分配新的逐跳和端到端标识
+func (c *Conn) WriteMessage(m *Message) error {
+	if m.IsRequest() && m.HopByHop == 0 {
+		m.HopByHop = atomic.AddUint32(&c.hbh, 1)
+		m.EndToEnd = atomic.AddUint32(&c.e2e, 1)
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err = c.nc.Write(data)
+	return err
+}
+
+// 读取应用消息，基础协议的看门狗和断开请求在此应答
+// 对端请求断开连接时关闭连接并返回错误，可以用IsDisconnected判断
+func (c *Conn) ReadMessage() (*Message, error) {
+	for {
+		m, err := ReadMessage(c.nc)
+		if err != nil {
+			return nil, err
+		}
+		atomic.StoreInt64(&c.lastRecv, time.Now().UnixNano())
+		switch {
+		case m.Code == CodeDeviceWatchdog && m.IsRequest():
+			ans := m.Answer(Unsigned32(AVPResultCode, 0, Success))
+			ans.Add(c.local.Origin()...)
+			ans.Add(Unsigned32(AVPOriginStateID, 0, c.state))
+			if err = c.WriteMessage(ans); err != nil {
+				return nil, err
+			}
+		case m.Code == CodeDisconnectPeer && m.IsRequest():
+			ans := m.Answer(Unsigned32(AVPResultCode, 0, Success))
+			ans.Add(c.local.Origin()...)
+			c.WriteMessage(ans)
+			c.nc.Close()
+			return nil, errPeerDisconnected
+		case m.Code == CodeDeviceWatchdog, m.Code == CodeDisconnectPeer, m.Code == CodeCapabilitiesExchange:
+			// 看门狗和断开请求的应答只用于更新接收时间
+		default:
+			return m, nil
+		}
+	}
+}
+
+var errPeerDisconnected = errors.New("diameter: peer disconnected")
+
+// 连接是否因对端请求断开而关闭
+func IsDisconnected(err error) bool {
+	return err == errPeerDisconnected
+}
+
+// 连接空闲超过interval时发送DWR，超过两个周期没有收到任何消息时关闭连接(RFC3539-3.4.1)
+func (c *Conn) Watchdog(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			idle := now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastRecv)))
+			if idle >= 2*interval {
+				c.nc.Close()
+				return
+			}
+			if idle < interval {
+				continue
+			}
+			dwr := baseRequest(CodeDeviceWatchdog)
+			dwr.Add(c.local.Origin()...)
+			dwr.Add(Unsigned32(AVPOriginStateID, 0, c.state))
+			if err := c.WriteMessage(dwr); err != nil {
+				c.nc.Close()
+				return
+			}
+		}
+	}
+}
+
+// 发送DPR后关闭连接，不等待DPA
+func (c *Conn) Close() error {
+	dpr := baseRequest(CodeDisconnectPeer)
+	dpr.Add(c.local.Origin()...)
+	dpr.Add(Unsigned32(AVPDisconnectCause, 0, DisconnectRebooting))
+	c.WriteMessage(dpr)
+	return c.nc.Close()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.nc.RemoteAddr()
+}
@@ -0,0 +1,98 @@
+package diameter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testIdentity(host string, apps ...uint32) Identity {
+	return Identity{Host: host, Realm: "hebeiyidong.3gpp.net", ProductName: "volte", VendorID: Vendor3GPP, AppIDs: apps}
+}
+
+// 建立一对完成能力交换的连接
+func testConnPair(t *testing.T, client, server Identity) (*Conn, *Conn, error) {
+	a, b := net.Pipe()
+	type result struct {
+		c   *Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := Accept(b, server, time.Second)
+		done <- result{c, err}
+	}()
+	c, err := Client(a, client, time.Second)
+	r := <-done
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return c, r.c, err
+}
+
+func TestCapabilitiesExchange(t *testing.T) {
+	c, s, err := testConnPair(t, testIdentity("s-cscf.hebeiyidong.3gpp.net", AppCx), testIdentity("hss.hebeiyidong.3gpp.net", AppCx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.nc.Close()
+	defer s.nc.Close()
+	if c.Peer.Host != "hss.hebeiyidong.3gpp.net" || !c.Peer.Supports(AppCx) || c.Peer.ProductName != "volte" {
+		t.Errorf("client peer = %+v", c.Peer)
+	}
+	if s.Peer.Host != "s-cscf.hebeiyidong.3gpp.net" || s.Peer.Realm != "hebeiyidong.3gpp.net" || !s.Peer.Supports(AppCx) {
+		t.Errorf("server peer = %+v", s.Peer)
+	}
+}
+
+func TestNoCommonApplication(t *testing.T) {
+	_, _, err := testConnPair(t, testIdentity("s-cscf.hebeiyidong.3gpp.net", 4), testIdentity("hss.hebeiyidong.3gpp.net", AppCx))
+	if err != ErrNoCommonApplication {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestConnWatchdog(t *testing.T) {
+	c, s, err := testConnPair(t, testIdentity("s-cscf.hebeiyidong.3gpp.net", AppCx), testIdentity("hss.hebeiyidong.3gpp.net", AppCx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.nc.Close()
+	defer s.nc.Close()
+	// 服务端自动应答DWR，客户端只收到应用消息
+	go func() {
+		dwr := baseRequest(CodeDeviceWatchdog)
+		dwr.Add(c.local.Origin()...)
+		c.WriteMessage(dwr)
+		c.WriteMessage(NewRequest(CodeServerAssignment, AppCx, UTF8String(AVPSessionID, 0, "sid")))
+	}()
+	received := make(chan *Message, 1)
+	go func() {
+		m, err := c.ReadMessage()
+		if err != nil {
+			t.Error(err)
+		}
+		received <- m
+	}()
+	m, err := s.ReadMessage()
+	if err != nil || m.Code != CodeServerAssignment || !m.IsRequest() || m.HopByHop == 0 {
+		t.Fatalf("read = %+v, %v", m, err)
+	}
+	if err = s.WriteMessage(m.Answer(Unsigned32(AVPResultCode, 0, Success))); err != nil {
+		t.Fatal(err)
+	}
+	if ans := <-received; ans == nil || ans.IsRequest() || ans.HopByHop != m.HopByHop {
+		t.Errorf("answer = %+v", ans)
+	}
+}
+
+func TestConnDisconnect(t *testing.T) {
+	c, s, err := testConnPair(t, testIdentity("s-cscf.hebeiyidong.3gpp.net", AppCx), testIdentity("hss.hebeiyidong.3gpp.net", AppCx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Close()
+	if _, err = s.ReadMessage(); !IsDisconnected(err) {
+		t.Errorf("err = %v", err)
+	}
+}
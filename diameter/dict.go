@@ -0,0 +1,95 @@
+package diameter
+
+// 应用标识
+const (
+	AppCommon uint32 = 0        // 基础协议消息(RFC6733-2.4)
+	AppCx     uint32 = 16777216 // Cx/Dx接口(3GPP TS 29.229)
+)
+
+// 3GPP的厂商标识
+const Vendor3GPP uint32 = 10415
+
+// 基础协议命令码(RFC6733-3.1)
+const (
+	CodeCapabilitiesExchange uint32 = 257 // CER/CEA
+	CodeDeviceWatchdog       uint32 = 280 // DWR/DWA
+	CodeDisconnectPeer       uint32 = 282 // DPR/DPA
+)
+
+// Cx接口命令码(3GPP TS 29.229 6.1)
+const (
+	CodeUserAuthorization       uint32 = 300 // UAR/UAA
+	CodeServerAssignment        uint32 = 301 // SAR/SAA
+	CodeLocationInfo            uint32 = 302 // LIR/LIA
+	CodeMultimediaAuth          uint32 = 303 // MAR/MAA
+	CodeRegistrationTermination uint32 = 304 // RTR/RTA
+)
+
+// 基础协议AVP(RFC6733-4.5)
+const (
+	AVPUserName                    uint32 = 1
+	AVPHostIPAddress               uint32 = 257
+	AVPAuthApplicationID           uint32 = 258
+	AVPVendorSpecificApplicationID uint32 = 260
+	AVPSessionID                   uint32 = 263
+	AVPOriginHost                  uint32 = 264
+	AVPSupportedVendorID           uint32 = 265
+	AVPVendorID                    uint32 = 266
+	AVPResultCode                  uint32 = 268
+	AVPProductName                 uint32 = 269
+	AVPDisconnectCause             uint32 = 273
+	AVPAuthSessionState            uint32 = 277
+	AVPOriginStateID               uint32 = 278
+	AVPDestinationRealm            uint32 = 283
+	AVPDestinationHost             uint32 = 293
+	AVPOriginRealm                 uint32 = 296
+	AVPExperimentalResult          uint32 = 297
+	AVPExperimentalResultCode      uint32 = 298
+)
+
+// Cx接口AVP，厂商标识为3GPP(3GPP TS 29.229 6.3)
+const (
+	AVPPublicIdentity          uint32 = 601
+	AVPServerName              uint32 = 602
+	AVPUserData                uint32 = 606
+	AVPSIPNumberAuthItems      uint32 = 607
+	AVPSIPAuthenticationScheme uint32 = 608
+	AVPSIPAuthenticate         uint32 = 609
+	AVPSIPAuthorization        uint32 = 610
+	AVPSIPAuthDataItem         uint32 = 612
+	AVPSIPItemNumber           uint32 = 613
+	AVPServerAssignmentType    uint32 = 614
+	AVPDeregistrationReason    uint32 = 615
+	AVPReasonCode              uint32 = 616
+	AVPReasonInfo              uint32 = 617
+	AVPUserAuthorizationType   uint32 = 623
+	AVPConfidentialityKey      uint32 = 625
+	AVPIntegrityKey            uint32 = 626
+)
+
+// 基础协议结果码(RFC6733-7.1)
+const (
+	Success             uint32 = 2001
+	CommandUnsupported  uint32 = 3001
+	UnableToDeliver     uint32 = 3002
+	NoCommonApplication uint32 = 5010
+	UnableToComply      uint32 = 5012
+)
+
+// Cx接口的实验结果码(3GPP TS 29.229 6.2)
+const (
+	FirstRegistration      uint32 = 2001
+	SubsequentRegistration uint32 = 2002
+	UnregisteredService    uint32 = 2003
+	ErrorUserUnknown       uint32 = 5001
+)
+
+// Auth-Session-State，Cx接口不维护会话状态
+const NoStateMaintained uint32 = 1
+
+// Disconnect-Cause(RFC6733-5.4.3)
+const (
+	DisconnectRebooting uint32 = 0
+	DisconnectBusy      uint32 = 1
+	DisconnectDoNotWant uint32 = 2
+)
@@ -0,0 +1,174 @@
+package diameter
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// 协议版本和消息头部长度(RFC6733-3)
+const (
+	Version   uint8 = 1
+	HeaderLen       = 20
+	// 消息长度只有3字节
+	MaxMessageLen = 1<<24 - 1
+)
+
+// 命令标志位(RFC6733-3)
+const (
+	FlagRequest       uint8 = 0x80
+	FlagProxiable     uint8 = 0x40
+	FlagError         uint8 = 0x20
+	FlagRetransmitted uint8 = 0x10
+)
+
+var (
+	ErrInvalidVersion = errors.New("diameter: invalid version")
+	ErrMessageLength  = errors.New("diameter: message length error")
+)
+
+// Diameter消息
+// 布局：Version(1) | Length(3) | Flags(1) | Code(3) | Application-ID(4) | Hop-by-Hop(4) | End-to-End(4) | AVPs
+type Message struct {
+	Flags    uint8
+	Code     uint32 // 命令码，只使用低24位
+	AppID    uint32
+	HopByHop uint32 // 逐跳标识，应答与请求相同，用于匹配同一条连接上的请求
+	EndToEnd uint32 // 端到端标识，用于检测重复的请求
+	AVPs     []AVP
+}
+
+// 创建请求，逐跳和端到端标识在发送时分配
+func NewRequest(code, app uint32, avps ...AVP) *Message {
+	return &Message{Flags: FlagRequest | FlagProxiable, Code: code, AppID: app, AVPs: avps}
+}
+
+// 创建请求的应答，复制命令码、标识和Session-Id
+func (m *Message) Answer(avps ...AVP) *Message {
+	ans := &Message{
+		Flags:    m.Flags &^ (FlagRequest | FlagRetransmitted | FlagError),
+		Code:     m.Code,
+		AppID:    m.AppID,
+		HopByHop: m.HopByHop,
+		EndToEnd: m.EndToEnd,
+	}
+	if sid, ok := m.Find(AVPSessionID, 0); ok {
+		ans.AVPs = append(ans.AVPs, sid)
+	}
+	ans.AVPs = append(ans.AVPs, avps...)
+	return ans
+}
+
+func (m *Message) IsRequest() bool {
+	return m.Flags&FlagRequest != 0
+}
+
+// 追加AVP
+func (m *Message) Add(avps ...AVP) *Message {
+	m.AVPs = append(m.AVPs, avps...)
+	return m
+}
+
+// 查找第一个匹配的AVP
+func (m *Message) Find(code, vendor uint32) (AVP, bool) {
+	return Find(m.AVPs, code, vendor)
+}
+
+// 查找全部匹配的AVP
+func (m *Message) FindAll(code, vendor uint32) []AVP {
+	return FindAll(m.AVPs, code, vendor)
+}
+
+// Session-Id，没有时返回空字符串
+func (m *Message) SessionID() string {
+	if a, ok := m.Find(AVPSessionID, 0); ok {
+		return a.String()
+	}
+	return ""
+}
+
+// 结果码，优先使用Result-Code，没有时使用Experimental-Result中的结果码
+func (m *Message) ResultCode() (uint32, bool) {
+	if a, ok := m.Find(AVPResultCode, 0); ok {
+		v, err := a.Uint32()
+		return v, err == nil
+	}
+	if a, ok := m.Find(AVPExperimentalResult, 0); ok {
+		group, err := a.Group()
+		if err != nil {
+			return 0, false
+		}
+		if code, ok := Find(group, AVPExperimentalResultCode, 0); ok {
+			v, err := code.Uint32()
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+// 编码
+func (m *Message) Marshal() ([]byte, error) {
+	buf := make([]byte, HeaderLen)
+	for _, a := range m.AVPs {
+		buf = append(buf, a.Marshal()...)
+	}
+	if len(buf) > MaxMessageLen {
+		return nil, ErrMessageLength
+	}
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	buf[0] = Version
+	binary.BigEndian.PutUint32(buf[4:8], m.Code&0xffffff)
+	buf[4] = m.Flags
+	binary.BigEndian.PutUint32(buf[8:12], m.AppID)
+	binary.BigEndian.PutUint32(buf[12:16], m.HopByHop)
+	binary.BigEndian.PutUint32(buf[16:20], m.EndToEnd)
+	return buf, nil
+}
+
+// 解码一条完整的消息
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < HeaderLen {
+		return nil, ErrMessageLength
+	}
+	if data[0] != Version {
+		return nil, ErrInvalidVersion
+	}
+	l := int(binary.BigEndian.Uint32(data[0:4]) & 0xffffff)
+	if l < HeaderLen || l != len(data) {
+		return nil, ErrMessageLength
+	}
+	m := &Message{
+		Flags:    data[4],
+		Code:     binary.BigEndian.Uint32(data[4:8]) & 0xffffff,
+		AppID:    binary.BigEndian.Uint32(data[8:12]),
+		HopByHop: binary.BigEndian.Uint32(data[12:16]),
+		EndToEnd: binary.BigEndian.Uint32(data[16:20]),
+	}
+	avps, err := parseAVPs(data[HeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	m.AVPs = avps
+	return m, nil
+}
+
+// 从字节流中读取一条消息，先读取头部获得消息长度
+func ReadMessage(r io.Reader) (*Message, error) {
+	header := make([]byte, HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, ErrInvalidVersion
+	}
+	l := int(binary.BigEndian.Uint32(header[0:4]) & 0xffffff)
+	if l < HeaderLen {
+		return nil, ErrMessageLength
+	}
+	data := make([]byte, l)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[HeaderLen:]); err != nil {
+		return nil, err
+	}
+	return Unmarshal(data)
+}
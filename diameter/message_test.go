@@ -0,0 +1,73 @@
+package diameter
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessageMarshal(t *testing.T) {
+	req := NewRequest(CodeUserAuthorization, AppCx,
+		UTF8String(AVPSessionID, 0, "i-cscf.hebeiyidong.3gpp.net;1;1"),
+		UTF8String(AVPUserName, 0, "daxiong"),
+	)
+	req.HopByHop = 0x01020304
+	req.EndToEnd = 0x05060708
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{0x01, 0x00, 0x00, byte(len(data)), 0xc0, 0x00, 0x01, 0x2c, 0x01, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	if !bytes.Equal(data[:HeaderLen], header) {
+		t.Errorf("header = %x, want %x", data[:HeaderLen], header)
+	}
+	m, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsRequest() || m.Code != CodeUserAuthorization || m.AppID != AppCx || m.HopByHop != req.HopByHop || m.EndToEnd != req.EndToEnd {
+		t.Errorf("header = %+v", m)
+	}
+	if m.SessionID() != "i-cscf.hebeiyidong.3gpp.net;1;1" {
+		t.Errorf("session = %v", m.SessionID())
+	}
+	if a, _ := m.Find(AVPUserName, 0); a.String() != "daxiong" {
+		t.Errorf("user = %v", a.String())
+	}
+}
+
+func TestMessageAnswer(t *testing.T) {
+	req := NewRequest(CodeLocationInfo, AppCx, UTF8String(AVPSessionID, 0, "sid"))
+	req.Flags |= FlagRetransmitted
+	req.HopByHop, req.EndToEnd = 7, 8
+	ans := req.Answer(Grouped(AVPExperimentalResult, 0,
+		Unsigned32(AVPVendorID, 0, Vendor3GPP),
+		Unsigned32(AVPExperimentalResultCode, 0, UnregisteredService)))
+	if ans.IsRequest() || ans.Flags&FlagRetransmitted != 0 || ans.Code != req.Code || ans.HopByHop != 7 || ans.EndToEnd != 8 {
+		t.Errorf("answer = %+v", ans)
+	}
+	if ans.SessionID() != "sid" {
+		t.Errorf("session = %v", ans.SessionID())
+	}
+	if code, ok := ans.ResultCode(); !ok || code != UnregisteredService {
+		t.Errorf("result = %v, %v", code, ok)
+	}
+	ans = req.Answer(Unsigned32(AVPResultCode, 0, Success))
+	if code, ok := ans.ResultCode(); !ok || code != Success {
+		t.Errorf("result = %v, %v", code, ok)
+	}
+}
+
+func TestUnmarshalError(t *testing.T) {
+	data, _ := NewRequest(CodeDeviceWatchdog, AppCommon, UTF8String(AVPOriginHost, 0, "hss")).Marshal()
+	if _, err := Unmarshal(data[:HeaderLen-1]); err != ErrMessageLength {
+		t.Errorf("short header err = %v", err)
+	}
+	if _, err := Unmarshal(data[:len(data)-4]); err != ErrMessageLength {
+		t.Errorf("truncated err = %v", err)
+	}
+	bad := append([]byte{}, data...)
+	bad[0] = 2
+	if _, err := Unmarshal(bad); err != ErrInvalidVersion {
+		t.Errorf("version err = %v", err)
+	}
+}
@@ -5,12 +5,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -28,14 +26,35 @@ type EpcMsg struct {
 	Method     string `json:"method"`
 	EnbID      string `json:"utran-cell-id-3gpp,omitempty"`
 	UserIP     string `json:"ue-ip,omitempty"`
+	UserIPv6   string `json:"ue-ipv6,omitempty"`
+	IPv6Prefix string `json:"ue-ipv6-prefix,omitempty"`
 	UeIdentity string `json:"ue-identity,omitempty"`
+	DetachType string `json:"detach-type,omitempty"`
+	Rand       string `json:"rand,omitempty"`          // 鉴权请求的RAND
+	Autn       string `json:"autn,omitempty"`          // 鉴权请求的AUTN
+	Res        string `json:"res,omitempty"`           // UE计算的RES
+	Auts       string `json:"auts,omitempty"`          // UE的SQN不同步时返回的AUTS
+	Cause      string `json:"cause,omitempty"`         // 拒绝附着的原因值
+	BearerID   string `json:"eps-bearer-id,omitempty"` // 建立或删除的EPS承载标识
+	QCI        string `json:"qci,omitempty"`           // 承载的QCI
+	GBR        string `json:"gbr,omitempty"`           // 专用承载的保证比特率，单位kbps
 }
 
 // 基站连接核心网的配置信息
 type CoreNetConnection struct {
 	PgwAddr   string
 	PgwConn   net.Conn // 基站连接核心网的上游行链路连接
-	beatheart int      // 心跳时间间隔
+	MmeAddr   string   // 没有配置MME时EPC消息也发给PGW
+	MmeConn   net.Conn
+	beatheart int // 心跳时间间隔
+}
+
+// 消息发往的核心网连接，配置了MME时EPC消息发给MME
+func (c *CoreNetConnection) upstream(protocal byte) net.Conn {
+	if protocal == modules.EPCPROTOCAL && c.MmeConn != nil {
+		return c.MmeConn
+	}
+	return c.PgwConn
 }
 
 var (
@@ -66,9 +85,11 @@ func main() {
 
 // 读取配置文件
 func init() {
+	config.Setup()
 	sport := viper.GetInt("eNodeB.server.port")
 	bcPort := viper.GetInt("eNodeB.broadcast.port")
 	sTime = viper.GetInt("eNodeB.scan.time")
+	ipv6 := viper.GetBool("eNodeB.ipv6")
 	CellID = viper.GetString(config.Domain + ".enb.id")
 	bmsg, _ = json.Marshal(&EpcMsg{
 		Protocal: "epc",
@@ -77,38 +98,33 @@ func init() {
 	})
 
 	// 启动与ue连接的服务器
-	bConn, bAddr = initAPServer(sport, bcPort)
+	bConn, bAddr = initAPServer(sport, bcPort, ipv6)
 	NetSideConn = new(CoreNetConnection)
 	// 创建与核心网中PGW连接的UDP连接
 	NetSideConn.PgwAddr = viper.GetString(config.Domain + ".pgw.host")
+	NetSideConn.MmeAddr = viper.GetString(config.Domain + ".mme.host")
 	NetSideConn.beatheart = viper.GetInt("eNodeB.beatheart.time")
 	logger.Info("配置文件读取成功", "")
 }
 
-// 与UE连接的UDP广播服务端
-func initAPServer(port int, bport int) (*net.UDPConn, *net.UDPAddr) {
-	localIP, err := getLocalLanIP()
+// 与UE连接的UDP广播服务端，IPv6没有广播，使用链路本地的全节点组播地址发现UE
+func initAPServer(port int, bport int, ipv6 bool) (*net.UDPConn, *net.UDPAddr) {
+	localIP, ifname, err := getLocalLanIP(ipv6)
 	if err != nil {
 		log.Panicln("获取本地IP地址失败", err)
 	}
-	host := localIP.IP.To4().String() + ":" + strconv.Itoa(port)
-	la, err := net.ResolveUDPAddr("udp4", host)
-	if err != nil {
-		log.Panicln("eNodeB host配置解析失败", err)
+	la := &net.UDPAddr{IP: localIP.IP, Port: port}
+	if localIP.IP.IsLinkLocalUnicast() {
+		la.Zone = ifname
 	}
-	conn, err := net.ListenUDP("udp4", la)
+	conn, err := net.ListenUDP("udp", la)
 	if err != nil {
 		log.Panicln("eNodeB host监听失败", err)
 	}
-	bip, err := lastAddr(localIP)
+	ra, err := broadcastAddr(localIP, ifname, bport)
 	if err != nil {
 		log.Panicln("获取本地广播地址失败", err)
 	}
-	broadcast := bip.String() + ":" + strconv.Itoa(bport)
-	ra, err := net.ResolveUDPAddr("udp4", broadcast)
-	if err != nil {
-		log.Panicln("eNodeB 广播地址配置解析失败", err)
-	}
 
 	logger.Info("UDP广播服务器启动... [%v]", la)
 	logger.Info("UDP广播子网... [%v]", ra)
@@ -141,21 +157,31 @@ func working(ctx context.Context, conn *net.UDPConn, remote *net.UDPAddr, scan i
 
 func tunneling(ctx context.Context, coreConn *CoreNetConnection, bConn *net.UDPConn, bAddr *net.UDPAddr) {
 	var err error
-	coreConn.PgwConn, err = net.Dial("udp4", coreConn.PgwAddr)
+	coreConn.PgwConn, err = net.Dial("udp", coreConn.PgwAddr)
 	if err != nil {
 		logger.Info("[%v] 连接核心网PGW失败 %v", ctx.Value("Entity"), err)
 		return
 	}
-	// 向mme和pgw发送心跳包，让对端知道自己的公网IP和端口
+	// 向pgw发送心跳包，让对端知道自己的公网IP和端口
 	go heartbeat(ctx, coreConn.PgwConn, coreConn.beatheart)
 	go forwardMsgFromNetToUe(ctx, coreConn.PgwConn, bConn, bAddr)
+	if len(coreConn.MmeAddr) > 0 {
+		coreConn.MmeConn, err = net.Dial("udp", coreConn.MmeAddr)
+		if err != nil {
+			logger.Info("[%v] 连接核心网MME失败 %v", ctx.Value("Entity"), err)
+			return
+		}
+		go forwardMsgFromNetToUe(ctx, coreConn.MmeConn, bConn, bAddr)
+	}
 	go forwardMsgFromUeToNet(ctx, bConn, coreConn)
 }
 
 func heartbeat(ctx context.Context, conn net.Conn, period int) {
+	// 心跳的内容为基站标识
+	pkg := new(modules.Package)
+	pkg.Construct(modules.BEATHEART, modules.BEATHEART, CellID)
+	msg := pkg.Bytes()
 	for {
-		signal := []byte{0x0F, 0x0F, 0x0F, 0x0F}
-		msg := append(signal, []byte(CellID)...)
 		_, err := conn.Write(msg)
 		if err != nil {
 			logger.Error("[%v] 心跳探测发送失败 %v", ctx.Value("Entity"), err)
@@ -174,19 +200,19 @@ func forwardMsgFromNetToUe(ctx context.Context, conn net.Conn, bconn *net.UDPCon
 			logger.Warn("[%v] 基站转发广播网络侧消息协程退出...", ctx.Value("Entity"))
 			return
 		default:
-			data := make([]byte, 10240) // 最多读取10KB数据包
+			data := make([]byte, modules.MaxDatagramSize)
 			n, err := conn.Read(data)
 			if err != nil {
 				logger.Error("[%v] 读取网络侧数据错误 %v", ctx.Value("Entity"), err)
 				continue
 			}
 			if n != 0 {
-				msg, isSip := parseSipData(data[:n])
-				if !isSip {
-					logger.Info("[%v] 基站接收来自网络侧消息 %v\n %v(%v bytes)", ctx.Value("Entity"), data[0:4], string(data[4:n]), n)
-				} else {
-					logger.Info("[%v] 基站接收来自网络侧消息 \n%v(%v bytes)", ctx.Value("Entity"), string(data[:n]), n)
+				msg, err := fromNet(data[:n])
+				if err != nil {
+					logger.Error("[%v] 网络侧消息解析失败 %v", ctx.Value("Entity"), err)
+					continue
 				}
+				logger.Info("[%v] 基站接收来自网络侧消息 \n%v(%v bytes)", ctx.Value("Entity"), string(msg), n)
 				// 将收到的消息广播出去
 				working(ctx, bconn, baddr, 0, msg)
 			}
@@ -206,16 +232,21 @@ func forwardMsgFromUeToNet(ctx context.Context, src *net.UDPConn, cConn *CoreNet
 			logger.Warn("[%v] 基站转发协程退出...", ctx.Value("Entity"))
 			return
 		default:
-			data := make([]byte, 10240) // 10KB
+			data := make([]byte, modules.MaxDatagramSize)
 			n, _, err = src.ReadFromUDP(data)
 			if err != nil && n == 0 {
 				logger.Error("[%v] 基站接收消息失败 %x %v", ctx.Value("Entity"), n, err)
 			}
-			msg, _ := parseSipData(data[:n])
+			protocal, msg, err := fromUe(data[:n])
+			if err != nil {
+				logger.Error("[%v] Ue消息解析失败 %v", ctx.Value("Entity"), err)
+				continue
+			}
 			logger.Info("[%v] 基站接收来自Ue消息 \n%v(%v bytes)", ctx.Value("Entity"), string(data[:n]), n)
-			err = send(cConn.PgwConn, msg)
+			conn := cConn.upstream(protocal)
+			err = send(conn, msg)
 			if err != nil {
-				logger.Error("[%v] 基站转发消息失败[to pgw] %v %v", ctx.Value("Entity"), n, err)
+				logger.Error("[%v] 基站转发消息失败[to %v] %v %v", ctx.Value("Entity"), conn.RemoteAddr(), n, err)
 			}
 		}
 	}
@@ -229,71 +260,158 @@ func send(conn net.Conn, msg []byte) error {
 	return nil
 }
 
-func parseSipData(data []byte) ([]byte, bool) {
+// UE的消息转换为发往核心网的帧，JSON格式的为EPC消息，其余为SIP消息，同时返回消息的协议
+func fromUe(data []byte) (byte, []byte, error) {
+	pkg := new(modules.Package)
 	em := new(EpcMsg)
-	err := json.Unmarshal(data, em)
-	if err == nil { // JSON格式消息来自Ue且非SIP消息类型
-		pd := make([]byte, 4, 655335)
-		body := fmt.Sprintln("UTRAN-CELL-ID-3GPP=" + em.EnbID)
-		binary.BigEndian.PutUint16(pd, 0x0100) // attach request
-		binary.BigEndian.PutUint16(pd[2:], uint16(len(body)))
-		pd = append(pd, []byte(body)...)
-		logger.Info("EPC Msg %v", pd)
-		return pd, false
+	if err := json.Unmarshal(data, em); err == nil {
+		method, ok := ueMethod(em.Method)
+		if !ok {
+			return 0, nil, errors.New("ErrUnknownMethod")
+		}
+		args := map[string]string{"UTRAN-CELL-ID-3GPP": em.EnbID}
+		// PGW按UE标识分配和回收地址
+		if len(em.UeIdentity) > 0 {
+			args["UE-IDENTITY"] = em.UeIdentity
+		}
+		if len(em.DetachType) > 0 {
+			args["DETACH-TYPE"] = em.DetachType
+		}
+		// 鉴权响应携带RES，SQN不同步时携带AUTS和鉴权请求的RAND
+		if len(em.Res) > 0 {
+			args["RES"] = em.Res
+		}
+		if len(em.Auts) > 0 {
+			args["AUTS"] = em.Auts
+			args["RAND"] = em.Rand
+		}
+		body := modules.StrLineMarshal(args)
+		pkg.Construct(modules.EPCPROTOCAL, method, body)
+		logger.Info("EPC Msg %v", body)
+		return modules.EPCPROTOCAL, pkg.Bytes(), nil
 	}
 	logger.Info("SIP Msg")
-	if data[0] == 0x01 { // 来自核心网
-		em.Protocal = PotoMap[data[0]]
-		em.Method = MethMap[data[1]]
-		for k, v := range modules.StrLineUnmarshal(data[4:]) {
-			if k == "UTRAN-CELL-ID-3GPP" {
-				em.EnbID = v
-				continue
-			}
-			if strings.ToLower(k) == "ip" {
-				em.UserIP = v
-				continue
-			}
-			if k == "UE-IDENTITY" {
-				em.UeIdentity = v
-				continue
-			}
+	if err := pkg.Init(data); err != nil {
+		return 0, nil, err
+	}
+	return pkg.GetRoute()[0], pkg.Bytes(), nil
+}
+
+// UE发来的EPC消息的类型，未携带类型的消息为附着请求
+func ueMethod(name string) (byte, bool) {
+	if len(name) == 0 {
+		return modules.AttachRequest, true
+	}
+	for m, n := range MethMap {
+		if n == name {
+			return m, true
 		}
-		pda, _ := json.Marshal(em)
-		return pda, false
 	}
-	// 来自核心网的SIP消息不需要解析
-	return data, true
+	return 0, false
 }
 
-func getLocalLanIP() (*net.IPNet, error) {
+// 核心网的消息转换为发往UE的消息，EPC消息转换为JSON格式，SIP消息去掉帧头
+func fromNet(data []byte) ([]byte, error) {
+	pkg := new(modules.Package)
+	if err := pkg.Init(data); err != nil {
+		return nil, err
+	}
+	route := pkg.GetRoute()
+	if route[0] != modules.EPCPROTOCAL {
+		return pkg.GetData(), nil
+	}
+	em := &EpcMsg{
+		Protocal: PotoMap[route[0]],
+		Method:   MethMap[route[1]],
+	}
+	for k, v := range modules.StrLineUnmarshal(pkg.GetData()) {
+		if k == "UTRAN-CELL-ID-3GPP" {
+			em.EnbID = v
+			continue
+		}
+		if strings.ToLower(k) == "ip" {
+			em.UserIP = v
+			continue
+		}
+		if k == "IPV6" {
+			em.UserIPv6 = v
+			continue
+		}
+		if k == "IPV6-PREFIX" {
+			em.IPv6Prefix = v
+			continue
+		}
+		if k == "UE-IDENTITY" {
+			em.UeIdentity = v
+			continue
+		}
+		if k == "DETACH-TYPE" {
+			em.DetachType = v
+			continue
+		}
+		if k == "RAND" {
+			em.Rand = v
+			continue
+		}
+		if k == "AUTN" {
+			em.Autn = v
+			continue
+		}
+		if k == "CAUSE" {
+			em.Cause = v
+			continue
+		}
+		if k == "EPS-BEARER-ID" {
+			em.BearerID = v
+			continue
+		}
+		if k == "QCI" {
+			em.QCI = v
+			continue
+		}
+		if k == "GBR" {
+			em.GBR = v
+			continue
+		}
+	}
+	return json.Marshal(em)
+}
+
+// 本机局域网地址和所在的网卡，ipv6为true时查找IPv6地址
+func getLocalLanIP(ipv6 bool) (*net.IPNet, string, error) {
 	if net.FlagUp != 1 {
-		return nil, errors.New("ErrNoNet")
+		return nil, "", errors.New("ErrNoNet")
 	}
 	ifs, e := net.Interfaces()
 	if e != nil {
-		return nil, e
+		return nil, "", e
 	}
 	for i := 0; i < len(ifs); i++ {
 		addrs, e := ifs[i].Addrs()
 		if e != nil {
-			return nil, e
+			return nil, "", e
 		}
 		for _, address := range addrs {
 			log.Printf("_if: %v(%v) _addr: %v\n", ifs[i], ifs[i].Flags, address)
-			if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.To4().IsLoopback() && isLan(ipnet.IP.String()) {
-				return ipnet, nil
+			ipnet, ok := address.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || (ipnet.IP.To4() == nil) != ipv6 {
+				continue
+			}
+			if isLan(ipnet.IP.String()) {
+				return ipnet, ifs[i].Name, nil
 			}
 		}
 	}
-	return nil, errors.New("ErrNetInterfaceNotFound")
+	return nil, "", errors.New("ErrNetInterfaceNotFound")
 }
 
-var LanIPSeg = [4]string{
+var LanIPSeg = [6]string{
 	"10.0.0.0/8",
 	"172.16.0.0/12",
 	"192.168.0.0/16",
 	"127.0.0.1/8",
+	"fc00::/7",  // IPv6唯一本地地址
+	"fe80::/10", // IPv6链路本地地址
 }
 
 func isLan(s string) bool {
@@ -308,14 +426,33 @@ func isLan(s string) bool {
 	return false
 }
 
-func lastAddr(n *net.IPNet) (net.IP, error) {
-	if n.IP.To4() == nil {
-		return net.IP{}, errors.New("ErrNoIPv4")
+// UE发现基站使用的地址，IPv4为子网的广播地址，IPv6为网卡上的全节点组播地址ff02::1
+func broadcastAddr(n *net.IPNet, ifname string, port int) (*net.UDPAddr, error) {
+	v4 := n.IP.To4()
+	if v4 == nil {
+		if len(ifname) == 0 {
+			return nil, errors.New("ErrNoInterface")
+		}
+		return &net.UDPAddr{IP: net.IPv6linklocalallnodes, Port: port, Zone: ifname}, nil
+	}
+	mask := n.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
 	}
-	ip := make(net.IP, len(n.IP.To4()))
-	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(n.IP.To4())|^binary.BigEndian.Uint32(net.IP(n.Mask).To4()))
-	return ip, nil
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(v4)|^binary.BigEndian.Uint32(mask))
+	return &net.UDPAddr{IP: ip, Port: port}, nil
 }
 
 var PotoMap = map[byte]string{0x01: "epc"}
-var MethMap = map[byte]string{0x00: "attach request", 0x0A: "attach accept"}
+var MethMap = map[byte]string{
+	0x00: "attach request",
+	0x03: "authentication request",
+	0x04: "authentication response",
+	0x09: "create bearer request",
+	0x0A: "attach accept",
+	0x15: "detach request",
+	0x16: "detach accept",
+	0x18: "attach reject",
+	0x1B: "delete bearer request",
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/VegetableManII/volte/config"
 	"github.com/VegetableManII/volte/controller"
 	. "github.com/VegetableManII/volte/modules"
-	"github.com/spf13/viper"
 
 	"github.com/wonderivan/logger"
 )
@@ -17,6 +16,7 @@ import (
 var (
 	self      *controller.HssEntity
 	localhost string
+	conf      *config.Network
 )
 
 /*
@@ -36,8 +36,9 @@ func main() {
 	go ReceiveMessage(ctx, conn, coreIn)
 	go ProcessDownStreamData(ctx, coreOutDown)
 	go ProcessUpStreamData(ctx, coreOutUp)
-
-	go self.CoreProcessor(ctx, coreIn, coreOutUp, coreOutDown)
+	// Cx接口使用Diameter时由网关收发Cx消息
+	up, down := controller.CxTransport(ctx, conf, "hss", coreIn, coreOutUp, coreOutDown)
+	go self.CoreProcessor(ctx, coreIn, up, down)
 
 	<-quit
 	logger.Warn("[HSS] hss 功能实体退出...")
@@ -49,20 +50,18 @@ func main() {
 # 归属地查询服务器
 hss:
   host: 127.0.0.1:7777
+# 用户数据存储: mysql、sqlite、memory
+store:
+  driver: memory
+  seed: ./sql/users.yml
 # 数据库配置信息
-mysql:
-  host: "root:@tcp(127.0.0.1:3306)/volte?charset=utf8&parseTime=True&loc=Local"
+mysql: "root:@tcp(127.0.0.1:3306)/volte?charset=utf8&parseTime=True&loc=Local"
 */
 
 func init() {
-	localhost = config.Elements["HSS"].ActualAddr
-	dbconf := viper.GetString("mysql")
+	conf = config.Setup()
+	localhost = conf.Elements["HSS"].ActualAddr
 	self = new(controller.HssEntity)
-	self.Init(dbconf)
-	RegistRouter()
-}
-
-func RegistRouter() {
-	self.Regist([2]byte{EPCPROTOCAL, MultiMediaAuthenticationRequest}, self.MultimediaAuthorizationRequestF)
-	self.Regist([2]byte{EPCPROTOCAL, UserAuthorizationRequest}, self.UserAuthorizationRequestF)
+	self.Init(conf, config.HSSStore())
+	self.RegistRouter()
 }
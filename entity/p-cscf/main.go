@@ -10,7 +10,6 @@ import (
 	"github.com/VegetableManII/volte/controller"
 	. "github.com/VegetableManII/volte/modules"
 
-	"github.com/spf13/viper"
 	"github.com/wonderivan/logger"
 )
 
@@ -34,6 +33,8 @@ func main() {
 
 	conn := CreateServer(localhost)
 	go ReceiveMessage(ctx, conn, coreIn)
+	// 按配置开启TCP和TLS传输，发送协程经上下文选择
+	ctx = controller.StreamTransport(ctx, localhost, coreIn)
 	go ProcessDownStreamData(ctx, coreOutDown)
 	go ProcessUpStreamData(ctx, coreOutUp)
 	// 开启IMS域的逻辑处理协程
@@ -46,16 +47,11 @@ func main() {
 }
 
 func init() {
-	localhost = viper.GetString(config.Domain + ".p-cscf.host")
-	dns := viper.GetString(config.Domain + ".domain")
+	conf := config.Setup()
+	localhost = conf.Elements["PCSCF"].ActualAddr
 	logger.Info("配置文件读取成功", "")
 	// 启动 CSCF 的UDP服务器
 	self = new(controller.P_CscfEntity)
-	self.Init("p-cscf."+dns, localhost)
-	RegistRouter()
-}
-
-func RegistRouter() {
-	self.Regist([2]byte{SIPPROTOCAL, SipRequest}, self.SIPREQUESTF)
-	self.Regist([2]byte{SIPPROTOCAL, SipResponse}, self.SIPRESPONSEF)
+	self.Init(conf)
+	self.RegistRouter()
 }
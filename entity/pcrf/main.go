@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/controller"
+	. "github.com/VegetableManII/volte/modules"
+
+	"github.com/wonderivan/logger"
+)
+
+var (
+	self      *controller.PcrfEntity
+	localhost string
+)
+
+/*
+读协程读消息->解析前管道->协议解析->解析后管道->写协程写消息
+
+	readGoroutine --->> chan *Msg --->> parser --->> chan *Msg --->> writeGoroutine
+*/
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, "Entity", "PCRF")
+	coreIn := make(chan *Package, 4)
+	coreOutUp := make(chan *Package, 2)
+	coreOutDown := make(chan *Package, 2)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	conn := CreateServer(localhost)
+	go ReceiveMessage(ctx, conn, coreIn)
+
+	go ProcessDownStreamData(ctx, coreOutDown)
+	go ProcessUpStreamData(ctx, coreOutUp)
+
+	go self.CoreProcessor(ctx, coreIn, coreOutUp, coreOutDown)
+
+	<-quit
+	logger.Warn("[PCRF] pcrf 功能实体退出...")
+	cancel()
+	logger.Warn("[PCRF] pcrf 子协程退出完成...")
+}
+
+func init() {
+	conf := config.Setup()
+	localhost = conf.Elements["PCRF"].ActualAddr
+	logger.Info("配置文件读取成功", "")
+	self = new(controller.PcrfEntity)
+	self.Init(conf)
+	self.RegistRouter()
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/VegetableManII/volte/controller"
 	. "github.com/VegetableManII/volte/modules"
 
-	"github.com/spf13/viper"
 	"github.com/wonderivan/logger"
 )
 
@@ -47,16 +46,10 @@ func main() {
 }
 
 func init() {
-	localhost = viper.GetString(config.Domain + ".pgw.host")
-	dhcp := viper.GetString(config.Domain + ".pgw.dhcp")
+	conf := config.Setup()
+	localhost = conf.Elements["PGW"].ActualAddr
 	logger.Info("配置文件读取成功", "")
 	self = new(controller.PgwEntity)
-	self.Init(dhcp)
-	RegistRouter()
-}
-
-func RegistRouter() {
-	self.Regist([2]byte{EPCPROTOCAL, AttachRequest}, self.AttachRequestF)
-	self.Regist([2]byte{SIPPROTOCAL, SipRequest}, self.SIPREQUESTF)
-	self.Regist([2]byte{SIPPROTOCAL, SipResponse}, self.SIPRESPONSEF)
+	self.Init(conf, config.HSSStore())
+	self.RegistRouter()
 }
@@ -10,13 +10,13 @@ import (
 	"github.com/VegetableManII/volte/controller"
 	. "github.com/VegetableManII/volte/modules"
 
-	"github.com/spf13/viper"
 	"github.com/wonderivan/logger"
 )
 
 var (
 	self      *controller.S_CscfEntity
 	localhost string
+	conf      *config.Network
 )
 
 /*
@@ -32,13 +32,16 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	// 开启IMS域的逻辑处理协程
-	go self.CoreProcessor(ctx, coreIn, coreOutUp, coreOutDown)
-
 	conn := CreateServer(localhost)
 	go ReceiveMessage(ctx, conn, coreIn)
+	// 按配置开启TCP和TLS传输，发送协程经上下文选择
+	ctx = controller.StreamTransport(ctx, localhost, coreIn)
 	go ProcessDownStreamData(ctx, coreOutDown)
 	go ProcessUpStreamData(ctx, coreOutUp)
+	// Cx接口使用Diameter时由网关收发Cx消息
+	up, down := controller.CxTransport(ctx, conf, "s-cscf", coreIn, coreOutUp, coreOutDown)
+	// 开启IMS域的逻辑处理协程
+	go self.CoreProcessor(ctx, coreIn, up, down)
 
 	<-quit
 	logger.Warn("[S-CSCF] s-cscf 功能实体退出...")
@@ -47,17 +50,11 @@ func main() {
 }
 
 func init() {
-	localhost = viper.GetString(config.Domain + ".s-cscf.host")
-	dns := viper.GetString(config.Domain + ".domain")
+	conf = config.Setup()
+	localhost = conf.Elements["SCSCF"].ActualAddr
 	logger.Info("配置文件读取成功", "")
 	// 启动 CSCF 的UDP服务器
 	self = new(controller.S_CscfEntity)
-	self.Init("s-cscf."+dns, localhost)
-	RegistRouter()
-}
-
-func RegistRouter() {
-	self.Regist([2]byte{SIPPROTOCAL, SipRequest}, self.SIPREQUESTF)
-	self.Regist([2]byte{EPCPROTOCAL, MultiMediaAuthenticationAnswer}, self.MutimediaAuthorizationAnswerF)
-	self.Regist([2]byte{SIPPROTOCAL, SipResponse}, self.SIPRESPONSEF)
+	self.Init(conf)
+	self.RegistRouter()
 }
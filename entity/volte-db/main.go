@@ -0,0 +1,64 @@
+/*
+HSS数据库管理工具，按配置文件中的store配置连接数据库：
+
+	migrate 执行尚未执行的迁移脚本
+	seed    执行迁移后写入初始用户数据，已存在的用户不覆盖
+
+go run ./entity/volte-db -f ./config.yml [-s ./sql/users.yml] migrate|seed
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/controller"
+)
+
+func main() {
+	var confile, seed string
+	flag.StringVar(&confile, "f", "", "配置文件路径")
+	flag.StringVar(&seed, "s", "", "初始用户数据文件，默认使用配置文件中的store.seed")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -f config.yml [-s users.yml] migrate|seed\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if _, err := os.Stat(confile); err != nil || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	config.SetupLogger("volte-db")
+	if err := config.Load(confile); err != nil {
+		log.Fatalln("配置文件读取失败", err)
+	}
+	sc := config.HSSStore()
+	if sc.Driver == "memory" {
+		log.Fatalln("内存存储不需要数据库迁移")
+	}
+
+	switch flag.Arg(0) {
+	case "migrate":
+		db, err := controller.OpenDatabase(sc)
+		if err != nil {
+			log.Fatalln("数据库迁移失败", err)
+		}
+		db.Close()
+	case "seed":
+		if len(seed) > 0 {
+			sc.Seed = seed
+		}
+		if len(sc.Seed) == 0 {
+			log.Fatalln("未指定初始用户数据文件")
+		}
+		if _, err := controller.OpenSubscriberStore(sc); err != nil {
+			log.Fatalln("写入初始用户数据失败", err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+在一个进程中启动完整的IMS核心网：HSS、PGW、P-CSCF、I-CSCF、S-CSCF，配置了MME、PCRF时同时启动，
+可以同时启动配置文件中的多个网络域，功能实体之间仍然通过本地UDP通信。
+go run ./entity/volte-lab -f ./config.yml [-d hebeiyidong,chongqingdianxin]
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/VegetableManII/volte/config"
+	"github.com/VegetableManII/volte/controller"
+	. "github.com/VegetableManII/volte/modules"
+
+	"github.com/wonderivan/logger"
+)
+
+// 功能实体的逻辑核心，启动前需要完成初始化和路由注册
+type entity struct {
+	name string          // 功能实体名称，用于日志
+	host string          // 监听地址
+	core controller.Base // 逻辑核心
+	cx   string          // 使用Cx接口的功能实体在网络域中的名称
+	conf *config.Network
+	sip  bool // 是否是CSCF，按配置开启TCP和TLS传输
+}
+
+// 正在运行的功能实体
+type lab struct {
+	wg    sync.WaitGroup
+	conns []*net.UDPConn
+}
+
+func main() {
+	var confile, domains string
+	flag.StringVar(&confile, "f", "", "配置文件路径")
+	flag.StringVar(&domains, "d", "", "启动的网络域，多个网络域使用逗号分隔，默认启动全部网络域")
+	flag.Parse()
+	if _, err := os.Stat(confile); err != nil {
+		flag.Usage()
+		os.Exit(0)
+	}
+	config.SetupLogger("volte-lab")
+	if err := config.Load(confile); err != nil {
+		log.Panicln("配置文件读取失败", err)
+	}
+	names := config.Networks()
+	if len(domains) > 0 {
+		names = strings.Split(domains, ",")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	l := new(lab)
+	for _, name := range names {
+		conf, err := config.NewNetwork(strings.TrimSpace(name))
+		if err != nil {
+			log.Panicln("网络域配置读取失败", name, err)
+		}
+		for _, e := range entities(conf) {
+			l.start(ctx, conf.Name, e)
+		}
+		logger.Info("[volte-lab] 网络域 %v 启动完成", conf.Name)
+	}
+
+	<-quit
+	logger.Warn("[volte-lab] 功能实体退出...")
+	cancel()
+	// 关闭连接，解除接收协程的阻塞
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Warn("[volte-lab] 子协程退出完成...")
+	case <-time.After(5 * time.Second):
+		logger.Error("[volte-lab] 等待子协程退出超时")
+	}
+}
+
+// 网络域中的全部功能实体
+func entities(conf *config.Network) []entity {
+	hss := new(controller.HssEntity)
+	hss.Init(conf, config.HSSStore())
+	hss.RegistRouter()
+	pgw := new(controller.PgwEntity)
+	pgw.Init(conf, config.HSSStore())
+	pgw.RegistRouter()
+	pcscf := new(controller.P_CscfEntity)
+	pcscf.Init(conf)
+	pcscf.RegistRouter()
+	icscf := new(controller.I_CscfEntity)
+	icscf.Init(conf)
+	icscf.RegistRouter()
+	scscf := new(controller.S_CscfEntity)
+	scscf.Init(conf)
+	scscf.RegistRouter()
+	es := []entity{
+		{"HSS", conf.Elements["HSS"].ActualAddr, hss, "hss", conf, false},
+		{"PGW", conf.Elements["PGW"].ActualAddr, pgw, "", conf, false},
+		{"P-CSCF", conf.Elements["PCSCF"].ActualAddr, pcscf, "", conf, true},
+		{"I-CSCF", conf.Elements["ICSCF"].ActualAddr, icscf, "i-cscf", conf, true},
+		{"S-CSCF", conf.Elements["SCSCF"].ActualAddr, scscf, "s-cscf", conf, true},
+	}
+	// 没有配置MME时基站直接向PGW附着
+	if host := conf.Elements["MME"].ActualAddr; len(host) > 0 {
+		mme := new(controller.MmeEntity)
+		mme.Init(conf)
+		mme.RegistRouter()
+		es = append(es, entity{"MME", host, mme, "", conf, false})
+	}
+	// 没有配置PCRF时P-CSCF直接请求PGW建立语音专用承载
+	if host := conf.Elements["PCRF"].ActualAddr; len(host) > 0 {
+		pcrf := new(controller.PcrfEntity)
+		pcrf.Init(conf)
+		pcrf.RegistRouter()
+		es = append(es, entity{"PCRF", host, pcrf, "", conf, false})
+	}
+	return es
+}
+
+/*
+与单独部署的功能实体相同的处理流程：
+
+	readGoroutine --->> chan *Msg --->> parser --->> chan *Msg --->> writeGoroutine
+*/
+func (l *lab) start(ctx context.Context, domain string, e entity) {
+	ctx = context.WithValue(ctx, "Entity", e.name+"@"+domain)
+	coreIn := make(chan *Package, 4)
+	coreOutUp := make(chan *Package, 2)
+	coreOutDown := make(chan *Package, 2)
+
+	conn := CreateServer(e.host)
+	l.conns = append(l.conns, conn)
+	l.run(func() { ReceiveMessage(ctx, conn, coreIn) })
+	if e.sip {
+		ctx = controller.StreamTransport(ctx, e.host, coreIn)
+	}
+	l.run(func() { ProcessDownStreamData(ctx, coreOutDown) })
+	l.run(func() { ProcessUpStreamData(ctx, coreOutUp) })
+	up, down := coreOutUp, coreOutDown
+	if len(e.cx) > 0 {
+		up, down = controller.CxTransport(ctx, e.conf, e.cx, coreIn, coreOutUp, coreOutDown)
+	}
+	l.run(func() { e.core.CoreProcessor(ctx, coreIn, up, down) })
+}
+
+func (l *lab) run(f func()) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		f()
+	}()
+}
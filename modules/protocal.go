@@ -1,9 +1,10 @@
 package modules
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
+	"strings"
 )
 
 const CRLF = "\r\n"
@@ -16,21 +17,42 @@ const (
 
 // epc message的消息类型
 const (
-	AttachRequest byte = 0x00 // UE发起Attach请求
-	// AuthenticationInformatRequest   byte = 0x01
-	// AuthenticationInformatResponse  byte = 0x02
-	// AuthenticationRequest           byte = 0x03 // 网络侧向UE发起，UE侧需要实现该接口
-	// AuthenticationResponse          byte = 0x04 // UE响应网络侧，由UE实现
-	// UpdateLocationRequest           byte = 0x05
-	// UpdateLocationACK               byte = 0x06
-	// CreateSessionRequest            byte = 0x07
-	// CreateSessionResponse           byte = 0x08
-	// QCI                             byte = 0x09
-	AttachAccept                    byte = 0x0A // 网络侧向UE发起，通知附着成功
-	UserAuthorizationRequest        byte = 0x0B
-	UserAuthorizationAnswer         byte = 0x0C
-	MultiMediaAuthenticationRequest byte = 0x0D
-	MultiMediaAuthenticationAnswer  byte = 0x0E
+	AttachRequest                    byte = 0x00 // UE发起Attach请求
+	AuthenticationInformationRequest byte = 0x01 // MME向HSS请求EPS鉴权向量(S6a AIR)
+	AuthenticationInformationAnswer  byte = 0x02
+	AuthenticationRequest            byte = 0x03 // 网络侧向UE发起，UE侧需要实现该接口
+	AuthenticationResponse           byte = 0x04 // UE响应网络侧，由UE实现，携带RES或重新同步的AUTS
+	UpdateLocationRequest            byte = 0x05 // MME向HSS登记并获取签约数据(S6a ULR)
+	UpdateLocationAnswer             byte = 0x06
+	CreateSessionRequest             byte = 0x07 // MME请求PGW为UE建立会话并分配地址
+	CreateSessionResponse            byte = 0x08
+	CreateBearerRequest              byte = 0x09 // PGW为UE的IMS会话建立专用承载，携带EPS承载标识和QCI
+	AttachAccept                     byte = 0x0A // 网络侧向UE发起，通知附着成功
+	UserAuthorizationRequest         byte = 0x0B
+	UserAuthorizationAnswer          byte = 0x0C
+	MultiMediaAuthenticationRequest  byte = 0x0D
+	MultiMediaAuthenticationAnswer   byte = 0x0E
+	ServerAssignmentRequest          byte = 0x0F // S-CSCF通知HSS为用户服务或不再为用户服务
+	ServerAssignmentAnswer           byte = 0x10
+	LocationInfoRequest              byte = 0x11 // I-CSCF查询为用户服务的S-CSCF
+	LocationInfoAnswer               byte = 0x12
+	RegistrationTerminationRequest   byte = 0x13 // HSS要求S-CSCF注销用户
+	RegistrationTerminationAnswer    byte = 0x14
+	DetachRequest                    byte = 0x15 // UE或网络侧发起去附着
+	DetachAccept                     byte = 0x16 // 去附着完成，UE关机时网络侧不发送
+	DetachIndication                 byte = 0x17 // PGW通知IMS侧UE已去附着，P-CSCF转发给为用户服务的S-CSCF
+	AttachReject                     byte = 0x18 // 网络侧拒绝附着，携带EMM原因值
+	DeleteSessionRequest             byte = 0x19 // UE去附着后MME请求PGW删除会话
+	DeleteSessionResponse            byte = 0x1A
+	DeleteBearerRequest              byte = 0x1B // PGW删除专用承载，删除默认承载时由MME发起去附着
+	BearerResourceAllocation         byte = 0x1C // 没有PCRF时P-CSCF收到SDP应答后请求PGW为会话建立专用承载
+	BearerResourceRelease            byte = 0x1D // 没有PCRF时IMS会话结束后P-CSCF请求PGW删除会话的专用承载
+	AARequest                        byte = 0x1E // P-CSCF向PCRF上报IMS会话的媒体信息(Rx AAR)
+	AAAnswer                         byte = 0x1F
+	SessionTerminationRequest        byte = 0x20 // IMS会话结束后P-CSCF通知PCRF(Rx STR)
+	SessionTerminationAnswer         byte = 0x21
+	ReAuthRequest                    byte = 0x22 // PCRF向PGW安装或删除PCC规则(Gx RAR)，PGW按规则建立或删除专用承载
+	ReAuthAnswer                     byte = 0x23
 )
 
 // sip message的消息类型
@@ -39,11 +61,41 @@ const (
 	SipResponse byte = 0x01
 )
 
+// 帧格式(版本1)，所有字段为网络字节序
+//
+//	| 0 | 1 | 2 | 3 |
+//	| magic | v | f |  magic为0xFE 0xED，v为版本，f为标志位
+//	| p | m | length|  p为协议，m为方法，length为data字段的长度(4字节)
+//	| length| [txid |  标志位FrameFlagTransaction置位时携带8字节的事务标识
+//	|     txid]     |
+//	|     data      |
+//
+// 0xFE不会出现在UTF-8编码中，帧不会与SIP消息、旧格式的EPC消息和心跳混淆
+const (
+	FrameMagic     uint16 = 0xFEED
+	FrameVersion   byte   = 0x01
+	FrameHeaderLen        = 10
+	FrameTxIDLen          = 8
+)
+
+// 帧标志位
+const (
+	FrameFlagTransaction byte = 0x01 // 携带事务标识
+)
+
+var (
+	ErrFrameTooShort      = errors.New("ErrFrameTooShort")
+	ErrFrameVersion       = errors.New("ErrFrameVersion")
+	ErrFrameLength        = errors.New("ErrFrameLength")
+	ErrInvalidLegacyFrame = errors.New("ErrInvalidLegacyFrame")
+)
+
 type CommonMsg struct {
-	_protocal uint8       // 0x01 表示电路域协议
-	_method   uint8       // 对应协议的不同请求响应方法
-	_size     uint16      // data字段的长度
-	_data     [65535]byte // 最大65535字节大小
+	_protocal uint8  // 0x01 表示电路域协议
+	_method   uint8  // 对应协议的不同请求响应方法
+	_flags    uint8  // 帧标志位
+	_txid     uint64 // 事务标识，标志位FrameFlagTransaction置位时有效
+	_data     []byte
 }
 type ShortConn string  // 短连接
 type LongConn struct { // 长地址
@@ -54,14 +106,24 @@ type Package struct {
 	msg    CommonMsg
 	shortc ShortConn
 	longc  LongConn
+	raw    bool // SIP消息不加帧头直接发送，用于外部的SIP实体
+	// 面向连接传输的协议和连接，空的协议为UDP
+	// 接收时stream为消息到达的连接的对端地址，发送时优先使用该连接
+	transport string
+	stream    string
 }
 
 /*
-EPC消息内容布局 byte
+旧格式的消息布局，接收时仍然兼容
+EPC消息 byte
 	| 0 | 1 | 2 | 3 |
   0 | p | m | size  |
   1	|     data      |
-SIP消息布局
+心跳
+	| 0 | 1 | 2 | 3 |
+  0 |  0x0F0F0F0F   |
+  1	|   基站标识     |
+SIP消息
 	| 0 | 1 | 2 | 3 |
   0	|     data      |
 
@@ -71,28 +133,36 @@ SIP Header 格式如下
 	找到第一个\r\n的位置，	左边部分即为SIP Header部分
 
 */
-// 接收消息时通过字节流创建Package
+// 接收消息时通过字节流创建Package，依次识别新格式的帧、旧格式的心跳和EPC消息，其余为SIP消息
 func (p *Package) Init(data []byte) error {
-	// 填充消息字节数据
-	if data[0] == EPCPROTOCAL {
-		l := binary.BigEndian.Uint16(data[2:4])
-		p.msg._protocal = data[0]
-		p.msg._method = data[1]
-		p.msg._size = l
-		copy(p.msg._data[:], data[4:l+4])
-	} else {
+	switch {
+	case len(data) >= 2 && binary.BigEndian.Uint16(data) == FrameMagic:
+		return p.msg.Unmarshal(data)
+	case len(data) >= 4 && binary.BigEndian.Uint32(data) == 0x0F0F0F0F:
+		p.msg = CommonMsg{_protocal: BEATHEART, _method: BEATHEART, _data: copyBytes(data[4:])}
+	case len(data) > 0 && data[0] == EPCPROTOCAL:
+		if len(data) < 4 {
+			return ErrInvalidLegacyFrame
+		}
+		l := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < l+4 {
+			return ErrInvalidLegacyFrame
+		}
+		p.msg = CommonMsg{_protocal: EPCPROTOCAL, _method: data[1], _data: copyBytes(data[4 : l+4])}
+	default:
 		m, err := GetSipMethod(data)
 		if err != nil {
 			return err
 		}
-		p.msg._protocal = SIPPROTOCAL
-		p.msg._method = m
-		p.msg._size = uint16(len(data))
-		copy(p.msg._data[:], data[:])
+		p.msg = CommonMsg{_protocal: SIPPROTOCAL, _method: m, _data: copyBytes(data)}
 	}
 	return nil
 }
 
+func copyBytes(data []byte) []byte {
+	return append([]byte{}, data...)
+}
+
 func (p *Package) SetShortConn(dst string) {
 	p.shortc = ShortConn(dst)
 }
@@ -122,39 +192,132 @@ func (p *Package) Construct(_type, _method byte, body string) {
 	// 消息构建
 	p.msg._protocal = _type
 	p.msg._method = _method
-	size := len([]byte(body))
-	if size == 0 { // 消息转发，内容不需要改变
+	if len(body) == 0 { // 消息转发，内容不需要改变
 		return
 	}
-	p.msg._data = [65535]byte{}
-	p.msg._size = uint16(size)
-	copy(p.msg._data[:], []byte(body))
+	p.msg._data = []byte(body)
+}
+
+// 设置事务标识，为0时不携带
+func (p *Package) SetTransactionID(id uint64) {
+	p.msg._txid = id
+	if id == 0 {
+		p.msg._flags &^= FrameFlagTransaction
+	} else {
+		p.msg._flags |= FrameFlagTransaction
+	}
+}
+
+// 事务标识，没有携带时返回false
+func (p *Package) GetTransactionID() (uint64, bool) {
+	return p.msg._txid, p.msg._flags&FrameFlagTransaction != 0
+}
+
+// 设置发送使用的传输协议，TCP和TLS经对应的连接发送
+func (p *Package) SetTransport(transport string) {
+	p.transport = strings.ToUpper(transport)
+}
+
+// 接收或发送使用的传输协议
+func (p *Package) GetTransport() string {
+	if len(p.transport) == 0 {
+		return TransportUDP
+	}
+	return p.transport
+}
+
+// 设置面向连接传输时优先使用的连接，应答从请求到达的连接返回(RFC3261-18.2.2)
+func (p *Package) SetStreamConn(addr string) {
+	p.stream = addr
+}
+
+// 消息来源的实际地址，面向连接传输时为连接的对端地址
+func (p *Package) GetRemoteAddr() string {
+	if len(p.stream) > 0 {
+		return p.stream
+	}
+	if p.longc.remoteAddr == nil {
+		return ""
+	}
+	return p.longc.remoteAddr.String()
+}
+
+// SIP消息不加帧头直接发送，发往核心网之外的SIP实体时使用
+func (p *Package) SetRaw(raw bool) {
+	p.raw = raw
 }
 
 func (p *Package) IsBeatHeart() bool {
-	return p.msg._protocal == 0x0F &&
-		p.msg._method == 0x0F && p.msg._size == 0x0F0F
+	return p.msg._protocal == BEATHEART && p.msg._method == BEATHEART
 }
 
 func (p *Package) GetRoute() [2]byte {
 	return [2]byte{p.msg._protocal, p.msg._method}
 }
 
-// 获取消息的内容截断末尾的'\0'
+// 获取消息的内容
 func (p *Package) GetData() []byte {
-	return p.msg._data[:p.msg._size]
+	return p.msg._data
+}
+
+// 发送的字节流，设置了不加帧头的SIP消息直接发送内容
+func (p *Package) Bytes() []byte {
+	if p.raw && p.msg._protocal == SIPPROTOCAL {
+		return p.msg.GetSipMessage()
+	}
+	return p.msg.Marshal()
+}
+
+// 编码为新格式的帧
+func (msg *CommonMsg) Marshal() []byte {
+	l := FrameHeaderLen + len(msg._data)
+	if msg._flags&FrameFlagTransaction != 0 {
+		l += FrameTxIDLen
+	}
+	buf := make([]byte, FrameHeaderLen, l)
+	binary.BigEndian.PutUint16(buf[0:2], FrameMagic)
+	buf[2] = FrameVersion
+	buf[3] = msg._flags
+	buf[4] = msg._protocal
+	buf[5] = msg._method
+	binary.BigEndian.PutUint32(buf[6:10], uint32(len(msg._data)))
+	if msg._flags&FrameFlagTransaction != 0 {
+		buf = buf[:FrameHeaderLen+FrameTxIDLen]
+		binary.BigEndian.PutUint64(buf[FrameHeaderLen:], msg._txid)
+	}
+	return append(buf, msg._data...)
+}
+
+// 解码新格式的帧，长度不足或者版本不支持时返回错误
+func (msg *CommonMsg) Unmarshal(data []byte) error {
+	if len(data) < FrameHeaderLen {
+		return ErrFrameTooShort
+	}
+	if data[2] != FrameVersion {
+		return ErrFrameVersion
+	}
+	m := CommonMsg{_flags: data[3], _protocal: data[4], _method: data[5]}
+	body := data[FrameHeaderLen:]
+	if m._flags&FrameFlagTransaction != 0 {
+		if len(body) < FrameTxIDLen {
+			return ErrFrameTooShort
+		}
+		m._txid = binary.BigEndian.Uint64(body)
+		body = body[FrameTxIDLen:]
+	}
+	if uint64(len(body)) != uint64(binary.BigEndian.Uint32(data[6:10])) {
+		return ErrFrameLength
+	}
+	m._data = copyBytes(body)
+	*msg = m
+	return nil
 }
 
+// EPC消息的字节流
 func (msg *CommonMsg) GetEpcMessage() []byte {
-	buf := new(bytes.Buffer)
-	buf.Grow(4 + int(msg._size))
-	binary.Write(buf, binary.BigEndian, msg._protocal)
-	binary.Write(buf, binary.BigEndian, msg._method)
-	binary.Write(buf, binary.BigEndian, msg._size)
-	binary.Write(buf, binary.BigEndian, msg._data[:msg._size])
-	return buf.Bytes()
+	return msg.Marshal()
 }
 
 func (msg *CommonMsg) GetSipMessage() []byte {
-	return msg._data[:msg._size]
+	return msg._data
 }
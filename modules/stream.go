@@ -0,0 +1,336 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wonderivan/logger"
+)
+
+// SIP的传输协议，与Via中的名称一致
+const (
+	TransportUDP = "UDP"
+	TransportTCP = "TCP"
+	TransportTLS = "TLS"
+)
+
+// 路径MTU未知时超过1300字节的请求改用面向连接的传输发送(RFC3261-18.1.1)
+const (
+	MTU               = 1500
+	MaxUDPRequestSize = MTU - 200
+)
+
+// 面向连接传输时单条消息的最大长度
+const MaxStreamMessageSize = 1 << 20
+
+// 建立连接的超时时间，连接空闲超过StreamIdleTimeout后关闭
+var (
+	StreamDialTimeout = 3 * time.Second
+	StreamIdleTimeout = 10 * time.Minute
+)
+
+var (
+	ErrStreamHeader  = errors.New("ErrStreamHeader")
+	ErrContentLength = errors.New("ErrContentLength")
+)
+
+// 面向连接的SIP传输(RFC3261-18)，TCP和TLS各使用一个
+// 连接按对端地址复用，接受的连接和主动建立的连接都可以发送消息
+type Stream struct {
+	sync.Mutex
+	transport string
+	ln        net.Listener
+	conf      *tls.Config
+	conns     map[string]net.Conn // 对端地址 -> 连接
+	in        chan *Package
+}
+
+// 开始监听TCP或TLS连接，连接上收到的消息交给in，ctx结束时关闭全部连接
+// TLS的conf需要包含本端证书，同时用于主动建立的连接
+func ListenStream(ctx context.Context, transport, host string, conf *tls.Config, in chan *Package) (*Stream, error) {
+	s := &Stream{
+		transport: strings.ToUpper(transport),
+		conf:      conf,
+		conns:     make(map[string]net.Conn),
+		in:        in,
+	}
+	var err error
+	if s.transport == TransportTLS {
+		s.ln, err = tls.Listen("tcp", host, conf)
+	} else {
+		s.transport = TransportTCP
+		s.ln, err = net.Listen("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("[%v] %v服务监听启动成功 %v", ctx.Value("Entity"), s.transport, s.ln.Addr())
+	go func() {
+		<-ctx.Done()
+		s.ln.Close()
+		s.Lock()
+		for _, c := range s.conns {
+			c.Close()
+		}
+		s.Unlock()
+	}()
+	go func() {
+		for {
+			c, err := s.ln.Accept()
+			if err != nil {
+				logger.Warn("[%v] %v服务监听退出 %v", ctx.Value("Entity"), s.transport, err)
+				return
+			}
+			key := c.RemoteAddr().String()
+			s.add(key, c)
+			go s.serve(ctx, key, c)
+		}
+	}()
+	return s, nil
+}
+
+// 传输协议
+func (s *Stream) Transport() string {
+	return s.transport
+}
+
+// 监听地址
+func (s *Stream) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// 发送消息，优先使用prefer对应的连接，其次使用到host的已有连接，都没有时建立新的连接
+func (s *Stream) Send(ctx context.Context, prefer, host string, data []byte) error {
+	s.Lock()
+	key, c := prefer, s.conns[prefer]
+	if c == nil {
+		key, c = host, s.conns[host]
+	}
+	s.Unlock()
+	if c == nil {
+		var err error
+		if c, err = s.dial(ctx, host); err != nil {
+			return err
+		}
+		key = host
+	}
+	if _, err := c.Write(data); err != nil {
+		s.remove(key, c)
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *Stream) dial(ctx context.Context, host string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: StreamDialTimeout}
+	var c net.Conn
+	var err error
+	if s.transport == TransportTLS {
+		c, err = tls.DialWithDialer(d, "tcp", host, s.conf)
+	} else {
+		c, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.add(host, c)
+	go s.serve(ctx, host, c)
+	return c, nil
+}
+
+// 保存连接，同一对端已有连接时保留原有的连接，新连接只用于接收
+func (s *Stream) add(key string, c net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.conns[key]; !ok {
+		s.conns[key] = c
+	}
+}
+
+func (s *Stream) remove(key string, c net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// 读取连接上的消息交给逻辑核心，连接出错或空闲超时后关闭
+func (s *Stream) serve(ctx context.Context, key string, c net.Conn) {
+	defer Recover(ctx)
+	defer func() {
+		s.remove(key, c)
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(StreamIdleTimeout))
+		data, err := ReadStreamMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				logger.Warn("[%v] %v连接断开 %v, peer: %v", ctx.Value("Entity"), s.transport, err, key)
+			}
+			return
+		}
+		pkg := new(Package)
+		if err = pkg.Init(data); err != nil {
+			logger.Error("[%v] 消息分发失败, Error: %v", ctx.Value("Entity"), err)
+			continue
+		}
+		pkg.transport = s.transport
+		pkg.stream = key
+		select {
+		case s.in <- pkg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 从字节流中读取一条消息，消息之间的CRLF保活(RFC5626-4.4.1)被跳过
+// 帧按帧头中的长度读取，SIP消息读取到空行为止的头部后按Content-Length读取消息体(RFC3261-18.3)
+func ReadStreamMessage(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		r.Discard(1)
+	}
+	if head, err := r.Peek(2); err == nil && binary.BigEndian.Uint16(head) == FrameMagic {
+		return readFrame(r)
+	}
+	return readSipMessage(r)
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, FrameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	l := int(binary.BigEndian.Uint32(header[6:10]))
+	if header[3]&FrameFlagTransaction != 0 {
+		l += FrameTxIDLen
+	}
+	if l > MaxStreamMessageSize {
+		return nil, ErrFrameLength
+	}
+	data := make([]byte, FrameHeaderLen+l)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[FrameHeaderLen:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readSipMessage(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	length := -1
+	for {
+		line, err := readLine(r, &buf)
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, CRLF)
+		if len(line) == 0 {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		// Content-Length的简写为l(RFC3261-20.14)
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		if name != "content-length" && name != "l" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		if err != nil || n < 0 {
+			return nil, ErrContentLength
+		}
+		length = n
+	}
+	// 面向连接传输时必须携带Content-Length
+	if length < 0 || buf.Len()+length > MaxStreamMessageSize {
+		return nil, ErrContentLength
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// 读取一行写入buf，按读缓冲区的大小分段读取，超过消息长度上限时不再读取
+func readLine(r *bufio.Reader, buf *bytes.Buffer) (string, error) {
+	start := buf.Len()
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if buf.Len()+len(chunk) > MaxStreamMessageSize {
+			return "", ErrStreamHeader
+		}
+		buf.Write(chunk)
+		if err == nil {
+			return string(buf.Bytes()[start:]), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+}
+
+type streamsKey struct{}
+
+// 将功能实体的面向连接传输加入上下文，发送协程按消息的传输协议选择
+func WithStreams(ctx context.Context, streams ...*Stream) context.Context {
+	m := make(map[string]*Stream)
+	if old, ok := ctx.Value(streamsKey{}).(map[string]*Stream); ok {
+		for t, s := range old {
+			m[t] = s
+		}
+	}
+	for _, s := range streams {
+		if s != nil {
+			m[s.transport] = s
+		}
+	}
+	return context.WithValue(ctx, streamsKey{}, m)
+}
+
+func streamOf(ctx context.Context, transport string) *Stream {
+	m, _ := ctx.Value(streamsKey{}).(map[string]*Stream)
+	return m[transport]
+}
+
+// 指定了面向连接传输的消息经对应的连接发送，SIP消息不加帧头
+// 返回false时没有对应的传输，使用UDP发送
+func sendStream(ctx context.Context, pkg *Package) (bool, error) {
+	if pkg.GetTransport() == TransportUDP {
+		return false, nil
+	}
+	s := streamOf(ctx, pkg.transport)
+	if s == nil {
+		logger.Warn("[%v] 没有%v传输，使用UDP发送", ctx.Value("Entity"), pkg.transport)
+		return false, nil
+	}
+	data := pkg.Bytes()
+	if pkg.msg._protocal == SIPPROTOCAL {
+		data = pkg.msg.GetSipMessage()
+	}
+	return true, s.Send(ctx, pkg.stream, string(pkg.shortc), data)
+}
@@ -10,13 +10,17 @@ import (
 	"github.com/wonderivan/logger"
 )
 
+// UDP数据报的最大长度
+const MaxDatagramSize = 65535
+
+// 监听地址可以是IPv4或IPv6，未指定IP(如 :5060、[::]:5060)时同时接收IPv4和IPv6的消息
 func CreateServer(host string) *net.UDPConn {
-	lo, err := net.ResolveUDPAddr("udp4", host)
+	lo, err := net.ResolveUDPAddr("udp", host)
 	if err != nil {
 		logger.Fatal("解析地址失败 %v", err)
 	}
 	logger.Info("服务监听启动成功 %v", lo.String())
-	conn, err := net.ListenUDP("udp4", lo)
+	conn, err := net.ListenUDP("udp", lo)
 	if err != nil {
 		log.Panicln("udp server 监听失败", err)
 	}
@@ -34,26 +38,12 @@ func ReceiveMessage(ctx context.Context, conn *net.UDPConn, in chan *Package) {
 			logger.Warn("[%v] 接收消息协程退出", ctx.Value("Entity"))
 			return
 		default:
-			data := make([]byte, 10240) // 10KB
+			data := make([]byte, MaxDatagramSize)
 			n, ra, err := conn.ReadFromUDP(data)
 			if err != nil {
 				logger.Error("[%v] Server读取数据错误 %v", ctx.Value("Entity"), err)
 			}
 			if n != 0 {
-				// 心跳兼容
-				if data[0] == 0x0F && data[1] == 0x0F && data[2] == 0x0F && data[3] == 0x0F {
-					pkg := &Package{
-						msg: CommonMsg{
-							_protocal: 0x0F,
-							_method:   0x0F,
-							_size:     0x0F0F,
-						},
-						shortc: ShortConn(data[4:n]),
-					}
-					pkg.SetLongAddr(ra)
-					in <- pkg
-					continue
-				}
 				distribute(ctx, data[:n], ra, conn, in)
 			} else {
 				logger.Info("[%v] Read Len[%v]", ctx.Value("Entity"), n)
@@ -74,32 +64,20 @@ func ProcessDownStreamData(ctx context.Context, down chan *Package) {
 			return
 		case pkg := <-down:
 			host := string(pkg.shortc)
-			var err error
-			if pkg.msg._protocal == EPCPROTOCAL {
-				// 使用下游固定地址 或 使用下游连接
-				if host == "" {
-					n, err := pkg.longc.conn.WriteToUDP(pkg.msg.GetEpcMessage(), pkg.longc.remoteAddr)
-					if err != nil || n == 0 {
-						logger.Error("[%v] 向下行连接发送数据失败 err: %v, down: %v", ctx.Value("Entity"), err, pkg.longc.remoteAddr)
-					}
-				} else { // 使用固定连接
-					err = sendUDPMessage(ctx, host, pkg.msg.GetEpcMessage())
-					if err != nil {
-						logger.Error("[%v] 向下行固定网络地址发送数据失败 err: %v, dowm: %v", ctx.Value("Entity"), err, host)
-					}
+			// 面向连接的传输 或 使用下游固定地址 或 使用下游连接
+			if ok, err := sendStream(ctx, pkg); ok {
+				if err != nil {
+					logger.Error("[%v] 经%v向下行发送数据失败 err: %v, down: %v", ctx.Value("Entity"), pkg.transport, err, host)
 				}
-
-			} else {
-				if host == "" {
-					n, err := pkg.longc.conn.WriteToUDP(pkg.msg.GetSipMessage(), pkg.longc.remoteAddr)
-					if err != nil || n == 0 {
-						logger.Error("[%v] 向下行连接发送数据失败 err: %v, down: %v", ctx.Value("Entity"), err, pkg.longc.remoteAddr)
-					}
-				} else {
-					err = sendUDPMessage(ctx, host, pkg.msg.GetSipMessage())
-					if err != nil {
-						logger.Error("[%v] 向下行固定网络地址发送数据失败 err: %v, dowm: %v", ctx.Value("Entity"), err, host)
-					}
+			} else if host == "" {
+				n, err := pkg.longc.conn.WriteToUDP(pkg.Bytes(), pkg.longc.remoteAddr)
+				if err != nil || n == 0 {
+					logger.Error("[%v] 向下行连接发送数据失败 err: %v, down: %v", ctx.Value("Entity"), err, pkg.longc.remoteAddr)
+				}
+			} else { // 使用固定连接
+				err := sendUDPMessage(ctx, host, pkg.Bytes())
+				if err != nil {
+					logger.Error("[%v] 向下行固定网络地址发送数据失败 err: %v, dowm: %v", ctx.Value("Entity"), err, host)
 				}
 			}
 		}
@@ -115,17 +93,15 @@ func ProcessUpStreamData(ctx context.Context, up chan *Package) {
 			return
 		case pkt := <-up:
 			host := string(pkt.shortc)
-			var err error
-			if pkt.msg._protocal == EPCPROTOCAL {
-				err = sendUDPMessage(ctx, host, pkt.msg.GetEpcMessage())
+			if ok, err := sendStream(ctx, pkt); ok {
 				if err != nil {
-					logger.Error("[%v] 向上行节点发送数据失败 err: %v, up: %v", ctx.Value("Entity"), err, host)
-				}
-			} else {
-				err = sendUDPMessage(ctx, host, pkt.msg.GetSipMessage())
-				if err != nil {
-					logger.Error("[%v] 向上行节点发送数据失败 err: %v, up: %v", ctx.Value("Entity"), err, host)
+					logger.Error("[%v] 经%v向上行节点发送数据失败 err: %v, up: %v", ctx.Value("Entity"), pkt.transport, err, host)
 				}
+				continue
+			}
+			err := sendUDPMessage(ctx, host, pkt.Bytes())
+			if err != nil {
+				logger.Error("[%v] 向上行节点发送数据失败 err: %v, up: %v", ctx.Value("Entity"), err, host)
 			}
 		}
 	}
@@ -138,7 +114,7 @@ func Send(pkg *Package, out chan *Package) {
 // 需要向其他功能实体发送数据是的通用方法，异步接收
 func sendUDPMessage(ctx context.Context, host string, data []byte) (err error) {
 	defer Recover(ctx)
-	ra, err := net.Dial("udp4", host)
+	ra, err := net.Dial("udp", host)
 	if err != nil {
 		return err
 	}
@@ -160,6 +136,10 @@ func distribute(ctx context.Context, data []byte, ra *net.UDPAddr, conn *net.UDP
 	} else {
 		pkg.SetLongAddr(ra)   // 默认携带请求对端地址，用于判断是上行还是下行
 		pkg.SetLongConn(conn) // 默认信息包都携带自身连接conn，用于需要时进行动态连接响应
+		if pkg.IsBeatHeart() {
+			// 心跳的内容为基站标识
+			pkg.SetShortConn(string(pkg.GetData()))
+		}
 		c <- pkg
 	}
 }
@@ -1,8 +1,22 @@
 package modules
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStrLineUnmarshal(t *testing.T) {
@@ -35,3 +49,246 @@ func TestIntToUint16(t *testing.T) {
 	b := uint16(a)
 	t.Log(b)
 }
+
+func TestFrame(t *testing.T) {
+	body := "UserName=daxiong\r\nResultCode=2001"
+	pkg := new(Package)
+	pkg.Construct(EPCPROTOCAL, UserAuthorizationAnswer, body)
+	data := pkg.Bytes()
+	want := []byte{0xFE, 0xED, FrameVersion, 0x00, EPCPROTOCAL, UserAuthorizationAnswer, 0x00, 0x00, 0x00, byte(len(body))}
+	if !bytes.Equal(data[:FrameHeaderLen], want) {
+		t.Errorf("header = %x, want %x", data[:FrameHeaderLen], want)
+	}
+	got := new(Package)
+	if err := got.Init(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetRoute() != pkg.GetRoute() || string(got.GetData()) != body {
+		t.Errorf("decode = %x %q", got.GetRoute(), got.GetData())
+	}
+	if _, ok := got.GetTransactionID(); ok {
+		t.Error("unexpected transaction id")
+	}
+
+	// 携带事务标识
+	pkg.SetTransactionID(0x0102030405060708)
+	got = new(Package)
+	if err := got.Init(pkg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := got.GetTransactionID(); !ok || id != 0x0102030405060708 || string(got.GetData()) != body {
+		t.Errorf("transaction id = %x, %v, data = %q", id, ok, got.GetData())
+	}
+
+	// 超过65535字节的消息
+	large := strings.Repeat("a", 70000)
+	pkg.Construct(SIPPROTOCAL, SipRequest, large)
+	got = new(Package)
+	if err := got.Init(pkg.Bytes()); err != nil || len(got.GetData()) != len(large) {
+		t.Errorf("large = %v, %v", len(got.GetData()), err)
+	}
+}
+
+func TestFrameError(t *testing.T) {
+	pkg := new(Package)
+	pkg.Construct(EPCPROTOCAL, AttachRequest, "UTRAN-CELL-ID-3GPP=1")
+	data := pkg.Bytes()
+	if err := new(Package).Init(data[:FrameHeaderLen-1]); err != ErrFrameTooShort {
+		t.Errorf("short = %v", err)
+	}
+	if err := new(Package).Init(data[:len(data)-1]); err != ErrFrameLength {
+		t.Errorf("truncated = %v", err)
+	}
+	bad := append([]byte{}, data...)
+	bad[2] = 0x02
+	if err := new(Package).Init(bad); err != ErrFrameVersion {
+		t.Errorf("version = %v", err)
+	}
+	if err := new(Package).Init([]byte{EPCPROTOCAL, AttachRequest, 0x00, 0x10, 'a'}); err != ErrInvalidLegacyFrame {
+		t.Errorf("legacy = %v", err)
+	}
+}
+
+// 旧格式的消息仍然可以解析
+func TestInitLegacy(t *testing.T) {
+	body := "UTRAN-CELL-ID-3GPP=1"
+	legacy := append([]byte{EPCPROTOCAL, AttachRequest, 0x00, byte(len(body))}, body...)
+	pkg := new(Package)
+	if err := pkg.Init(legacy); err != nil || pkg.GetRoute() != [2]byte{EPCPROTOCAL, AttachRequest} || string(pkg.GetData()) != body {
+		t.Errorf("epc = %x %q %v", pkg.GetRoute(), pkg.GetData(), err)
+	}
+
+	pkg = new(Package)
+	if err := pkg.Init(append([]byte{0x0F, 0x0F, 0x0F, 0x0F}, "enb-1"...)); err != nil || !pkg.IsBeatHeart() || string(pkg.GetData()) != "enb-1" {
+		t.Errorf("heartbeat = %x %q %v", pkg.GetRoute(), pkg.GetData(), err)
+	}
+
+	sip := "SIP/2.0 200 OK\r\nCall-ID: 1\r\n\r\n"
+	pkg = new(Package)
+	if err := pkg.Init([]byte(sip)); err != nil || pkg.GetRoute() != [2]byte{SIPPROTOCAL, SipResponse} || string(pkg.GetData()) != sip {
+		t.Errorf("sip = %x %q %v", pkg.GetRoute(), pkg.GetData(), err)
+	}
+	// 不加帧头发送的SIP消息与原始内容相同
+	pkg.SetRaw(true)
+	if string(pkg.Bytes()) != sip {
+		t.Errorf("raw = %q", pkg.Bytes())
+	}
+}
+
+func TestReadStreamMessage(t *testing.T) {
+	req := "REGISTER sip:hebeiyidong.3gpp.net SIP/2.0\r\nCall-ID: 1\r\nl: 4\r\n\r\nabcd"
+	resp := "SIP/2.0 200 OK\r\nCall-ID: 1\r\nContent-Length: 0\r\n\r\n"
+	pkg := new(Package)
+	pkg.Construct(EPCPROTOCAL, AttachRequest, "UTRAN-CELL-ID-3GPP=1")
+	frame := pkg.Bytes()
+
+	// 消息之间的CRLF保活被跳过
+	r := bufio.NewReader(strings.NewReader(req + "\r\n\r\n" + resp + string(frame)))
+	for _, want := range []string{req, resp, string(frame)} {
+		data, err := ReadStreamMessage(r)
+		if err != nil || string(data) != want {
+			t.Fatalf("read = %q, %v, want %q", data, err, want)
+		}
+	}
+	if _, err := ReadStreamMessage(r); err != io.EOF {
+		t.Errorf("end = %v", err)
+	}
+
+	r = bufio.NewReader(strings.NewReader("SIP/2.0 200 OK\r\nCall-ID: 1\r\n\r\n"))
+	if _, err := ReadStreamMessage(r); err != ErrContentLength {
+		t.Errorf("without content-length = %v", err)
+	}
+	r = bufio.NewReader(strings.NewReader("SIP/2.0 200 OK\r\nContent-Length: 10\r\n\r\nabc"))
+	if _, err := ReadStreamMessage(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated body = %v", err)
+	}
+
+	// 长于读缓冲区的头部行分段读取
+	long := "SIP/2.0 200 OK\r\nSubject: " + strings.Repeat("a", 10000) + "\r\nContent-Length: 0\r\n\r\n"
+	if data, err := ReadStreamMessage(bufio.NewReader(strings.NewReader(long))); err != nil || string(data) != long {
+		t.Errorf("long header = %v", err)
+	}
+	// 没有换行的数据超过上限后不再读取
+	endless := &testEndlessReader{}
+	if _, err := ReadStreamMessage(bufio.NewReader(endless)); err != ErrStreamHeader {
+		t.Errorf("endless line = %v", err)
+	}
+	if endless.n > MaxStreamMessageSize+8192 {
+		t.Errorf("read %v bytes", endless.n)
+	}
+}
+
+// 不断返回不含换行的数据
+type testEndlessReader struct {
+	n int
+}
+
+func (r *testEndlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.n += len(p)
+	return len(p), nil
+}
+
+const testStreamRequest = "MESSAGE sip:1010@hebeiyidong.3gpp.net SIP/2.0\r\nCall-ID: 1\r\nContent-Length: 5\r\n\r\nhello"
+const testStreamResponse = "SIP/2.0 200 OK\r\nCall-ID: 1\r\nContent-Length: 0\r\n\r\n"
+
+// 请求经新建的连接发送，应答从请求到达的连接返回
+func testStream(t *testing.T, transport string, server, client *tls.Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverIn, clientIn := make(chan *Package, 1), make(chan *Package, 1)
+	ss, err := ListenStream(ctx, transport, "127.0.0.1:0", server, serverIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := ListenStream(ctx, transport, "127.0.0.1:0", client, clientIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cctx, sctx := WithStreams(ctx, cs), WithStreams(ctx, ss)
+
+	req := new(Package)
+	req.Construct(SIPPROTOCAL, SipRequest, testStreamRequest)
+	req.SetShortConn(ss.Addr().String())
+	req.SetTransport(transport)
+	if ok, err := sendStream(cctx, req); !ok || err != nil {
+		t.Fatalf("send request = %v, %v", ok, err)
+	}
+	var got *Package
+	select {
+	case got = <-serverIn:
+	case <-time.After(3 * time.Second):
+		t.Fatal("request not received")
+	}
+	if got.GetTransport() != strings.ToUpper(transport) || got.GetRoute() != [2]byte{SIPPROTOCAL, SipRequest} || string(got.GetData()) != testStreamRequest {
+		t.Fatalf("request = %v %x %q", got.GetTransport(), got.GetRoute(), got.GetData())
+	}
+
+	resp := new(Package)
+	resp.Construct(SIPPROTOCAL, SipResponse, testStreamResponse)
+	resp.SetShortConn(cs.Addr().String())
+	resp.SetTransport(transport)
+	resp.SetStreamConn(got.GetRemoteAddr())
+	if ok, err := sendStream(sctx, resp); !ok || err != nil {
+		t.Fatalf("send response = %v, %v", ok, err)
+	}
+	select {
+	case got = <-clientIn:
+	case <-time.After(3 * time.Second):
+		t.Fatal("response not received")
+	}
+	if string(got.GetData()) != testStreamResponse || got.GetRemoteAddr() != ss.Addr().String() {
+		t.Errorf("response = %q from %v", got.GetData(), got.GetRemoteAddr())
+	}
+	// 应答使用已有的连接，服务端没有建立新的连接
+	ss.Lock()
+	n := len(ss.conns)
+	ss.Unlock()
+	if n != 1 {
+		t.Errorf("server connections = %d", n)
+	}
+
+	// 没有对应的传输时使用UDP
+	req.SetTransport("UDP")
+	if ok, _ := sendStream(cctx, req); ok {
+		t.Errorf("udp should not use stream")
+	}
+}
+
+func TestStreamTCP(t *testing.T) {
+	testStream(t, "tcp", nil, nil)
+}
+
+func TestStreamTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "volte"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	testStream(t, "tls", conf, conf)
+}
@@ -60,6 +60,25 @@ func (h *Args) Set(key string, value string) {
 	h.values = append(h.values, value)
 }
 
+// 删除键
+func (h *Args) Del(key string) {
+	for i, k := range h.keys {
+		if k == key {
+			h.keys = append(h.keys[:i:i], h.keys[i+1:]...)
+			h.values = append(h.values[:i:i], h.values[i+1:]...)
+			return
+		}
+	}
+}
+
+// 复制参数，修改副本不影响原参数
+func (h Args) Clone() Args {
+	return Args{
+		keys:   append([]string(nil), h.keys...),
+		values: append([]string(nil), h.values...),
+	}
+}
+
 // 使用分号开头，用key[=value]方式，通过分号拼接成字符串
 func (h Args) String() string {
 	return h.customString(func(key string, value string) string {
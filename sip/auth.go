@@ -0,0 +1,381 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+)
+
+// 认证方案
+const SchemeDigest = "Digest"
+
+// 认证参数 auth-param = token "=" ( token / quoted-string ) (RFC7235-2.1)
+type authParam struct {
+	key    string
+	value  string
+	quoted bool // 输出时是否使用引号
+}
+
+// 认证头域中的参数列表，保持参数的原始顺序
+type AuthParams struct {
+	value []authParam
+}
+
+// 获取参数的值，参数名不区分大小写
+func (p AuthParams) Get(key string) (string, bool) {
+	for _, item := range p.value {
+		if strings.EqualFold(item.key, key) {
+			return item.value, true
+		}
+	}
+	return "", false
+}
+
+// 设置使用引号的参数
+func (p *AuthParams) Set(key, value string) {
+	p.set(authParam{key, value, true})
+}
+
+// 设置不使用引号的参数
+func (p *AuthParams) SetToken(key, value string) {
+	p.set(authParam{key, value, false})
+}
+
+// 删除参数
+func (p *AuthParams) Del(key string) {
+	for i, item := range p.value {
+		if strings.EqualFold(item.key, key) {
+			p.value = append(p.value[:i], p.value[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *AuthParams) set(param authParam) {
+	for i, item := range p.value {
+		if strings.EqualFold(item.key, param.key) {
+			p.value[i] = param
+			return
+		}
+	}
+	p.value = append(p.value, param)
+}
+
+// 字符串表达，参数之间使用逗号和空格分隔
+func (p AuthParams) String() string {
+	items := make([]string, 0, len(p.value))
+	for _, item := range p.value {
+		if item.quoted {
+			items = append(items, item.key+"="+quote(item.value))
+		} else {
+			items = append(items, item.key+"="+item.value)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// 解析认证头域中逗号分隔的参数，引号内可以包含逗号、等号和转义字符
+func parseAuthParams(str string) (p AuthParams, err error) {
+	for i := 0; i < len(str); {
+		// 跳过分隔符
+		for i < len(str) && (str[i] == ',' || str[i] == ' ' || str[i] == '\t') {
+			i++
+		}
+		if i >= len(str) {
+			break
+		}
+		eq := strings.IndexByte(str[i:], '=')
+		if eq <= 0 {
+			err = errors.New("sip: auth param no value")
+			return
+		}
+		key := strings.TrimSpace(str[i : i+eq])
+		i += eq + 1
+		for i < len(str) && (str[i] == ' ' || str[i] == '\t') {
+			i++
+		}
+		param := authParam{key: key}
+		if i < len(str) && str[i] == '"' {
+			var sb strings.Builder
+			i++
+			closed := false
+			for ; i < len(str); i++ {
+				c := str[i]
+				if c == '\\' && i+1 < len(str) {
+					i++
+					sb.WriteByte(str[i])
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(c)
+			}
+			if !closed {
+				err = errors.New("sip: auth param unclosed quote")
+				return
+			}
+			param.value, param.quoted = sb.String(), true
+		} else {
+			end := strings.IndexByte(str[i:], ',')
+			if end < 0 {
+				end = len(str) - i
+			}
+			param.value = strings.TrimSpace(str[i : i+end])
+			i += end
+		}
+		p.value = append(p.value, param)
+	}
+	return
+}
+
+// 拆分认证方案和参数
+func splitScheme(str string) (scheme, params string, err error) {
+	str = strings.TrimSpace(str)
+	i := strings.IndexAny(str, " \t")
+	if i <= 0 {
+		if len(str) == 0 {
+			err = errors.New("sip: auth scheme empty")
+		}
+		return str, "", err
+	}
+	return str[:i], strings.TrimSpace(str[i+1:]), nil
+}
+
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// 认证信息 Authorization、Proxy-Authorization (RFC3261-20.7、20.28)
+type Credentials struct {
+	Scheme    string     // 认证方案，一般为Digest
+	Username  string     // 用户名，IMS中为IMPI
+	Realm     string     // 认证域
+	Nonce     string     // 服务器质询中的nonce
+	URI       string     // 请求的Request-URI
+	Response  string     // 摘要认证结果
+	Algorithm string     // 摘要算法
+	CNonce    string     // 客户端随机数
+	Opaque    string     // 服务器质询中的opaque
+	Qop       string     // 客户端选择的保护质量
+	NC        string     // nonce使用次数
+	Params    AuthParams // 其他参数，如auts、integrity-protected
+}
+
+func ParseCredentials(str string) (c *Credentials, err error) {
+	scheme, params, err := splitScheme(str)
+	if err != nil {
+		return
+	}
+	p, err := parseAuthParams(params)
+	if err != nil {
+		return
+	}
+	c = &Credentials{Scheme: scheme}
+	for _, item := range p.value {
+		switch strings.ToLower(item.key) {
+		case "username":
+			c.Username = item.value
+		case "realm":
+			c.Realm = item.value
+		case "nonce":
+			c.Nonce = item.value
+		case "uri":
+			c.URI = item.value
+		case "response":
+			c.Response = item.value
+		case "algorithm":
+			c.Algorithm = item.value
+		case "cnonce":
+			c.CNonce = item.value
+		case "opaque":
+			c.Opaque = item.value
+		case "qop":
+			c.Qop = item.value
+		case "nc":
+			c.NC = item.value
+		default:
+			c.Params.value = append(c.Params.value, item)
+		}
+	}
+	return
+}
+
+// 字符串表达，Digest方案中username、realm、nonce、uri、response为必选参数，值为空时也输出
+func (c Credentials) String() string {
+	var p AuthParams
+	digest := strings.EqualFold(c.Scheme, SchemeDigest)
+	setQuoted := func(key, value string, required bool) {
+		if len(value) > 0 || required {
+			p.Set(key, value)
+		}
+	}
+	setToken := func(key, value string) {
+		if len(value) > 0 {
+			p.SetToken(key, value)
+		}
+	}
+	setQuoted("username", c.Username, digest)
+	setQuoted("realm", c.Realm, digest)
+	setQuoted("nonce", c.Nonce, digest)
+	setQuoted("uri", c.URI, digest)
+	setQuoted("response", c.Response, digest)
+	setToken("algorithm", c.Algorithm)
+	setQuoted("cnonce", c.CNonce, false)
+	setQuoted("opaque", c.Opaque, false)
+	setToken("qop", c.Qop)
+	setToken("nc", c.NC)
+	p.value = append(p.value, c.Params.value...)
+	return strings.TrimSpace(c.Scheme + " " + p.String())
+}
+
+// 计算摘要认证结果所需的参数
+func (c Credentials) DigestParams(method, body string) DigestParams {
+	return DigestParams{
+		Username: c.Username,
+		Realm:    c.Realm,
+		Nonce:    c.Nonce,
+		URI:      c.URI,
+		Method:   method,
+		Qop:      c.Qop,
+		NC:       c.NC,
+		CNonce:   c.CNonce,
+		Body:     body,
+	}
+}
+
+// 认证质询 WWW-Authenticate、Proxy-Authenticate (RFC3261-20.44、20.27)
+type Challenge struct {
+	Scheme    string     // 认证方案，一般为Digest
+	Realm     string     // 认证域
+	Domain    string     // 保护的URI范围
+	Nonce     string     // 服务器随机数，AKA中为RAND和AUTN
+	Opaque    string     // 客户端需要原样返回的数据
+	Stale     bool       // nonce是否过期
+	Algorithm string     // 摘要算法
+	Qop       []string   // 服务器支持的保护质量
+	Params    AuthParams // 其他参数，如ik、ck
+}
+
+func ParseChallenge(str string) (c *Challenge, err error) {
+	scheme, params, err := splitScheme(str)
+	if err != nil {
+		return
+	}
+	p, err := parseAuthParams(params)
+	if err != nil {
+		return
+	}
+	c = &Challenge{Scheme: scheme}
+	for _, item := range p.value {
+		switch strings.ToLower(item.key) {
+		case "realm":
+			c.Realm = item.value
+		case "domain":
+			c.Domain = item.value
+		case "nonce":
+			c.Nonce = item.value
+		case "opaque":
+			c.Opaque = item.value
+		case "stale":
+			c.Stale = strings.EqualFold(item.value, "true")
+		case "algorithm":
+			c.Algorithm = item.value
+		case "qop":
+			for _, qop := range strings.Split(item.value, ",") {
+				if qop = strings.TrimSpace(qop); len(qop) > 0 {
+					c.Qop = append(c.Qop, qop)
+				}
+			}
+		default:
+			c.Params.value = append(c.Params.value, item)
+		}
+	}
+	return
+}
+
+// 字符串表达，Digest方案中realm和nonce为必选参数
+func (c Challenge) String() string {
+	var p AuthParams
+	digest := strings.EqualFold(c.Scheme, SchemeDigest)
+	if len(c.Realm) > 0 || digest {
+		p.Set("realm", c.Realm)
+	}
+	if len(c.Domain) > 0 {
+		p.Set("domain", c.Domain)
+	}
+	if len(c.Nonce) > 0 || digest {
+		p.Set("nonce", c.Nonce)
+	}
+	if len(c.Opaque) > 0 {
+		p.Set("opaque", c.Opaque)
+	}
+	if c.Stale {
+		p.SetToken("stale", "true")
+	}
+	if len(c.Algorithm) > 0 {
+		p.SetToken("algorithm", c.Algorithm)
+	}
+	if len(c.Qop) > 0 {
+		p.Set("qop", strings.Join(c.Qop, ","))
+	}
+	p.value = append(p.value, c.Params.value...)
+	return strings.TrimSpace(c.Scheme + " " + p.String())
+}
+
+// 是否支持指定的保护质量
+func (c Challenge) SupportQop(qop string) bool {
+	for _, q := range c.Qop {
+		if strings.EqualFold(q, qop) {
+			return true
+		}
+	}
+	return false
+}
+
+// 认证成功后服务器返回的信息 Authentication-Info (RFC3261-20.6)
+type AuthenticationInfo struct {
+	NextNonce string // 下次认证使用的nonce
+	Qop       string // 本次认证的保护质量
+	RspAuth   string // 服务器对客户端的认证结果
+	CNonce    string // 客户端随机数
+	NC        string // nonce使用次数
+}
+
+func ParseAuthenticationInfo(str string) (info *AuthenticationInfo, err error) {
+	p, err := parseAuthParams(str)
+	if err != nil {
+		return
+	}
+	info = new(AuthenticationInfo)
+	info.NextNonce, _ = p.Get("nextnonce")
+	info.Qop, _ = p.Get("qop")
+	info.RspAuth, _ = p.Get("rspauth")
+	info.CNonce, _ = p.Get("cnonce")
+	info.NC, _ = p.Get("nc")
+	return
+}
+
+// 字符串表达
+func (info AuthenticationInfo) String() string {
+	var p AuthParams
+	if len(info.NextNonce) > 0 {
+		p.Set("nextnonce", info.NextNonce)
+	}
+	if len(info.Qop) > 0 {
+		p.SetToken("qop", info.Qop)
+	}
+	if len(info.RspAuth) > 0 {
+		p.Set("rspauth", info.RspAuth)
+	}
+	if len(info.CNonce) > 0 {
+		p.Set("cnonce", info.CNonce)
+	}
+	if len(info.NC) > 0 {
+		p.SetToken("nc", info.NC)
+	}
+	return p.String()
+}
@@ -0,0 +1,103 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCredentials(t *testing.T) {
+	str := `Digest username="jiqimao@hebeiyidong.3gpp.net",realm="hebeiyidong.3gpp.net", nonce="CjzpV0rLoc5LIrVMpSrgwg==", uri="sip:hebeiyidong.3gpp.net", response="", qop=auth-int, nc=00000001, cnonce="a,b=\"c\"", auts="Axbt9KlzBA0MV8MJN1Zw", integrity-protected="no"`
+	c, err := ParseCredentials(str)
+	if err != nil {
+		t.Fatalf("ParseCredentials() error = %v", err)
+	}
+	if c.Scheme != SchemeDigest || c.Username != "jiqimao@hebeiyidong.3gpp.net" || c.Realm != "hebeiyidong.3gpp.net" {
+		t.Errorf("ParseCredentials() = %+v", c)
+	}
+	if c.Nonce != "CjzpV0rLoc5LIrVMpSrgwg==" || c.Qop != QopAuthInt || c.NC != "00000001" || c.CNonce != `a,b="c"` {
+		t.Errorf("ParseCredentials() = %+v", c)
+	}
+	if v, ok := c.Params.Get("AUTS"); !ok || v != "Axbt9KlzBA0MV8MJN1Zw" {
+		t.Errorf("auts = %v, %v", v, ok)
+	}
+	// 空的nonce和response需要保留
+	want := `Digest username="jiqimao@hebeiyidong.3gpp.net", realm="hebeiyidong.3gpp.net", nonce="CjzpV0rLoc5LIrVMpSrgwg==", uri="sip:hebeiyidong.3gpp.net", response="", cnonce="a,b=\"c\"", qop=auth-int, nc=00000001, auts="Axbt9KlzBA0MV8MJN1Zw", integrity-protected="no"`
+	if got := c.String(); got != want {
+		t.Errorf("String() = %v\nwant %v", got, want)
+	}
+	again, err := ParseCredentials(c.String())
+	if err != nil || again.String() != want {
+		t.Errorf("round trip = %v, %v", again, err)
+	}
+
+	for _, bad := range []string{"", `Digest username="abc`, `Digest username`} {
+		if _, err := ParseCredentials(bad); err == nil {
+			t.Errorf("ParseCredentials(%q) want error", bad)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	str := `Digest realm="hebeiyidong.3gpp.net", nonce="CjzpV0rLoc5LIrVMpSrgwg==", stale=TRUE, algorithm=AKAv1-MD5, qop="auth,auth-int", ik="00112233", ck="44556677"`
+	c, err := ParseChallenge(str)
+	if err != nil {
+		t.Fatalf("ParseChallenge() error = %v", err)
+	}
+	if c.Realm != "hebeiyidong.3gpp.net" || !c.Stale || c.Algorithm != AlgorithmAKAv1MD5 {
+		t.Errorf("ParseChallenge() = %+v", c)
+	}
+	if !c.SupportQop(QopAuth) || !c.SupportQop(QopAuthInt) || len(c.Qop) != 2 {
+		t.Errorf("qop = %v", c.Qop)
+	}
+	c.Params.Del("ck")
+	c.Params.Del("ik")
+	want := `Digest realm="hebeiyidong.3gpp.net", nonce="CjzpV0rLoc5LIrVMpSrgwg==", stale=true, algorithm=AKAv1-MD5, qop="auth,auth-int"`
+	if got := c.String(); got != want {
+		t.Errorf("String() = %v\nwant %v", got, want)
+	}
+}
+
+func TestAuthenticationInfo(t *testing.T) {
+	info, err := ParseAuthenticationInfo(`qop=auth, rspauth="6629fae49393a05397450978507c4ef1", cnonce="0a4f113b", nc=00000001`)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Qop != QopAuth || info.RspAuth != "6629fae49393a05397450978507c4ef1" || info.NC != "00000001" {
+		t.Errorf("ParseAuthenticationInfo() = %+v", info)
+	}
+	want := `qop=auth, rspauth="6629fae49393a05397450978507c4ef1", cnonce="0a4f113b", nc=00000001`
+	if got := info.String(); got != want {
+		t.Errorf("String() = %v", got)
+	}
+}
+
+func TestAuthHeaders(t *testing.T) {
+	msg := "SIP/2.0 407 Proxy Authentication Required\r\n" +
+		"Via: SIP/2.0/UDP 10.0.1.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:jiqimao@hebeiyidong.3gpp.net>;tag=1928301774\r\n" +
+		"To: <sip:daxiong@hebeiyidong.3gpp.net>;tag=a6c85cf\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Proxy-Authenticate: Digest realm=\"hebeiyidong.3gpp.net\", nonce=\"abc\", algorithm=MD5\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	m, err := NewMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("NewMessage() error = %v", err)
+	}
+	if m.Header.ProxyAuthenticate == nil || m.Header.ProxyAuthenticate.Nonce != "abc" {
+		t.Fatalf("Proxy-Authenticate = %+v", m.Header.ProxyAuthenticate)
+	}
+	m.Header.ProxyAuthorization = &Credentials{Scheme: SchemeDigest, Username: "jiqimao", Realm: "hebeiyidong.3gpp.net", Nonce: "abc", URI: "sip:daxiong@hebeiyidong.3gpp.net", Response: "00"}
+	m.Header.AuthenticationInfo = &AuthenticationInfo{NextNonce: "def"}
+	out := m.String()
+	for _, line := range []string{
+		`Proxy-Authenticate: Digest realm="hebeiyidong.3gpp.net", nonce="abc", algorithm=MD5`,
+		`Proxy-Authorization: Digest username="jiqimao", realm="hebeiyidong.3gpp.net", nonce="abc", uri="sip:daxiong@hebeiyidong.3gpp.net", response="00"`,
+		`Authentication-Info: nextnonce="def"`,
+	} {
+		if !strings.Contains(out, line+CRLF) {
+			t.Errorf("message missing %q:\n%v", line, out)
+		}
+	}
+}
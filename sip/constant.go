@@ -7,6 +7,9 @@ const (
 	// 协议类型
 	SchemeSip = "sip"
 
+	// 事务标识branch的固定前缀(RFC3261-8.1.1.7)
+	BranchMagicCookie = "z9hG4bK"
+
 	// SIP请求方法-RFC3261
 	MethodInvite   = "INVITE"
 	MethodAck      = "ACK"
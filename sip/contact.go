@@ -0,0 +1,115 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+)
+
+// 联系地址列表，注册请求和应答中可以包含多个联系地址(RFC3261-10.2.1)
+// 注销全部联系地址时使用"*"(RFC3261-10.2.2)
+type ContactList struct {
+	value    []User // 实际的值
+	wildcard bool   // 是否为"*"
+}
+
+// 解析一行Contact，一行中可以包含逗号分隔的多个联系地址
+func parseContact(str string, oldValue ContactList) (newValue ContactList, err error) {
+	newValue = oldValue
+	str = strings.TrimSpace(str)
+	if str == "*" {
+		newValue.wildcard = true
+		return
+	}
+	for _, part := range splitContact(str) {
+		var item User
+		if strings.Contains(part, "<") {
+			item, err = parseUser(part)
+		} else {
+			// 没有尖括号时分号后的参数属于头域而不是URI(RFC3261-20)
+			params := ""
+			if i := strings.Index(part, ";"); i >= 0 {
+				part, params = part[:i], part[i:]
+			}
+			item.URI, err = NewURI(part)
+			item.Arguments = parseArgs(params)
+		}
+		if err != nil {
+			return
+		}
+		newValue.value = append(newValue.value, item)
+	}
+	if len(newValue.value) == 0 {
+		err = errors.New("sip: contact empty")
+	}
+	return
+}
+
+// 按逗号拆分联系地址，忽略引号和尖括号中的逗号
+func splitContact(str string) (parts []string) {
+	quoted, angle, start := false, false, 0
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			angle = true
+		case c == '>':
+			angle = false
+		case c == ',' && !angle:
+			if part := strings.TrimSpace(str[start:i]); len(part) > 0 {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(str[start:]); len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return
+}
+
+// 获取第一条记录
+func (c ContactList) FirstItem() (item User, isExist bool) {
+	if len(c.value) == 0 {
+		return
+	}
+	return c.value[0], true
+}
+
+// 全部记录
+func (c ContactList) Items() []User {
+	return c.value
+}
+
+// 记录数量
+func (c ContactList) Len() int {
+	return len(c.value)
+}
+
+// 是否为"*"
+func (c ContactList) IsWildcard() bool {
+	return c.wildcard
+}
+
+// 添加记录
+func (c *ContactList) Add(items ...User) {
+	c.value = append(c.value, items...)
+}
+
+// 清空全部记录
+func (c *ContactList) Reset() {
+	c.value, c.wildcard = nil, false
+}
+
+// 每个联系地址一行
+func (c ContactList) lines() []string {
+	if c.wildcard {
+		return []string{"*"}
+	}
+	lines := make([]string, 0, len(c.value))
+	for _, item := range c.value {
+		lines = append(lines, item.String())
+	}
+	return lines
+}
@@ -0,0 +1,67 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+const testContactRegister = `REGISTER sip:hebeiyidong.3gpp.net SIP/2.0
+Via: SIP/2.0/UDP 192.168.0.100:45508;branch=z9hG4bK1158493fb1e25c83f14f5e7ee368;rport
+From: <sip:1011@hebeiyidong.3gpp.net>;tag=22365c3a331
+To: <sip:1011@hebeiyidong.3gpp.net>
+Call-ID: 93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100
+CSeq: 2 REGISTER
+Max-Forwards: 70
+Contact: "ue, 1" <sip:1011@192.168.0.100:45508>;expires=600, <sip:1011@10.0.0.1:5060>
+m: sip:1011@10.0.0.2:5060;expires=0
+Expires: 3600
+Content-Length: 0
+
+`
+
+func TestContactList(t *testing.T) {
+	req := mustParse(t, testContactRegister)
+	contacts := req.Header.Contact.Items()
+	if len(contacts) != 3 || req.Header.Contact.IsWildcard() {
+		t.Fatalf("contacts = %v", contacts)
+	}
+	if contacts[0].DisplayName != "ue, 1" || contacts[0].URI.Domain != "192.168.0.100:45508" {
+		t.Errorf("first contact = %v", contacts[0])
+	}
+	if v, _ := contacts[0].Arguments.Get("expires"); v != "600" {
+		t.Errorf("first contact expires = %v", v)
+	}
+	// 没有尖括号时参数属于头域
+	if v, err := contacts[2].Arguments.Get("expires"); err != nil || v != "0" || contacts[2].URI.Domain != "10.0.0.2:5060" {
+		t.Errorf("third contact = %v", contacts[2])
+	}
+	if e, ok := req.Header.Expires.Value(); !ok || e != 3600 {
+		t.Errorf("expires = %v %v", e, ok)
+	}
+	if n := strings.Count(req.String(), "Contact: "); n != 3 {
+		t.Errorf("contact lines = %d, want 3", n)
+	}
+
+	wildcard := mustParse(t, strings.Replace(testContactRegister, `Contact: "ue, 1" <sip:1011@192.168.0.100:45508>;expires=600, <sip:1011@10.0.0.1:5060>
+m: sip:1011@10.0.0.2:5060;expires=0
+Expires: 3600`, "Contact: *\nExpires: 0", 1))
+	if !wildcard.Header.Contact.IsWildcard() || !wildcard.Header.Expires.IsRequestLogOut() {
+		t.Fatalf("wildcard contact not parsed")
+	}
+	if !strings.Contains(wildcard.String(), "Contact: *"+CRLF) {
+		t.Errorf("wildcard contact string = %v", wildcard.String())
+	}
+}
+
+func TestMinExpires(t *testing.T) {
+	req := mustParse(t, testContactRegister)
+	resp := NewResponse(StatusIntervalTooBrief, req)
+	resp.Header.MinExpires = NewExpires(60)
+	parsed, err := NewMessage(strings.NewReader(resp.String()))
+	if err != nil {
+		t.Fatalf("parse response error = %v", err)
+	}
+	if e, ok := parsed.Header.MinExpires.Value(); !ok || e != 60 {
+		t.Errorf("min expires = %v %v", e, ok)
+	}
+}
@@ -0,0 +1,231 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 对话状态(RFC3261-12)
+type DialogState int
+
+const (
+	DialogEarly      DialogState = iota // 收到带To标签的临时应答
+	DialogConfirmed                     // 收到2xx应答
+	DialogTerminated                    // 对话结束
+)
+
+// 字符串表达
+func (s DialogState) String() string {
+	switch s {
+	case DialogEarly:
+		return "Early"
+	case DialogConfirmed:
+		return "Confirmed"
+	default:
+		return "Terminated"
+	}
+}
+
+// 对话标识(RFC3261-12)：Call-ID + 本端标签 + 对端标签
+type DialogID struct {
+	CallID    string
+	LocalTag  string
+	RemoteTag string
+}
+
+// 字符串表达
+func (id DialogID) String() string {
+	return fmt.Sprintf("%s;local=%s;remote=%s", id.CallID, id.LocalTag, id.RemoteTag)
+}
+
+// SIP对话，代理节点统一站在主叫(UAC)一侧描述对话，本端为主叫，对端为被叫
+type Dialog struct {
+	sync.Mutex
+	ID           DialogID
+	State        DialogState
+	LocalURI     URI    // 主叫地址(From)
+	RemoteURI    URI    // 被叫地址(To)
+	LocalTarget  URI    // 主叫的Contact
+	RemoteTarget URI    // 被叫的Contact
+	RouteSet     []User // 主叫一侧的路由集合，即应答中Record-Route的逆序
+	LocalSeq     int    // 主叫发出请求的CSeq序列号
+	RemoteSeq    int    // 被叫发出请求的CSeq序列号
+}
+
+// 对话是否已确认
+func (d *Dialog) IsConfirmed() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.State == DialogConfirmed
+}
+
+// 被叫一侧的路由集合，即应答中Record-Route的顺序
+func (d *Dialog) RemoteRouteSet() []User {
+	d.Lock()
+	defer d.Unlock()
+	result := make([]User, 0, len(d.RouteSet))
+	for i := len(d.RouteSet) - 1; i >= 0; i-- {
+		result = append(result, d.RouteSet[i])
+	}
+	return result
+}
+
+// 校验对话内请求的CSeq序列号并更新(RFC3261-12.2.2)，ACK和CANCEL沿用INVITE的序列号不做校验
+func (d *Dialog) CheckRequest(req *Message, fromCaller bool) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.State == DialogTerminated {
+		return errors.New("sip: dialog terminated")
+	}
+	method := req.RequestLine.Method
+	if method == MethodAck || method == MethodCancel {
+		return nil
+	}
+	seq := &d.RemoteSeq
+	if fromCaller {
+		seq = &d.LocalSeq
+	}
+	if *seq != 0 && req.Header.CSeq.CSeq <= *seq {
+		return errors.New("sip: dialog request cseq out of order")
+	}
+	*seq = req.Header.CSeq.CSeq
+	// INVITE和UPDATE可以刷新对端的目标地址(RFC3311-5.2)
+	if contact, ok := req.Header.Contact.FirstItem(); ok && (method == MethodInvite || method == MethodUpdate) {
+		if fromCaller {
+			d.LocalTarget = contact.URI
+		} else {
+			d.RemoteTarget = contact.URI
+		}
+	}
+	return nil
+}
+
+// 对话集合，以对话标识管理当前存在的全部对话
+type DialogSet struct {
+	sync.Mutex
+	dialogs map[DialogID]*Dialog
+}
+
+func NewDialogSet() *DialogSet {
+	return &DialogSet{
+		dialogs: make(map[DialogID]*Dialog),
+	}
+}
+
+// 根据INVITE的1xx/2xx应答创建或更新对话，非2xx最终应答结束对应的早期对话
+func (ds *DialogSet) UpdateWithResponse(resp *Message) *Dialog {
+	if !resp.IsResponse || resp.Header.CSeq.Method != MethodInvite {
+		return nil
+	}
+	id, err := dialogIDFromMessage(resp)
+	if err != nil {
+		return nil
+	}
+	code := resp.ResponseLine.StatusCode
+	ds.Lock()
+	defer ds.Unlock()
+	d, ok := ds.dialogs[id]
+	if code >= 300 {
+		if ok {
+			d.Lock()
+			if d.State == DialogEarly {
+				d.State = DialogTerminated
+				delete(ds.dialogs, id)
+			}
+			d.Unlock()
+		}
+		return nil
+	}
+	if code < 101 {
+		return nil
+	}
+	if !ok {
+		d = &Dialog{
+			ID:        id,
+			State:     DialogEarly,
+			LocalURI:  resp.Header.From.URI,
+			RemoteURI: resp.Header.To.URI,
+			LocalSeq:  resp.Header.CSeq.CSeq,
+		}
+		for _, rr := range resp.Header.RecordRoute.Items() {
+			d.RouteSet = append([]User{rr}, d.RouteSet...)
+		}
+		ds.dialogs[id] = d
+	}
+	d.Lock()
+	defer d.Unlock()
+	if contact, ok := resp.Header.Contact.FirstItem(); ok {
+		d.RemoteTarget = contact.URI
+	}
+	if code >= 200 {
+		d.State = DialogConfirmed
+	}
+	return d
+}
+
+// 匹配对话内请求所属的对话，fromCaller表示请求是否由主叫发出
+func (ds *DialogSet) Match(req *Message) (d *Dialog, fromCaller bool) {
+	id, err := dialogIDFromMessage(req)
+	if err != nil {
+		return nil, false
+	}
+	ds.Lock()
+	defer ds.Unlock()
+	if d, ok := ds.dialogs[id]; ok {
+		return d, true
+	}
+	reverse := DialogID{CallID: id.CallID, LocalTag: id.RemoteTag, RemoteTag: id.LocalTag}
+	if d, ok := ds.dialogs[reverse]; ok {
+		return d, false
+	}
+	return nil, false
+}
+
+// 查找Call-ID对应的全部对话
+func (ds *DialogSet) FindByCallID(callID string) (result []*Dialog) {
+	ds.Lock()
+	defer ds.Unlock()
+	for id, d := range ds.dialogs {
+		if id.CallID == callID {
+			result = append(result, d)
+		}
+	}
+	return
+}
+
+// 结束对话
+func (ds *DialogSet) Terminate(d *Dialog) {
+	d.Lock()
+	d.State = DialogTerminated
+	id := d.ID
+	d.Unlock()
+	ds.Lock()
+	defer ds.Unlock()
+	delete(ds.dialogs, id)
+}
+
+// 对话数量
+func (ds *DialogSet) Len() int {
+	ds.Lock()
+	defer ds.Unlock()
+	return len(ds.dialogs)
+}
+
+// 从消息中获取对话标识，From标签为主叫标签，To标签为被叫标签
+func dialogIDFromMessage(msg *Message) (id DialogID, err error) {
+	fromTag, err := msg.Header.From.Arguments.Get("tag")
+	if err != nil {
+		return
+	}
+	toTag, err := msg.Header.To.Arguments.Get("tag")
+	if err != nil {
+		return
+	}
+	id = DialogID{
+		CallID:    msg.Header.CallID,
+		LocalTag:  fromTag,
+		RemoteTag: toTag,
+	}
+	return
+}
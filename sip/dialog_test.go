@@ -0,0 +1,84 @@
+package sip
+
+import (
+	"testing"
+)
+
+const testRinging = `SIP/2.0 180 Ringing
+Via: SIP/2.0/UDP 192.168.0.100:45508;branch=z9hG4bK1158493fb1e25c83f14f5e7ee368;rport
+Record-Route: <sip:s-cscf.hebeiyidong.3gpp.net:54323;lr>
+Record-Route: <sip:p-cscf.hebeiyidong.3gpp.net:54321;lr>
+From: "1011" <sip:1011@hebeiyidong.3gpp.net>;tag=22365c3a331
+To: "1010" <sip:1010@hebeiyidong.3gpp.net>;tag=291589446
+Call-ID: 93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100
+CSeq: 1 INVITE
+Contact: <sip:1010@192.168.0.102:5060>
+Max-Forwards: 70
+Content-Length: 0
+
+`
+
+const testUpdateFromCallee = `UPDATE sip:1011@192.168.0.100:45508 SIP/2.0
+Via: SIP/2.0/UDP 192.168.0.102:5060;branch=z9hG4bK2158493fb1e25c83f14f5e7ee368
+From: "1010" <sip:1010@hebeiyidong.3gpp.net>;tag=291589446
+To: "1011" <sip:1011@hebeiyidong.3gpp.net>;tag=22365c3a331
+Call-ID: 93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100
+CSeq: 5 UPDATE
+Contact: <sip:1010@192.168.0.103:5060>
+Max-Forwards: 70
+Content-Length: 0
+
+`
+
+func TestDialogLifecycle(t *testing.T) {
+	ds := NewDialogSet()
+	ringing := mustParse(t, testRinging)
+
+	d := ds.UpdateWithResponse(ringing)
+	if d == nil || d.State != DialogEarly {
+		t.Fatalf("180 with to tag should create early dialog")
+	}
+	if d.RemoteTarget.Domain != "192.168.0.102:5060" {
+		t.Errorf("remote target = %v, want callee contact", d.RemoteTarget.String())
+	}
+	if len(d.RouteSet) != 2 || d.RouteSet[0].URI.Domain != "p-cscf.hebeiyidong.3gpp.net:54321" {
+		t.Errorf("route set should be reversed record-route, got %v", d.RouteSet)
+	}
+
+	ok := mustParse(t, testRinging)
+	ok.ResponseLine = NewResponseLineWithStatusCode(StatusOK)
+	if d2 := ds.UpdateWithResponse(ok); d2 != d || d.State != DialogConfirmed {
+		t.Errorf("2xx should confirm the early dialog")
+	}
+
+	update := mustParse(t, testUpdateFromCallee)
+	md, fromCaller := ds.Match(update)
+	if md != d || fromCaller {
+		t.Fatalf("update from callee should match dialog in reverse direction")
+	}
+	if err := md.CheckRequest(update, fromCaller); err != nil {
+		t.Errorf("first request from callee error = %v", err)
+	}
+	if d.RemoteTarget.Domain != "192.168.0.103:5060" {
+		t.Errorf("update should refresh remote target, got %v", d.RemoteTarget.String())
+	}
+	if err := md.CheckRequest(update, fromCaller); err == nil {
+		t.Errorf("request with old cseq should be rejected")
+	}
+
+	ds.Terminate(d)
+	if ds.Len() != 0 {
+		t.Errorf("dialog should be removed after terminate")
+	}
+}
+
+func TestDialogEarlyTerminated(t *testing.T) {
+	ds := NewDialogSet()
+	ds.UpdateWithResponse(mustParse(t, testRinging))
+	busy := mustParse(t, testRinging)
+	busy.ResponseLine = NewResponseLineWithStatusCode(StatusBusyHere)
+	ds.UpdateWithResponse(busy)
+	if ds.Len() != 0 {
+		t.Errorf("non-2xx final response should terminate early dialog")
+	}
+}
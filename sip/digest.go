@@ -0,0 +1,70 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// 摘要认证算法
+const (
+	AlgorithmMD5      = "MD5"       // [RFC2617]
+	AlgorithmAKAv1MD5 = "AKAv1-MD5" // [RFC3310]
+	AlgorithmAKAv2MD5 = "AKAv2-MD5" // [RFC4169]
+)
+
+// 摘要认证的保护质量
+const (
+	QopAuth    = "auth"
+	QopAuthInt = "auth-int"
+)
+
+// 计算摘要认证响应所需的参数(RFC2617-3.2.2)
+type DigestParams struct {
+	Username string
+	Realm    string
+	Nonce    string
+	URI      string
+	Method   string
+	Qop      string // 为空时使用RFC2069的计算方式
+	NC       string
+	CNonce   string
+	Body     string // qop为auth-int时参与计算
+}
+
+// AKA摘要认证使用的口令，AKAv1直接使用RES，AKAv2使用RES、IK、CK派生(RFC4169-3)
+func AKAPassword(algorithm string, res, ik, ck []byte) ([]byte, error) {
+	switch strings.ToUpper(algorithm) {
+	case strings.ToUpper(AlgorithmAKAv1MD5):
+		return res, nil
+	case strings.ToUpper(AlgorithmAKAv2MD5):
+		key := make([]byte, 0, len(res)+len(ik)+len(ck))
+		key = append(append(append(key, res...), ik...), ck...)
+		mac := hmac.New(md5.New, key)
+		mac.Write([]byte("http-digest-akav2-password"))
+		return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil))), nil
+	}
+	return nil, errors.New("ErrUnsupportedAlgorithm")
+}
+
+// 计算摘要认证的response，结果为小写十六进制
+func DigestResponse(p DigestParams, password []byte) string {
+	ha1 := md5Hex(p.Username + ":" + p.Realm + ":" + string(password))
+	a2 := p.Method + ":" + p.URI
+	if p.Qop == QopAuthInt {
+		a2 += ":" + md5Hex(p.Body)
+	}
+	ha2 := md5Hex(a2)
+	if len(p.Qop) == 0 {
+		return md5Hex(ha1 + ":" + p.Nonce + ":" + ha2)
+	}
+	return md5Hex(ha1 + ":" + p.Nonce + ":" + p.NC + ":" + p.CNonce + ":" + p.Qop + ":" + ha2)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
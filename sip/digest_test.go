@@ -0,0 +1,49 @@
+package sip
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDigestResponse(t *testing.T) {
+	// RFC2617-3.5 示例
+	p := DigestParams{
+		Username: "Mufasa",
+		Realm:    "testrealm@host.com",
+		Nonce:    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		URI:      "/dir/index.html",
+		Method:   "GET",
+		Qop:      QopAuth,
+		NC:       "00000001",
+		CNonce:   "0a4f113b",
+	}
+	if got := DigestResponse(p, []byte("Circle Of Life")); got != "6629fae49393a05397450978507c4ef1" {
+		t.Errorf("DigestResponse() = %v", got)
+	}
+	// auth-int 对空消息体计算
+	p.Qop = QopAuthInt
+	if DigestResponse(p, []byte("Circle Of Life")) == "6629fae49393a05397450978507c4ef1" {
+		t.Errorf("auth-int response should differ from auth")
+	}
+}
+
+func TestAKAPassword(t *testing.T) {
+	res, _ := hex.DecodeString("a54211d5e3ba50bf")
+	ik, _ := hex.DecodeString("f769bcd751044604127672711c6d3441")
+	ck, _ := hex.DecodeString("b40ba9a3c58b2a05bbf0d987b21bf8cb")
+	v1, err := AKAPassword(AlgorithmAKAv1MD5, res, ik, ck)
+	if err != nil || string(v1) != string(res) {
+		t.Fatalf("AKAv1 password = %x, %v", v1, err)
+	}
+	v2, err := AKAPassword("akav2-md5", res, ik, ck)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// base64(HMAC-MD5(RES||IK||CK, "http-digest-akav2-password"))
+	if string(v2) != "shzt3q8CWaZnCAWqs3WmEQ==" {
+		t.Fatalf("AKAv2 password = %s", v2)
+	}
+	if _, err = AKAPassword(AlgorithmMD5, res, ik, ck); err == nil {
+		t.Fatalf("want error for non AKA algorithm")
+	}
+}
@@ -0,0 +1,99 @@
+package sip
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// 事件包
+const (
+	EventReg = "reg" // 注册状态事件包(RFC3680)
+)
+
+// 订阅状态(RFC6665-4.1.3)
+const (
+	SubscriptionActive     = "active"
+	SubscriptionPending    = "pending"
+	SubscriptionTerminated = "terminated"
+)
+
+// 订阅终止的原因(RFC6665-4.1.3)
+const (
+	ReasonDeactivated = "deactivated"
+	ReasonTimeout     = "timeout"
+	ReasonRejected    = "rejected"
+	ReasonNoResource  = "noresource"
+)
+
+// 事件头域(RFC6665-8.2.1)
+// Example：reg;id=1
+type Event struct {
+	Type      string // 事件包名称
+	Arguments Args   // 参数，如id
+}
+
+func parseEvent(str string) (item *Event, err error) {
+	str = strings.TrimSpace(str)
+	typ := str
+	if i := strings.Index(str, ";"); i >= 0 {
+		typ = str[:i]
+	}
+	typ = strings.TrimSpace(typ)
+	if len(typ) == 0 {
+		err = errors.New("sip: event type empty")
+		return
+	}
+	item = &Event{Type: typ, Arguments: parseArgs(str)}
+	return
+}
+
+// 字符串表达
+func (e Event) String() string {
+	return e.Type + e.Arguments.String()
+}
+
+// 订阅状态头域(RFC6665-8.2.3)
+// Example：active;expires=600、terminated;reason=deactivated
+type SubscriptionState struct {
+	State   string // 订阅状态
+	Expires int    // 订阅剩余的有效时间(秒)，只用于active和pending
+	Reason  string // 订阅终止的原因
+}
+
+func parseSubscriptionState(str string) (item *SubscriptionState, err error) {
+	str = strings.TrimSpace(str)
+	state := str
+	if i := strings.Index(str, ";"); i >= 0 {
+		state = str[:i]
+	}
+	item = &SubscriptionState{State: strings.ToLower(strings.TrimSpace(state))}
+	if len(item.State) == 0 {
+		return nil, errors.New("sip: subscription state empty")
+	}
+	args := parseArgs(str)
+	if v, e := args.Get("expires"); e == nil {
+		if item.Expires, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	item.Reason, _ = args.Get("reason")
+	return
+}
+
+// 字符串表达
+func (s SubscriptionState) String() string {
+	result := s.State
+	if s.State != SubscriptionTerminated {
+		result += ";expires=" + strconv.Itoa(s.Expires)
+	}
+	if len(s.Reason) > 0 {
+		result += ";reason=" + s.Reason
+	}
+	return result
+}
+
+// 订阅是否已终止
+func (s SubscriptionState) IsTerminated() bool {
+	return s.State == SubscriptionTerminated
+}
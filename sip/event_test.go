@@ -0,0 +1,61 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEventHeaders(t *testing.T) {
+	req := mustParse(t, strings.Replace(testContactRegister, "Expires: 3600", "Event: reg;id=7\nSubscription-State: active;expires=600", 1))
+	if req.Header.Event == nil || req.Header.Event.Type != EventReg {
+		t.Fatalf("event = %v", req.Header.Event)
+	}
+	if id, _ := req.Header.Event.Arguments.Get("id"); id != "7" {
+		t.Errorf("event id = %v", id)
+	}
+	state := req.Header.SubscriptionState
+	if state == nil || state.State != SubscriptionActive || state.Expires != 600 || state.IsTerminated() {
+		t.Fatalf("subscription state = %+v", state)
+	}
+	str := req.String()
+	if !strings.Contains(str, "Event: reg;id=7"+CRLF) || !strings.Contains(str, "Subscription-State: active;expires=600"+CRLF) {
+		t.Errorf("message string = %v", str)
+	}
+	terminated, err := parseSubscriptionState("terminated;reason=noresource")
+	if err != nil || !terminated.IsTerminated() || terminated.Reason != ReasonNoResource {
+		t.Fatalf("terminated state = %+v, %v", terminated, err)
+	}
+	if terminated.String() != "terminated;reason=noresource" {
+		t.Errorf("terminated string = %v", terminated.String())
+	}
+}
+
+func TestRegInfo(t *testing.T) {
+	info := RegInfo{
+		Version: 1,
+		State:   RegInfoFull,
+		Registrations: []Registration{{
+			AOR:   "sip:1011@hebeiyidong.3gpp.net",
+			ID:    "a7",
+			State: RegStateActive,
+			Contacts: []RegContact{
+				{ID: "76", State: RegStateActive, Event: RegEventRegistered, Expires: 3600, URI: "sip:1011@192.168.0.100:45508"},
+				{ID: "77", State: RegStateTerminated, Event: RegEventExpired, URI: "sip:1011@10.0.0.1:5060"},
+			},
+		}},
+	}
+	str := info.String()
+	if !strings.Contains(str, `xmlns="urn:ietf:params:xml:ns:reginfo"`) || !strings.Contains(str, `event="expired"`) {
+		t.Errorf("reginfo = %v", str)
+	}
+	parsed, err := ParseRegInfo(str)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if parsed.Version != 1 || len(parsed.Registrations) != 1 || len(parsed.Registrations[0].Contacts) != 2 {
+		t.Fatalf("parsed reginfo = %+v", parsed)
+	}
+	if c := parsed.Registrations[0].Contacts[0]; c.Expires != 3600 || c.URI != "sip:1011@192.168.0.100:45508" {
+		t.Errorf("contact = %+v", c)
+	}
+}
@@ -21,6 +21,18 @@ func parseExpires(str string) (item Expires, err error) {
 	return
 }
 
+func NewExpires(seconds int) Expires {
+	return Expires{value: &seconds}
+}
+
+// 获取过期时间(秒)，未设置时返回false
+func (e Expires) Value() (int, bool) {
+	if e.value == nil {
+		return 0, false
+	}
+	return *(e.value), true
+}
+
 // 是否是注销请求
 func (e Expires) IsRequestLogOut() bool {
 	return e.value != nil && *(e.value) == 0
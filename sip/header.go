@@ -11,24 +11,31 @@ import (
 // 行范式：header = "header-name" HCOLON header-value *(COMMA header-value)
 // 头域至少包含TO、FROM、CSeq、Call-ID、Max-Forwards、Via字段
 type Header struct {
-	Via               ViaList     // (RFC3261-8.1.1.7) 请求路径
-	From              User        // (RFC3261-8.1.1.3) 请求的原始发起者
-	To                User        // (RFC3261-8.1.1.2) 请求的原始到达者
-	CallID            string      // (RFC3261-8.1.1.4) 唯一标志
-	CSeq              CSeq        // (RFC3261-8.1.1.5) 命令序列号
-	MaxForwards       MaxForwards // (RFC3261-8.1.1.6) 最大转发数量限制
-	AccessNetworkInfo string      // (可选) UE终端无线接入点eNodeB标识信息
-	ContentLength     int         // 正文长度
-	ContentType       string      // (可选) 正文格式描述
-	Contact           *User       // (可选) (RFC3261-8.1.1.8) 直接访问方式
-	Expires           Expires     // (可选) 消息或内容过期时间
-	Route             Route       // (可选) 请求的路由表
-	RecordRoute       RecordRoute // (可选) 后续消息流处理的服务器列表
-	UserAgent         string      // (可选) UAC的信息
-	Authorization     string      // (可选) 用户认证信息
-	WWWAuthenticate   string      // (可选) 支持的认证方式和适用realm的参数的拒绝原因
-	ServiceRoute      string
-	UnsupportLines    []string // 暂不支持的行
+	Via                ViaList             // (RFC3261-8.1.1.7) 请求路径
+	From               User                // (RFC3261-8.1.1.3) 请求的原始发起者
+	To                 User                // (RFC3261-8.1.1.2) 请求的原始到达者
+	CallID             string              // (RFC3261-8.1.1.4) 唯一标志
+	CSeq               CSeq                // (RFC3261-8.1.1.5) 命令序列号
+	MaxForwards        MaxForwards         // (RFC3261-8.1.1.6) 最大转发数量限制
+	AccessNetworkInfo  string              // (可选) UE终端无线接入点eNodeB标识信息
+	ContentLength      int                 // 正文长度
+	ContentType        string              // (可选) 正文格式描述
+	Contact            ContactList         // (可选) (RFC3261-8.1.1.8) 直接访问方式，注册时可以有多个
+	Expires            Expires             // (可选) 消息或内容过期时间
+	MinExpires         Expires             // (可选) (RFC3261-20.23) 注册间隔过短时服务器支持的最小过期时间
+	Route              Route               // (可选) 请求的路由表
+	RecordRoute        RecordRoute         // (可选) 后续消息流处理的服务器列表
+	UserAgent          string              // (可选) UAC的信息
+	Authorization      *Credentials        // (可选) 用户认证信息
+	ProxyAuthorization *Credentials        // (可选) 用户向代理提供的认证信息
+	WWWAuthenticate    *Challenge          // (可选) 支持的认证方式和适用realm的参数的拒绝原因
+	ProxyAuthenticate  *Challenge          // (可选) 代理发起的认证质询
+	AuthenticationInfo *AuthenticationInfo // (可选) 认证成功后服务器返回的信息
+	Path               Route               // (可选) (RFC3327) 注册请求经过的代理列表
+	ServiceRoute       Route               // (可选) (RFC3608) 注册成功后UE发起请求的预加载路由
+	Event              *Event              // (可选) (RFC6665-8.2.1) 订阅和通知的事件包
+	SubscriptionState  *SubscriptionState  // (可选) (RFC6665-8.2.3) NOTIFY中的订阅状态
+	UnsupportLines     []string            // 暂不支持的行
 }
 
 // 设置To的标签为From标签
@@ -59,25 +66,43 @@ func (h Header) String() (result string) {
 	if len(h.ContentType) > 0 {
 		result += h.lineString(HeaderFieldContentType.Name, h.ContentType)
 	}
-	if h.Contact != nil {
-		result += h.lineString(HeaderFieldContact.Name, h.Contact.String())
+	for _, contact := range h.Contact.lines() {
+		result += h.lineString(HeaderFieldContact.Name, contact)
 	}
 	result += h.lineString(HeaderFieldExpires.Name, h.Expires.String())
+	result += h.lineString(HeaderFieldMinExpires.Name, h.MinExpires.String())
 	if len(h.UserAgent) > 0 {
 		result += h.lineString(HeaderFieldUserAgent.Name, h.UserAgent)
 	}
-	if len(h.Authorization) > 0 {
-		result += h.lineString(HeaderFieldAuthorization.Name, h.Authorization)
+	if h.Authorization != nil {
+		result += h.lineString(HeaderFieldAuthorization.Name, h.Authorization.String())
 	}
-	if len(h.WWWAuthenticate) > 0 {
-		result += h.lineString(HeaderFieldWWWAuthenticate.Name, h.WWWAuthenticate)
+	if h.ProxyAuthorization != nil {
+		result += h.lineString(HeaderFieldProxyAuthorization.Name, h.ProxyAuthorization.String())
+	}
+	if h.WWWAuthenticate != nil {
+		result += h.lineString(HeaderFieldWWWAuthenticate.Name, h.WWWAuthenticate.String())
+	}
+	if h.ProxyAuthenticate != nil {
+		result += h.lineString(HeaderFieldProxyAuthenticate.Name, h.ProxyAuthenticate.String())
+	}
+	if h.AuthenticationInfo != nil {
+		result += h.lineString(HeaderFieldAuthenticationInfo.Name, h.AuthenticationInfo.String())
 	}
 	if len(h.AccessNetworkInfo) > 0 {
 		result += h.lineString(HeaderFieldAccessNetworkInfo.Name, h.AccessNetworkInfo)
 	}
-	if len(h.ServiceRoute) > 0 {
-		result += h.lineString(HeaderFieldServiceRoute.Name, h.ServiceRoute)
-
+	for _, path := range h.Path.value {
+		result += h.lineString(HeaderFieldPath.Name, path.String())
+	}
+	for _, serviceRoute := range h.ServiceRoute.value {
+		result += h.lineString(HeaderFieldServiceRoute.Name, serviceRoute.String())
+	}
+	if h.Event != nil {
+		result += h.lineString(HeaderFieldEvent.Name, h.Event.String())
+	}
+	if h.SubscriptionState != nil {
+		result += h.lineString(HeaderFieldSubscriptionState.Name, h.SubscriptionState.String())
 	}
 	for _, line := range h.UnsupportLines {
 		result += h.emptyLineString(line)
@@ -85,6 +110,21 @@ func (h Header) String() (result string) {
 	return
 }
 
+// 按名称查询头域的值，名称不区分大小写，同名的多行依次返回，用于iFC按名称匹配头域
+func (h Header) Values(name string) (values []string) {
+	for _, line := range strings.Split(h.String(), CRLF) {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if strings.EqualFold(key, name) {
+			values = append(values, strings.TrimSpace(line[i+1:]))
+		}
+	}
+	return
+}
+
 // 解析消息头的单个行
 func (h *Header) parse(line string) (err error) {
 	// 解析冒号的位置
@@ -114,27 +154,37 @@ func (h *Header) parse(line string) (err error) {
 	case HeaderFieldContentType.LowerName(), HeaderFieldContentType.Abbr:
 		h.ContentType = value
 	case HeaderFieldContact.LowerName(), HeaderFieldContact.Abbr:
-		if contact, e := parseUser(value); e != nil {
-			err = e
-		} else {
-			h.Contact = &contact
-		}
+		h.Contact, err = parseContact(value, h.Contact)
 	case HeaderFieldExpires.LowerName(), HeaderFieldExpires.Abbr:
 		h.Expires, err = parseExpires(value)
+	case HeaderFieldMinExpires.LowerName():
+		h.MinExpires, err = parseExpires(value)
 	case HeaderFieldRoute.LowerName(), HeaderFieldRoute.Abbr:
 		h.Route, err = parseRoute(value, h.Route)
 	case HeaderFieldRecordRoute.LowerName(), HeaderFieldRecordRoute.Abbr:
 		h.RecordRoute, err = parseRecordRoute(value, h.RecordRoute)
 	case HeaderFieldUserAgent.LowerName(), HeaderFieldUserAgent.Abbr:
 		h.UserAgent = value
-	case HeaderFieldAuthorization.LowerName(), HeaderFieldAuthorization.Abbr:
-		h.Authorization = value
-	case HeaderFieldWWWAuthenticate.LowerName(), HeaderFieldWWWAuthenticate.Abbr:
-		h.WWWAuthenticate = value
+	case HeaderFieldAuthorization.LowerName():
+		h.Authorization, err = ParseCredentials(value)
+	case HeaderFieldProxyAuthorization.LowerName():
+		h.ProxyAuthorization, err = ParseCredentials(value)
+	case HeaderFieldWWWAuthenticate.LowerName():
+		h.WWWAuthenticate, err = ParseChallenge(value)
+	case HeaderFieldProxyAuthenticate.LowerName():
+		h.ProxyAuthenticate, err = ParseChallenge(value)
+	case HeaderFieldAuthenticationInfo.LowerName():
+		h.AuthenticationInfo, err = ParseAuthenticationInfo(value)
 	case HeaderFieldAccessNetworkInfo.LowerName():
 		h.AccessNetworkInfo = value
+	case HeaderFieldPath.LowerName():
+		h.Path, err = parseRoute(value, h.Path)
 	case HeaderFieldServiceRoute.LowerName():
-		h.ServiceRoute = value
+		h.ServiceRoute, err = parseRoute(value, h.ServiceRoute)
+	case HeaderFieldEvent.LowerName(), HeaderFieldEvent.Abbr:
+		h.Event, err = parseEvent(value)
+	case HeaderFieldSubscriptionState.LowerName():
+		h.SubscriptionState, err = parseSubscriptionState(value)
 	default:
 		h.UnsupportLines = append(h.UnsupportLines, line)
 	}
@@ -12,23 +12,30 @@ type HeaderFieldItem struct {
 
 // SIP的头域字段名
 var (
-	HeaderFieldVia               = HeaderFieldItem{"Via", "v"}
-	HeaderFieldFrom              = HeaderFieldItem{"From", "f"}
-	HeaderFieldTo                = HeaderFieldItem{"To", "t"}
-	HeaderFieldCallID            = HeaderFieldItem{"Call-ID", "i"}
-	HeaderFieldCSeq              = HeaderFieldItem{"CSeq", ""}
-	HeaderFieldMaxForwards       = HeaderFieldItem{"Max-Forwards", ""}
-	HeaderFieldContentType       = HeaderFieldItem{"Content-Type", "c"}
-	HeaderFieldContentLength     = HeaderFieldItem{"Content-Length", "l"}
-	HeaderFieldContact           = HeaderFieldItem{"Contact", "m"}
-	HeaderFieldExpires           = HeaderFieldItem{"Expires", ""}
-	HeaderFieldRoute             = HeaderFieldItem{"Route", ""}
-	HeaderFieldRecordRoute       = HeaderFieldItem{"Record-Route", ""}
-	HeaderFieldUserAgent         = HeaderFieldItem{"User-Agent", ""}
-	HeaderFieldAuthorization     = HeaderFieldItem{"Authorization", ""}
-	HeaderFieldWWWAuthenticate   = HeaderFieldItem{"WWW-Authenticate", ""}
-	HeaderFieldAccessNetworkInfo = HeaderFieldItem{"P-Access-Network-Info", ""}
-	HeaderFieldServiceRoute      = HeaderFieldItem{"Service-Route", ""}
+	HeaderFieldVia                = HeaderFieldItem{"Via", "v"}
+	HeaderFieldFrom               = HeaderFieldItem{"From", "f"}
+	HeaderFieldTo                 = HeaderFieldItem{"To", "t"}
+	HeaderFieldCallID             = HeaderFieldItem{"Call-ID", "i"}
+	HeaderFieldCSeq               = HeaderFieldItem{"CSeq", ""}
+	HeaderFieldMaxForwards        = HeaderFieldItem{"Max-Forwards", ""}
+	HeaderFieldContentType        = HeaderFieldItem{"Content-Type", "c"}
+	HeaderFieldContentLength      = HeaderFieldItem{"Content-Length", "l"}
+	HeaderFieldContact            = HeaderFieldItem{"Contact", "m"}
+	HeaderFieldExpires            = HeaderFieldItem{"Expires", ""}
+	HeaderFieldMinExpires         = HeaderFieldItem{"Min-Expires", ""}
+	HeaderFieldRoute              = HeaderFieldItem{"Route", ""}
+	HeaderFieldRecordRoute        = HeaderFieldItem{"Record-Route", ""}
+	HeaderFieldUserAgent          = HeaderFieldItem{"User-Agent", ""}
+	HeaderFieldAuthorization      = HeaderFieldItem{"Authorization", ""}
+	HeaderFieldWWWAuthenticate    = HeaderFieldItem{"WWW-Authenticate", ""}
+	HeaderFieldProxyAuthorization = HeaderFieldItem{"Proxy-Authorization", ""}
+	HeaderFieldProxyAuthenticate  = HeaderFieldItem{"Proxy-Authenticate", ""}
+	HeaderFieldAuthenticationInfo = HeaderFieldItem{"Authentication-Info", ""}
+	HeaderFieldAccessNetworkInfo  = HeaderFieldItem{"P-Access-Network-Info", ""}
+	HeaderFieldServiceRoute       = HeaderFieldItem{"Service-Route", ""}
+	HeaderFieldPath               = HeaderFieldItem{"Path", ""}
+	HeaderFieldEvent              = HeaderFieldItem{"Event", "o"}
+	HeaderFieldSubscriptionState  = HeaderFieldItem{"Subscription-State", ""}
 )
 
 func (f HeaderFieldItem) LowerName() string {
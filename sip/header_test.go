@@ -0,0 +1,23 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderValues(t *testing.T) {
+	req := mustParse(t, strings.Replace(testContactRegister, "Expires: 3600", "Expires: 3600\nAccept-Contact: *;+g.3gpp.icsi-ref=\"urn%3Aurn-7%3A3gpp-service.ims.icsi.mmtel\"\naccept-contact: *;audio", 1))
+	if v := req.Header.Values("Call-ID"); len(v) != 1 || v[0] != "93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100" {
+		t.Errorf("call-id = %v", v)
+	}
+	if v := req.Header.Values("contact"); len(v) != 3 {
+		t.Errorf("contact = %v", v)
+	}
+	// 暂不支持的头域同样可以按名称查询
+	if v := req.Header.Values("Accept-Contact"); len(v) != 2 || v[1] != "*;audio" {
+		t.Errorf("accept-contact = %v", v)
+	}
+	if v := req.Header.Values("Subject"); len(v) != 0 {
+		t.Errorf("subject = %v", v)
+	}
+}
@@ -49,6 +49,132 @@ func NewResponse(code StatusCodeItem, req *Message) *Message {
 	}
 }
 
+// 作为UAC发起新的请求(RFC3261-8.1.1)，Via由发送时添加
+func NewRequest(method string, requestURI URI, from, to User, callID string, cseq int) *Message {
+	req := &Message{
+		IsRequest: true,
+		RequestLine: RequestLine{
+			Method:     method,
+			RequestURI: requestURI,
+			SIPVersion: SIPVersion,
+		},
+		Header: Header{
+			From:   from,
+			To:     to,
+			CallID: callID,
+			CSeq: CSeq{
+				CSeq:   cseq,
+				Method: method,
+			},
+		},
+	}
+	req.Header.MaxForwards.Reset()
+	return req
+}
+
+// 生成INVITE非2xx最终应答对应的ACK请求，由客户端事务逐跳发送(RFC3261-17.1.1.3)
+func newAckForNon2xx(req *Message, resp *Message) *Message {
+	ack := &Message{
+		IsRequest: true,
+		RequestLine: RequestLine{
+			Method:     MethodAck,
+			RequestURI: req.RequestLine.RequestURI,
+			SIPVersion: SIPVersion,
+		},
+		Header: Header{
+			From:   req.Header.From,
+			To:     resp.Header.To,
+			CallID: req.Header.CallID,
+			CSeq: CSeq{
+				CSeq:   req.Header.CSeq.CSeq,
+				Method: MethodAck,
+			},
+			Route:             req.Header.Route,
+			AccessNetworkInfo: req.Header.AccessNetworkInfo,
+		},
+	}
+	if req.Header.Via.Len() > 0 {
+		ack.Header.Via.value = []Via{req.Header.Via.value[0]}
+	}
+	ack.Header.MaxForwards.Reset()
+	return ack
+}
+
+// 生成取消请求的CANCEL，与被取消的请求使用相同的branch(RFC3261-9.1)
+func NewCancel(req *Message) *Message {
+	cancel := &Message{
+		IsRequest: true,
+		RequestLine: RequestLine{
+			Method:     MethodCancel,
+			RequestURI: req.RequestLine.RequestURI,
+			SIPVersion: SIPVersion,
+		},
+		Header: Header{
+			From:   req.Header.From,
+			To:     req.Header.To,
+			CallID: req.Header.CallID,
+			CSeq: CSeq{
+				CSeq:   req.Header.CSeq.CSeq,
+				Method: MethodCancel,
+			},
+			Route:             req.Header.Route,
+			AccessNetworkInfo: req.Header.AccessNetworkInfo,
+		},
+	}
+	if req.Header.Via.Len() > 0 {
+		cancel.Header.Via.value = []Via{req.Header.Via.value[0]}
+		cancel.Header.Via.SetReceivedInfo(req.Transport(), req.RealAddress())
+	}
+	cancel.Header.MaxForwards.Reset()
+	return cancel
+}
+
+// 代理对请求的Route预处理(RFC3261-16.4)，第一个Route指向本服务器时将其移除并返回
+func (m *Message) PreprocessRoute(s *Server) (item User, removed bool) {
+	if !m.Header.Route.FirstIsCurrentDomain(s) {
+		return
+	}
+	item, removed = m.Header.Route.FirstItem()
+	m.Header.Route.RemoveFirst()
+	return
+}
+
+// 请求的下一跳地址(RFC3261-16.6)，Route不为空时发往第一个Route，否则发往Request-URI
+func (m *Message) NextHopHost() string {
+	return m.NextHopURI().Domain
+}
+
+// 请求下一跳的URI
+func (m *Message) NextHopURI() URI {
+	if item, ok := m.Header.Route.FirstItem(); ok {
+		return item.URI
+	}
+	return m.RequestLine.RequestURI
+}
+
+// 会话描述的消息体类型(RFC3264)
+const ContentTypeSDP = "application/sdp"
+
+// 消息是否携带SDP，Content-Type可以携带参数
+func (m *Message) HasSDP() bool {
+	if len(m.Body) == 0 {
+		return false
+	}
+	mt := strings.TrimSpace(strings.SplitN(m.Header.ContentType, ";", 2)[0])
+	return strings.EqualFold(mt, ContentTypeSDP)
+}
+
+// 深拷贝消息，保存的消息不受后续修改的影响
+func (m *Message) Clone() *Message {
+	msg, err := NewMessage(strings.NewReader(m.String()))
+	if err != nil {
+		c := *m
+		return &c
+	}
+	msg.Header.Via.SetReceivedInfo(m.Transport(), m.RealAddress())
+	return &msg
+}
+
 // 字符串表示
 func (m *Message) String() (result string) {
 	// 输出首行
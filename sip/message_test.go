@@ -119,3 +119,23 @@ func TestMessageBase(t *testing.T) {
 		})
 	}
 }
+
+func TestMessageHasSDP(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"application/sdp", "v=0", true},
+		{"Application/SDP; charset=utf-8", "v=0", true},
+		{"application/sdp", "", false},
+		{"application/reginfo+xml", "<reginfo/>", false},
+		{"", "v=0", false},
+	}
+	for _, tt := range tests {
+		m := &Message{Header: Header{ContentType: tt.contentType}, Body: tt.body}
+		if got := m.HasSDP(); got != tt.want {
+			t.Errorf("HasSDP(%q, %q) = %v, want %v", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
@@ -15,15 +15,16 @@ func parseRecordRoute(str string, oldValue RecordRoute) (newValue RecordRoute, e
 }
 
 // 将本机信息加入RecordRoute节点列表中
-func (rr *RecordRoute) AddServerInfo() {
+func (rr *RecordRoute) AddServerInfo(s *Server) {
 	item := User{
 		DisplayName: "",
-		URI: URI{
-			Scheme:   SchemeSip,
-			Username: "",
-			Domain:   ServerDomainHost(),
-		},
-		Arguments: Args{},
+		URI:         s.URI(""),
+		Arguments:   Args{},
 	}
 	rr.value = append([]User{item}, rr.value...)
 }
+
+// 全部记录
+func (rr RecordRoute) Items() []User {
+	return rr.value
+}
@@ -0,0 +1,78 @@
+package sip
+
+import (
+	"encoding/xml"
+)
+
+// 注册状态事件的消息体类型(RFC3680-5.3)
+const ContentTypeRegInfo = "application/reginfo+xml"
+
+// 注册状态文档的类型
+const (
+	RegInfoFull    = "full"    // 包含全部注册信息
+	RegInfoPartial = "partial" // 只包含变化的注册信息
+)
+
+// 注册和联系地址的状态
+const (
+	RegStateInit       = "init"
+	RegStateActive     = "active"
+	RegStateTerminated = "terminated"
+)
+
+// 联系地址状态变化的原因(RFC3680-5.4)
+const (
+	RegEventRegistered   = "registered"   // 用户注册
+	RegEventCreated      = "created"      // 管理员创建
+	RegEventRefreshed    = "refreshed"    // 用户刷新注册
+	RegEventShortened    = "shortened"    // 网络缩短了有效时间
+	RegEventExpired      = "expired"      // 有效时间到期
+	RegEventDeactivated  = "deactivated"  // 网络注销，用户可以重新注册
+	RegEventProbation    = "probation"    // 网络注销，用户需要稍后重新注册
+	RegEventUnregistered = "unregistered" // 用户注销
+	RegEventRejected     = "rejected"     // 网络注销，用户不能重新注册
+)
+
+// 注册状态文档 application/reginfo+xml (RFC3680-5.3)
+type RegInfo struct {
+	XMLName       xml.Name       `xml:"urn:ietf:params:xml:ns:reginfo reginfo"`
+	Version       int            `xml:"version,attr"` // 每次通知递增，从0开始
+	State         string         `xml:"state,attr"`   // full或partial
+	Registrations []Registration `xml:"registration"`
+}
+
+// 一个公共用户标识(AOR)的注册状态
+type Registration struct {
+	AOR      string       `xml:"aor,attr"`
+	ID       string       `xml:"id,attr"`
+	State    string       `xml:"state,attr"`
+	Contacts []RegContact `xml:"contact"`
+}
+
+// 注册的一个联系地址
+type RegContact struct {
+	ID      string `xml:"id,attr"`
+	State   string `xml:"state,attr"`
+	Event   string `xml:"event,attr"`
+	Expires int    `xml:"expires,attr,omitempty"`
+	CallID  string `xml:"callid,attr,omitempty"`
+	CSeq    int    `xml:"cseq,attr,omitempty"`
+	URI     string `xml:"uri"`
+}
+
+func ParseRegInfo(body string) (info *RegInfo, err error) {
+	info = new(RegInfo)
+	if err = xml.Unmarshal([]byte(body), info); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// 字符串表达，包含XML声明
+func (info RegInfo) String() string {
+	data, err := xml.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return xml.Header + string(data)
+}
@@ -1,6 +1,6 @@
 package sip
 
-// 请求的路由表
+// 请求的路由表，Path和Service-Route使用相同的格式
 type Route struct {
 	value []User // 实际的值
 }
@@ -15,11 +15,11 @@ func parseRoute(str string, oldValue Route) (newValue Route, err error) {
 }
 
 // 检查第一个域是否是自己
-func (r Route) FirstIsCurrentDomain() bool {
+func (r Route) FirstIsCurrentDomain(s *Server) bool {
 	if len(r.value) == 0 {
 		return false
 	}
-	return r.value[0].URI.Domain == ServerDomainHost()
+	return s.IsHost(r.value[0].URI.Domain)
 }
 
 // 获取第一条记录
@@ -29,9 +29,30 @@ func (r Route) FirstItem() (item User, isExist bool) {
 		return
 	}
 	item = r.value[0]
+	isExist = true
 	return
 }
 
+// 全部记录
+func (r Route) Items() []User {
+	return r.value
+}
+
+// 记录数量
+func (r Route) Len() int {
+	return len(r.value)
+}
+
+// 在开头插入记录，用于预加载路由
+func (r *Route) Prepend(items ...User) {
+	r.value = append(append([]User{}, items...), r.value...)
+}
+
+// 将本机信息加入到开头，用于Path(RFC3327-5.2)
+func (r *Route) AddServerInfo(s *Server) {
+	r.Prepend(User{URI: s.URI(""), Arguments: Args{}})
+}
+
 // 删除第一条记录
 func (r *Route) RemoveFirst() {
 	if len(r.value) == 0 {
@@ -0,0 +1,94 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+const testRoutedInvite = `INVITE sip:1010@hebeiyidong.3gpp.net SIP/2.0
+Via: SIP/2.0/UDP p-cscf.hebeiyidong.3gpp.net:54321;branch=z9hG4bK4b43c2ff8
+Via: SIP/2.0/UDP 192.168.0.100:45508;branch=z9hG4bK1158493fb1e25c83f14f5e7ee368;rport
+Route: <sip:orig@s-cscf.hebeiyidong.3gpp.net:54323;lr>
+Route: <sip:i-cscf.chongqingdianxin.3gpp.net:44322;lr>
+Record-Route: <sip:p-cscf.hebeiyidong.3gpp.net:54321;lr>
+From: "1011" <sip:1011@hebeiyidong.3gpp.net>;tag=22365c3a331
+To: "1010" <sip:1010@hebeiyidong.3gpp.net>
+Call-ID: 93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100
+CSeq: 1 INVITE
+Max-Forwards: 69
+Content-Length: 0
+
+`
+
+var testScscf = &Server{IP: "127.0.0.1", Domain: "s-cscf.hebeiyidong.3gpp.net", Port: 54323}
+
+func TestPreprocessRoute(t *testing.T) {
+	req := mustParse(t, testRoutedInvite)
+
+	item, removed := req.PreprocessRoute(testScscf)
+	if !removed || item.URI.Username != "orig" {
+		t.Fatalf("route to current server should be removed, got %v %v", item, removed)
+	}
+	if host := req.NextHopHost(); host != "i-cscf.chongqingdianxin.3gpp.net:44322" {
+		t.Errorf("next hop = %v, want first route", host)
+	}
+	if _, removed = req.PreprocessRoute(testScscf); removed {
+		t.Errorf("route to other server should be kept")
+	}
+	req.Header.Route.RemoveFirst()
+	if host := req.NextHopHost(); host != "hebeiyidong.3gpp.net" {
+		t.Errorf("next hop = %v, want request uri", host)
+	}
+}
+
+func TestRecordRouteAndPath(t *testing.T) {
+	req := mustParse(t, testRoutedInvite)
+
+	req.Header.RecordRoute.AddServerInfo(testScscf)
+	req.Header.Path.AddServerInfo(testScscf)
+	req.Header.ServiceRoute.Prepend(User{URI: testScscf.URI("orig"), Arguments: Args{}})
+	str := req.String()
+	for _, line := range []string{
+		"Record-Route: <sip:s-cscf.hebeiyidong.3gpp.net:54323;lr>",
+		"Path: <sip:s-cscf.hebeiyidong.3gpp.net:54323;lr>",
+		"Service-Route: <sip:orig@s-cscf.hebeiyidong.3gpp.net:54323;lr>",
+	} {
+		if !strings.Contains(str, line) {
+			t.Errorf("message should contain %q, got\n%v", line, str)
+		}
+	}
+	msg := mustParse(t, strings.ReplaceAll(str, CRLF, "\n"))
+	if msg.Header.RecordRoute.Items()[0].URI.Domain != testScscf.DomainHost() || msg.Header.ServiceRoute.Len() != 1 {
+		t.Errorf("record-route and service-route should be parsed back")
+	}
+}
+
+func TestMultiHopServers(t *testing.T) {
+	pcscf, err := NewServer("p-cscf.hebeiyidong.3gpp.net", "127.0.0.1:54321")
+	if err != nil {
+		t.Fatalf("NewServer error = %v", err)
+	}
+	req := mustParse(t, testInvite)
+	// UE -> P-CSCF -> S-CSCF，两个服务器在同一进程中依次转发
+	for _, s := range []*Server{pcscf, testScscf} {
+		req.Header.RecordRoute.AddServerInfo(s)
+		req.Header.Via.AddServerInfo(s)
+	}
+	if req.Header.Via.Len() != 3 || req.Header.Via.FirstSentBy() != testScscf.DomainHost() {
+		t.Fatalf("via should be added by each hop, got %v", req.Header.Via.value)
+	}
+	resp := NewResponse(StatusOK, req)
+	// 应答原路返回，每一跳只移除自己的Via
+	resp.Header.Via.RemoveFirst(pcscf)
+	if resp.Header.Via.Len() != 3 {
+		t.Errorf("via of other server should not be removed")
+	}
+	resp.Header.Via.RemoveFirst(testScscf)
+	resp.Header.Via.RemoveFirst(pcscf)
+	if resp.Header.Via.FirstSentBy() != "192.168.0.100:45508" {
+		t.Errorf("response should reach UE, first via = %v", resp.Header.Via.FirstSentBy())
+	}
+	if rr := resp.Header.RecordRoute.Items(); len(rr) != 2 || rr[1].URI.Domain != pcscf.DomainHost() {
+		t.Errorf("record-route = %v", rr)
+	}
+}
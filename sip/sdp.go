@@ -0,0 +1,35 @@
+package sip
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SDP的媒体描述(RFC4566-5.14)
+type SDPMedia struct {
+	Type      string // 媒体类型，如audio、video
+	Port      int    // 端口为0时媒体被拒绝或删除(RFC3264-6)
+	Proto     string // 传输协议，如RTP/AVP
+	Bandwidth int    // 媒体级的b=AS，单位kbps，未携带时为0
+}
+
+// 解析SDP中的媒体描述，按m=行的顺序返回，会话级的带宽不计入媒体
+func ParseSDPMedia(body string) []SDPMedia {
+	var media []SDPMedia
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(line[2:])
+			if len(fields) < 3 {
+				continue
+			}
+			// 端口可以携带个数，如49170/2
+			port, _ := strconv.Atoi(strings.SplitN(fields[1], "/", 2)[0])
+			media = append(media, SDPMedia{Type: fields[0], Port: port, Proto: fields[2]})
+		case strings.HasPrefix(line, "b=AS:") && len(media) > 0:
+			media[len(media)-1].Bandwidth, _ = strconv.Atoi(strings.TrimSpace(line[5:]))
+		}
+	}
+	return media
+}
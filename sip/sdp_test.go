@@ -0,0 +1,31 @@
+package sip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSDPMedia(t *testing.T) {
+	body := "v=0\r\n" +
+		"o=- 0 0 IN IP4 10.0.1.2\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 10.0.1.2\r\n" +
+		"b=AS:1000\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 49170 RTP/AVP 104 110\r\n" +
+		"b=AS:41\r\n" +
+		"a=rtpmap:104 AMR-WB/16000\r\n" +
+		"m=video 0 RTP/AVP 99\r\n" +
+		"m=text 51372/2 RTP/AVP 98\n"
+	want := []SDPMedia{
+		{Type: "audio", Port: 49170, Proto: "RTP/AVP", Bandwidth: 41},
+		{Type: "video", Port: 0, Proto: "RTP/AVP"},
+		{Type: "text", Port: 51372, Proto: "RTP/AVP"},
+	}
+	if got := ParseSDPMedia(body); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSDPMedia() = %+v, want %+v", got, want)
+	}
+	if got := ParseSDPMedia("v=0\r\nm=audio\r\n"); len(got) != 0 {
+		t.Errorf("invalid media line = %+v", got)
+	}
+}
@@ -1,21 +1,53 @@
 package sip
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
 )
 
-var (
-	ServerIP     string // 区域IP
-	ServerDomain string // 区域域名，用于Via
-	ServerPort   int    // 区域端口号
-)
+// SIP服务器的身份信息，每个功能实体持有自己的身份，同一进程中可以运行多个功能实体
+type Server struct {
+	IP     string // 区域IP
+	Domain string // 区域域名，用于Via
+	Port   int    // 区域端口号
+}
+
+// 根据域名和IP:Port格式的监听地址创建服务器身份
+func NewServer(domain, host string) (*Server, error) {
+	ip, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, errors.New("sip: server port format error")
+	}
+	return &Server{IP: ip, Domain: domain, Port: p}, nil
+}
 
-// 区域名称，IP:Port格式
-func ServerIpHost() string {
-	return fmt.Sprintf("%s:%d", ServerIP, ServerPort)
+// 区域名称，IP:Port格式，IPv6地址带方括号
+func (s *Server) IpHost() string {
+	return net.JoinHostPort(s.IP, strconv.Itoa(s.Port))
 }
 
 // 区域名称，Domain:Port格式
-func ServerDomainHost() string {
-	return fmt.Sprintf("%s:%d", ServerDomain, ServerPort)
+func (s *Server) DomainHost() string {
+	return fmt.Sprintf("%s:%d", s.Domain, s.Port)
+}
+
+// 本服务器的SIP地址，用于Record-Route、Path和Service-Route，均为松散路由(RFC3261-16.6)
+func (s *Server) URI(user string) URI {
+	return URI{
+		Scheme:    SchemeSip,
+		Username:  user,
+		Domain:    s.DomainHost(),
+		Arguments: NewArgs(map[string]string{"lr": ""}),
+	}
+}
+
+// 地址是否指向本服务器
+func (s *Server) IsHost(host string) bool {
+	return host == s.DomainHost() || host == s.Domain
 }
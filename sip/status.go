@@ -52,6 +52,7 @@ var (
 	StatusBusyHere                    = StatusCodeItem{486, "Busy Here"}
 	StatusRequestTerminated           = StatusCodeItem{487, "Request Terminated"}
 	StatusNotAcceptableHere           = StatusCodeItem{488, "Not Acceptable Here"}
+	StatusBadEvent                    = StatusCodeItem{489, "Bad Event"}
 	StatusRequestPending              = StatusCodeItem{491, "Request Pending"}
 	StatusUndecipherable              = StatusCodeItem{493, "Undecipherable"}
 
@@ -0,0 +1,241 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 事务定时器的基础时长(RFC3261-17.1.1.1)
+var (
+	T1 = 500 * time.Millisecond // RTT估计值
+	T2 = 4 * time.Second        // 非INVITE请求和INVITE应答的最大重传间隔
+	T4 = 5 * time.Second        // 消息在网络中保留的最长时间
+)
+
+// 事务状态(RFC3261-17)
+type TransactionState int
+
+const (
+	TransactionCalling    TransactionState = iota // INVITE客户端事务初始状态
+	TransactionTrying                             // 非INVITE事务初始状态
+	TransactionProceeding                         // 收到或发送了临时应答
+	TransactionCompleted                          // 收到或发送了最终应答，等待吸收重传
+	TransactionConfirmed                          // INVITE服务端事务收到ACK
+	TransactionTerminated                         // 事务结束
+)
+
+// 字符串表达
+func (s TransactionState) String() string {
+	switch s {
+	case TransactionCalling:
+		return "Calling"
+	case TransactionTrying:
+		return "Trying"
+	case TransactionProceeding:
+		return "Proceeding"
+	case TransactionCompleted:
+		return "Completed"
+	case TransactionConfirmed:
+		return "Confirmed"
+	default:
+		return "Terminated"
+	}
+}
+
+// 事务层发送消息的回调，由上层决定消息的实际发送路径
+type TransportFunc func(msg *Message)
+
+// 事务层，按事务标识管理客户端事务和服务端事务
+type TransactionLayer struct {
+	sync.Mutex
+	clients map[string]*ClientTransaction
+	servers map[string]*ServerTransaction
+}
+
+func NewTransactionLayer() *TransactionLayer {
+	return &TransactionLayer{
+		clients: make(map[string]*ClientTransaction),
+		servers: make(map[string]*ServerTransaction),
+	}
+}
+
+// (接收请求) 匹配服务端事务，重传的请求由事务层吸收并返回false，新的请求创建事务并返回true
+// ACK不创建事务，2xx对应的ACK直接交给上层处理
+func (tl *TransactionLayer) ServerRequest(req *Message, send TransportFunc) (*ServerTransaction, bool) {
+	key, err := serverTransactionKey(req)
+	if err != nil {
+		return nil, true
+	}
+	tl.Lock()
+	tx, ok := tl.servers[key]
+	if !ok && req.RequestLine.Method != MethodAck {
+		tx = newServerTransaction(key, req, send)
+		tx.terminate = func() { tl.removeServer(key, tx) }
+		tl.servers[key] = tx
+	}
+	tl.Unlock()
+	if req.RequestLine.Method == MethodAck {
+		if tx == nil {
+			return nil, true
+		}
+		tx.receiveAck()
+		return tx, false
+	}
+	if ok {
+		tx.receiveRetransmission()
+		return tx, false
+	}
+	return tx, true
+}
+
+// 查找请求或应答所属的服务端事务，应答需要先移除本服务器的Via
+func (tl *TransactionLayer) MatchServer(msg *Message) *ServerTransaction {
+	key, err := serverTransactionKey(msg)
+	if err != nil {
+		return nil
+	}
+	tl.Lock()
+	defer tl.Unlock()
+	return tl.servers[key]
+}
+
+// 查找CANCEL请求要取消的INVITE服务端事务(RFC3261-9.2)
+func (tl *TransactionLayer) MatchCancel(cancel *Message) *ServerTransaction {
+	key, err := serverTransactionKey(cancel)
+	if err != nil {
+		return nil
+	}
+	key = strings.TrimSuffix(key, MethodCancel) + MethodInvite
+	tl.Lock()
+	defer tl.Unlock()
+	return tl.servers[key]
+}
+
+// 代理取消INVITE事务(RFC3261-16.10)
+// 向转发INVITE的下一跳发送CANCEL，由下游应答487；INVITE没有在途的客户端事务时直接应答487
+func (tl *TransactionLayer) CancelInvite(inv *ServerTransaction) {
+	if inv.State() != TransactionProceeding {
+		return
+	}
+	ctx := inv.Client()
+	if ctx == nil {
+		inv.Respond(NewResponse(StatusRequestTerminated, inv.Request()))
+		return
+	}
+	switch ctx.State() {
+	case TransactionCalling, TransactionProceeding:
+		tl.Request(NewCancel(ctx.Request()), ctx.send)
+	default:
+		inv.Respond(NewResponse(StatusRequestTerminated, inv.Request()))
+	}
+}
+
+// 发起新的客户端事务并发送请求
+func (tl *TransactionLayer) Request(req *Message, send TransportFunc) *ClientTransaction {
+	return tl.Forward(nil, req, send)
+}
+
+// 代理转发请求，客户端事务超时后由服务端事务向请求方应答408
+func (tl *TransactionLayer) Forward(stx *ServerTransaction, req *Message, send TransportFunc) *ClientTransaction {
+	key, err := clientTransactionKey(req)
+	if err != nil {
+		send(req)
+		return nil
+	}
+	tx := newClientTransaction(key, req, send)
+	tx.server = stx
+	if stx != nil {
+		stx.setClient(tx)
+	}
+	tx.terminate = func() { tl.removeClient(key, tx) }
+	tl.Lock()
+	old, ok := tl.clients[key]
+	tl.clients[key] = tx
+	tl.Unlock()
+	if ok {
+		old.stop()
+	}
+	tx.start()
+	return tx
+}
+
+// (接收应答) 匹配客户端事务，返回应答是否需要交给上层处理
+// 未匹配到事务的应答(如2xx的重传)交给上层无状态转发
+func (tl *TransactionLayer) ClientResponse(resp *Message) (*ClientTransaction, bool) {
+	key, err := clientTransactionKey(resp)
+	if err != nil {
+		return nil, true
+	}
+	tl.Lock()
+	tx, ok := tl.clients[key]
+	tl.Unlock()
+	if !ok {
+		return nil, true
+	}
+	return tx, tx.receive(resp)
+}
+
+func (tl *TransactionLayer) removeServer(key string, tx *ServerTransaction) {
+	tl.Lock()
+	defer tl.Unlock()
+	if tl.servers[key] == tx {
+		delete(tl.servers, key)
+	}
+}
+
+func (tl *TransactionLayer) removeClient(key string, tx *ClientTransaction) {
+	tl.Lock()
+	defer tl.Unlock()
+	if tl.clients[key] == tx {
+		delete(tl.clients, key)
+	}
+}
+
+// 客户端事务标识(RFC3261-17.1.3)：branch + CSeq方法
+func clientTransactionKey(msg *Message) (string, error) {
+	branch := msg.Header.Via.TransactionBranch()
+	if len(branch) == 0 {
+		return "", errors.New("sip: transaction branch not found")
+	}
+	return branch + "|" + msg.Header.CSeq.Method, nil
+}
+
+// 服务端事务标识(RFC3261-17.2.3)：branch + sent-by + 方法，ACK匹配对应的INVITE事务
+func serverTransactionKey(msg *Message) (string, error) {
+	branch := msg.Header.Via.TransactionBranch()
+	if !strings.HasPrefix(branch, BranchMagicCookie) {
+		return "", errors.New("sip: transaction branch not compliant with rfc3261")
+	}
+	method := msg.Header.CSeq.Method
+	if method == MethodAck {
+		method = MethodInvite
+	}
+	return branch + "|" + msg.Header.Via.FirstSentBy() + "|" + method, nil
+}
+
+// 是否是可靠传输，可靠传输不需要重传且不需要等待吸收重传
+func isReliable(transport string) bool {
+	switch strings.ToUpper(transport) {
+	case "TCP", "TLS", "SCTP":
+		return true
+	}
+	return false
+}
+
+// 停止定时器
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// 重传间隔翻倍，不超过上限
+func doubleInterval(d time.Duration, limit time.Duration) time.Duration {
+	d *= 2
+	if limit > 0 && d > limit {
+		d = limit
+	}
+	return d
+}
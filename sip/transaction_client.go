@@ -0,0 +1,210 @@
+package sip
+
+import (
+	"sync"
+	"time"
+)
+
+// 客户端事务(RFC3261-17.1)
+// INVITE事务：Timer A 重传请求，Timer B 事务超时，Timer D 等待吸收应答重传
+// 非INVITE事务：Timer E 重传请求，Timer F 事务超时，Timer K 等待吸收应答重传
+type ClientTransaction struct {
+	sync.Mutex
+	key        string
+	isInvite   bool
+	reliable   bool
+	state      TransactionState
+	request    *Message
+	ack        *Message           // 非2xx最终应答对应的ACK
+	send       TransportFunc      // 发送请求的回调
+	server     *ServerTransaction // 代理转发时对应的服务端事务
+	interval   time.Duration      // 当前重传间隔
+	retransmit *time.Timer        // Timer A / Timer E
+	timeout    *time.Timer        // Timer B / Timer F
+	linger     *time.Timer        // Timer D / Timer K
+	terminate  func()
+}
+
+func newClientTransaction(key string, req *Message, send TransportFunc) *ClientTransaction {
+	tx := &ClientTransaction{
+		key:      key,
+		isInvite: req.RequestLine.Method == MethodInvite,
+		reliable: isReliable(req.Header.Via.FirstTransport()),
+		request:  req.Clone(),
+		send:     send,
+	}
+	if tx.isInvite {
+		tx.state = TransactionCalling
+	} else {
+		tx.state = TransactionTrying
+	}
+	return tx
+}
+
+// 事务状态
+func (tx *ClientTransaction) State() TransactionState {
+	tx.Lock()
+	defer tx.Unlock()
+	return tx.state
+}
+
+// 事务发起的请求
+func (tx *ClientTransaction) Request() *Message {
+	return tx.request
+}
+
+// 代理转发时对应的服务端事务
+func (tx *ClientTransaction) Server() *ServerTransaction {
+	return tx.server
+}
+
+// 发送请求并启动定时器
+// 发送可能阻塞在传输层上，不持有锁，发送期间收到最终应答或事务被停止时不再启动定时器
+func (tx *ClientTransaction) start() {
+	tx.send(tx.request)
+	tx.Lock()
+	defer tx.Unlock()
+	// 传输层可能按消息大小更换传输协议(RFC3261-18.1.1)，以发送后第一个Via中的协议为准
+	tx.reliable = isReliable(tx.request.Header.Via.FirstTransport())
+	switch {
+	case tx.state == TransactionCalling || tx.state == TransactionTrying:
+		tx.interval = T1
+	case tx.state == TransactionProceeding && !tx.isInvite:
+		tx.interval = T2
+	default:
+		return
+	}
+	if !tx.reliable {
+		tx.retransmit = time.AfterFunc(tx.interval, tx.onRetransmit)
+	}
+	tx.timeout = time.AfterFunc(64*T1, tx.onTimeout)
+}
+
+// 处理收到的应答，返回是否需要交给上层处理，需要发送的ACK在解锁后发送
+func (tx *ClientTransaction) receive(resp *Message) bool {
+	var ack *Message
+	defer func() {
+		if ack != nil {
+			tx.send(ack)
+		}
+	}()
+	tx.Lock()
+	defer tx.Unlock()
+	code := resp.ResponseLine.StatusCode
+	switch tx.state {
+	case TransactionCalling, TransactionTrying, TransactionProceeding:
+		if code < 200 {
+			if tx.isInvite {
+				// INVITE收到临时应答后不再重传请求
+				stopTimer(tx.retransmit)
+				stopTimer(tx.timeout)
+			} else if tx.state == TransactionTrying && tx.retransmit != nil {
+				tx.interval = T2
+			}
+			tx.state = TransactionProceeding
+			return true
+		}
+		stopTimer(tx.retransmit)
+		stopTimer(tx.timeout)
+		if tx.isInvite && code < 300 {
+			// 2xx的ACK由UAC端到端发送，事务直接结束
+			tx.state = TransactionTerminated
+			tx.terminate()
+			return true
+		}
+		if tx.isInvite {
+			tx.ack = newAckForNon2xx(tx.request, resp)
+			ack = tx.ack.Clone()
+		}
+		tx.state = TransactionCompleted
+		tx.startLinger()
+		return true
+	case TransactionCompleted:
+		// 吸收最终应答的重传，INVITE事务需要重发ACK
+		if tx.isInvite && code >= 300 && tx.ack != nil {
+			ack = tx.ack.Clone()
+		}
+		return false
+	}
+	return false
+}
+
+// 进入Completed状态后等待吸收应答的重传，可靠传输立即结束
+func (tx *ClientTransaction) startLinger() {
+	var wait time.Duration
+	if !tx.reliable {
+		if tx.isInvite {
+			wait = 32 * time.Second
+		} else {
+			wait = T4
+		}
+	}
+	tx.linger = time.AfterFunc(wait, tx.onLinger)
+}
+
+// Timer A / Timer E，在锁内复制请求，解锁后发送
+func (tx *ClientTransaction) onRetransmit() {
+	tx.Lock()
+	if tx.state != TransactionCalling && tx.state != TransactionTrying && tx.state != TransactionProceeding {
+		tx.Unlock()
+		return
+	}
+	if tx.isInvite && tx.state != TransactionCalling {
+		tx.Unlock()
+		return
+	}
+	req := tx.request.Clone()
+	if tx.isInvite {
+		tx.interval = doubleInterval(tx.interval, 0)
+	} else if tx.state == TransactionProceeding {
+		tx.interval = T2
+	} else {
+		tx.interval = doubleInterval(tx.interval, T2)
+	}
+	tx.retransmit = time.AfterFunc(tx.interval, tx.onRetransmit)
+	tx.Unlock()
+	tx.send(req)
+}
+
+// Timer B / Timer F
+func (tx *ClientTransaction) onTimeout() {
+	tx.Lock()
+	if tx.state == TransactionCompleted || tx.state == TransactionTerminated {
+		tx.Unlock()
+		return
+	}
+	if tx.isInvite && tx.state != TransactionCalling {
+		tx.Unlock()
+		return
+	}
+	stopTimer(tx.retransmit)
+	tx.state = TransactionTerminated
+	tx.Unlock()
+	tx.terminate()
+	// 向请求方告知请求超时
+	if tx.server != nil {
+		tx.server.Respond(NewResponse(StatusRequestTimeout, tx.server.Request()))
+	}
+}
+
+// Timer D / Timer K
+func (tx *ClientTransaction) onLinger() {
+	tx.Lock()
+	if tx.state != TransactionCompleted {
+		tx.Unlock()
+		return
+	}
+	tx.state = TransactionTerminated
+	tx.Unlock()
+	tx.terminate()
+}
+
+// 停止事务的所有定时器
+func (tx *ClientTransaction) stop() {
+	tx.Lock()
+	defer tx.Unlock()
+	stopTimer(tx.retransmit)
+	stopTimer(tx.timeout)
+	stopTimer(tx.linger)
+	tx.state = TransactionTerminated
+}
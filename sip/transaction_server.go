@@ -0,0 +1,166 @@
+package sip
+
+import (
+	"sync"
+	"time"
+)
+
+// 服务端事务(RFC3261-17.2)
+// INVITE事务：Timer G 重传最终应答，Timer H 等待ACK超时，Timer I 等待吸收ACK重传
+// 非INVITE事务：Timer J 等待吸收请求重传
+type ServerTransaction struct {
+	sync.Mutex
+	key        string
+	isInvite   bool
+	reliable   bool
+	state      TransactionState
+	request    *Message
+	response   *Message           // 最后发送的应答
+	send       TransportFunc      // 发送应答的回调
+	client     *ClientTransaction // 代理转发请求时对应的客户端事务
+	interval   time.Duration      // 当前重传间隔
+	retransmit *time.Timer        // Timer G
+	timeout    *time.Timer        // Timer H
+	linger     *time.Timer        // Timer I / Timer J
+	terminate  func()
+}
+
+func newServerTransaction(key string, req *Message, send TransportFunc) *ServerTransaction {
+	tx := &ServerTransaction{
+		key:      key,
+		isInvite: req.RequestLine.Method == MethodInvite,
+		reliable: isReliable(req.Header.Via.FirstTransport()),
+		request:  req.Clone(),
+		send:     send,
+	}
+	if tx.isInvite {
+		tx.state = TransactionProceeding
+	} else {
+		tx.state = TransactionTrying
+	}
+	return tx
+}
+
+// 事务状态
+func (tx *ServerTransaction) State() TransactionState {
+	tx.Lock()
+	defer tx.Unlock()
+	return tx.state
+}
+
+// 事务收到的请求
+func (tx *ServerTransaction) Request() *Message {
+	return tx.request
+}
+
+// 代理转发请求时对应的客户端事务
+func (tx *ServerTransaction) Client() *ClientTransaction {
+	tx.Lock()
+	defer tx.Unlock()
+	return tx.client
+}
+
+func (tx *ServerTransaction) setClient(client *ClientTransaction) {
+	tx.Lock()
+	defer tx.Unlock()
+	tx.client = client
+}
+
+// 发送应答，事务结束后的应答会被忽略
+func (tx *ServerTransaction) Respond(resp *Message) {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.state != TransactionTrying && tx.state != TransactionProceeding {
+		return
+	}
+	code := resp.ResponseLine.StatusCode
+	tx.response = resp
+	tx.send(resp)
+	if code < 200 {
+		tx.state = TransactionProceeding
+		return
+	}
+	if tx.isInvite && code < 300 {
+		// 2xx的重传由UAS负责，事务直接结束
+		tx.state = TransactionTerminated
+		tx.terminate()
+		return
+	}
+	tx.state = TransactionCompleted
+	if tx.isInvite {
+		if !tx.reliable {
+			tx.interval = T1
+			tx.retransmit = time.AfterFunc(tx.interval, tx.onRetransmit)
+		}
+		tx.timeout = time.AfterFunc(64*T1, tx.onTimeout)
+		return
+	}
+	var wait time.Duration
+	if !tx.reliable {
+		wait = 64 * T1
+	}
+	tx.linger = time.AfterFunc(wait, tx.onLinger)
+}
+
+// 收到重传的请求，重发最后一个应答
+func (tx *ServerTransaction) receiveRetransmission() {
+	tx.Lock()
+	defer tx.Unlock()
+	if (tx.state == TransactionProceeding || tx.state == TransactionCompleted) && tx.response != nil {
+		tx.send(tx.response)
+	}
+}
+
+// 收到非2xx最终应答对应的ACK
+func (tx *ServerTransaction) receiveAck() {
+	tx.Lock()
+	defer tx.Unlock()
+	if !tx.isInvite || tx.state != TransactionCompleted {
+		return
+	}
+	stopTimer(tx.retransmit)
+	stopTimer(tx.timeout)
+	tx.state = TransactionConfirmed
+	var wait time.Duration
+	if !tx.reliable {
+		wait = T4
+	}
+	tx.linger = time.AfterFunc(wait, tx.onLinger)
+}
+
+// Timer G
+func (tx *ServerTransaction) onRetransmit() {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.state != TransactionCompleted {
+		return
+	}
+	tx.send(tx.response)
+	tx.interval = doubleInterval(tx.interval, T2)
+	tx.retransmit = time.AfterFunc(tx.interval, tx.onRetransmit)
+}
+
+// Timer H
+func (tx *ServerTransaction) onTimeout() {
+	tx.Lock()
+	if tx.state != TransactionCompleted {
+		tx.Unlock()
+		return
+	}
+	stopTimer(tx.retransmit)
+	tx.state = TransactionTerminated
+	tx.Unlock()
+	tx.terminate()
+}
+
+// Timer I / Timer J
+func (tx *ServerTransaction) onLinger() {
+	tx.Lock()
+	if tx.state != TransactionCompleted && tx.state != TransactionConfirmed {
+		tx.Unlock()
+		return
+	}
+	tx.state = TransactionTerminated
+	tx.Unlock()
+	tx.terminate()
+}
@@ -0,0 +1,325 @@
+package sip
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录事务层发送的消息
+type sentRecorder struct {
+	sync.Mutex
+	msgs []*Message
+}
+
+func (r *sentRecorder) send(msg *Message) {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+func (r *sentRecorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.msgs)
+}
+
+func (r *sentRecorder) last() *Message {
+	r.Lock()
+	defer r.Unlock()
+	return r.msgs[len(r.msgs)-1]
+}
+
+func useShortTimers(t *testing.T) {
+	t1, t2, t4 := T1, T2, T4
+	T1, T2, T4 = 10*time.Millisecond, 40*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() {
+		T1, T2, T4 = t1, t2, t4
+	})
+}
+
+var testServer = &Server{IP: "127.0.0.1", Domain: "p-cscf.hebeiyidong.3gpp.net", Port: 54321}
+
+func mustParse(t *testing.T, str string) *Message {
+	msg, err := NewMessage(strings.NewReader(strings.ReplaceAll(str, "\n", CRLF)))
+	if err != nil {
+		t.Fatalf("parse message error = %v", err)
+	}
+	return &msg
+}
+
+const testInvite = `INVITE sip:1010@hebeiyidong.3gpp.net SIP/2.0
+Via: SIP/2.0/UDP 192.168.0.100:45508;branch=z9hG4bK1158493fb1e25c83f14f5e7ee368;rport
+From: "1011" <sip:1011@hebeiyidong.3gpp.net>;tag=22365c3a331
+To: "1010" <sip:1010@hebeiyidong.3gpp.net>
+Call-ID: 93fb1e2-cd303fba92f18-6ebf2a6@192.168.0.100
+CSeq: 1 INVITE
+Max-Forwards: 70
+Content-Length: 0
+
+`
+
+const testRegister = `REGISTER sip:hebeiyidong.3gpp.net SIP/2.0
+Via: SIP/2.0/UDP 10.255.1.111:5090;branch=z9hG4bK199912928954841999
+From: "jiqimao" <sip:jiqimao@hebeiyidong.3gpp.net>;tag=690713
+To: "jiqimao" <sip:jiqimao@hebeiyidong.3gpp.net>
+Call-ID: RgeX-136783086082016@10.255.1.111
+CSeq: 3 REGISTER
+Max-Forwards: 70
+Content-Length: 0
+
+`
+
+func TestServerTransactionAbsorbRetransmission(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testRegister)
+
+	tx, isNew := tl.ServerRequest(req, rec.send)
+	if !isNew || tx == nil {
+		t.Fatalf("first request should create transaction")
+	}
+	if _, isNew = tl.ServerRequest(mustParse(t, testRegister), rec.send); isNew {
+		t.Errorf("retransmitted request should be absorbed")
+	}
+	if rec.count() != 0 {
+		t.Errorf("no response should be sent before TU responds, sent %d", rec.count())
+	}
+	tx.Respond(NewResponse(StatusUnauthorized, req))
+	if tx.State() != TransactionCompleted {
+		t.Errorf("state = %v, want Completed", tx.State())
+	}
+	tl.ServerRequest(mustParse(t, testRegister), rec.send)
+	if rec.count() != 2 {
+		t.Errorf("retransmitted request should resend last response, sent %d", rec.count())
+	}
+	// Timer J 到期后事务结束
+	time.Sleep(64*T1 + 50*time.Millisecond)
+	if tl.MatchServer(req) != nil {
+		t.Errorf("transaction should be removed after timer J")
+	}
+}
+
+func TestServerInviteTransactionAck(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testInvite)
+
+	tx, _ := tl.ServerRequest(req, rec.send)
+	tx.Respond(NewResponse(StatusTrying, req))
+	tx.Respond(NewResponse(StatusBusyHere, req))
+	// Timer G 重传最终应答
+	time.Sleep(3*T1 + 5*time.Millisecond)
+	if rec.count() < 3 {
+		t.Errorf("final response should be retransmitted, sent %d", rec.count())
+	}
+	ack := NewResponse(StatusOK, req)
+	ack.IsRequest, ack.IsResponse = true, false
+	ack.RequestLine = RequestLine{Method: MethodAck, RequestURI: req.RequestLine.RequestURI, SIPVersion: SIPVersion}
+	ack.Header.CSeq.Method = MethodAck
+	if _, isNew := tl.ServerRequest(ack, rec.send); isNew {
+		t.Errorf("ack for non-2xx should be absorbed by transaction")
+	}
+	if tx.State() != TransactionConfirmed {
+		t.Errorf("state = %v, want Confirmed", tx.State())
+	}
+}
+
+func TestClientTransactionRetransmit(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testRegister)
+
+	tx := tl.Request(req, rec.send)
+	// Timer E: T1, 2T1, 4T1(=T2) ...
+	time.Sleep(8*T1 + 5*time.Millisecond)
+	sent := rec.count()
+	if sent < 3 {
+		t.Errorf("request should be retransmitted, sent %d", sent)
+	}
+	resp := NewResponse(StatusOK, req)
+	if _, pass := tl.ClientResponse(resp); !pass {
+		t.Errorf("first final response should pass to TU")
+	}
+	if tx.State() != TransactionCompleted {
+		t.Errorf("state = %v, want Completed", tx.State())
+	}
+	if _, pass := tl.ClientResponse(resp); pass {
+		t.Errorf("retransmitted final response should be absorbed")
+	}
+	time.Sleep(2 * T2)
+	if rec.count() != sent {
+		t.Errorf("request should not be retransmitted after final response")
+	}
+}
+
+func TestClientTransactionBlockedSend(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testRegister)
+
+	// 传输层阻塞在第一次发送上时，应答仍然可以被事务处理
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	done := make(chan *ClientTransaction)
+	go func() {
+		done <- tl.Request(req, func(msg *Message) {
+			once.Do(func() {
+				close(entered)
+				<-release
+			})
+			rec.send(msg)
+		})
+	}()
+	<-entered
+	passed := make(chan bool)
+	go func() {
+		_, pass := tl.ClientResponse(NewResponse(StatusOK, req))
+		passed <- pass
+	}()
+	select {
+	case pass := <-passed:
+		if !pass {
+			t.Errorf("final response should pass to TU")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("response blocked behind the request send")
+	}
+	close(release)
+	tx := <-done
+	if tx.State() != TransactionCompleted {
+		t.Errorf("state = %v, want Completed", tx.State())
+	}
+	// 发送期间已经收到最终应答，不再重传请求
+	time.Sleep(4 * T1)
+	if rec.count() != 1 {
+		t.Errorf("request should not be retransmitted after final response, sent %d", rec.count())
+	}
+}
+
+func TestClientTransactionTransportSwitch(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testRegister)
+
+	// 传输层发送时改用TCP，事务不再重传
+	tl.Request(req, func(msg *Message) {
+		msg.Header.Via.SetFirstTransport("tcp")
+		rec.send(msg)
+	})
+	time.Sleep(8 * T1)
+	if rec.count() != 1 {
+		t.Errorf("request over TCP should not be retransmitted, sent %d", rec.count())
+	}
+	if v := rec.last().Header.Via.FirstTransport(); v != "TCP" {
+		t.Errorf("via transport = %v, want TCP", v)
+	}
+}
+
+func TestClientInviteTransactionTimeout(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	down, up := new(sentRecorder), new(sentRecorder)
+	req := mustParse(t, testInvite)
+
+	stx, _ := tl.ServerRequest(req, down.send)
+	fwd := req.Clone()
+	fwd.Header.Via.AddServerInfo(testServer)
+	tl.Forward(stx, fwd, up.send)
+	time.Sleep(64*T1 + 50*time.Millisecond)
+	if up.count() < 5 {
+		t.Errorf("invite should be retransmitted by timer A, sent %d", up.count())
+	}
+	if down.count() == 0 || down.last().ResponseLine.StatusCode != StatusRequestTimeout.Code {
+		t.Errorf("server transaction should respond 408 after timer B")
+	}
+}
+
+func TestClientInviteTransactionAck(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testInvite)
+
+	tl.Request(req, rec.send)
+	resp := NewResponse(StatusBusyHere, req)
+	resp.Header.To.Arguments.Set("tag", "291589446")
+	if _, pass := tl.ClientResponse(resp); !pass {
+		t.Errorf("final response should pass to TU")
+	}
+	ack := rec.last()
+	if !ack.IsRequest || ack.RequestLine.Method != MethodAck {
+		t.Fatalf("client transaction should send ack, got %v", ack.String())
+	}
+	if tag, _ := ack.Header.To.Arguments.Get("tag"); tag != "291589446" {
+		t.Errorf("ack to tag = %v, want 291589446", tag)
+	}
+	if ack.Header.Via.TransactionBranch() != req.Header.Via.TransactionBranch() {
+		t.Errorf("ack should use the branch of invite")
+	}
+	tl.ClientResponse(resp)
+	if rec.last().RequestLine.Method != MethodAck {
+		t.Errorf("retransmitted final response should trigger ack again")
+	}
+}
+
+func TestCancelInviteTransaction(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	down, up := new(sentRecorder), new(sentRecorder)
+	req := mustParse(t, testInvite)
+
+	stx, _ := tl.ServerRequest(req, down.send)
+	stx.Respond(NewResponse(StatusTrying, req))
+	fwd := req.Clone()
+	fwd.Header.Via.AddServerInfo(testServer)
+	tl.Forward(stx, fwd, up.send)
+
+	cancel := NewCancel(req)
+	if cstx, isNew := tl.ServerRequest(cancel, down.send); !isNew || cstx == stx {
+		t.Fatalf("cancel should create its own transaction")
+	}
+	if tl.MatchCancel(cancel) != stx {
+		t.Fatalf("cancel should match the invite transaction")
+	}
+	tl.CancelInvite(stx)
+	sent := up.last()
+	if sent.RequestLine.Method != MethodCancel {
+		t.Fatalf("cancel should be forwarded downstream, got %v", sent.RequestLine.Method)
+	}
+	if sent.Header.Via.TransactionBranch() != fwd.Header.Via.TransactionBranch() {
+		t.Errorf("cancel should use the branch of forwarded invite")
+	}
+	// 下游应答487，由INVITE服务端事务返回给请求方
+	terminated := NewResponse(StatusRequestTerminated, fwd)
+	if _, pass := tl.ClientResponse(terminated); !pass {
+		t.Errorf("487 should pass to TU")
+	}
+	terminated.Header.Via.RemoveFirst(testServer)
+	stx.Respond(terminated)
+	if down.last().ResponseLine.StatusCode != StatusRequestTerminated.Code {
+		t.Errorf("invite should be answered with 487")
+	}
+}
+
+func TestCancelInviteWithoutClient(t *testing.T) {
+	useShortTimers(t)
+	tl := NewTransactionLayer()
+	rec := new(sentRecorder)
+	req := mustParse(t, testInvite)
+
+	stx, _ := tl.ServerRequest(req, rec.send)
+	tl.CancelInvite(stx)
+	if rec.count() == 0 || rec.last().ResponseLine.StatusCode != StatusRequestTerminated.Code {
+		t.Errorf("invite without client transaction should be answered with 487 locally")
+	}
+	if stx.State() != TransactionCompleted {
+		t.Errorf("state = %v, want Completed", stx.State())
+	}
+}
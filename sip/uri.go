@@ -2,7 +2,9 @@ package sip
 
 import (
 	"errors"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -44,6 +46,36 @@ func (u URI) IsEqual(obj URI) bool {
 	return u.Scheme == obj.Scheme && u.Username == obj.Username && u.Domain == obj.Domain
 }
 
+// 主机部分，IPv6地址去掉方括号(RFC3261-19.1.1)
+func (u URI) Host() string {
+	host, _ := splitHostPort(u.Domain)
+	return host
+}
+
+// 端口，没有指定时为0
+func (u URI) Port() int {
+	_, port := splitHostPort(u.Domain)
+	return port
+}
+
+// 拆分host[:port]，IPv6地址的host带方括号，如[2001:db8::1]:5060
+func splitHostPort(hostport string) (string, int) {
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		p, _ := strconv.Atoi(port)
+		return host, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), 0
+}
+
+// URI要求的传输协议(RFC3261-19.1.4)，sips使用TLS，否则为transport参数，没有指定时为空
+func (u URI) Transport() string {
+	if strings.EqualFold(u.Scheme, "sips") {
+		return "TLS"
+	}
+	t, _ := u.Arguments.Get("transport")
+	return strings.ToUpper(t)
+}
+
 // 解析URI
 func (u *URI) parse(str string) (err error) {
 	result := uriRegExpWithUser.FindStringSubmatch(str)
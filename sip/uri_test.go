@@ -36,3 +36,46 @@ func TestURI(t *testing.T) {
 		})
 	}
 }
+
+func TestURITransport(t *testing.T) {
+	tests := []struct {
+		item string
+		want string
+	}{
+		{"sip:alice@atlanta.com", ""},
+		{"sip:alice@atlanta.com;transport=tcp", "TCP"},
+		{"sip:p-cscf.hebeiyidong.3gpp.net;lr;transport=udp", "UDP"},
+		{"sips:1212@gateway.com", "TLS"},
+	}
+	for _, tt := range tests {
+		u, err := NewURI(tt.item)
+		if err != nil {
+			t.Fatalf("URI error = %v", err)
+		}
+		if got := u.Transport(); got != tt.want {
+			t.Errorf("%v transport = %v, want %v", tt.item, got, tt.want)
+		}
+	}
+}
+
+func TestURIIPv6(t *testing.T) {
+	tests := []struct {
+		item string
+		host string
+		port int
+	}{
+		{"sip:[2001:db8::1]:5060;lr", "2001:db8::1", 5060},
+		{"sip:alice@[2001:db8::10]", "2001:db8::10", 0},
+		{"sips:alice:secret@[fe80::1]:5061;transport=tcp", "fe80::1", 5061},
+		{"sip:alice@atlanta.com:5060", "atlanta.com", 5060},
+	}
+	for _, tt := range tests {
+		u, err := NewURI(tt.item)
+		if err != nil {
+			t.Fatalf("URI error = %v", err)
+		}
+		if u.String() != tt.item || u.Host() != tt.host || u.Port() != tt.port {
+			t.Errorf("%v = %v, host %v, port %v", tt.item, u.String(), u.Host(), u.Port())
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package sip
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 )
 
@@ -23,3 +25,19 @@ func Clone(src interface{}, target interface{}) {
 	str, _ := json.Marshal(src)
 	_ = json.Unmarshal(str, target)
 }
+
+// 生成新的From或To标签(RFC3261-19.3)
+func NewTag() string {
+	return randomHex(8)
+}
+
+// 生成新的Call-ID(RFC3261-8.1.1.4)
+func NewCallID(host string) string {
+	return randomHex(16) + "@" + host
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -28,6 +28,18 @@ func (v Via) String() string {
 	return fmt.Sprintf("%s/%s %s%s", v.SIPVersion, v.Transport, v.Client, v.Arguments.String())
 }
 
+// 发送方的主机部分，IPv6地址去掉方括号
+func (v Via) Host() string {
+	host, _ := splitHostPort(v.Client)
+	return host
+}
+
+// 发送方的端口，没有指定时为0
+func (v Via) Port() int {
+	_, port := splitHostPort(v.Client)
+	return port
+}
+
 // 解析Via信息
 func (v *Via) parse(str string) (err error) {
 	result := viaRegExp.FindStringSubmatch(str)
@@ -34,3 +34,31 @@ func TestVia(t *testing.T) {
 		})
 	}
 }
+
+func TestViaIPv6(t *testing.T) {
+	str := "SIP/2.0/UDP [2001:db8::9]:5060;branch=z9hG4bK111643fe9a9f389667c5e7d8873;rport"
+	v, err := parseVia(str)
+	if err != nil {
+		t.Fatalf("Via error = %v", err)
+	}
+	if v.String() != str || v.Host() != "2001:db8::9" || v.Port() != 5060 {
+		t.Errorf("Via = %v, host %v, port %v", v.String(), v.Host(), v.Port())
+	}
+
+	// received不带方括号，转发时重新组合为带方括号的地址
+	var vl ViaList
+	vl.Add(str)
+	vl.SetReceivedInfo("UDP", "[2001:db8::20]:45508")
+	vl.UpdateReceivedInfo()
+	if received, _ := vl.value[0].Arguments.Get("received"); received != "2001:db8::20" {
+		t.Errorf("received = %v", received)
+	}
+	if addr, real := vl.FirstAddrInfo(); !real || addr != "[2001:db8::20]:45508" {
+		t.Errorf("first addr = %v, %v", addr, real)
+	}
+
+	s, err := NewServer("p-cscf.hebeiyidong.3gpp.net", "[::1]:54321")
+	if err != nil || s.IP != "::1" || s.IpHost() != "[::1]:54321" {
+		t.Errorf("server = %v, %v", s, err)
+	}
+}
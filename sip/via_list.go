@@ -1,7 +1,9 @@
 package sip
 
 import (
-	"fmt"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
 	"strings"
 
 	"github.com/wonderivan/logger"
@@ -36,32 +38,36 @@ func (vl ViaList) FirstAddrInfo() (string, bool) {
 	ip, _ := via.Arguments.Get("received")
 	port, _ := via.Arguments.Get("rport")
 	if len(ip) > 0 && len(port) > 0 {
-		return fmt.Sprintf("%s:%s", ip, port), true
+		return net.JoinHostPort(ip, port), true
 	} else {
 		return via.Client, false
 	}
 }
 
-// (转发请求) 设置第一个Via的接收实际信息
+// (转发请求) 设置第一个Via的接收实际信息，received中的IPv6地址不带方括号(RFC5118-4.5)
 func (vl *ViaList) UpdateReceivedInfo() {
-	ipPort := strings.Split(vl.receivedAddr, ":")
-	// FIXME 更好的方式
-	if vl.value[0].Transport != "TCP" && vl.value[0].Transport != "UDP" {
+	ip, port, err := net.SplitHostPort(vl.receivedAddr)
+	if err != nil {
+		return
+	}
+	switch strings.ToUpper(vl.value[0].Transport) {
+	case "UDP", "TCP", "TLS", "SCTP":
+	default:
 		vl.value[0].Transport = "UDP"
 	}
-	vl.value[0].Arguments.Set("received", ipPort[0])
-	vl.value[0].Arguments.Set("rport", ipPort[1])
+	vl.value[0].Arguments.Set("received", ip)
+	vl.value[0].Arguments.Set("rport", port)
 	return
 }
 
 // (转发请求) 添加当前服务器的信息到Via的开头
-func (vl *ViaList) AddServerInfo() {
+func (vl *ViaList) AddServerInfo(s *Server) {
 	via := Via{
 		SIPVersion: SIPVersion,
 		Transport:  strings.ToUpper(vl.receivedTransport),
-		Client:     ServerDomainHost(),
+		Client:     s.DomainHost(),
 		Arguments: NewArgs(map[string]string{
-			"branch": vl.TransactionBranch(),
+			"branch": vl.nextBranch(s.DomainHost()),
 		}),
 	}
 	vl.value = append([]Via{via}, vl.value...)
@@ -69,10 +75,10 @@ func (vl *ViaList) AddServerInfo() {
 }
 
 // (转发应答) 移除第一个是自己服务器的Via
-func (vl *ViaList) RemoveFirst() {
+func (vl *ViaList) RemoveFirst(s *Server) {
 	via := vl.value[0]
-	logger.Warn("via: %v, firt: %v, server: %v", vl.value[0], via.Client, ServerDomainHost())
-	if via.Client == ServerDomainHost() || via.Client == ServerDomain {
+	logger.Warn("via: %v, firt: %v, server: %v", vl.value[0], via.Client, s.DomainHost())
+	if s.IsHost(via.Client) {
 		vl.value = vl.value[1:]
 	}
 	return
@@ -80,6 +86,49 @@ func (vl *ViaList) RemoveFirst() {
 
 // 获取当前事务标识
 func (vl ViaList) TransactionBranch() (result string) {
+	if len(vl.value) == 0 {
+		return
+	}
 	result, _ = vl.value[0].Arguments.Get("branch")
 	return
 }
+
+// 获取第一个Via的发送方地址(sent-by)
+func (vl ViaList) FirstSentBy() string {
+	if len(vl.value) == 0 {
+		return ""
+	}
+	return vl.value[0].Client
+}
+
+// 获取第一个Via的传输协议
+func (vl ViaList) FirstTransport() string {
+	if len(vl.value) == 0 {
+		return ""
+	}
+	return vl.value[0].Transport
+}
+
+// (发送请求) 设置第一个Via的传输协议，与实际发送使用的协议一致(RFC3261-18.1.1)
+func (vl *ViaList) SetFirstTransport(transport string) {
+	if len(vl.value) == 0 {
+		return
+	}
+	vl.value[0].Transport = strings.ToUpper(transport)
+}
+
+// Via记录数量
+func (vl ViaList) Len() int {
+	return len(vl.value)
+}
+
+// 根据上一跳的事务标识生成本服务器转发时的事务标识(RFC3261-16.6.8)
+// 同一请求的重传、对应的CANCEL会得到相同的branch，同一请求多次经过本服务器时branch不同
+// 本服务器发起的请求没有上一跳，使用随机的branch
+func (vl ViaList) nextBranch(host string) string {
+	if len(vl.value) == 0 {
+		return BranchMagicCookie + randomHex(8)
+	}
+	sum := md5.Sum([]byte(vl.TransactionBranch() + vl.FirstSentBy() + host))
+	return BranchMagicCookie + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,136 @@
+// HSS数据库的版本化迁移脚本，按数据库类型分目录存放，文件名为 版本号_说明.sql
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed mysql/*.sql sqlite/*.sql
+var scripts embed.FS
+
+// 记录已执行版本的表
+const versionTable = "schema_migrations"
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// 读取数据库类型对应的全部迁移脚本，按版本号排序
+func Load(dialect string) ([]Migration, error) {
+	entries, err := scripts.ReadDir(dialect)
+	if err != nil {
+		return nil, errors.New("ErrUnsupportedDialect")
+	}
+	var ms []Migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		idx := strings.Index(name, "_")
+		if idx < 0 {
+			return nil, errors.New("ErrMigrationName")
+		}
+		version, err := strconv.Atoi(name[:idx])
+		if err != nil {
+			return nil, errors.New("ErrMigrationName")
+		}
+		data, err := scripts.ReadFile(path.Join(dialect, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Migration{Version: version, Name: name[idx+1:], SQL: string(data)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// 执行尚未执行的迁移脚本，返回本次执行的迁移
+func Migrate(db *sql.DB, dialect string) ([]Migration, error) {
+	ms, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS " + versionTable +
+		" (version INTEGER NOT NULL PRIMARY KEY, name VARCHAR(128) NOT NULL, applied_at DATETIME NOT NULL)")
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range ms {
+		if applied[m.Version] {
+			continue
+		}
+		if err = apply(db, m); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func appliedVersions(db *sql.DB) (map[int]bool, error) {
+	rows, err := db.Query("SELECT version FROM " + versionTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// 在一个事务中执行迁移脚本并记录版本，mysql的DDL语句会隐式提交
+func apply(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range Statements(m.SQL) {
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO "+versionTable+" (version, name, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Name, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// 拆分脚本中的语句，忽略 -- 开头的注释行
+func Statements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	var stmts []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); len(stmt) > 0 {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
@@ -0,0 +1,33 @@
+-- 将迁移脚本之前由sql/users.sql创建的users表升级为0001的结构，新建的数据库中users表不存在时不做修改
+-- mysql的ALTER TABLE不支持IF NOT EXISTS，按information_schema判断后执行
+SET @has_users = (SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users');
+
+SET @ddl = IF(@has_users > 0 AND (SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = 'root_k') = 0,
+  'ALTER TABLE `users` ADD COLUMN `root_k` varchar(32) NOT NULL DEFAULT '''' COMMENT ''用户根密钥K'' AFTER `imsi`',
+  'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF(@has_users > 0 AND (SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = 'opc') = 0,
+  'ALTER TABLE `users` ADD COLUMN `opc` varchar(32) NOT NULL DEFAULT '''' COMMENT ''运营商密钥OPc'' AFTER `root_k`',
+  'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- 0006将ip扩展为静态地址，这里只保证字段存在
+SET @ddl = IF(@has_users > 0 AND (SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = 'ip') = 0,
+  'ALTER TABLE `users` ADD COLUMN `ip` varchar(32) NOT NULL DEFAULT '''' AFTER `apn`',
+  'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- 基线的ip字段有唯一索引，多个用户不能同时为空，升级后ip用于静态地址，只删除索引，保留运营商配置的地址，由0006扩展长度
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND INDEX_NAME = 'uqidx_ip') > 0,
+  'ALTER TABLE `users` DROP INDEX `uqidx_ip`',
+  'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
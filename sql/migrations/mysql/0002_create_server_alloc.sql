@@ -0,0 +1,12 @@
+-- I-CSCF查询时为用户分配的S-CSCF记录
+CREATE TABLE IF NOT EXISTS `server_alloc` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `sip_username` varchar(32) NOT NULL DEFAULT '' COMMENT 'SIP网络用户名',
+  `scscf_addr` varchar(64) NOT NULL DEFAULT '' COMMENT '分配的S-CSCF地址',
+  `bind_t` datetime NOT NULL DEFAULT '1000-01-01 00:00:00' COMMENT '绑定时间',
+  `unbind_t` datetime NOT NULL DEFAULT '1000-01-01 00:00:00' COMMENT '解绑时间',
+  `ctime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `utime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  PRIMARY KEY (`id`),
+  KEY `idx_sip_username` (`sip_username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,13 @@
+-- 用户附着后建立的PDN会话，记录PGW分配的IP地址
+CREATE TABLE IF NOT EXISTS `session` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `imsi` varchar(64) NOT NULL DEFAULT '' COMMENT 'LTE用户唯一标识',
+  `apn` varchar(32) NOT NULL DEFAULT 'hebeiyidong' COMMENT 'APN网络',
+  `ip` varchar(32) NOT NULL DEFAULT '' COMMENT '分配IP地址',
+  `pgw_addr` varchar(64) NOT NULL DEFAULT '' COMMENT '分配地址的PGW',
+  `ctime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `utime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uqidx_ip` (`ip`),
+  KEY `idx_imsi` (`imsi`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,10 @@
+-- 用户鉴权序列号SQN，每次生成鉴权向量后递增
+CREATE TABLE IF NOT EXISTS `sqn` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `imsi` varchar(64) NOT NULL DEFAULT '' COMMENT 'LTE用户唯一标识',
+  `sqn` bigint(20) unsigned NOT NULL DEFAULT '0' COMMENT '鉴权序列号',
+  `ctime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `utime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uqidx_imsi` (`imsi`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,11 @@
+-- 用户的初始过滤准则(iFC)，随MAA下发给S-CSCF触发应用服务器
+CREATE TABLE IF NOT EXISTS `ifc` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `sip_username` varchar(32) NOT NULL DEFAULT '' COMMENT 'SIP网络用户名',
+  `priority` int(11) NOT NULL DEFAULT '0' COMMENT '优先级，数值小的优先评估',
+  `criteria` text NOT NULL COMMENT 'InitialFilterCriteria的XML(3GPP TS 29.228)',
+  `ctime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `utime` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  PRIMARY KEY (`id`),
+  KEY `idx_sip_username` (`sip_username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,6 @@
+-- PGW地址租约：用户的静态地址，会话记录租约的到期时间
+-- ip为逗号分隔的IPv4和IPv6地址，IPv6前缀使用CIDR格式，users的ip由0001或0000创建，这里扩展长度
+ALTER TABLE `users` MODIFY COLUMN `ip` varchar(64) NOT NULL DEFAULT '' COMMENT '静态IP地址，为空时动态分配';
+ALTER TABLE `session` MODIFY COLUMN `ip` varchar(64) NOT NULL DEFAULT '' COMMENT '分配IP地址';
+ALTER TABLE `session` ADD COLUMN `expire` datetime NOT NULL DEFAULT '1000-01-01 00:00:00' COMMENT '租约到期时间';
+CREATE INDEX `idx_pgw_addr` ON `session` (`pgw_addr`);
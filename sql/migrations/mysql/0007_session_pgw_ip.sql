@@ -0,0 +1,3 @@
+-- 租约按PGW保存和删除，不同PGW的地址池可以重叠，地址在同一PGW内唯一
+ALTER TABLE `session` DROP INDEX `uqidx_ip`;
+CREATE UNIQUE INDEX `uqidx_pgw_addr_ip` ON `session` (`pgw_addr`, `ip`);
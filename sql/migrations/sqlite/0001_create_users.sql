@@ -0,0 +1,17 @@
+-- 用户签约数据
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  imsi VARCHAR(64) NOT NULL DEFAULT '',
+  root_k VARCHAR(32) NOT NULL DEFAULT '',
+  opc VARCHAR(32) NOT NULL DEFAULT '',
+  mnc VARCHAR(32) NOT NULL DEFAULT '01',
+  mcc INTEGER NOT NULL DEFAULT 86,
+  apn VARCHAR(32) NOT NULL DEFAULT 'hebeiyidong',
+  sip_username VARCHAR(32) NOT NULL DEFAULT '',
+  sip_dns VARCHAR(64) NOT NULL DEFAULT '3gpp.net',
+  ctime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  utime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00'
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uqidx_imsi ON users (imsi);
+CREATE UNIQUE INDEX IF NOT EXISTS uqidx_sip_username ON users (sip_username);
+CREATE INDEX IF NOT EXISTS idx_ctime_utime ON users (ctime);
@@ -0,0 +1,11 @@
+-- I-CSCF查询时为用户分配的S-CSCF记录
+CREATE TABLE IF NOT EXISTS server_alloc (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  sip_username VARCHAR(32) NOT NULL DEFAULT '',
+  scscf_addr VARCHAR(64) NOT NULL DEFAULT '',
+  bind_t DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  unbind_t DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  ctime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  utime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00'
+);
+CREATE INDEX IF NOT EXISTS idx_server_alloc_sip_username ON server_alloc (sip_username);
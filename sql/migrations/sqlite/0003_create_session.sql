@@ -0,0 +1,12 @@
+-- 用户附着后建立的PDN会话，记录PGW分配的IP地址
+CREATE TABLE IF NOT EXISTS session (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  imsi VARCHAR(64) NOT NULL DEFAULT '',
+  apn VARCHAR(32) NOT NULL DEFAULT 'hebeiyidong',
+  ip VARCHAR(32) NOT NULL DEFAULT '',
+  pgw_addr VARCHAR(64) NOT NULL DEFAULT '',
+  ctime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  utime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00'
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uqidx_ip ON session (ip);
+CREATE INDEX IF NOT EXISTS idx_session_imsi ON session (imsi);
@@ -0,0 +1,9 @@
+-- 用户鉴权序列号SQN，每次生成鉴权向量后递增
+CREATE TABLE IF NOT EXISTS sqn (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  imsi VARCHAR(64) NOT NULL DEFAULT '',
+  sqn BIGINT NOT NULL DEFAULT 0,
+  ctime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  utime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00'
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uqidx_sqn_imsi ON sqn (imsi);
@@ -0,0 +1,10 @@
+-- 用户的初始过滤准则(iFC)，随MAA下发给S-CSCF触发应用服务器
+CREATE TABLE IF NOT EXISTS ifc (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  sip_username VARCHAR(32) NOT NULL DEFAULT '',
+  priority INTEGER NOT NULL DEFAULT 0,
+  criteria TEXT NOT NULL DEFAULT '',
+  ctime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00',
+  utime DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00'
+);
+CREATE INDEX IF NOT EXISTS idx_ifc_sip_username ON ifc (sip_username);
@@ -0,0 +1,5 @@
+-- PGW地址租约：用户的静态地址，会话记录租约的到期时间
+-- ip为逗号分隔的IPv4和IPv6地址，IPv6前缀使用CIDR格式，sqlite不限制VARCHAR的长度
+ALTER TABLE users ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE session ADD COLUMN expire DATETIME NOT NULL DEFAULT '1000-01-01 00:00:00';
+CREATE INDEX IF NOT EXISTS idx_session_pgw_addr ON session (pgw_addr);